@@ -33,16 +33,23 @@ func GetVersion() string {
 // App is a struct tracking the resources associated with the application
 type App struct {
 	// public
-	Name          string
-	Config        *config.Config
-	TelemetryDB   *database.AppDb
-	OperationalDB *database.AppDb
-	Address       ServerAddress
-	Handler       http.Handler
-	LogManager    *logging.LogManager
-	AuthManager   *AuthManager
+	Name             string
+	Config           *config.Config
+	TelemetryDB      *database.AppDb
+	OperationalDB    *database.AppDb
+	Address          ServerAddress
+	Handler          http.Handler
+	LogManager       *logging.LogManager
+	AuthManager      *AuthManager
+	StagingWorkers   *StagingWorkerPool
+	ProcessedReports *ProcessedReportsLedger
+	Retention        *RetentionManager
 
 	// private
+	idCaches  *idCaches
+	clones    *cloneDetector
+	erasures  *customerEraser
+	revoked   *tokenRevocationCache
 	server    *http.Server
 	signals   chan os.Signal
 	debugMode bool
@@ -76,6 +83,15 @@ func NewApp(name string, cfg *config.Config, handler http.Handler, debugMode boo
 		panic(err)
 	}
 
+	// setup the tagSet and customer id caches, invalidating cached ids
+	// when the associated telemetry DB rows are changed, by this or other
+	// processes
+	a.idCaches, err = newIdCaches(a.TelemetryDB, &cfg.IdCache)
+	if err != nil {
+		panic(err)
+	}
+	a.TelemetryDB.AddRowChangeHook(a.idCaches.rowChanged)
+
 	// setup address
 	a.Address.Setup(cfg.API)
 
@@ -92,9 +108,68 @@ func NewApp(name string, cfg *config.Config, handler http.Handler, debugMode boo
 	}
 	a.AuthManager = authManager
 
+	// check tokens against the revocations recorded in the operational DB
+	revocationRefresh, err := configDuration(
+		"auth.revocationRefresh",
+		cfg.Auth.RevocationRefresh,
+		config.DEF_AUTH_REVOCATION_REFRESH,
+	)
+	if err != nil {
+		slog.Error(
+			"config auth.revocationRefresh invalid",
+			slog.String("auth.revocationRefresh", cfg.Auth.RevocationRefresh),
+			slog.String("error", err.Error()),
+		)
+		panic(err)
+	}
+	a.revoked = newTokenRevocationCache(a.OperationalDB, revocationRefresh)
+	a.AuthManager.SetRevocations(a.revoked)
+
+	// instantiate the cloned client detector based upon config settings
+	a.clones, err = newCloneDetector(a, &cfg.CloneDetection)
+	if err != nil {
+		panic(err)
+	}
+
+	// instantiate the customer eraser based upon config settings
+	a.erasures, err = newCustomerEraser(a, &cfg.Erasure)
+	if err != nil {
+		panic(err)
+	}
+
+	// instantiate the staged report worker pool, which will be started
+	// by Run() if report staging is enabled
+	stagingWorkers, err := NewStagingWorkerPool(a, &cfg.Staging)
+	if err != nil {
+		panic(err)
+	}
+	a.StagingWorkers = stagingWorkers
+
+	// instantiate the processed reports ledger, whose background pruning
+	// job will be started by Run()
+	processedReports, err := NewProcessedReportsLedger(a, &cfg.ProcessedReports)
+	if err != nil {
+		panic(err)
+	}
+	a.ProcessedReports = processedReports
+
+	// instantiate the telemetry data retention manager, whose background
+	// job will be started by Run() if retention is enabled
+	retention, err := NewRetentionManager(a, &cfg.Retention)
+	if err != nil {
+		panic(err)
+	}
+	a.Retention = retention
+
 	return a
 }
 
+// StagingEnabled returns true if received telemetry reports should be
+// staged for processing by the background workers
+func (a *App) StagingEnabled() bool {
+	return stageTelemetryReports || a.Config.Staging.Enabled
+}
+
 func (a *App) SetupLogging() error {
 	logCfg := &a.Config.Logging
 
@@ -146,11 +221,42 @@ func (a *App) Initialize() (err error) {
 			"Successful DB connect and setup tables",
 			slog.String("database", adb.Name()),
 		)
+
+		// report any differences between the DB and the table specs,
+		// such as those caused by manual DDL changes
+		a.logSchemaDrift(adb)
 	}
 
 	return
 }
 
+// logSchemaDrift logs any differences between the DB's tables and the
+// associated table specs
+func (a *App) logSchemaDrift(adb *database.AppDb) {
+	report, err := adb.CheckSchemaDrift()
+	if err != nil {
+		slog.Warn(
+			"Unable to check for DB schema drift",
+			slog.String("database", adb.Name()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	if !report.HasDrift() {
+		slog.Debug("No DB schema drift detected", slog.String("database", adb.Name()))
+		return
+	}
+
+	for _, drift := range report.Tables {
+		slog.Warn(
+			"DB schema drift detected",
+			slog.String("database", adb.Name()),
+			slog.Any("drift", drift),
+		)
+	}
+}
+
 func (a *App) ListenAndServe() (err error) {
 	// start the server up
 	slog.Info("Starting Telemetry "+a.Name, slog.String("listenOn", a.ListenOn()))
@@ -181,6 +287,16 @@ func (a *App) Shutdown() (err error) {
 	}
 	slog.Debug("Succeeded in shutdown of server")
 
+	// stop the staged report workers, waiting for in progress reports
+	a.StagingWorkers.Stop()
+
+	// stop the processed reports ledger pruning, waiting for any in
+	// progress prune
+	a.ProcessedReports.Stop()
+
+	// stop the retention job, waiting for any in progress purge batch
+	a.Retention.Stop()
+
 	// close the DB connections
 	adbs := []*database.AppDb{
 		a.TelemetryDB,
@@ -221,6 +337,26 @@ var (
 	}
 )
 
+// StartBackgroundJobs starts the enabled background jobs, which must only
+// be run by servers that ingest reports, such as the telemetry-server,
+// rather than by every server, such as the telemetry-admin, sharing the
+// same DBs. The jobs are stopped by Shutdown.
+func (a *App) StartBackgroundJobs() {
+	// start the staged report workers if staging is enabled
+	if a.StagingEnabled() {
+		a.StagingWorkers.Start()
+	}
+
+	// start pruning the processed reports ledger, which is used whether or
+	// not reports are staged, independently of telemetry data retention
+	a.ProcessedReports.Start()
+
+	// start the telemetry data retention job if retention is enabled
+	if a.Config.Retention.Enabled {
+		a.Retention.Start()
+	}
+}
+
 func (a *App) Run() {
 	// relay signals
 	signal.Notify(a.signals, caughtSignals...)
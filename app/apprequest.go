@@ -8,6 +8,7 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -63,6 +64,48 @@ func (ar *AppRequest) GetHeader(header string) (value string) {
 	return
 }
 
+func (ar *AppRequest) GetQueryParam(param string) (value string) {
+	value = ar.R.URL.Query().Get(param)
+	ar.Log.Debug("Request query parameter", slog.String(param, value))
+	return
+}
+
+// GetVarInt64 retrieves the named request path variable as an int64
+func (ar *AppRequest) GetVarInt64(name string) (value int64, err error) {
+	value, err = strconv.ParseInt(ar.Vars[name], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("invalid %s value %q", name, ar.Vars[name])
+	}
+	return
+}
+
+// GetPagination retrieves the limit and offset query parameters, using
+// defLimit if no limit was specified, and ensuring that the limit does
+// not exceed maxLimit
+func (ar *AppRequest) GetPagination(defLimit, maxLimit uint) (limit, offset uint, err error) {
+	limit = defLimit
+
+	if param := ar.GetQueryParam("limit"); param != "" {
+		value, parseErr := strconv.ParseUint(param, 10, 0)
+		if parseErr != nil || value == 0 || value > uint64(maxLimit) {
+			err = fmt.Errorf("invalid limit value %q, must be between 1 and %d", param, maxLimit)
+			return
+		}
+		limit = uint(value)
+	}
+
+	if param := ar.GetQueryParam("offset"); param != "" {
+		value, parseErr := strconv.ParseUint(param, 10, 0)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid offset value %q", param)
+			return
+		}
+		offset = uint(value)
+	}
+
+	return
+}
+
 func (ar *AppRequest) GetAuthorization() string {
 	return ar.GetHeader("Authorization")
 }
@@ -75,6 +118,14 @@ func (ar *AppRequest) GetRegistrationId() string {
 	return ar.GetHeader("X-Telemetry-Registration-Id")
 }
 
+func (ar *AppRequest) GetClientVersion() string {
+	return ar.GetHeader("X-Telemetry-Client-Version")
+}
+
+func (ar *AppRequest) GetUserAgent() string {
+	return ar.GetHeader("User-Agent")
+}
+
 func (ar *AppRequest) SetHeader(header, value string) {
 	ar.Log.Debug("Response header", slog.String(header, value))
 	ar.W.Header().Set(header, value)
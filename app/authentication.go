@@ -1,129 +1,126 @@
 package app
 
 import (
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"log/slog"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/SUSE/telemetry-server/app/config"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 type AuthManager struct {
 	config       *config.AuthConfig
-	secret       []byte
 	duration     time.Duration
+	reuse        time.Duration
 	issuer       string
+	audience     string
 	methods      []jwt.SigningMethod
 	validMethods []string
+	keyring      *authKeyring
+	revocations  TokenRevocations
 }
 
-var durationSfxMap = map[string]time.Duration{
-	"s": time.Second,
-	"m": time.Minute,
-	"h": time.Hour,
-	"d": time.Hour * 24,
-	"w": time.Hour * 24 * 7,
-}
-
-func validDurationSuffixes() (sfxs string) {
-	for k := range durationSfxMap {
-		sfxs += k
-	}
-	return
-}
+// ErrTokenRevoked indicates that an otherwise valid token has been revoked
+var ErrTokenRevoked = errors.New("token has been revoked")
 
 // use 1 week as default time duration
 const DEFAULT_AUTH_TIME_DURATION time.Duration = time.Hour * 24 * 7
 
-// authDuration is a helper function that converts an auth di
+// authDuration is a helper function that converts an auth duration config
+// setting into a time.Duration
 func authDuration(cfgDuration string) (timeDuration time.Duration, err error) {
-	// support s for seconds, m for minutes, h for hours, d for days and
-	// w for weeks, with no suffix meaning seconds
-
-	// strip off surrounding whitespace
-	stripped := strings.TrimSpace(cfgDuration)
+	return configDuration("auth.duration", cfgDuration, config.DEF_AUTH_DURATION)
+}
 
-	// use the default duration if none specified
-	if stripped == "" {
-		stripped = config.DEF_AUTH_DURATION
+// authReuseThreshold is a helper function that converts an auth reuse
+// threshold config setting, a percentage of the token duration, into the
+// minimum remaining lifetime of a reusable token, with 0 meaning that
+// tokens should never be reused
+func authReuseThreshold(cfgThreshold int, duration time.Duration) (threshold time.Duration, err error) {
+	switch {
+	case cfgThreshold == 0:
+		cfgThreshold = config.DEF_AUTH_REUSE_THRESHOLD
+	case cfgThreshold < 0:
+		return 0, nil
+	case cfgThreshold > 100:
+		return 0, fmt.Errorf("invalid auth.reuseThreshold value %d, must be at most 100", cfgThreshold)
 	}
 
-	sfx := strings.TrimLeft(stripped, " +-0123456789")
-	digits := strings.TrimSpace(strings.TrimSuffix(stripped, sfx))
+	return duration * time.Duration(cfgThreshold) / 100, nil
+}
 
-	slog.Debug("timeDuration", slog.String("cfgDuration", cfgDuration), slog.String("stripped", stripped), slog.String("digits", digits), slog.String("sfx", sfx))
+func NewAuthManager(ac *config.AuthConfig) (am *AuthManager, err error) {
+	am = new(AuthManager)
 
-	// convert the digits to an int64
-	durationCount, err := strconv.ParseInt(digits, 0, 64)
+	am.duration, err = authDuration(ac.Duration)
 	if err != nil {
-		return
-	}
-
-	// duration must be > 0
-	if durationCount <= 0 {
-		err = fmt.Errorf(
-			"invalid auth.duration value '%s', must be greater than 0",
-			cfgDuration,
+		slog.Error(
+			"config auth.duration invalid",
+			slog.String("auth.duration", ac.Duration),
+			slog.String("error", err.Error()),
 		)
-		return
-	}
-
-	// assume seconds if no suffix specified
-	if sfx == "" {
-		sfx = "s"
+		return nil, err
 	}
 
-	// determine the suffix multiplier
-	sfxMult, ok := durationSfxMap[sfx]
-	if !ok {
-		err = fmt.Errorf(
-			"invalid auth.duration suffix '%s', must be one of [%s]",
-			sfx,
-			validDurationSuffixes(),
+	am.reuse, err = authReuseThreshold(ac.ReuseThreshold, am.duration)
+	if err != nil {
+		slog.Error(
+			"config auth.reuseThreshold invalid",
+			slog.Int("auth.reuseThreshold", ac.ReuseThreshold),
+			slog.String("error", err.Error()),
 		)
-		return
+		return nil, err
 	}
 
-	timeDuration = time.Duration(durationCount) * sfxMult
+	if ac.Issuer != "" {
+		am.issuer = ac.Issuer
+	} else {
+		am.issuer = "telemetry-service-gateway"
+	}
 
-	return
-}
+	am.audience = ac.Audience
 
-func NewAuthManager(ac *config.AuthConfig) (am *AuthManager, err error) {
-	am = new(AuthManager)
-	am.secret, err = base64.StdEncoding.DecodeString(ac.Secret)
-	if err != nil {
-		slog.Error("config auth.secret must be a valid base64 encoded value")
-		return nil, err
+	algorithm := ac.Algorithm
+	if algorithm == "" {
+		algorithm = config.DEF_AUTH_ALGORITHM
 	}
 
-	am.duration, err = authDuration(ac.Duration)
+	method, err := authSigningMethod(algorithm)
 	if err != nil {
 		slog.Error(
-			"config auth.duration invalid",
-			slog.String("auth.duration", ac.Duration),
+			"config auth.algorithm invalid",
+			slog.String("auth.algorithm", algorithm),
 			slog.String("error", err.Error()),
 		)
 		return nil, err
 	}
 
-	if ac.Issuer != "" {
-		am.issuer = ac.Issuer
-	} else {
-		am.issuer = "telemetry-service-gateway"
+	// first method is the method used for newly generated tokens,
+	// remaining methods are valid for existing tokens
+	am.methods = []jwt.SigningMethod{method}
+	if isHMACMethod(method) {
+		for _, m := range []jwt.SigningMethod{
+			jwt.SigningMethodHS512,
+			jwt.SigningMethodHS384,
+			jwt.SigningMethodHS256,
+		} {
+			if m != method {
+				am.methods = append(am.methods, m)
+			}
+		}
 	}
 
-	am.methods = []jwt.SigningMethod{
-		// first method is the method used for newly generated tokens,
-		// remaining methods are valid for existing tokens. Add new
-		// preferred methods to start of list
-		jwt.SigningMethodHS512,
-		jwt.SigningMethodHS384,
-		jwt.SigningMethodHS256,
+	am.keyring, err = newAuthKeyring(ac, method)
+	if err != nil {
+		slog.Error(
+			"config auth keys invalid",
+			slog.String("auth.algorithm", algorithm),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
 	}
 
 	// generate list of valid methods
@@ -148,6 +145,21 @@ func (am *AuthManager) Issuer() string {
 	return am.issuer
 }
 
+// Duration returns the lifetime of newly created tokens
+func (am *AuthManager) Duration() time.Duration {
+	return am.duration
+}
+
+// SetRevocations sets the TokenRevocations that are consulted to determine
+// whether otherwise valid tokens have been revoked
+func (am *AuthManager) SetRevocations(revocations TokenRevocations) {
+	am.revocations = revocations
+}
+
+func (am *AuthManager) Audience() string {
+	return am.audience
+}
+
 func (am *AuthManager) SigningMethod() jwt.SigningMethod {
 	return am.methods[0]
 }
@@ -160,16 +172,65 @@ func (am *AuthManager) Subject(sub any) string {
 	return fmt.Sprintf("%v", sub)
 }
 
-func (am *AuthManager) CreateToken() (tokenString string, err error) {
-	token := jwt.NewWithClaims(
-		am.SigningMethod(),
-		jwt.MapClaims{
-			"exp": am.newExpiration(),
-			"iss": am.Issuer(),
-		},
-	)
+// CanIssue returns true if the AuthManager has a key to sign tokens with
+func (am *AuthManager) CanIssue() bool {
+	return am.keyring.active.signingKey != nil
+}
+
+// ActiveKid returns the kid of the key used to sign new tokens, which is
+// empty if the legacy, unidentified, key is used
+func (am *AuthManager) ActiveKid() string {
+	return am.keyring.active.kid
+}
 
-	tokenString, err = token.SignedString(am.secret)
+// JWKS returns the JSON Web Key Set of public keys that tokens may be
+// verified with, which is empty if a shared secret is used
+func (am *AuthManager) JWKS() (jwks JWKS, err error) {
+	jwks.Keys = []JWK{}
+
+	for _, pk := range am.keyring.publicKeys() {
+		jwk, err := newJWK(pk.kid, am.SigningMethod().Alg(), pk.key)
+		if err != nil {
+			slog.Error("JWK generation failed", slog.String("kid", pk.kid), slog.String("error", err.Error()))
+			return jwks, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return
+}
+
+// CreateToken creates a new token bound to the specified client
+// registration id, which is recorded as the token's subject
+func (am *AuthManager) CreateToken(registrationId int64) (tokenString string, err error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"exp": am.newExpirationFrom(now),
+		"iss": am.Issuer(),
+		"sub": am.Subject(registrationId),
+		"iat": jwt.NewNumericDate(now),
+		"jti": uuid.NewString(),
+	}
+	if am.Audience() != "" {
+		claims["aud"] = am.Audience()
+	}
+
+	token := jwt.NewWithClaims(am.SigningMethod(), claims)
+
+	// services configured with only public keys can verify but not issue tokens
+	if !am.CanIssue() {
+		err = fmt.Errorf("token issuing not enabled, active auth key has no private key")
+		slog.Error("jwt token signing failed", slog.String("error", err.Error()))
+		return
+	}
+
+	// identify the signing key so that it can be found during verification
+	// after the keys have been rotated
+	if kid := am.ActiveKid(); kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	tokenString, err = token.SignedString(am.keyring.active.signingKey)
 	if err != nil {
 		slog.Error("jwt token signing failed", slog.String("error", err.Error()))
 	}
@@ -177,19 +238,123 @@ func (am *AuthManager) CreateToken() (tokenString string, err error) {
 	return
 }
 
-func (am *AuthManager) VerifyToken(tokenString string) (err error) {
-	_, err = jwt.Parse(
-		tokenString,
-		func(*jwt.Token) (any, error) { return am.secret, nil },
+// parseToken parses and validates the token, including checking that it
+// hasn't been revoked, returning the token and its claims if it is valid
+func (am *AuthManager) parseToken(tokenString string, extraOpts ...jwt.ParserOption) (token *jwt.Token, claims *jwt.RegisteredClaims, err error) {
+	opts := []jwt.ParserOption{
 		jwt.WithValidMethods(am.ValidMethods()),
 		jwt.WithIssuer(am.Issuer()),
 		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+	if am.Audience() != "" {
+		opts = append(opts, jwt.WithAudience(am.Audience()))
+	}
+	opts = append(opts, extraOpts...)
+
+	claims = new(jwt.RegisteredClaims)
+	token, err = jwt.ParseWithClaims(
+		tokenString,
+		claims,
+		// select the verification keys based upon the token's kid
+		am.keyring.verificationKeys,
+		opts...,
 	)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	if am.revocations != nil {
+		var issuedAt time.Time
+		if claims.IssuedAt != nil {
+			issuedAt = claims.IssuedAt.Time
+		}
+
+		revoked, err := am.revocations.IsRevoked(claims.ID, issuedAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to check token revocation: %w", err)
+		}
+		if revoked {
+			return nil, nil, ErrTokenRevoked
+		}
+	}
+
+	return
+}
+
+// ParseToken verifies that the token is valid, returning its claims
+func (am *AuthManager) ParseToken(tokenString string) (claims *jwt.RegisteredClaims, err error) {
+	_, claims, err = am.parseToken(tokenString)
 	if err != nil {
-		slog.Error("token parse failed", slog.String("tokenString", tokenString))
+		slog.Error(
+			"token parse failed",
+			slog.String("tokenString", tokenString),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// RemainingLifetime returns how long the token with the specified claims
+// remains valid for, which is 0 if it has expired
+func (am *AuthManager) RemainingLifetime(claims *jwt.RegisteredClaims) time.Duration {
+	if claims.ExpiresAt == nil {
+		return 0
+	}
+
+	return max(time.Until(claims.ExpiresAt.Time), 0)
+}
+
+// VerifyToken verifies that the token is valid and was issued to the
+// specified client registration id
+func (am *AuthManager) VerifyToken(tokenString string, registrationId int64) (err error) {
+	_, _, err = am.parseToken(
+		tokenString,
+		// tokens issued to other clients, or without a subject, are rejected
+		jwt.WithSubject(am.Subject(registrationId)),
+	)
+
+	if err != nil {
+		slog.Error(
+			"token parse failed",
+			slog.String("tokenString", tokenString),
+			slog.Int64("registrationId", registrationId),
+			slog.String("error", err.Error()),
+		)
 		return
 	}
 
 	return
 }
+
+// TokenReusable checks if the specified client registration's existing
+// token can be returned to the client rather than a new token, which
+// requires that it is valid, was signed with the active key and method,
+// and has at least the reuse threshold of its lifetime remaining
+func (am *AuthManager) TokenReusable(tokenString string, registrationId int64) bool {
+	if am.reuse == 0 || tokenString == "" {
+		return false
+	}
+
+	token, claims, err := am.parseToken(
+		tokenString,
+		jwt.WithSubject(am.Subject(registrationId)),
+	)
+	if err != nil {
+		slog.Debug(
+			"existing token not reusable",
+			slog.Int64("registrationId", registrationId),
+			slog.String("error", err.Error()),
+		)
+		return false
+	}
+
+	// tokens signed with retired keys should be replaced
+	kid, _ := token.Header["kid"].(string)
+	if token.Method.Alg() != am.SigningMethod().Alg() || kid != am.ActiveKid() {
+		return false
+	}
+
+	return am.RemainingLifetime(claims) >= am.reuse
+}
@@ -1,9 +1,21 @@
 package app
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/SUSE/telemetry-server/app/config"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -99,6 +111,344 @@ func (t *AuthenticationTestSuite) TestTimeDurations() {
 	}
 }
 
+// writePEM writes a PEM block of the specified type and data to a file
+// in the specified directory, returning the file's path
+func (t *AuthenticationTestSuite) writePEM(dir, name, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	t.Require().NoError(os.WriteFile(path, data, 0600))
+	return path
+}
+
+// writeKeyPair writes the private key, and its public key, to PEM files in
+// the specified directory, returning their paths
+func (t *AuthenticationTestSuite) writeKeyPair(dir, name string, key crypto.Signer) (privPath, pubPath string) {
+	privDer, err := x509.MarshalPKCS8PrivateKey(key)
+	t.Require().NoError(err)
+	pubDer, err := x509.MarshalPKIXPublicKey(key.Public())
+	t.Require().NoError(err)
+
+	privPath = t.writePEM(dir, name+".key", "PRIVATE KEY", privDer)
+	pubPath = t.writePEM(dir, name+".pub", "PUBLIC KEY", pubDer)
+	return
+}
+
+func (t *AuthenticationTestSuite) TestTokenSigningAlgorithms() {
+	dir := t.T().TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	t.Require().NoError(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	t.Require().NoError(err)
+	ecP384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	t.Require().NoError(err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	t.Require().NoError(err)
+	_, otherEdKey, err := ed25519.GenerateKey(rand.Reader)
+	t.Require().NoError(err)
+
+	rsaPriv, rsaPub := t.writeKeyPair(dir, "rsa", rsaKey)
+	ecPriv, ecPub := t.writeKeyPair(dir, "ec", ecKey)
+	ecP384Priv, _ := t.writeKeyPair(dir, "ecp384", ecP384Key)
+	edPriv, edPub := t.writeKeyPair(dir, "ed", edKey)
+	_, otherEdPub := t.writeKeyPair(dir, "othered", otherEdKey)
+
+	tests := []struct {
+		name       string
+		algorithm  string
+		privateKey string
+		publicKeys []string
+	}{
+		{name: "RS256", algorithm: "RS256", privateKey: rsaPriv, publicKeys: []string{rsaPub}},
+		{name: "ES256", algorithm: "ES256", privateKey: ecPriv, publicKeys: []string{ecPub}},
+		{name: "EdDSA", algorithm: "EdDSA", privateKey: edPriv, publicKeys: []string{otherEdPub, edPub}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			issuer, err := NewAuthManager(&config.AuthConfig{
+				Algorithm:  tt.algorithm,
+				PrivateKey: tt.privateKey,
+			})
+			t.Require().NoError(err)
+			t.True(issuer.CanIssue())
+
+			token, err := issuer.CreateToken(1)
+			t.Require().NoError(err)
+			t.NoError(issuer.VerifyToken(token, 1), "issuer should verify its own tokens")
+
+			// a verify only manager can validate, but not create, tokens
+			verifier, err := NewAuthManager(&config.AuthConfig{
+				Algorithm:  tt.algorithm,
+				PublicKeys: tt.publicKeys,
+			})
+			t.Require().NoError(err)
+			t.False(verifier.CanIssue())
+			t.NoError(verifier.VerifyToken(token, 1), "verifier should accept tokens signed by the private key")
+
+			_, err = verifier.CreateToken(1)
+			t.Error(err, "verifier should not be able to create tokens")
+		})
+	}
+
+	// tokens signed with a key that isn't configured are rejected
+	issuer, err := NewAuthManager(&config.AuthConfig{Algorithm: "EdDSA", PrivateKey: edPriv})
+	t.Require().NoError(err)
+	token, err := issuer.CreateToken(1)
+	t.Require().NoError(err)
+	verifier, err := NewAuthManager(&config.AuthConfig{Algorithm: "EdDSA", PublicKeys: []string{otherEdPub}})
+	t.Require().NoError(err)
+	t.Error(verifier.VerifyToken(token, 1), "token signed with an unknown key should be rejected")
+
+	// tokens signed with a different algorithm are rejected
+	hmacIssuer, err := NewAuthManager(&config.AuthConfig{Secret: "VGVzdGluZ1NlY3JldAo="})
+	t.Require().NoError(err)
+	hmacToken, err := hmacIssuer.CreateToken(1)
+	t.Require().NoError(err)
+	t.Error(verifier.VerifyToken(hmacToken, 1), "token signed with another algorithm should be rejected")
+
+	// invalid configurations
+	_, err = NewAuthManager(&config.AuthConfig{Algorithm: "none"})
+	t.Error(err, "the none algorithm should be rejected")
+	_, err = NewAuthManager(&config.AuthConfig{Algorithm: "RS256"})
+	t.Error(err, "asymmetric algorithms should require keys")
+	_, err = NewAuthManager(&config.AuthConfig{Algorithm: "ES256", PrivateKey: ecP384Priv})
+	t.Error(err, "ES256 should require a P-256 key")
+	_, err = NewAuthManager(&config.AuthConfig{Algorithm: "RS256", PrivateKey: edPriv})
+	t.Error(err, "RS256 should require an RSA key")
+}
+
+func (t *AuthenticationTestSuite) TestKeyRotation() {
+	dir := t.T().TempDir()
+
+	_, oldKey, err := ed25519.GenerateKey(rand.Reader)
+	t.Require().NoError(err)
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	t.Require().NoError(err)
+	_, legacyKey, err := ed25519.GenerateKey(rand.Reader)
+	t.Require().NoError(err)
+
+	oldPriv, oldPub := t.writeKeyPair(dir, "old", oldKey)
+	newPriv, _ := t.writeKeyPair(dir, "new", newKey)
+	legacyPriv, legacyPub := t.writeKeyPair(dir, "legacy", legacyKey)
+
+	// tokens issued before keyring entries were introduced have no kid
+	legacyAm, err := NewAuthManager(&config.AuthConfig{Algorithm: "EdDSA", PrivateKey: legacyPriv})
+	t.Require().NoError(err)
+	legacyToken, err := legacyAm.CreateToken(1)
+	t.Require().NoError(err)
+
+	oldAm, err := NewAuthManager(&config.AuthConfig{
+		Algorithm:  "EdDSA",
+		PublicKeys: []string{legacyPub},
+		Keys:       []config.AuthKeyConfig{{Kid: "old", PrivateKey: oldPriv}},
+	})
+	t.Require().NoError(err)
+	t.Equal("old", oldAm.ActiveKid())
+	oldToken, err := oldAm.CreateToken(1)
+	t.Require().NoError(err)
+
+	// rotate to the new key, retaining the old key for verification
+	newAm, err := NewAuthManager(&config.AuthConfig{
+		Algorithm:  "EdDSA",
+		PublicKeys: []string{legacyPub},
+		Keys: []config.AuthKeyConfig{
+			{Kid: "old", PublicKey: oldPub},
+			{Kid: "new", PrivateKey: newPriv},
+		},
+		ActiveKid: "new",
+	})
+	t.Require().NoError(err)
+	t.Equal("new", newAm.ActiveKid())
+
+	newToken, err := newAm.CreateToken(1)
+	t.Require().NoError(err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, jwt.MapClaims{})
+	t.Require().NoError(err)
+	t.Equal("new", parsed.Header["kid"], "new tokens should be signed with the active key")
+
+	t.NoError(newAm.VerifyToken(newToken, 1))
+	t.NoError(newAm.VerifyToken(oldToken, 1), "tokens signed with retired keys should remain valid")
+	t.NoError(newAm.VerifyToken(legacyToken, 1), "tokens without a kid should be verified with the legacy keys")
+	t.Error(oldAm.VerifyToken(newToken, 1), "tokens signed with an unknown kid should be rejected")
+
+	// tokens claiming the kid of a different key should be rejected
+	forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"exp": jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		"iss": newAm.Issuer(),
+		"sub": "1",
+	})
+	forged.Header["kid"] = "new"
+	forgedToken, err := forged.SignedString(oldKey)
+	t.Require().NoError(err)
+	t.Error(newAm.VerifyToken(forgedToken, 1), "token signed by a key other than its kid should be rejected")
+
+	// all public keys are published, identified by their kids
+	jwks, err := newAm.JWKS()
+	t.Require().NoError(err)
+	t.Require().Len(jwks.Keys, 3)
+	t.Equal("old", jwks.Keys[0].Kid)
+	t.Equal("new", jwks.Keys[1].Kid)
+	t.Empty(jwks.Keys[2].Kid)
+	for _, jwk := range jwks.Keys {
+		t.Equal("OKP", jwk.Kty)
+		t.Equal("Ed25519", jwk.Crv)
+		t.Equal("EdDSA", jwk.Alg)
+		t.NotEmpty(jwk.X)
+	}
+
+	// shared secrets can be rotated too, but are never published
+	hmacOld, err := NewAuthManager(&config.AuthConfig{
+		Keys: []config.AuthKeyConfig{{Kid: "s1", Secret: "T2xkU2VjcmV0Cg=="}},
+	})
+	t.Require().NoError(err)
+	hmacOldToken, err := hmacOld.CreateToken(1)
+	t.Require().NoError(err)
+	hmacNew, err := NewAuthManager(&config.AuthConfig{
+		Keys: []config.AuthKeyConfig{
+			{Kid: "s2", Secret: "TmV3U2VjcmV0Cg=="},
+			{Kid: "s1", Secret: "T2xkU2VjcmV0Cg=="},
+		},
+	})
+	t.Require().NoError(err)
+	t.Equal("s2", hmacNew.ActiveKid(), "the first keyring entry should be active by default")
+	t.NoError(hmacNew.VerifyToken(hmacOldToken, 1))
+	jwks, err = hmacNew.JWKS()
+	t.Require().NoError(err)
+	t.Empty(jwks.Keys)
+
+	// invalid keyring configurations
+	_, err = NewAuthManager(&config.AuthConfig{Keys: []config.AuthKeyConfig{{Secret: "T2xkU2VjcmV0Cg=="}}})
+	t.Error(err, "keyring entries require a kid")
+	_, err = NewAuthManager(&config.AuthConfig{
+		Keys:      []config.AuthKeyConfig{{Kid: "s1", Secret: "T2xkU2VjcmV0Cg=="}},
+		ActiveKid: "s2",
+	})
+	t.Error(err, "the active kid must exist")
+}
+
+func (t *AuthenticationTestSuite) TestTokenClaims() {
+	am, err := NewAuthManager(&config.AuthConfig{
+		Secret:   "VGVzdGluZ1NlY3JldAo=",
+		Audience: "telemetry-server",
+	})
+	t.Require().NoError(err)
+
+	token, err := am.CreateToken(42)
+	t.Require().NoError(err)
+
+	claims := jwt.MapClaims{}
+	_, _, err = jwt.NewParser().ParseUnverified(token, claims)
+	t.Require().NoError(err)
+	t.Equal("42", claims["sub"], "subject should be the registration id")
+	t.Equal("telemetry-server", claims["aud"])
+	t.NotEmpty(claims["iat"])
+	t.NotEmpty(claims["jti"])
+
+	// each token should have a unique id
+	other, err := am.CreateToken(42)
+	t.Require().NoError(err)
+	otherClaims := jwt.MapClaims{}
+	_, _, err = jwt.NewParser().ParseUnverified(other, otherClaims)
+	t.Require().NoError(err)
+	t.NotEqual(claims["jti"], otherClaims["jti"])
+
+	t.NoError(am.VerifyToken(token, 42))
+	t.Error(am.VerifyToken(token, 43), "token issued to another registration should be rejected")
+
+	// tokens for another audience should be rejected
+	otherAm, err := NewAuthManager(&config.AuthConfig{
+		Secret:   "VGVzdGluZ1NlY3JldAo=",
+		Audience: "other-service",
+	})
+	t.Require().NoError(err)
+	t.Error(otherAm.VerifyToken(token, 42), "token for another audience should be rejected")
+
+	// tokens without an audience should be rejected when one is required
+	noAudAm, err := NewAuthManager(&config.AuthConfig{Secret: "VGVzdGluZ1NlY3JldAo="})
+	t.Require().NoError(err)
+	noAudToken, err := noAudAm.CreateToken(42)
+	t.Require().NoError(err)
+	t.NoError(noAudAm.VerifyToken(noAudToken, 42))
+	t.Error(am.VerifyToken(noAudToken, 42), "token without an audience should be rejected")
+
+	// tokens without a subject, e.g. issued by older releases, should be
+	// rejected, requiring the client to re-authenticate
+	legacy := jwt.NewWithClaims(noAudAm.SigningMethod(), jwt.MapClaims{
+		"exp": jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		"iss": noAudAm.Issuer(),
+	})
+	legacyToken, err := legacy.SignedString(noAudAm.keyring.active.signingKey)
+	t.Require().NoError(err)
+	t.Error(noAudAm.VerifyToken(legacyToken, 42), "token without a subject should be rejected")
+}
+
+func (t *AuthenticationTestSuite) TestTokenReuse() {
+	duration := time.Hour * 24 * 7
+
+	thresholds := []struct {
+		config      int
+		expectValue time.Duration
+		expectFail  bool
+	}{
+		{config: 0, expectValue: duration / 2},
+		{config: 25, expectValue: duration / 4},
+		{config: 100, expectValue: duration},
+		{config: -1, expectValue: 0},
+		{config: 101, expectFail: true},
+	}
+	for _, tt := range thresholds {
+		threshold, err := authReuseThreshold(tt.config, duration)
+		if tt.expectFail {
+			t.Error(err, "authReuseThreshold(%d) should have failed", tt.config)
+		} else {
+			t.NoError(err)
+			t.Equal(tt.expectValue, threshold, "authReuseThreshold(%d) returned wrong value", tt.config)
+		}
+	}
+
+	am, err := NewAuthManager(&config.AuthConfig{Secret: "VGVzdGluZ1NlY3JldAo="})
+	t.Require().NoError(err)
+
+	token, err := am.CreateToken(42)
+	t.Require().NoError(err)
+
+	claims, err := am.ParseToken(token)
+	t.Require().NoError(err)
+	t.Equal("42", claims.Subject)
+	t.NotEmpty(claims.ID)
+	t.InDelta(duration.Seconds(), am.RemainingLifetime(claims).Seconds(), 5)
+
+	_, err = am.ParseToken("not-a-token")
+	t.Error(err)
+
+	t.True(am.TokenReusable(token, 42), "fresh token should be reusable")
+	t.False(am.TokenReusable(token, 43), "token issued to another registration should not be reusable")
+	t.False(am.TokenReusable("", 42), "missing token should not be reusable")
+
+	// tokens with less than the threshold remaining should be replaced
+	shortAm, err := NewAuthManager(&config.AuthConfig{Secret: "VGVzdGluZ1NlY3JldAo=", Duration: "1h"})
+	t.Require().NoError(err)
+	shortToken, err := shortAm.CreateToken(42)
+	t.Require().NoError(err)
+	t.NoError(am.VerifyToken(shortToken, 42))
+	t.False(am.TokenReusable(shortToken, 42), "token near expiry should not be reusable")
+
+	// tokens signed with a key other than the active key should be replaced
+	rotatedAm, err := NewAuthManager(&config.AuthConfig{
+		Keys:   []config.AuthKeyConfig{{Kid: "k2", Secret: "TmV3U2VjcmV0Cg=="}},
+		Secret: "VGVzdGluZ1NlY3JldAo=",
+	})
+	t.Require().NoError(err)
+	t.NoError(rotatedAm.VerifyToken(token, 42))
+	t.False(rotatedAm.TokenReusable(token, 42), "token signed with a retired key should not be reusable")
+
+	// reuse can be disabled
+	noReuseAm, err := NewAuthManager(&config.AuthConfig{Secret: "VGVzdGluZ1NlY3JldAo=", ReuseThreshold: -1})
+	t.Require().NoError(err)
+	t.False(noReuseAm.TokenReusable(token, 42), "tokens should not be reused when disabled")
+}
+
 func TestAuthenticationTestSuite(t *testing.T) {
 	suite.Run(t, new(AuthenticationTestSuite))
 }
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+// JWK is a JSON Web Key, as defined by RFC 7517, describing a public key
+// that tokens may be verified with
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set, as defined by RFC 7517
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func jwkEncode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwkEncodeCoordinate encodes an EC coordinate as a fixed length value
+// based upon the curve's size
+func jwkEncodeCoordinate(coord *big.Int, bitSize int) string {
+	return jwkEncode(coord.FillBytes(make([]byte, (bitSize+7)/8)))
+}
+
+// newJWK generates a JWK for the specified public key
+func newJWK(kid, alg string, publicKey any) (jwk JWK, err error) {
+	jwk = JWK{
+		Kid: kid,
+		Use: "sig",
+		Alg: alg,
+	}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = jwkEncode(key.N.Bytes())
+		jwk.E = jwkEncode(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		params := key.Curve.Params()
+		jwk.Kty = "EC"
+		jwk.Crv = params.Name
+		jwk.X = jwkEncodeCoordinate(key.X, params.BitSize)
+		jwk.Y = jwkEncodeCoordinate(key.Y, params.BitSize)
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = jwkEncode(key)
+	default:
+		err = fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+
+	return
+}
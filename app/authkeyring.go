@@ -0,0 +1,205 @@
+package app
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+
+	"github.com/SUSE/telemetry-server/app/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// authKey is a key that tokens are signed and/or verified with; keys
+// without a signing key can only be used to verify existing tokens
+type authKey struct {
+	kid        string
+	signingKey any
+	verifyKeys []jwt.VerificationKey
+}
+
+// authKeyring tracks the keys identified by kid, the active key used to
+// sign new tokens, and the legacy key, configured via the auth.secret,
+// auth.privateKey and auth.publicKeys settings, which is used to verify
+// tokens that have no kid in their header
+type authKeyring struct {
+	method jwt.SigningMethod
+	active *authKey
+	legacy *authKey
+	keys   map[string]*authKey
+	kids   []string // configured order
+}
+
+func newAuthKeyring(ac *config.AuthConfig, method jwt.SigningMethod) (kr *authKeyring, err error) {
+	kr = &authKeyring{
+		method: method,
+		keys:   make(map[string]*authKey),
+	}
+
+	if kr.legacy, err = loadLegacyAuthKey(ac, method); err != nil {
+		return nil, err
+	}
+
+	for i, kc := range ac.Keys {
+		if kc.Kid == "" {
+			return nil, fmt.Errorf("auth.keys entry %d has no kid", i)
+		}
+		if _, found := kr.keys[kc.Kid]; found {
+			return nil, fmt.Errorf("auth.keys kid %q is not unique", kc.Kid)
+		}
+
+		key, err := loadAuthKey(&kc, method)
+		if err != nil {
+			return nil, fmt.Errorf("auth.keys kid %q invalid: %w", kc.Kid, err)
+		}
+		kr.keys[kc.Kid] = key
+		kr.kids = append(kr.kids, kc.Kid)
+	}
+
+	// the active key defaults to the first configured keyring entry,
+	// falling back to the legacy key if no keyring entries exist
+	switch {
+	case ac.ActiveKid != "":
+		active, found := kr.keys[ac.ActiveKid]
+		if !found {
+			return nil, fmt.Errorf("auth.activeKid %q not found in auth.keys", ac.ActiveKid)
+		}
+		kr.active = active
+	case len(kr.kids) > 0:
+		kr.active = kr.keys[kr.kids[0]]
+	default:
+		kr.active = kr.legacy
+	}
+
+	if kr.active == nil {
+		return nil, fmt.Errorf("auth algorithm %q requires auth.keys, or an auth.privateKey or auth.publicKeys", method.Alg())
+	}
+
+	return
+}
+
+// loadLegacyAuthKey loads the key specified by the auth.secret, for HMAC
+// algorithms, or the auth.privateKey and auth.publicKeys settings, returning
+// nil if none are specified
+func loadLegacyAuthKey(ac *config.AuthConfig, method jwt.SigningMethod) (key *authKey, err error) {
+	if isHMACMethod(method) {
+		// for backwards compatibility, an empty secret is accepted if
+		// no keyring entries have been configured
+		if ac.Secret == "" && len(ac.Keys) > 0 {
+			return
+		}
+		return loadAuthKey(&config.AuthKeyConfig{Secret: ac.Secret}, method)
+	}
+
+	key = new(authKey)
+
+	if ac.PrivateKey != "" {
+		privKey, pubKey, err := loadPrivateKey(method, ac.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("auth.privateKey invalid: %w", err)
+		}
+		key.signingKey = privKey
+		key.verifyKeys = append(key.verifyKeys, pubKey)
+	}
+
+	for _, path := range ac.PublicKeys {
+		pubKey, err := loadPublicKey(method, path)
+		if err != nil {
+			return nil, fmt.Errorf("auth.publicKeys invalid: %w", err)
+		}
+		key.verifyKeys = append(key.verifyKeys, pubKey)
+	}
+
+	if len(key.verifyKeys) == 0 {
+		return nil, nil
+	}
+
+	return
+}
+
+// loadAuthKey loads the secret, for HMAC algorithms, or the private or
+// public key, for asymmetric algorithms, specified by the key config
+func loadAuthKey(kc *config.AuthKeyConfig, method jwt.SigningMethod) (key *authKey, err error) {
+	key = &authKey{kid: kc.Kid}
+
+	if isHMACMethod(method) {
+		secret, err := base64.StdEncoding.DecodeString(kc.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("secret must be a valid base64 encoded value: %w", err)
+		}
+		key.signingKey = secret
+		key.verifyKeys = []jwt.VerificationKey{secret}
+		return key, nil
+	}
+
+	switch {
+	case kc.PrivateKey != "":
+		privKey, pubKey, err := loadPrivateKey(method, kc.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		key.signingKey = privKey
+		key.verifyKeys = []jwt.VerificationKey{pubKey}
+	case kc.PublicKey != "":
+		pubKey, err := loadPublicKey(method, kc.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		key.verifyKeys = []jwt.VerificationKey{pubKey}
+	default:
+		return nil, fmt.Errorf("auth algorithm %q requires a privateKey or publicKey", method.Alg())
+	}
+
+	return
+}
+
+// verificationKeys returns the keys that may be used to verify a token
+// based upon the kid, if any, in its header
+func (kr *authKeyring) verificationKeys(token *jwt.Token) (any, error) {
+	kidValue, found := token.Header["kid"]
+	if !found {
+		if kr.legacy == nil {
+			return nil, fmt.Errorf("token has no kid and no legacy auth key is configured")
+		}
+		return jwt.VerificationKeySet{Keys: kr.legacy.verifyKeys}, nil
+	}
+
+	kid, ok := kidValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("token kid is not a string")
+	}
+
+	key, found := kr.keys[kid]
+	if !found {
+		slog.Debug("token kid not found in keyring", slog.String("kid", kid))
+		return nil, fmt.Errorf("token kid %q is not a known key", kid)
+	}
+
+	return jwt.VerificationKeySet{Keys: key.verifyKeys}, nil
+}
+
+// publicKeys returns the public keys, identified by kid where known, that
+// tokens may be verified with; HMAC secrets are never included
+func (kr *authKeyring) publicKeys() (keys []authPublicKey) {
+	if isHMACMethod(kr.method) {
+		return
+	}
+
+	for _, kid := range kr.kids {
+		for _, verifyKey := range kr.keys[kid].verifyKeys {
+			keys = append(keys, authPublicKey{kid: kid, key: verifyKey})
+		}
+	}
+
+	if kr.legacy != nil {
+		for _, verifyKey := range kr.legacy.verifyKeys {
+			keys = append(keys, authPublicKey{key: verifyKey})
+		}
+	}
+
+	return
+}
+
+type authPublicKey struct {
+	kid string
+	key any
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// authSigningMethod looks up the named signing method, ensuring that it is
+// one of the supported HMAC, RSA, ECDSA or EdDSA methods
+func authSigningMethod(alg string) (method jwt.SigningMethod, err error) {
+	method = jwt.GetSigningMethod(alg)
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC,
+		*jwt.SigningMethodRSA,
+		*jwt.SigningMethodRSAPSS,
+		*jwt.SigningMethodECDSA,
+		*jwt.SigningMethodEd25519:
+		return
+	}
+
+	return nil, fmt.Errorf("unsupported auth algorithm %q", alg)
+}
+
+// isHMACMethod returns true if the signing method uses a shared secret
+func isHMACMethod(method jwt.SigningMethod) bool {
+	_, ok := method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
+// parsePrivateKey parses a PEM encoded private key of the type required by
+// the specified asymmetric signing method
+func parsePrivateKey(method jwt.SigningMethod, pemData []byte) (key crypto.PrivateKey, err error) {
+	switch m := method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return jwt.ParseRSAPrivateKeyFromPEM(pemData)
+	case *jwt.SigningMethodECDSA:
+		var ecKey *ecdsa.PrivateKey
+		if ecKey, err = jwt.ParseECPrivateKeyFromPEM(pemData); err != nil {
+			return
+		}
+		if err = checkCurve(m, &ecKey.PublicKey); err != nil {
+			return
+		}
+		return ecKey, nil
+	case *jwt.SigningMethodEd25519:
+		return jwt.ParseEdPrivateKeyFromPEM(pemData)
+	}
+
+	return nil, fmt.Errorf("auth algorithm %q doesn't use private keys", method.Alg())
+}
+
+// parsePublicKey parses a PEM encoded public key of the type required by
+// the specified asymmetric signing method
+func parsePublicKey(method jwt.SigningMethod, pemData []byte) (key crypto.PublicKey, err error) {
+	switch m := method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return jwt.ParseRSAPublicKeyFromPEM(pemData)
+	case *jwt.SigningMethodECDSA:
+		var ecKey *ecdsa.PublicKey
+		if ecKey, err = jwt.ParseECPublicKeyFromPEM(pemData); err != nil {
+			return
+		}
+		if err = checkCurve(m, ecKey); err != nil {
+			return
+		}
+		return ecKey, nil
+	case *jwt.SigningMethodEd25519:
+		return jwt.ParseEdPublicKeyFromPEM(pemData)
+	}
+
+	return nil, fmt.Errorf("auth algorithm %q doesn't use public keys", method.Alg())
+}
+
+// checkCurve ensures that an ECDSA key uses the curve required by the method
+func checkCurve(method *jwt.SigningMethodECDSA, key *ecdsa.PublicKey) error {
+	if key.Curve.Params().BitSize != method.CurveBits {
+		return fmt.Errorf(
+			"auth algorithm %q requires a %d bit curve, not %s",
+			method.Alg(),
+			method.CurveBits,
+			key.Curve.Params().Name,
+		)
+	}
+	return nil
+}
+
+// loadPrivateKey loads the PEM private key file for the specified signing
+// method, returning both the private key and the associated public key
+func loadPrivateKey(method jwt.SigningMethod, path string) (privKey crypto.PrivateKey, pubKey crypto.PublicKey, err error) {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read private key file %q: %w", path, err)
+	}
+
+	if privKey, err = parsePrivateKey(method, pemData); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key file %q: %w", path, err)
+	}
+
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("private key file %q type %T is not a signer", path, privKey)
+	}
+
+	return privKey, signer.Public(), nil
+}
+
+// loadPublicKey loads the PEM public key file for the specified signing method
+func loadPublicKey(method jwt.SigningMethod, path string) (pubKey crypto.PublicKey, err error) {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key file %q: %w", path, err)
+	}
+
+	if pubKey, err = parsePublicKey(method, pemData); err != nil {
+		return nil, fmt.Errorf("failed to parse public key file %q: %w", path, err)
+	}
+
+	return
+}
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/database"
+)
+
+// newClientActivity creates the activity entry for a newly registered client,
+// using the client's transaction so that it is only created if the
+// registration succeeds
+func (a *App) newClientActivity(ar *AppRequest, client *database.ClientsRow) (err error) {
+	activity := new(database.ClientActivityRow)
+	if err = activity.SetupDB(a.OperationalDB); err != nil {
+		return fmt.Errorf("clientActivityRow.SetupDB() failed: %w", err)
+	}
+	if err = activity.SetTx(client.Tx()); err != nil {
+		return fmt.Errorf("clientActivityRow.SetTx() failed: %w", err)
+	}
+
+	activity.InitRegistrationId(client.Id, client.RegistrationDate)
+	activity.UserAgent = ar.GetUserAgent()
+	activity.ClientVersion = ar.GetClientVersion()
+
+	if err = activity.Insert(); err != nil {
+		return fmt.Errorf("failed to create activity for registration %d: %w", client.Id, err)
+	}
+
+	return
+}
+
+// recordClientActivity records an activity of the registration, creating
+// its activity entry if needed, using the supplied record function to record
+// the specific activity, along with the client software used by the request
+func (a *App) recordClientActivity(ar *AppRequest, registrationId int64, record func(activity *database.ClientActivityRow, at time.Time) error) (err error) {
+	activity := new(database.ClientActivityRow)
+	if err = activity.SetupDB(a.OperationalDB); err != nil {
+		return fmt.Errorf("clientActivityRow.SetupDB() failed: %w", err)
+	}
+
+	now := database.DbNow()
+	activity.InitRegistrationId(registrationId, now)
+	activity.UserAgent = ar.GetUserAgent()
+	activity.ClientVersion = ar.GetClientVersion()
+
+	if err = record(activity, now); err != nil {
+		return fmt.Errorf("failed to record activity for registration %d: %w", registrationId, err)
+	}
+
+	return
+}
+
+// recordClientReport records that the registration submitted a report
+func (a *App) recordClientReport(ar *AppRequest, registrationId int64) error {
+	return a.recordClientActivity(ar, registrationId, (*database.ClientActivityRow).RecordReport)
+}
+
+// recordClientAuthentication records that the registration authenticated
+func (a *App) recordClientAuthentication(ar *AppRequest, registrationId int64) error {
+	return a.recordClientActivity(ar, registrationId, (*database.ClientActivityRow).RecordAuthentication)
+}
+
+// lookupClientActivity returns the activity of the registration, or nil if
+// it has no activity entry
+func (a *App) lookupClientActivity(registrationId int64) (*database.ClientActivityEntry, error) {
+	activities, _, err := a.listClientActivity(&database.ClientActivityQuery{RegistrationId: registrationId})
+	if err != nil || len(activities) == 0 {
+		return nil, err
+	}
+
+	return activities[0], nil
+}
+
+// listClientActivity returns the client activity entries selected by the
+// query, ordered by registration id, along with the total number of entries
+// selected by the query, ignoring its limit and offset
+func (a *App) listClientActivity(q *database.ClientActivityQuery) (activities []*database.ClientActivityEntry, total uint, err error) {
+	row := new(database.ClientActivityRow)
+	if err = row.SetupDB(a.OperationalDB); err != nil {
+		return nil, 0, fmt.Errorf("clientActivityRow.SetupDB() failed: %w", err)
+	}
+
+	if activities, err = row.List(q); err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve client activity: %w", err)
+	}
+
+	if total, err = row.Count(q); err != nil {
+		return nil, 0, fmt.Errorf("failed to count client activity: %w", err)
+	}
+
+	return
+}
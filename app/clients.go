@@ -0,0 +1,186 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/database"
+)
+
+// authorizeClient verifies that the request was made by a registered client
+// using the most recent authtoken issued to it, returning the client, or
+// generating an appropriate error response, with a WWW-Authenticate
+// challenge indicating whether the client needs to register or
+// re-authenticate, and returning nil
+func (a *App) authorizeClient(ar *AppRequest) *database.ClientsRow {
+	// retrieve required headers
+	hdrRegistrationId := ar.GetRegistrationId()
+	token := ar.GetAuthToken()
+
+	// missing registrationId or token suggests client needs to register
+	if (hdrRegistrationId == "") || (token == "") {
+		// client needs to register
+		ar.SetWwwAuthRegister()
+		ar.ErrorResponse(http.StatusUnauthorized, "Client registration required")
+		return nil
+	}
+
+	// verify that the provided registration id is a valid number
+	registrationId, err := strconv.ParseInt(hdrRegistrationId, 0, 64)
+	if err != nil {
+		// client needs to register
+		ar.SetWwwAuthRegister()
+		ar.ErrorResponse(http.StatusUnauthorized, "Invalid Registration Id")
+		return nil
+	}
+
+	// verify that a valid authtoken, issued to the registration id, has
+	// been provided
+	if err := a.AuthManager.VerifyToken(token, registrationId); err != nil {
+		// client needs to re-authenticate
+		ar.SetWwwAuthReauth()
+		ar.ErrorResponse(http.StatusUnauthorized, "Invalid Authorization")
+		return nil
+	}
+
+	ar.Log.Debug(
+		"Bearer Authorization Valid",
+		slog.String("token", token),
+	)
+
+	// verify that the registration exists
+	client := new(database.ClientsRow)
+	if err = client.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("clientsRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return nil
+	}
+
+	client.InitRegistrationId(registrationId)
+	if !client.Exists() {
+		// client needs to register
+		ar.SetWwwAuthRegister()
+		ar.ErrorResponse(http.StatusUnauthorized, "Invalid Registration Id")
+		return nil
+	}
+
+	// verify that the provided authtoken matches last authtoken issued to the client
+	if client.AuthToken != token {
+		// the token was issued to this registration but has since been
+		// superseded, suggesting that the registration is being used by
+		// a cloned system
+		forceReregister, err := a.clones.staleToken(client, token)
+		if err != nil {
+			ar.Log.Warn("clone signal recording failed", slog.String("error", err.Error()))
+		}
+		if forceReregister {
+			// suspected clone needs to register
+			ar.SetWwwAuthRegister()
+			ar.ErrorResponse(http.StatusUnauthorized, "Client registration required")
+			return nil
+		}
+
+		// client needs to re-authenticate
+		ar.SetWwwAuthReauth()
+		ar.ErrorResponse(http.StatusUnauthorized, "Invalid Authorization")
+		return nil
+	}
+
+	ar.Log.Debug(
+		"Client Authorized",
+		slog.Int64("registrationId", registrationId),
+	)
+
+	return client
+}
+
+// revokeRegistrations deletes the specified client registrations, along with
+// any clone signals and activity recorded for them, within a single transaction, such that
+// the revoked clients' authtokens are rejected by subsequent requests
+func (a *App) revokeRegistrations(ids []int64) (err error) {
+	tx, err := a.OperationalDB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin registration revocation transaction: %w", err)
+	}
+
+	// rollback any changes if we fail to commit the transaction
+	defer tx.Rollback()
+
+	client := new(database.ClientsRow)
+	if err = client.SetupDB(a.OperationalDB); err != nil {
+		return fmt.Errorf("clientsRow.SetupDB() failed: %w", err)
+	}
+	if err = client.SetTx(tx); err != nil {
+		return fmt.Errorf("clientsRow.SetTx() failed: %w", err)
+	}
+
+	cs := new(database.CloneSignalRow)
+	if err = cs.SetupDB(a.OperationalDB); err != nil {
+		return fmt.Errorf("cloneSignalRow.SetupDB() failed: %w", err)
+	}
+	if err = cs.SetTx(tx); err != nil {
+		return fmt.Errorf("cloneSignalRow.SetTx() failed: %w", err)
+	}
+
+	activity := new(database.ClientActivityRow)
+	if err = activity.SetupDB(a.OperationalDB); err != nil {
+		return fmt.Errorf("clientActivityRow.SetupDB() failed: %w", err)
+	}
+	if err = activity.SetTx(tx); err != nil {
+		return fmt.Errorf("clientActivityRow.SetTx() failed: %w", err)
+	}
+
+	for _, id := range ids {
+		cs.RegistrationId = id
+		if _, err = cs.DeleteForRegistration(); err != nil {
+			return fmt.Errorf("failed to delete clone signals of registration %d: %w", id, err)
+		}
+
+		activity.RegistrationId = id
+		if _, err = activity.DeleteForRegistration(); err != nil {
+			return fmt.Errorf("failed to delete activity of registration %d: %w", id, err)
+		}
+
+		client.InitRegistrationId(id)
+		if err = client.Delete(); err != nil {
+			return fmt.Errorf("failed to delete registration %d: %w", id, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit registration revocation: %w", err)
+	}
+
+	return
+}
+
+// clientsFilter selects client registrations; zero values match all
+// registrations
+type clientsFilter struct {
+	ClientId   string
+	SystemUUID string
+	// registered at, or after, this time
+	RegisteredAfter time.Time
+	// registered before this time
+	RegisteredBefore time.Time
+}
+
+// listClients returns the filter selected client registrations within the
+// specified page, ordered by id, without their authtokens
+func (a *App) listClients(filter *clientsFilter, limit, offset uint) (clients []*database.ClientsRow, err error) {
+	client := new(database.ClientsRow)
+	if err = client.SetupDB(a.OperationalDB); err != nil {
+		return nil, fmt.Errorf("clientsRow.SetupDB() failed: %w", err)
+	}
+	client.ClientId = filter.ClientId
+	client.SystemUUID = filter.SystemUUID
+
+	if clients, err = client.ListMatching(filter.RegisteredAfter, filter.RegisteredBefore, limit, offset); err != nil {
+		return nil, fmt.Errorf("failed to retrieve clients: %w", err)
+	}
+
+	return
+}
@@ -0,0 +1,282 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/config"
+	"github.com/SUSE/telemetry-server/app/database"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// clone detection policies
+const (
+	// suspected clones are only flagged for review by an administrator
+	CLONE_POLICY_FLAG = "flag"
+	// suspected clones presenting stale tokens are additionally forced to
+	// register again, obtaining a registration of their own
+	CLONE_POLICY_REREGISTER = "reregister"
+)
+
+// cloneDetector records signals indicating that a client registration is
+// in use by more than one system, e.g. a registered system's disk image was
+// cloned, flagging registrations that accumulate enough signals as suspected
+// clones for review by an administrator
+type cloneDetector struct {
+	app              *App
+	threshold        int64
+	policy           string
+	interleaveWindow time.Duration
+	staleTokenGrace  time.Duration
+}
+
+func newCloneDetector(a *App, cc *config.CloneDetectionConfig) (cd *cloneDetector, err error) {
+	cd = new(cloneDetector)
+	cd.app = a
+
+	switch {
+	case cc.Threshold < 0:
+		return nil, fmt.Errorf(
+			"invalid cloneDetection.threshold value '%d', must not be negative",
+			cc.Threshold,
+		)
+	case cc.Threshold == 0:
+		cd.threshold = int64(config.DEF_CLONE_DETECTION_THRESHOLD)
+	default:
+		cd.threshold = int64(cc.Threshold)
+	}
+
+	switch cc.Policy {
+	case "":
+		cd.policy = config.DEF_CLONE_DETECTION_POLICY
+	case CLONE_POLICY_FLAG, CLONE_POLICY_REREGISTER:
+		cd.policy = cc.Policy
+	default:
+		return nil, fmt.Errorf(
+			"invalid cloneDetection.policy value %q, must be one of %q or %q",
+			cc.Policy,
+			CLONE_POLICY_FLAG,
+			CLONE_POLICY_REREGISTER,
+		)
+	}
+
+	cd.interleaveWindow, err = configDuration(
+		"cloneDetection.interleaveWindow",
+		cc.InterleaveWindow,
+		config.DEF_CLONE_DETECTION_INTERLEAVE_WINDOW,
+	)
+	if err != nil {
+		slog.Error(
+			"config cloneDetection.interleaveWindow invalid",
+			slog.String("cloneDetection.interleaveWindow", cc.InterleaveWindow),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	cd.staleTokenGrace, err = configDuration(
+		"cloneDetection.staleTokenGrace",
+		cc.StaleTokenGrace,
+		config.DEF_CLONE_DETECTION_STALE_TOKEN_GRACE,
+	)
+	if err != nil {
+		slog.Error(
+			"config cloneDetection.staleTokenGrace invalid",
+			slog.String("cloneDetection.staleTokenGrace", cc.StaleTokenGrace),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	return
+}
+
+// forceReregister returns true if the client should be forced to register
+// again, which only applies to suspected clones under the reregister policy
+func (cd *cloneDetector) forceReregister(client *database.ClientsRow) bool {
+	return cd.policy == CLONE_POLICY_REREGISTER && client.CloneSuspected
+}
+
+// recordSignal records a clone signal for the client's registration, as
+// part of the client's transaction if any, flagging the client as a
+// suspected clone if the threshold number of signals has been reached.
+// Signals identifying a token, which is only the case for stale tokens, are
+// recorded once per token, with further presentations of the token counted
+// as occurrences of the existing signal. Once the client has been flagged as
+// a suspected clone, signals are only counted as occurrences of the most
+// recent existing signal of the same type, so that clones that continue to
+// present stale tokens don't add a signal per request.
+func (cd *cloneDetector) recordSignal(client *database.ClientsRow, related int64, signal, tokenId, details string) (err error) {
+	now := database.DbNow()
+
+	cs := new(database.CloneSignalRow)
+	if err = cs.SetupDB(cd.app.OperationalDB); err != nil {
+		return fmt.Errorf("cloneSignalRow.SetupDB() failed: %w", err)
+	}
+	if err = cs.SetTx(client.Tx()); err != nil {
+		return fmt.Errorf("cloneSignalRow.SetTx() failed: %w", err)
+	}
+
+	cs.Init(client.Id, related, signal, details, now)
+	cs.TokenId = tokenId
+
+	if client.CloneSuspected || tokenId != "" {
+		recorded, err := cs.RecordOccurrence(now, !client.CloneSuspected)
+		if err != nil {
+			return fmt.Errorf("failed to record %s clone signal occurrence for registration %d: %w", signal, client.Id, err)
+		}
+		if recorded {
+			slog.Debug(
+				"Clone signal occurrence recorded",
+				slog.Int64("registrationId", client.Id),
+				slog.Int64("signalId", cs.Id),
+				slog.String("signal", signal),
+			)
+			return nil
+		}
+	}
+
+	if err = cs.Insert(); err != nil {
+		return fmt.Errorf("failed to record %s clone signal for registration %d: %w", signal, client.Id, err)
+	}
+
+	slog.Warn(
+		"Clone signal detected",
+		slog.Int64("registrationId", client.Id),
+		slog.String("clientId", client.ClientId),
+		slog.String("signal", signal),
+		slog.String("details", details),
+	)
+
+	if client.CloneSuspected {
+		return
+	}
+
+	count, err := cs.CountForRegistration()
+	if err != nil {
+		return fmt.Errorf("failed to count clone signals for registration %d: %w", client.Id, err)
+	}
+	if count < cd.threshold {
+		return
+	}
+
+	if err = client.SetCloneSuspected(true, now); err != nil {
+		return fmt.Errorf("failed to flag registration %d as a suspected clone: %w", client.Id, err)
+	}
+
+	slog.Warn(
+		"Registration flagged as a suspected clone",
+		slog.Int64("registrationId", client.Id),
+		slog.String("clientId", client.ClientId),
+		slog.Int64("signals", count),
+		slog.String("policy", cd.policy),
+	)
+
+	return
+}
+
+// staleToken records that the specified valid, but superseded, token was
+// presented for the client's registration, returning true if the client
+// should be forced to register again. Superseded tokens presented within the
+// stale token grace period after the client's current token was issued are
+// ignored, as they are expected from requests that the client had in flight,
+// or retried, when it authenticated again.
+func (cd *cloneDetector) staleToken(client *database.ClientsRow, token string) (forceReregister bool, err error) {
+	if reissuedAt, ok := tokenIssuedAt(client.AuthToken); ok && time.Since(reissuedAt) < cd.staleTokenGrace {
+		slog.Debug(
+			"Superseded token presented within the grace period ignored",
+			slog.Int64("registrationId", client.Id),
+			slog.Time("reissuedAt", reissuedAt),
+		)
+		return cd.forceReregister(client), nil
+	}
+
+	claims, err := cd.app.AuthManager.ParseToken(token)
+	if err != nil {
+		return cd.forceReregister(client), fmt.Errorf("failed to parse stale token of registration %d: %w", client.Id, err)
+	}
+
+	err = cd.recordSignal(client, 0, database.CLONE_SIGNAL_STALE_TOKEN, claims.ID, "superseded token presented")
+	return cd.forceReregister(client), err
+}
+
+// tokenIssuedAt returns the issue time of a token that was issued by this
+// service, such as a client's current token, without verifying it
+func tokenIssuedAt(token string) (issuedAt time.Time, ok bool) {
+	claims := new(jwt.RegisteredClaims)
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil || claims.IssuedAt == nil {
+		return
+	}
+
+	return claims.IssuedAt.Time, true
+}
+
+// duplicateClientId records that the client's registration uses the same
+// clientId as an existing registration, but with a different systemUUID
+func (cd *cloneDetector) duplicateClientId(client, dup *database.ClientsRow) (err error) {
+	details := fmt.Sprintf(
+		"clientId already registered with systemUUID %q, registered with systemUUID %q",
+		dup.SystemUUID,
+		client.SystemUUID,
+	)
+	return cd.recordSignal(client, dup.Id, database.CLONE_SIGNAL_DUPLICATE_CLIENT_ID, "", details)
+}
+
+// authenticated checks the client's authentication against its previous
+// one, as recorded in its client activity, recording an interleaved
+// authentication signal if the previous authentication was within the
+// interleave window and a superseded token has since been presented for the
+// registration, indicating that the authentications are alternating between
+// systems holding different tokens, rather than a single system
+// authenticating again. Must be called before the authentication is recorded
+// in the client's activity.
+func (cd *cloneDetector) authenticated(client *database.ClientsRow) (err error) {
+	activity := new(database.ClientActivityRow)
+	if err = activity.SetupDB(cd.app.OperationalDB); err != nil {
+		return fmt.Errorf("clientActivityRow.SetupDB() failed: %w", err)
+	}
+	if err = activity.SetTx(client.Tx()); err != nil {
+		return fmt.Errorf("clientActivityRow.SetTx() failed: %w", err)
+	}
+
+	activity.RegistrationId = client.Id
+	if !activity.Exists() || activity.LastAuthenticatedAt == nil {
+		return
+	}
+	lastAuthenticated := *activity.LastAuthenticatedAt
+
+	elapsed := database.DbNow().Sub(lastAuthenticated)
+	if elapsed >= cd.interleaveWindow {
+		return
+	}
+
+	alternating, err := cd.staleTokenSince(client, lastAuthenticated)
+	if err != nil || !alternating {
+		return
+	}
+
+	details := fmt.Sprintf("authenticated again after %s, following a superseded token being presented", elapsed.Round(time.Second))
+	return cd.recordSignal(client, 0, database.CLONE_SIGNAL_INTERLEAVED_AUTH, "", details)
+}
+
+// staleTokenSince checks if a superseded token has been presented for the
+// client's registration at, or after, the specified time, including further
+// presentations of previously signalled tokens
+func (cd *cloneDetector) staleTokenSince(client *database.ClientsRow, since time.Time) (bool, error) {
+	cs := new(database.CloneSignalRow)
+	if err := cs.SetupDB(cd.app.OperationalDB); err != nil {
+		return false, fmt.Errorf("cloneSignalRow.SetupDB() failed: %w", err)
+	}
+	if err := cs.SetTx(client.Tx()); err != nil {
+		return false, fmt.Errorf("cloneSignalRow.SetTx() failed: %w", err)
+	}
+
+	cs.RegistrationId = client.Id
+	count, err := cs.CountSignalSince(database.CLONE_SIGNAL_STALE_TOKEN, since)
+	if err != nil {
+		return false, fmt.Errorf("failed to count stale token signals for registration %d: %w", client.Id, err)
+	}
+
+	return count > 0, nil
+}
@@ -41,6 +41,17 @@ func (d *DBConfig) Valid() error {
 // default duration, in days of an auth token
 const DEF_AUTH_DURATION string = "1w"
 
+// default token signing algorithm
+const DEF_AUTH_ALGORITHM string = "HS512"
+
+// default interval at which the token revocations cached by each server
+// instance are refreshed from the DB
+const DEF_AUTH_REVOCATION_REFRESH string = "30s"
+
+// default percentage of a new token's duration that a client's existing
+// token must have remaining to be returned by authentication requests
+const DEF_AUTH_REUSE_THRESHOLD int = 50
+
 type AuthConfig struct {
 	// should not be printed
 	Secret string `yaml:"secret"`
@@ -48,10 +59,250 @@ type AuthConfig struct {
 	Duration string `yaml:"duration"`
 	// issuer name
 	Issuer string `yaml:"issuer"`
+	// percentage of a new token's duration that a client's existing token
+	// must have remaining to be returned, rather than a new token, when the
+	// client authenticates; 0 uses the default, negative disables reuse
+	ReuseThreshold int `yaml:"reuseThreshold"`
+	// interval at which cached token revocations are refreshed, bounding
+	// how long a token revoked via another server instance remains usable
+	RevocationRefresh string `yaml:"revocationRefresh"`
+	// optional audience; if specified it is included in issued tokens
+	// and required to be present in verified tokens
+	Audience string `yaml:"audience"`
+	// token signing algorithm, one of HS512, HS384, HS256, which use the
+	// secret, or RS256, ES256, EdDSA and similar, which use PEM key files
+	Algorithm string `yaml:"algorithm"`
+	// path to the PEM private key file used to sign tokens with an
+	// asymmetric algorithm; may be omitted by services that only need
+	// to verify tokens
+	PrivateKey string `yaml:"privateKey"`
+	// paths to PEM public key files that tokens may be verified with, in
+	// addition to the public key of the private key, if specified
+	PublicKeys []string `yaml:"publicKeys"`
+	// keyring of keys identified by kid, allowing keys to be rotated
+	// without invalidating tokens signed with retired keys
+	Keys []AuthKeyConfig `yaml:"keys"`
+	// kid of the keyring key used to sign new tokens, defaults to the
+	// first keyring entry
+	ActiveKid string `yaml:"activeKid"`
+}
+
+type AuthKeyConfig struct {
+	// key identifier, included in the header of tokens signed by the key
+	Kid string `yaml:"kid"`
+	// should not be printed; base64 encoded secret for HMAC algorithms
+	Secret string `yaml:"secret"`
+	// path to the PEM private key file for asymmetric algorithms
+	PrivateKey string `yaml:"privateKey"`
+	// path to the PEM public key file for asymmetric algorithms, for
+	// retired keys that are only used to verify existing tokens
+	PublicKey string `yaml:"publicKey"`
+}
+
+func (kc AuthKeyConfig) String() string {
+	return fmt.Sprintf(
+		"{Kid:%s Secret:%s PrivateKey:%s PublicKey:%s}",
+		kc.Kid,
+		"********",
+		kc.PrivateKey,
+		kc.PublicKey,
+	)
 }
 
 func (ac *AuthConfig) String() string {
-	return fmt.Sprintf("{Secret:%s Duration:%s Issuer:%s}", "********", ac.Duration, ac.Issuer)
+	return fmt.Sprintf(
+		"{Secret:%s Duration:%s ReuseThreshold:%d RevocationRefresh:%s Issuer:%s Audience:%s Algorithm:%s PrivateKey:%s PublicKeys:%v Keys:%v ActiveKid:%s}",
+		"********",
+		ac.Duration,
+		ac.ReuseThreshold,
+		ac.RevocationRefresh,
+		ac.Issuer,
+		ac.Audience,
+		ac.Algorithm,
+		ac.PrivateKey,
+		ac.PublicKeys,
+		ac.Keys,
+		ac.ActiveKid,
+	)
+}
+
+// default number of staged report processing workers
+const DEF_STAGING_WORKERS int = 4
+
+// default interval between checks for newly staged reports
+const DEF_STAGING_POLL_INTERVAL string = "5s"
+
+// default duration a staged report may remain allocated before it is
+// considered lost and made available for processing again
+const DEF_STAGING_LEASE string = "10m"
+
+// default interval between checks for lost staged reports
+const DEF_STAGING_REAP_INTERVAL string = "1m"
+
+// default number of processing attempts before a staged report is
+// moved to the failedReports dead-letter table
+const DEF_STAGING_MAX_ATTEMPTS int = 5
+
+type StagingConfig struct {
+	// stage received reports for processing by background workers
+	Enabled bool `yaml:"enabled"`
+	// number of background workers processing staged reports
+	Workers int `yaml:"workers"`
+	// interval at which idle workers check for newly staged reports
+	PollInterval string `yaml:"pollInterval"`
+	// duration a report may remain allocated before it is considered lost
+	Lease string `yaml:"lease"`
+	// interval at which lost reports are checked for
+	ReapInterval string `yaml:"reapInterval"`
+	// number of processing attempts before a report is dead-lettered
+	MaxAttempts int `yaml:"maxAttempts"`
+}
+
+// default duration for which a processed reports ledger entry remains
+// reserved for the request processing its report, after which the request
+// is considered lost and a resubmission of the report may take it over
+const DEF_PROCESSED_REPORTS_RESERVATION string = "5m"
+
+// default maximum age of processed reports ledger entries
+const DEF_PROCESSED_REPORTS_MAX_AGE string = "7d"
+
+// default interval between prunes of the processed reports ledger
+const DEF_PROCESSED_REPORTS_PRUNE_INTERVAL string = "1h"
+
+// default maximum number of processed reports ledger entries deleted per
+// transaction
+const DEF_PROCESSED_REPORTS_BATCH_SIZE int = 1000
+
+type ProcessedReportsConfig struct {
+	// duration a report may remain reserved for processing before the
+	// request processing it is considered lost, which should exceed the
+	// time taken to process the largest reports
+	Reservation string `yaml:"reservation"`
+	// maximum age of ledger entries, which should exceed the period for
+	// which clients may resubmit a report, and must exceed the reservation,
+	// as pending entries are also pruned once they exceed it
+	MaxAge string `yaml:"maxAge"`
+	// interval at which entries exceeding the maximum age are pruned
+	PruneInterval string `yaml:"pruneInterval"`
+	// maximum number of entries deleted per transaction
+	BatchSize int `yaml:"batchSize"`
+}
+
+// default maximum number of tagSet ids cached by the server
+const DEF_ID_CACHE_TAGSETS int = 1024
+
+// default maximum number of customer reference ids cached by the server
+const DEF_ID_CACHE_CUSTOMERS int = 1024
+
+// default interval at which cached ids are checked for changes made by
+// other processes
+const DEF_ID_CACHE_REFRESH string = "10s"
+
+type IdCacheConfig struct {
+	// maximum number of tagSet ids cached, a negative value disables caching
+	TagSets int `yaml:"tagSets"`
+	// maximum number of customer reference ids cached, a negative value
+	// disables caching
+	Customers int `yaml:"customers"`
+	// interval at which the cache generations are checked for changes,
+	// made by other processes, that invalidate the cached ids
+	Refresh string `yaml:"refresh"`
+}
+
+// default number of clone signals recorded for a registration before it is
+// flagged as a suspected clone
+const DEF_CLONE_DETECTION_THRESHOLD int = 2
+
+// default action taken for suspected clones
+const DEF_CLONE_DETECTION_POLICY string = "flag"
+
+// default interval within which repeated authentications of a registration,
+// following a superseded token being presented, are considered to be
+// interleaved
+const DEF_CLONE_DETECTION_INTERLEAVE_WINDOW string = "1h"
+
+// default period, after a registration's token was reissued, within which
+// its superseded token may still be presented, e.g. by requests that were
+// in flight or retried when the token was reissued, without being recorded
+// as a clone signal
+const DEF_CLONE_DETECTION_STALE_TOKEN_GRACE string = "1m"
+
+type CloneDetectionConfig struct {
+	// number of clone signals recorded for a registration before it is
+	// flagged as a suspected clone for review by an administrator
+	Threshold int `yaml:"threshold"`
+	// action taken for suspected clones, either flag, which only flags
+	// them for review, or reregister, which additionally forces suspected
+	// clones presenting stale tokens to register again
+	Policy string `yaml:"policy"`
+	// interval within which repeated authentications of a registration,
+	// following a superseded token being presented, are considered to be
+	// interleaved
+	InterleaveWindow string `yaml:"interleaveWindow"`
+	// period, after a registration's token was reissued, within which its
+	// superseded tokens are ignored rather than recorded as clone signals
+	StaleTokenGrace string `yaml:"staleTokenGrace"`
+}
+
+// default handling of an erased customer's telemetry data
+const DEF_ERASURE_POLICY string = "purge"
+
+type ErasureConfig struct {
+	// default handling of an erased customer's telemetry data, either
+	// purge, which deletes it, or detach, which reassigns it to the
+	// anonymous customer
+	Policy string `yaml:"policy"`
+	// whether erased customerIds are replaced with a random pseudonym by
+	// default, rather than being retained in the deleted customers entry
+	Pseudonymise bool `yaml:"pseudonymise"`
+	// should not be printed; base64 encoded secret keying the HMAC of the
+	// erased customerIds recorded in erasure receipts, which is required
+	// for customers to be erased
+	Secret string `yaml:"secret"`
+}
+
+func (ec *ErasureConfig) String() string {
+	return fmt.Sprintf(
+		"{Policy:%s Pseudonymise:%t Secret:%s}",
+		ec.Policy,
+		ec.Pseudonymise,
+		"********",
+	)
+}
+
+// default interval between scheduled telemetry data retention purges
+const DEF_RETENTION_INTERVAL string = "1h"
+
+// default maximum number of telemetry data rows deleted per transaction
+const DEF_RETENTION_BATCH_SIZE int = 1000
+
+// default minimum period for which tagSets and customers entries must have
+// remained unreferenced before being garbage collected
+const DEF_RETENTION_ORPHAN_GRACE_PERIOD string = "1h"
+
+type RetentionRuleConfig struct {
+	// telemetryType of the telemetry data the rule applies to
+	TelemetryType string `yaml:"telemetryType"`
+	// optional tag limiting the rule to telemetry data with that tag
+	Tag string `yaml:"tag"`
+	// maximum age of the telemetry data, based upon its timestamp, e.g. 90d
+	MaxAge string `yaml:"maxAge"`
+}
+
+type RetentionConfig struct {
+	// whether the scheduled purge of expired telemetry data is enabled;
+	// it should only be enabled for one server instance
+	Enabled bool `yaml:"enabled"`
+	// interval between scheduled purges
+	Interval string `yaml:"interval"`
+	// maximum number of rows deleted per transaction
+	BatchSize int `yaml:"batchSize"`
+	// retention rules; telemetry data not matching any rule is retained
+	Rules []RetentionRuleConfig `yaml:"rules"`
+	// minimum period for which tagSets and customers entries must have
+	// remained unreferenced before being garbage collected, which must
+	// exceed the idCache.refresh interval
+	OrphanGracePeriod string `yaml:"orphanGracePeriod"`
 }
 
 type Config struct {
@@ -66,6 +317,18 @@ type Config struct {
 	Logging config.LogConfig `yaml:"logging"`
 	// authentication config settings
 	Auth AuthConfig `yaml:"auth"`
+	// report staging config settings
+	Staging StagingConfig `yaml:"staging"`
+	// processed reports ledger config settings
+	ProcessedReports ProcessedReportsConfig `yaml:"processedReports"`
+	// tagSet and customer id cache config settings
+	IdCache IdCacheConfig `yaml:"idCache"`
+	// cloned client detection config settings
+	CloneDetection CloneDetectionConfig `yaml:"cloneDetection"`
+	// customer data erasure config settings
+	Erasure ErasureConfig `yaml:"erasure"`
+	// telemetry data retention config settings
+	Retention RetentionConfig `yaml:"retention"`
 }
 
 func NewConfig(cfgFile string) *Config {
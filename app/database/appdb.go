@@ -3,26 +3,37 @@ package database
 import (
 	"fmt"
 	"log/slog"
+	"sync"
 
 	"github.com/SUSE/telemetry-server/app/config"
 )
 
 type AppDb struct {
-	name     string
-	dbConn   *DbConnection
-	dbTables DbTables
+	name         string
+	dbConn       *DbConnection
+	dbTables     DbTables
+	dbMigrations Migrations
+
+	// private
+	hooksMutex     sync.RWMutex
+	rowChangeHooks []RowChangeHook
 }
 
-func NewAppDb(name string, tables DbTables) (adb *AppDb) {
+// RowChangeHook is called when a table row that others may have cached
+// information about has been updated or deleted
+type RowChangeHook func(table string, id int64)
+
+func NewAppDb(name string, tables DbTables, migrations Migrations) (adb *AppDb) {
 	adb = new(AppDb)
-	adb.Init(name, tables)
+	adb.Init(name, tables, migrations)
 	return
 }
 
-func (adb *AppDb) Init(name string, tables DbTables) {
+func (adb *AppDb) Init(name string, tables DbTables, migrations Migrations) {
 	adb.name = name
 	adb.dbConn = new(DbConnection)
 	adb.dbTables = tables
+	adb.dbMigrations = migrations
 }
 
 func (adb *AppDb) Name() string {
@@ -59,10 +70,19 @@ func (adb *AppDb) Connect() (err error) {
 	return
 }
 
+// tables returns the AppDb's tables, including the schemaVersions table
+// that every AppDb needs to track the applied migrations
+func (adb *AppDb) tables() DbTables {
+	return append(DbTables{GetSchemaVersionsTableSpec()}, adb.dbTables...)
+}
+
+// EnsureTablesExist creates any missing tables, applies any outstanding
+// schema migrations and then creates any missing indexes, which may
+// depend upon columns added by the migrations
 func (adb *AppDb) EnsureTablesExist() (err error) {
 	slog.Debug("Updating schemas", slog.String("database", adb.name))
 
-	for _, ts := range adb.dbTables {
+	for _, ts := range adb.tables() {
 		err = adb.dbConn.CreateTableFromSpec(ts)
 		if err != nil {
 			slog.Error(
@@ -73,11 +93,63 @@ func (adb *AppDb) EnsureTablesExist() (err error) {
 			return
 		}
 	}
+
+	if err = adb.Migrate(); err != nil {
+		return
+	}
+
+	for _, ts := range adb.tables() {
+		err = adb.dbConn.CreateIndexesFromSpec(ts)
+		if err != nil {
+			slog.Error(
+				"failed to create indexes from spec",
+				slog.String("db", adb.name),
+				slog.String("error", err.Error()),
+			)
+			return
+		}
+	}
 	slog.Info("Updated schemas", slog.String("database", adb.name))
 
 	return
 }
 
+// Migrate applies any outstanding schema migrations, failing if the DB's
+// schema is newer than this binary supports
+func (adb *AppDb) Migrate() (err error) {
+	if err = adb.dbConn.ApplyMigrations(adb.dbMigrations); err != nil {
+		return
+	}
+
+	// migrations may have altered tables that cached statements refer to
+	adb.dbConn.StmtCache().Reset()
+
+	return
+}
+
+// SchemaVersion returns the DB's current schema version
+func (adb *AppDb) SchemaVersion() (int64, error) {
+	return adb.dbConn.SchemaVersion(adb.dbConn.DB())
+}
+
+// AddRowChangeHook registers a hook to be called when table rows that
+// support change notification are updated or deleted
+func (adb *AppDb) AddRowChangeHook(hook RowChangeHook) {
+	adb.hooksMutex.Lock()
+	defer adb.hooksMutex.Unlock()
+
+	adb.rowChangeHooks = append(adb.rowChangeHooks, hook)
+}
+
+func (adb *AppDb) notifyRowChanged(table string, id int64) {
+	adb.hooksMutex.RLock()
+	defer adb.hooksMutex.RUnlock()
+
+	for _, hook := range adb.rowChangeHooks {
+		hook(table, id)
+	}
+}
+
 func (adb *AppDb) Conn() *DbConnection {
 	if adb.dbConn != nil {
 		return adb.dbConn
@@ -93,12 +165,13 @@ func (adb *AppDb) Ping() error {
 	return adb.Conn().Ping()
 }
 
-func GetDb(name string, cfg *config.DBConfig, tables DbTables) (*AppDb, error) {
+func GetDb(name string, cfg *config.DBConfig, tables DbTables, migrations Migrations) (*AppDb, error) {
 	// create a new AppDb for the names application database using the
-	// specified config and tables
+	// specified config, tables and schema migrations
 	adb := NewAppDb(
 		name,
 		tables,
+		migrations,
 	)
 	if err := adb.Setup(cfg); err != nil {
 		slog.Error(
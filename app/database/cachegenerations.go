@@ -0,0 +1,313 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// cacheGenerations table specification
+// The cacheGenerations table records a generation counter for each table
+// whose rows may be cached by server processes, which is incremented, as
+// part of the same transaction, whenever such rows are changed or deleted.
+// Processes poll the generations, discarding their cached entries for a
+// table when its generation changes, so that changes made by other
+// processes, e.g. customer erasures via the telemetry-admin, are observed.
+var cacheGenerationsTableSpec = TableSpec{
+	Name: "cacheGenerations",
+	Columns: []TableSpecColumn{
+		{Name: "id", Type: "INTEGER", PrimaryKey: true, Identity: true},
+		{Name: "cachedTable", Type: "VARCHAR"},
+		{Name: "generation", Type: "INTEGER", Default: "0"},
+	},
+	Indexes: []TableSpecIndex{
+		{Columns: []string{"cachedTable"}, Unique: true},
+	},
+}
+
+func GetCacheGenerationsTableSpec() *TableSpec {
+	return &cacheGenerationsTableSpec
+}
+
+type CacheGenerationRow struct {
+	TableRowCommon
+
+	Id          int64  `json:"id"`
+	CachedTable string `json:"cachedTable"`
+	Generation  int64  `json:"generation"`
+}
+
+func (g *CacheGenerationRow) Init(cachedTable string) {
+	g.CachedTable = cachedTable
+}
+
+func (g *CacheGenerationRow) String() string {
+	bytes, _ := json.Marshal(g)
+	return string(bytes)
+}
+
+func (g *CacheGenerationRow) SetupDB(adb *AppDb) error {
+	g.SetTableSpec(GetCacheGenerationsTableSpec())
+	return g.TableRowCommon.SetupDB(adb)
+}
+
+func (g *CacheGenerationRow) RowId() int64 {
+	return g.Id
+}
+
+func (g *CacheGenerationRow) Exists() bool {
+	stmt, err := g.SelectStmt(
+		[]string{
+			"id",
+			"generation",
+		},
+		[]string{
+			"cachedTable",
+		},
+		SelectOpts{}, // no special options
+	)
+	if err != nil {
+		slog.Error(
+			"exists statement generation failed",
+			slog.String("table", g.TableName()),
+			slog.String("error", err.Error()),
+		)
+		panic(err)
+	}
+
+	row := g.Executor().QueryRow(stmt, g.CachedTable)
+	if err := row.Scan(&g.Id, &g.Generation); err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error(
+				"cache generation existence check failed",
+				slog.String("cachedTable", g.CachedTable),
+				slog.String("error", err.Error()),
+			)
+		}
+		return false
+	}
+	return true
+}
+
+func (g *CacheGenerationRow) Insert() (err error) {
+	stmt, err := g.InsertStmt(
+		[]string{
+			"cachedTable",
+			"generation",
+		},
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"insert statement generation failed",
+			slog.String("table", g.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := g.Executor().QueryRow(
+		stmt,
+		g.CachedTable,
+		g.Generation,
+	)
+	if err = row.Scan(&g.Id); err != nil {
+		slog.Error(
+			"insert failed",
+			slog.String("table", g.TableName()),
+			slog.String("cachedTable", g.CachedTable),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (g *CacheGenerationRow) Update() (err error) {
+	stmt, err := g.UpdateStmt(
+		[]string{
+			"cachedTable",
+			"generation",
+		},
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", g.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = g.Executor().Exec(
+		stmt,
+		g.CachedTable,
+		g.Generation,
+		g.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"update failed",
+			slog.String("table", g.TableName()),
+			slog.Int64("id", g.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (g *CacheGenerationRow) Delete() (err error) {
+	stmt, err := g.DeleteStmt(
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", g.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = g.Executor().Exec(
+		stmt,
+		g.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"delete failed",
+			slog.String("table", g.TableName()),
+			slog.Int64("id", g.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// Increment atomically increments the generation of the cached table,
+// adding its entry if it doesn't already exist
+func (g *CacheGenerationRow) Increment() (err error) {
+	incrementStmt, err := g.IncrementStmt(
+		[]string{
+			"generation",
+		},
+		nil,
+		[]string{
+			"cachedTable",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"increment statement generation failed",
+			slog.String("table", g.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	upsertStmt, err := g.UpsertStmt(
+		[]string{
+			"cachedTable",
+			"generation",
+		},
+		[]string{
+			"cachedTable",
+		},
+		"",
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"upsert statement generation failed",
+			slog.String("table", g.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	// the entry is added on first use, retrying the increment if it was
+	// added concurrently by another caller
+	for attempt := 0; attempt < 2; attempt++ {
+		result, err := g.Executor().Exec(incrementStmt, g.CachedTable)
+		if err != nil {
+			slog.Error(
+				"cache generation increment failed",
+				slog.String("cachedTable", g.CachedTable),
+				slog.String("error", err.Error()),
+			)
+			return err
+		}
+
+		if incremented, err := result.RowsAffected(); err != nil || incremented > 0 {
+			return err
+		}
+
+		row := g.Executor().QueryRow(upsertStmt, g.CachedTable, 1)
+		switch err = row.Scan(&g.Id); err {
+		case nil:
+			return nil
+		case sql.ErrNoRows:
+			continue
+		default:
+			slog.Error(
+				"cache generation insert failed",
+				slog.String("cachedTable", g.CachedTable),
+				slog.String("error", err.Error()),
+			)
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed to increment cache generation of %q", g.CachedTable)
+}
+
+// List returns the current generation of each cached table that has one
+func (g *CacheGenerationRow) List() (generations map[string]int64, err error) {
+	stmt, err := g.SelectStmt(
+		[]string{
+			"cachedTable",
+			"generation",
+		},
+		nil,
+		SelectOpts{}, // no special options
+	)
+	if err != nil {
+		slog.Error(
+			"list statement generation failed",
+			slog.String("table", g.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := g.Executor().Query(stmt)
+	if err != nil {
+		slog.Error("cache generations query failed", slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	generations = map[string]int64{}
+	for rows.Next() {
+		var cachedTable string
+		var generation int64
+		if err = rows.Scan(&cachedTable, &generation); err != nil {
+			slog.Error("cache generation scan failed", slog.String("error", err.Error()))
+			return nil, err
+		}
+		generations[cachedTable] = generation
+	}
+
+	return generations, rows.Err()
+}
+
+// verify that CacheGenerationRow conforms to the TableRowHandler interface
+var _ TableRowHandler = (*CacheGenerationRow)(nil)
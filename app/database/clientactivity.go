@@ -0,0 +1,585 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// clientActivity table specification
+// The clientActivity table tracks when each client registration was last
+// seen, how often it has reported and authenticated, and which client
+// software it was using, so that inactive registrations can be identified.
+// The lastActiveAt column holds the most recent of the activity times, so
+// that entries can be filtered by activity in the DB.
+var clientActivityTableSpec = TableSpec{
+	Name: "clientActivity",
+	Columns: []TableSpecColumn{
+		{Name: "id", Type: "INTEGER", PrimaryKey: true, Identity: true},
+		{Name: "registrationId", Type: "INTEGER"},
+		{Name: "firstSeenAt", Type: "TIMESTAMPTZ"},
+		{Name: "lastReportAt", Type: "TIMESTAMPTZ", Nullable: true},
+		{Name: "lastAuthenticatedAt", Type: "TIMESTAMPTZ", Nullable: true},
+		{Name: "reportCount", Type: "INTEGER", Default: "0"},
+		{Name: "authenticationCount", Type: "INTEGER", Default: "0"},
+		{Name: "userAgent", Type: "VARCHAR", Nullable: true},
+		{Name: "clientVersion", Type: "VARCHAR", Nullable: true},
+		{Name: "lastActiveAt", Type: "TIMESTAMPTZ", Nullable: true},
+	},
+	ForeignKeys: []TableSpecForeignKey{
+		{Column: "registrationId", ReferencedTable: "clients", ReferencedColumn: "id"},
+	},
+	Indexes: []TableSpecIndex{
+		{Columns: []string{"registrationId"}, Unique: true},
+	},
+}
+
+func GetClientActivityTableSpec() *TableSpec {
+	return &clientActivityTableSpec
+}
+
+type ClientActivityRow struct {
+	TableRowCommon
+
+	Id                  int64      `json:"id"`
+	RegistrationId      int64      `json:"registrationId"`
+	FirstSeenAt         time.Time  `json:"firstSeenAt"`
+	LastReportAt        *time.Time `json:"lastReportAt,omitempty"`
+	LastAuthenticatedAt *time.Time `json:"lastAuthenticatedAt,omitempty"`
+	ReportCount         int64      `json:"reportCount"`
+	AuthenticationCount int64      `json:"authenticationCount"`
+	UserAgent           string     `json:"userAgent,omitempty"`
+	ClientVersion       string     `json:"clientVersion,omitempty"`
+	LastActiveAt        time.Time  `json:"lastActiveAt"`
+}
+
+func (a *ClientActivityRow) InitRegistrationId(registrationId int64, firstSeenAt time.Time) {
+	a.RegistrationId = registrationId
+	a.FirstSeenAt = firstSeenAt
+	a.LastActiveAt = firstSeenAt
+}
+
+func (a *ClientActivityRow) SetupDB(adb *AppDb) error {
+	a.SetTableSpec(GetClientActivityTableSpec())
+	return a.TableRowCommon.SetupDB(adb)
+}
+
+func (a *ClientActivityRow) TableName() string {
+	return a.TableRowCommon.TableName()
+}
+
+func (a *ClientActivityRow) RowId() int64 {
+	return a.Id
+}
+
+func (a *ClientActivityRow) String() string {
+	bytes, _ := json.Marshal(a)
+	return string(bytes)
+}
+
+// activityColumns are the columns retrieved when loading or listing entries
+var activityColumns = []string{
+	"id",
+	"registrationId",
+	"firstSeenAt",
+	"lastReportAt",
+	"lastAuthenticatedAt",
+	"reportCount",
+	"authenticationCount",
+	"userAgent",
+	"clientVersion",
+	"lastActiveAt",
+}
+
+// scan populates the entry from a row retrieved using the activityColumns,
+// followed by any extra columns
+func (a *ClientActivityRow) scan(row interface{ Scan(...any) error }, extra ...any) (err error) {
+	var userAgent, clientVersion sql.NullString
+	var lastActiveAt sql.NullTime
+	dest := []any{
+		&a.Id,
+		&a.RegistrationId,
+		&a.FirstSeenAt,
+		&a.LastReportAt,
+		&a.LastAuthenticatedAt,
+		&a.ReportCount,
+		&a.AuthenticationCount,
+		&userAgent,
+		&clientVersion,
+		&lastActiveAt,
+	}
+	if err = row.Scan(append(dest, extra...)...); err != nil {
+		return
+	}
+	a.UserAgent = userAgent.String
+	a.ClientVersion = clientVersion.String
+
+	// entries are always last active when first seen
+	a.LastActiveAt = a.FirstSeenAt
+	if lastActiveAt.Valid {
+		a.LastActiveAt = lastActiveAt.Time
+	}
+
+	return
+}
+
+// Exists checks for, and loads, the activity entry of the registration
+func (a *ClientActivityRow) Exists() bool {
+	stmt, err := a.SelectStmt(
+		// select columns
+		activityColumns,
+		// match columns
+		[]string{
+			"registrationId",
+		},
+		SelectOpts{}, // no special options
+	)
+	if err != nil {
+		slog.Error(
+			"exists statement generation failed",
+			slog.String("table", a.TableName()),
+			slog.String("error", err.Error()),
+		)
+		panic(err)
+	}
+
+	row := a.Executor().QueryRow(stmt, a.RegistrationId)
+	if err := a.scan(row); err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error(
+				"check for matching entry failed",
+				slog.String("table", a.TableName()),
+				slog.Int64("registrationId", a.RegistrationId),
+				slog.String("error", err.Error()),
+			)
+		}
+		return false
+	}
+
+	return true
+}
+
+func (a *ClientActivityRow) Insert() (err error) {
+	stmt, err := a.InsertStmt(
+		[]string{
+			"registrationId",
+			"firstSeenAt",
+			"lastReportAt",
+			"lastAuthenticatedAt",
+			"reportCount",
+			"authenticationCount",
+			"userAgent",
+			"clientVersion",
+			"lastActiveAt",
+		},
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"insert statement generation failed",
+			slog.String("table", a.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := a.Executor().QueryRow(
+		stmt,
+		a.RegistrationId,
+		DbTime(a.FirstSeenAt),
+		nullableTime(a.LastReportAt),
+		nullableTime(a.LastAuthenticatedAt),
+		a.ReportCount,
+		a.AuthenticationCount,
+		nullable(a.UserAgent),
+		nullable(a.ClientVersion),
+		DbTime(a.LastActiveAt),
+	)
+	if err = row.Scan(
+		&a.Id,
+	); err != nil {
+		slog.Error(
+			"insert failed",
+			slog.String("table", a.TableName()),
+			slog.Int64("registrationId", a.RegistrationId),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// Upsert inserts the entry if no entry already exists for the registration,
+// otherwise leaving the existing entry unchanged; use Exists() to load the
+// resulting entry.
+func (a *ClientActivityRow) Upsert() (err error) {
+	stmt, err := a.UpsertStmt(
+		[]string{
+			"registrationId",
+			"firstSeenAt",
+			"lastActiveAt",
+		},
+		[]string{
+			"registrationId",
+		},
+		"",
+		"",
+	)
+	if err != nil {
+		slog.Error(
+			"upsert statement generation failed",
+			slog.String("table", a.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = a.Executor().Exec(
+		stmt,
+		a.RegistrationId,
+		DbTime(a.FirstSeenAt),
+		DbTime(a.FirstSeenAt),
+	)
+	if err != nil {
+		slog.Error(
+			"upsert failed",
+			slog.String("table", a.TableName()),
+			slog.Int64("registrationId", a.RegistrationId),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (a *ClientActivityRow) Update() (err error) {
+	stmt, err := a.UpdateStmt(
+		[]string{
+			"registrationId",
+			"firstSeenAt",
+			"lastReportAt",
+			"lastAuthenticatedAt",
+			"reportCount",
+			"authenticationCount",
+			"userAgent",
+			"clientVersion",
+			"lastActiveAt",
+		},
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", a.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = a.Executor().Exec(
+		stmt,
+		a.RegistrationId,
+		DbTime(a.FirstSeenAt),
+		nullableTime(a.LastReportAt),
+		nullableTime(a.LastAuthenticatedAt),
+		a.ReportCount,
+		a.AuthenticationCount,
+		nullable(a.UserAgent),
+		nullable(a.ClientVersion),
+		DbTime(a.LastActiveAt),
+		a.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"update failed",
+			slog.String("table", a.TableName()),
+			slog.Int64("id", a.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (a *ClientActivityRow) Delete() (err error) {
+	stmt, err := a.DeleteStmt(
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", a.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = a.Executor().Exec(
+		stmt,
+		a.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"delete failed",
+			slog.String("table", a.TableName()),
+			slog.Int64("id", a.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// DeleteForRegistration deletes the activity entry of the registration,
+// returning the number deleted
+func (a *ClientActivityRow) DeleteForRegistration() (deleted int64, err error) {
+	stmt, err := a.DeleteStmt(
+		[]string{
+			"registrationId",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", a.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := a.Executor().Exec(stmt, a.RegistrationId)
+	if err != nil {
+		slog.Error(
+			"client activity delete failed",
+			slog.Int64("registrationId", a.RegistrationId),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	return result.RowsAffected()
+}
+
+// RecordReport atomically records a report submitted by the registration at
+// the specified time, see record()
+func (a *ClientActivityRow) RecordReport(at time.Time) error {
+	return a.record("reportCount", "lastReportAt", at)
+}
+
+// RecordAuthentication atomically records an authentication of the
+// registration at the specified time, see record()
+func (a *ClientActivityRow) RecordAuthentication(at time.Time) error {
+	return a.record("authenticationCount", "lastAuthenticatedAt", at)
+}
+
+// record increments the count column, and sets the at and lastActiveAt
+// columns to the specified time, of the registration's entry, along with
+// the userAgent and clientVersion if set, using a single statement so that
+// concurrently recorded activities are all counted. An entry, first seen at
+// the specified time, is added if the registration doesn't already have one.
+func (a *ClientActivityRow) record(countCol, atCol string, at time.Time) (err error) {
+	updateCols := []string{atCol, "lastActiveAt"}
+	updateArgs := []any{DbTime(at), DbTime(at)}
+
+	// only replace the recorded client software details if provided
+	if a.UserAgent != "" {
+		updateCols = append(updateCols, "userAgent")
+		updateArgs = append(updateArgs, a.UserAgent)
+	}
+	if a.ClientVersion != "" {
+		updateCols = append(updateCols, "clientVersion")
+		updateArgs = append(updateArgs, a.ClientVersion)
+	}
+
+	stmt, err := a.IncrementStmt(
+		[]string{
+			countCol,
+		},
+		updateCols,
+		[]string{
+			"registrationId",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"increment statement generation failed",
+			slog.String("table", a.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	// the entry is added on first use, retrying the increment once added
+	for attempt := 0; attempt < 2; attempt++ {
+		result, err := a.Executor().Exec(stmt, append(updateArgs, a.RegistrationId)...)
+		if err != nil {
+			slog.Error(
+				"client activity increment failed",
+				slog.Int64("registrationId", a.RegistrationId),
+				slog.String("column", countCol),
+				slog.String("error", err.Error()),
+			)
+			return err
+		}
+
+		if recorded, err := result.RowsAffected(); err != nil || recorded > 0 {
+			return err
+		}
+
+		a.FirstSeenAt = at
+		if err = a.Upsert(); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("failed to record activity of registration %d", a.RegistrationId)
+}
+
+// ClientActivityQuery specifies the client activity entries to be retrieved
+// by List and counted by Count; empty values match all entries
+type ClientActivityQuery struct {
+	RegistrationId int64
+	ClientVersion  string
+	// only entries last active before this time will be retrieved, unless
+	// zero
+	InactiveSince time.Time
+	// only entries last active at, or after, this time will be retrieved,
+	// unless zero
+	ActiveSince time.Time
+	// maximum number of entries to retrieve, 0 for no limit
+	Limit uint
+	// number of matching entries to skip, if a limit is specified
+	Offset uint
+}
+
+// where returns the match columns and conditions selecting the query's
+// entries, along with their args
+func (q *ClientActivityQuery) where() (whereCols []string, conds []WhereCond, args []any) {
+	if q.RegistrationId != 0 {
+		whereCols = append(whereCols, "registrationId")
+		args = append(args, q.RegistrationId)
+	}
+	if q.ClientVersion != "" {
+		whereCols = append(whereCols, "clientVersion")
+		args = append(args, q.ClientVersion)
+	}
+
+	if !q.InactiveSince.IsZero() {
+		conds = append(conds, WhereCond{Column: "lastActiveAt", Op: WHERE_OP_LT})
+		args = append(args, DbTime(q.InactiveSince))
+	}
+	if !q.ActiveSince.IsZero() {
+		conds = append(conds, WhereCond{Column: "lastActiveAt", Op: WHERE_OP_GE})
+		args = append(args, DbTime(q.ActiveSince))
+	}
+
+	return
+}
+
+// ClientActivityEntry is a client activity entry, along with the clientId
+// of the associated registration
+type ClientActivityEntry struct {
+	*ClientActivityRow
+
+	ClientId string `json:"clientId"`
+}
+
+// List returns the client activity entries matching the query, ordered by
+// registration id
+func (a *ClientActivityRow) List(q *ClientActivityQuery) (entries []*ClientActivityEntry, err error) {
+	whereCols, conds, whereArgs := q.where()
+
+	opts := SelectOpts{
+		Joins: []string{
+			"registrationId",
+		},
+		Where:   conds,
+		OrderBy: "registrationId",
+		Limit:   q.Limit,
+		Offset:  q.Offset,
+	}
+	stmt, err := a.SelectStmt(
+		append(slices.Clone(activityColumns), "clients.clientId"),
+		whereCols,
+		opts,
+	)
+	if err != nil {
+		slog.Error(
+			"list statement generation failed",
+			slog.String("table", a.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := a.Executor().Query(stmt, opts.Args(whereArgs...)...)
+	if err != nil {
+		slog.Error("client activity query failed", slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := &ClientActivityEntry{ClientActivityRow: new(ClientActivityRow)}
+		if err = entry.SetupDB(a.db); err != nil {
+			return nil, err
+		}
+
+		var clientId sql.NullString
+		if err = entry.scan(rows, &clientId); err != nil {
+			slog.Error("client activity retrieval failed", slog.String("error", err.Error()))
+			return nil, err
+		}
+		entry.ClientId = clientId.String
+
+		entries = append(entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		slog.Error("client activity iteration failed", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	return
+}
+
+// Count returns the number of client activity entries matching the query,
+// ignoring its limit and offset
+func (a *ClientActivityRow) Count(q *ClientActivityQuery) (count uint, err error) {
+	whereCols, conds, whereArgs := q.where()
+
+	stmt, err := a.SelectStmt(
+		[]string{
+			"id",
+		},
+		whereCols,
+		SelectOpts{
+			Count: true,
+			Where: conds,
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"count statement generation failed",
+			slog.String("table", a.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	if err = a.Executor().QueryRow(stmt, whereArgs...).Scan(&count); err != nil {
+		slog.Error("client activity count failed", slog.String("error", err.Error()))
+	}
+
+	return
+}
+
+// verify that ClientActivityRow conforms to the TableRowHandler interface
+var _ TableRowHandler = (*ClientActivityRow)(nil)
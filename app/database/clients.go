@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"log/slog"
+	"time"
 
 	"github.com/SUSE/telemetry/pkg/restapi"
 	"github.com/SUSE/telemetry/pkg/types"
@@ -16,8 +17,13 @@ var clientsTableSpec = TableSpec{
 		{Name: "clientId", Type: "VARCHAR"},
 		{Name: "systemUUID", Type: "VARCHAR", Nullable: true},
 		{Name: "clientTimestamp", Type: "VARCHAR"},
-		{Name: "registrationDate", Type: "VARCHAR"},
+		{Name: "registrationDate", Type: "TIMESTAMPTZ"},
 		{Name: "authToken", Type: "VARCHAR"},
+		{Name: "cloneSuspected", Type: "BOOLEAN", Default: "false"},
+		{Name: "cloneSuspectedAt", Type: "TIMESTAMPTZ", Nullable: true},
+	},
+	Indexes: []TableSpecIndex{
+		{Columns: []string{"clientId"}},
 	},
 }
 
@@ -29,12 +35,16 @@ type ClientsRow struct {
 	// include common table row fields
 	TableRowCommon
 
-	Id               int64  `json:"id"`
-	ClientId         string `json:"clientId"`
-	SystemUUID       string `json:"systemUUID"`
-	ClientTimestamp  string `json:"clientTimestamp"`
-	RegistrationDate string `json:"registrationDate"`
-	AuthToken        string `json:"authToken"`
+	Id               int64     `json:"id"`
+	ClientId         string    `json:"clientId"`
+	SystemUUID       string    `json:"systemUUID"`
+	ClientTimestamp  string    `json:"clientTimestamp"`
+	RegistrationDate time.Time `json:"registrationDate"`
+	AuthToken        string    `json:"authToken,omitempty"`
+
+	// clone detection state, maintained separately from the registration
+	CloneSuspected   bool       `json:"cloneSuspected"`
+	CloneSuspectedAt *time.Time `json:"cloneSuspectedAt,omitempty"`
 }
 
 func (c *ClientsRow) InitAuthentication(caReq *restapi.ClientAuthenticationRequest) {
@@ -94,6 +104,8 @@ func (c *ClientsRow) Exists() bool {
 			"clientTimestamp",
 			"registrationDate",
 			"authToken",
+			"cloneSuspected",
+			"cloneSuspectedAt",
 		},
 		// match columns
 		[]string{
@@ -110,7 +122,7 @@ func (c *ClientsRow) Exists() bool {
 		panic(err)
 	}
 
-	row := c.DB().QueryRow(stmt, c.Id)
+	row := c.Executor().QueryRow(stmt, c.Id)
 	// if the entry was found, all fields not used to find the entry will have
 	// been updated to match what is in the DB
 	if err := row.Scan(
@@ -119,6 +131,8 @@ func (c *ClientsRow) Exists() bool {
 		&c.ClientTimestamp,
 		&c.RegistrationDate,
 		&c.AuthToken,
+		&c.CloneSuspected,
+		&c.CloneSuspectedAt,
 	); err != nil {
 		if err != sql.ErrNoRows {
 			slog.Error(
@@ -158,7 +172,7 @@ func (c *ClientsRow) RegistrationExists() bool {
 		panic(err)
 	}
 
-	row := c.DB().QueryRow(
+	row := c.Executor().QueryRow(
 		stmt,
 		c.ClientId,
 		c.SystemUUID,
@@ -211,7 +225,7 @@ func (c *ClientsRow) ClientIdExists() bool {
 		panic(err)
 	}
 
-	row := c.DB().QueryRow(
+	row := c.Executor().QueryRow(
 		stmt,
 		c.ClientId,
 	)
@@ -258,12 +272,12 @@ func (c *ClientsRow) Insert() (err error) {
 		)
 		return
 	}
-	row := c.DB().QueryRow(
+	row := c.Executor().QueryRow(
 		stmt,
 		c.ClientId,
 		c.SystemUUID,
 		c.ClientTimestamp,
-		c.RegistrationDate,
+		DbTime(c.RegistrationDate),
 		c.AuthToken,
 	)
 	if err = row.Scan(
@@ -303,12 +317,12 @@ func (c *ClientsRow) Update() (err error) {
 		)
 		return
 	}
-	_, err = c.DB().Exec(
+	_, err = c.Executor().Exec(
 		stmt,
 		c.ClientId,
 		c.SystemUUID,
 		c.ClientTimestamp,
-		c.RegistrationDate,
+		DbTime(c.RegistrationDate),
 		c.AuthToken,
 		c.Id,
 	)
@@ -338,7 +352,7 @@ func (c *ClientsRow) Delete() (err error) {
 		return
 	}
 
-	_, err = c.DB().Exec(
+	_, err = c.Executor().Exec(
 		stmt,
 		c.Id,
 	)
@@ -353,5 +367,263 @@ func (c *ClientsRow) Delete() (err error) {
 	return
 }
 
+// updateColumns updates only the specified columns of the client's entry,
+// leaving the remaining columns unchanged
+func (c *ClientsRow) updateColumns(columns []string, values ...any) (err error) {
+	stmt, err := c.UpdateStmt(
+		columns,
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", c.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = c.Executor().Exec(stmt, append(values, c.Id)...)
+	if err != nil {
+		slog.Error(
+			"update failed",
+			slog.String("table", c.TableName()),
+			slog.Int64("id", c.Id),
+			slog.Any("columns", columns),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// SetCloneSuspected flags, or clears the flag on, the client as a suspected
+// clone, recording when it was flagged
+func (c *ClientsRow) SetCloneSuspected(suspected bool, suspectedAt time.Time) (err error) {
+	var at *time.Time
+	if suspected {
+		at = &suspectedAt
+	}
+	if err = c.updateColumns([]string{"cloneSuspected", "cloneSuspectedAt"}, suspected, nullableTime(at)); err != nil {
+		return
+	}
+	c.CloneSuspected = suspected
+	c.CloneSuspectedAt = at
+
+	return
+}
+
+// ListCloneSuspected returns the clients flagged as suspected clones, with
+// their authTokens omitted
+func (c *ClientsRow) ListCloneSuspected(limit, offset uint) (clients []*ClientsRow, err error) {
+	opts := SelectOpts{
+		OrderBy: "id",
+		Limit:   limit,
+		Offset:  offset,
+	}
+	stmt, err := c.SelectStmt(
+		[]string{
+			"id",
+			"clientId",
+			"systemUUID",
+			"clientTimestamp",
+			"registrationDate",
+			"cloneSuspectedAt",
+		},
+		[]string{
+			"cloneSuspected",
+		},
+		opts,
+	)
+	if err != nil {
+		slog.Error(
+			"list statement generation failed",
+			slog.String("table", c.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := c.Executor().Query(stmt, opts.Args(true)...)
+	if err != nil {
+		slog.Error("suspected clones query failed", slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		client := new(ClientsRow)
+		if err = client.SetupDB(c.db); err != nil {
+			return nil, err
+		}
+
+		var systemUUID sql.NullString
+		if err = rows.Scan(
+			&client.Id,
+			&client.ClientId,
+			&systemUUID,
+			&client.ClientTimestamp,
+			&client.RegistrationDate,
+			&client.CloneSuspectedAt,
+		); err != nil {
+			slog.Error("suspected clone retrieval failed", slog.String("error", err.Error()))
+			return nil, err
+		}
+		client.SystemUUID = systemUUID.String
+		client.CloneSuspected = true
+
+		clients = append(clients, client)
+	}
+
+	if err = rows.Err(); err != nil {
+		slog.Error("suspected clones iteration failed", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	return
+}
+
+// RegistrationIdsForClientId returns the ids of the registrations using the
+// client's clientId, of which there may be several, e.g. for cloned systems
+func (c *ClientsRow) RegistrationIdsForClientId() (ids []int64, err error) {
+	stmt, err := c.SelectStmt(
+		[]string{
+			"id",
+		},
+		[]string{
+			"clientId",
+		},
+		SelectOpts{
+			OrderBy: "id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"select statement generation failed",
+			slog.String("table", c.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := c.Executor().Query(stmt, c.ClientId)
+	if err != nil {
+		slog.Error("clientId registrations query failed", slog.String("clientId", c.ClientId), slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			slog.Error("clientId registration retrieval failed", slog.String("error", err.Error()))
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		slog.Error("clientId registrations iteration failed", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	return
+}
+
+// ListMatching returns the clients matching the client's clientId and
+// systemUUID, if specified, registered at, or after, registeredAfter and
+// before registeredBefore, unless they are zero, ordered by id, limited to
+// the specified page if limit is non-zero. The authToken is never retrieved.
+func (c *ClientsRow) ListMatching(registeredAfter, registeredBefore time.Time, limit, offset uint) (clients []*ClientsRow, err error) {
+	var whereCols []string
+	var whereArgs []any
+	if c.ClientId != "" {
+		whereCols = append(whereCols, "clientId")
+		whereArgs = append(whereArgs, c.ClientId)
+	}
+	if c.SystemUUID != "" {
+		whereCols = append(whereCols, "systemUUID")
+		whereArgs = append(whereArgs, c.SystemUUID)
+	}
+
+	var conds []WhereCond
+	if !registeredAfter.IsZero() {
+		conds = append(conds, WhereCond{Column: "registrationDate", Op: WHERE_OP_GE})
+		whereArgs = append(whereArgs, DbTime(registeredAfter))
+	}
+	if !registeredBefore.IsZero() {
+		conds = append(conds, WhereCond{Column: "registrationDate", Op: WHERE_OP_LT})
+		whereArgs = append(whereArgs, DbTime(registeredBefore))
+	}
+
+	opts := SelectOpts{
+		Where:   conds,
+		OrderBy: "id",
+		Limit:   limit,
+		Offset:  offset,
+	}
+	stmt, err := c.SelectStmt(
+		[]string{
+			"id",
+			"clientId",
+			"systemUUID",
+			"clientTimestamp",
+			"registrationDate",
+			"cloneSuspected",
+			"cloneSuspectedAt",
+		},
+		whereCols,
+		opts,
+	)
+	if err != nil {
+		slog.Error(
+			"list statement generation failed",
+			slog.String("table", c.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := c.Executor().Query(stmt, opts.Args(whereArgs...)...)
+	if err != nil {
+		slog.Error("clients query failed", slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		client := new(ClientsRow)
+		if err = client.SetupDB(c.db); err != nil {
+			return nil, err
+		}
+
+		var systemUUID sql.NullString
+		if err = rows.Scan(
+			&client.Id,
+			&client.ClientId,
+			&systemUUID,
+			&client.ClientTimestamp,
+			&client.RegistrationDate,
+			&client.CloneSuspected,
+			&client.CloneSuspectedAt,
+		); err != nil {
+			slog.Error("client retrieval failed", slog.String("error", err.Error()))
+			return nil, err
+		}
+		client.SystemUUID = systemUUID.String
+
+		clients = append(clients, client)
+	}
+
+	if err = rows.Err(); err != nil {
+		slog.Error("clients iteration failed", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	return
+}
+
 // verify that ClientsRow conforms to the TableRowHandler interface
 var _ TableRowHandler = (*ClientsRow)(nil)
@@ -0,0 +1,570 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// cloneSignals table specification
+// The cloneSignals table records evidence that a client registration is
+// being used by more than one system, e.g. because a registered system's
+// disk image was cloned, such as stale tokens being presented, duplicate
+// clientIds with different systemUUIDs, and interleaved authentications.
+// Registrations accumulating enough signals are flagged as suspected clones
+// for review by an administrator. Repeated occurrences of a signal, such as
+// the same stale token being presented again, are counted against the
+// existing entry rather than being recorded again.
+var cloneSignalsTableSpec = TableSpec{
+	Name: "cloneSignals",
+	Columns: []TableSpecColumn{
+		{Name: "id", Type: "INTEGER", PrimaryKey: true, Identity: true},
+		{Name: "registrationId", Type: "INTEGER"},
+		{Name: "relatedRegistrationId", Type: "INTEGER", Nullable: true},
+		{Name: "signal", Type: "VARCHAR"},
+		{Name: "details", Type: "VARCHAR"},
+		{Name: "tokenId", Type: "VARCHAR", Nullable: true},
+		{Name: "occurrences", Type: "INTEGER", Default: "1"},
+		{Name: "detectedAt", Type: "TIMESTAMPTZ"},
+		{Name: "lastDetectedAt", Type: "TIMESTAMPTZ"},
+	},
+	Indexes: []TableSpecIndex{
+		{Columns: []string{"registrationId"}},
+	},
+}
+
+func GetCloneSignalsTableSpec() *TableSpec {
+	return &cloneSignalsTableSpec
+}
+
+// clone signal types
+const (
+	// a valid, but superseded, token was presented for the registration
+	CLONE_SIGNAL_STALE_TOKEN = "staleToken"
+	// a registration used a clientId already registered with a different
+	// systemUUID
+	CLONE_SIGNAL_DUPLICATE_CLIENT_ID = "duplicateClientId"
+	// the registration authenticated again shortly after a previous
+	// authentication, following a superseded token being presented, such
+	// that authentications alternate between systems holding different
+	// tokens
+	CLONE_SIGNAL_INTERLEAVED_AUTH = "interleavedAuthentication"
+)
+
+type CloneSignalRow struct {
+	TableRowCommon
+
+	Id                    int64     `json:"id"`
+	RegistrationId        int64     `json:"registrationId"`
+	RelatedRegistrationId int64     `json:"relatedRegistrationId,omitempty"`
+	Signal                string    `json:"signal"`
+	Details               string    `json:"details"`
+	TokenId               string    `json:"tokenId,omitempty"`
+	Occurrences           int64     `json:"occurrences"`
+	DetectedAt            time.Time `json:"detectedAt"`
+	LastDetectedAt        time.Time `json:"lastDetectedAt"`
+}
+
+func (s *CloneSignalRow) Init(registrationId, relatedRegistrationId int64, signal, details string, detectedAt time.Time) {
+	s.RegistrationId = registrationId
+	s.RelatedRegistrationId = relatedRegistrationId
+	s.Signal = signal
+	s.Details = details
+	s.Occurrences = 1
+	s.DetectedAt = detectedAt
+	s.LastDetectedAt = detectedAt
+}
+
+func (s *CloneSignalRow) SetupDB(adb *AppDb) error {
+	s.SetTableSpec(GetCloneSignalsTableSpec())
+	return s.TableRowCommon.SetupDB(adb)
+}
+
+func (s *CloneSignalRow) TableName() string {
+	return s.TableRowCommon.TableName()
+}
+
+func (s *CloneSignalRow) RowId() int64 {
+	return s.Id
+}
+
+func (s *CloneSignalRow) String() string {
+	bytes, _ := json.Marshal(s)
+	return string(bytes)
+}
+
+// relatedRegistrationId returns the related registration id as a nullable
+// value, since 0 indicates that there is no related registration
+func (s *CloneSignalRow) relatedRegistrationId() sql.NullInt64 {
+	return sql.NullInt64{
+		Int64: s.RelatedRegistrationId,
+		Valid: s.RelatedRegistrationId != 0,
+	}
+}
+
+// tokenId returns the token id as a nullable value, since only stale token
+// signals identify the token that was presented
+func (s *CloneSignalRow) tokenId() sql.NullString {
+	return sql.NullString{
+		String: s.TokenId,
+		Valid:  s.TokenId != "",
+	}
+}
+
+func (s *CloneSignalRow) Exists() bool {
+	stmt, err := s.SelectStmt(
+		// select columns
+		[]string{
+			"registrationId",
+			"relatedRegistrationId",
+			"signal",
+			"details",
+			"tokenId",
+			"occurrences",
+			"detectedAt",
+			"lastDetectedAt",
+		},
+		// match columns
+		[]string{
+			"id",
+		},
+		SelectOpts{}, // no special options
+	)
+	if err != nil {
+		slog.Error(
+			"exists statement generation failed",
+			slog.String("table", s.TableName()),
+			slog.String("error", err.Error()),
+		)
+		panic(err)
+	}
+
+	var related sql.NullInt64
+	var tokenId sql.NullString
+	row := s.Executor().QueryRow(stmt, s.Id)
+	if err := row.Scan(
+		&s.RegistrationId,
+		&related,
+		&s.Signal,
+		&s.Details,
+		&tokenId,
+		&s.Occurrences,
+		&s.DetectedAt,
+		&s.LastDetectedAt,
+	); err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error(
+				"check for matching entry failed",
+				slog.String("table", s.TableName()),
+				slog.Int64("id", s.Id),
+				slog.String("error", err.Error()),
+			)
+		}
+		return false
+	}
+	s.RelatedRegistrationId = related.Int64
+	s.TokenId = tokenId.String
+
+	return true
+}
+
+func (s *CloneSignalRow) Insert() (err error) {
+	stmt, err := s.InsertStmt(
+		[]string{
+			"registrationId",
+			"relatedRegistrationId",
+			"signal",
+			"details",
+			"tokenId",
+			"occurrences",
+			"detectedAt",
+			"lastDetectedAt",
+		},
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"insert statement generation failed",
+			slog.String("table", s.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := s.Executor().QueryRow(
+		stmt,
+		s.RegistrationId,
+		s.relatedRegistrationId(),
+		s.Signal,
+		s.Details,
+		s.tokenId(),
+		s.Occurrences,
+		DbTime(s.DetectedAt),
+		DbTime(s.LastDetectedAt),
+	)
+	if err = row.Scan(
+		&s.Id,
+	); err != nil {
+		slog.Error(
+			"insert failed",
+			slog.String("table", s.TableName()),
+			slog.Int64("registrationId", s.RegistrationId),
+			slog.String("signal", s.Signal),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (s *CloneSignalRow) Update() (err error) {
+	stmt, err := s.UpdateStmt(
+		[]string{
+			"registrationId",
+			"relatedRegistrationId",
+			"signal",
+			"details",
+			"tokenId",
+			"occurrences",
+			"detectedAt",
+			"lastDetectedAt",
+		},
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", s.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = s.Executor().Exec(
+		stmt,
+		s.RegistrationId,
+		s.relatedRegistrationId(),
+		s.Signal,
+		s.Details,
+		s.tokenId(),
+		s.Occurrences,
+		DbTime(s.DetectedAt),
+		DbTime(s.LastDetectedAt),
+		s.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"update failed",
+			slog.String("table", s.TableName()),
+			slog.Int64("id", s.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (s *CloneSignalRow) Delete() (err error) {
+	stmt, err := s.DeleteStmt(
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", s.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = s.Executor().Exec(
+		stmt,
+		s.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"delete failed",
+			slog.String("table", s.TableName()),
+			slog.Int64("id", s.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// CountForRegistration returns the number of signals recorded for the
+// registration
+func (s *CloneSignalRow) CountForRegistration() (count int64, err error) {
+	stmt, err := s.SelectStmt(
+		[]string{
+			"id",
+		},
+		[]string{
+			"registrationId",
+		},
+		SelectOpts{
+			Count: true,
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"count statement generation failed",
+			slog.String("table", s.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := s.Executor().QueryRow(stmt, s.RegistrationId)
+	if err = row.Scan(&count); err != nil {
+		slog.Error(
+			"clone signal count failed",
+			slog.Int64("registrationId", s.RegistrationId),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// CountSignalSince returns the number of signals of the specified type
+// last detected for the registration at, or after, the specified time
+func (s *CloneSignalRow) CountSignalSince(signal string, since time.Time) (count int64, err error) {
+	stmt, err := s.SelectStmt(
+		[]string{
+			"id",
+		},
+		[]string{
+			"registrationId",
+			"signal",
+		},
+		SelectOpts{
+			Count: true,
+			Where: []WhereCond{
+				{Column: "lastDetectedAt", Op: WHERE_OP_GE},
+			},
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"count statement generation failed",
+			slog.String("table", s.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := s.Executor().QueryRow(stmt, s.RegistrationId, signal, DbTime(since))
+	if err = row.Scan(&count); err != nil {
+		slog.Error(
+			"clone signal count failed",
+			slog.Int64("registrationId", s.RegistrationId),
+			slog.String("signal", signal),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// RecordOccurrence records a further occurrence of the signal, detected at
+// the specified time, against the registration's most recent entry for the
+// signal, also matching its tokenId if matchTokenId is true, returning false
+// if there is no such entry
+func (s *CloneSignalRow) RecordOccurrence(detectedAt time.Time, matchTokenId bool) (recorded bool, err error) {
+	whereCols := []string{"registrationId", "signal"}
+	whereArgs := []any{s.RegistrationId, s.Signal}
+	if matchTokenId {
+		whereCols = append(whereCols, "tokenId")
+		whereArgs = append(whereArgs, s.TokenId)
+	}
+
+	opts := SelectOpts{
+		OrderBy:    "id",
+		Descending: true,
+		Limit:      1,
+	}
+	queryStmt, err := s.SelectStmt(
+		[]string{
+			"id",
+		},
+		whereCols,
+		opts,
+	)
+	if err != nil {
+		slog.Error(
+			"query statement generation failed",
+			slog.String("table", s.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	incrementStmt, err := s.IncrementStmt(
+		[]string{
+			"occurrences",
+		},
+		[]string{
+			"lastDetectedAt",
+		},
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"increment statement generation failed",
+			slog.String("table", s.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	var id int64
+	row := s.Executor().QueryRow(queryStmt, opts.Args(whereArgs...)...)
+	if err = row.Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		slog.Error(
+			"clone signal lookup failed",
+			slog.Int64("registrationId", s.RegistrationId),
+			slog.String("signal", s.Signal),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := s.Executor().Exec(incrementStmt, DbTime(detectedAt), id)
+	if err != nil {
+		slog.Error(
+			"clone signal occurrence update failed",
+			slog.Int64("id", id),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		slog.Error("clone signal occurrence count unavailable", slog.Int64("id", id), slog.String("error", err.Error()))
+		return
+	}
+	s.Id = id
+
+	return count == 1, nil
+}
+
+// ListForRegistration returns the signals recorded for the registration,
+// oldest first
+func (s *CloneSignalRow) ListForRegistration() (signals []*CloneSignalRow, err error) {
+	stmt, err := s.SelectStmt(
+		[]string{
+			"id",
+			"registrationId",
+			"relatedRegistrationId",
+			"signal",
+			"details",
+			"tokenId",
+			"occurrences",
+			"detectedAt",
+			"lastDetectedAt",
+		},
+		[]string{
+			"registrationId",
+		},
+		SelectOpts{
+			OrderBy: "id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"list statement generation failed",
+			slog.String("table", s.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := s.Executor().Query(stmt, s.RegistrationId)
+	if err != nil {
+		slog.Error("clone signals query failed", slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		signal := new(CloneSignalRow)
+		if err = signal.SetupDB(s.db); err != nil {
+			return nil, err
+		}
+
+		var related sql.NullInt64
+		var tokenId sql.NullString
+		if err = rows.Scan(
+			&signal.Id,
+			&signal.RegistrationId,
+			&related,
+			&signal.Signal,
+			&signal.Details,
+			&tokenId,
+			&signal.Occurrences,
+			&signal.DetectedAt,
+			&signal.LastDetectedAt,
+		); err != nil {
+			slog.Error("clone signal retrieval failed", slog.String("error", err.Error()))
+			return nil, err
+		}
+		signal.RelatedRegistrationId = related.Int64
+		signal.TokenId = tokenId.String
+
+		signals = append(signals, signal)
+	}
+
+	if err = rows.Err(); err != nil {
+		slog.Error("clone signals iteration failed", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	return
+}
+
+// DeleteForRegistration deletes the signals recorded for the registration,
+// returning the number deleted
+func (s *CloneSignalRow) DeleteForRegistration() (deleted int64, err error) {
+	stmt, err := s.DeleteStmt(
+		[]string{
+			"registrationId",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", s.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := s.Executor().Exec(stmt, s.RegistrationId)
+	if err != nil {
+		slog.Error(
+			"clone signals delete failed",
+			slog.Int64("registrationId", s.RegistrationId),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	return result.RowsAffected()
+}
+
+// verify that CloneSignalRow conforms to the TableRowHandler interface
+var _ TableRowHandler = (*CloneSignalRow)(nil)
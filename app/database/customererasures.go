@@ -0,0 +1,315 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// customerErasures table specification
+// The customerErasures table records a receipt for each customer erasure,
+// identifying the erased customers entry and what was done to it and its
+// telemetry data. The erased customerId itself is never recorded, only its
+// keyed hash, so that the erasure of a given customerId can still be
+// verified by those holding the key.
+var customerErasuresTableSpec = TableSpec{
+	Name: "customerErasures",
+	Columns: []TableSpecColumn{
+		{Name: "id", Type: "INTEGER", PrimaryKey: true, Identity: true},
+		{Name: "customerRefId", Type: "INTEGER"},
+		{Name: "customerIdHash", Type: "VARCHAR"},
+		{Name: "pseudonymised", Type: "BOOLEAN", Default: "false"},
+		{Name: "policy", Type: "VARCHAR"},
+		{Name: "dataItems", Type: "INTEGER", Default: "0"},
+		{Name: "erasedAt", Type: "TIMESTAMPTZ"},
+	},
+	Indexes: []TableSpecIndex{
+		{Columns: []string{"customerIdHash"}},
+	},
+}
+
+func GetCustomerErasuresTableSpec() *TableSpec {
+	return &customerErasuresTableSpec
+}
+
+type CustomerErasureRow struct {
+	TableRowCommon
+
+	Id             int64     `json:"id"`
+	CustomerRefId  int64     `json:"customerRefId"`
+	CustomerIdHash string    `json:"customerIdHash"`
+	Pseudonymised  bool      `json:"pseudonymised"`
+	Policy         string    `json:"policy"`
+	DataItems      int64     `json:"dataItems"`
+	ErasedAt       time.Time `json:"erasedAt"`
+}
+
+// Init initialises the receipt for the erasure of the specified customers
+// entry
+func (e *CustomerErasureRow) Init(customerRefId int64, customerIdHash string, pseudonymised bool, policy string, dataItems int64, erasedAt time.Time) {
+	e.CustomerRefId = customerRefId
+	e.CustomerIdHash = customerIdHash
+	e.Pseudonymised = pseudonymised
+	e.Policy = policy
+	e.DataItems = dataItems
+	e.ErasedAt = erasedAt
+}
+
+func (e *CustomerErasureRow) SetupDB(adb *AppDb) error {
+	e.SetTableSpec(GetCustomerErasuresTableSpec())
+	return e.TableRowCommon.SetupDB(adb)
+}
+
+func (e *CustomerErasureRow) TableName() string {
+	return e.TableRowCommon.TableName()
+}
+
+func (e *CustomerErasureRow) RowId() int64 {
+	return e.Id
+}
+
+func (e *CustomerErasureRow) String() string {
+	bytes, _ := json.Marshal(e)
+	return string(bytes)
+}
+
+// erasureColumns are the columns retrieved when listing erasure receipts
+var erasureColumns = []string{
+	"id",
+	"customerRefId",
+	"customerIdHash",
+	"pseudonymised",
+	"policy",
+	"dataItems",
+	"erasedAt",
+}
+
+// scan retrieves the erasureColumns values of the row into the entry
+func (e *CustomerErasureRow) scan(row interface{ Scan(...any) error }) error {
+	return row.Scan(
+		&e.Id,
+		&e.CustomerRefId,
+		&e.CustomerIdHash,
+		&e.Pseudonymised,
+		&e.Policy,
+		&e.DataItems,
+		&e.ErasedAt,
+	)
+}
+
+func (e *CustomerErasureRow) Exists() bool {
+	stmt, err := e.SelectStmt(
+		// select columns
+		erasureColumns,
+		// match columns
+		[]string{
+			"id",
+		},
+		SelectOpts{}, // no special options
+	)
+	if err != nil {
+		slog.Error(
+			"exists statement generation failed",
+			slog.String("table", e.TableName()),
+			slog.String("error", err.Error()),
+		)
+		panic(err)
+	}
+
+	row := e.Executor().QueryRow(stmt, e.Id)
+	if err := e.scan(row); err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error(
+				"check for matching entry failed",
+				slog.String("table", e.TableName()),
+				slog.Int64("id", e.Id),
+				slog.String("error", err.Error()),
+			)
+		}
+		return false
+	}
+
+	return true
+}
+
+func (e *CustomerErasureRow) Insert() (err error) {
+	stmt, err := e.InsertStmt(
+		[]string{
+			"customerRefId",
+			"customerIdHash",
+			"pseudonymised",
+			"policy",
+			"dataItems",
+			"erasedAt",
+		},
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"insert statement generation failed",
+			slog.String("table", e.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := e.Executor().QueryRow(
+		stmt,
+		e.CustomerRefId,
+		e.CustomerIdHash,
+		e.Pseudonymised,
+		e.Policy,
+		e.DataItems,
+		DbTime(e.ErasedAt),
+	)
+	if err = row.Scan(
+		&e.Id,
+	); err != nil {
+		slog.Error(
+			"insert failed",
+			slog.String("table", e.TableName()),
+			slog.Int64("customerRefId", e.CustomerRefId),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (e *CustomerErasureRow) Update() (err error) {
+	stmt, err := e.UpdateStmt(
+		[]string{
+			"customerRefId",
+			"customerIdHash",
+			"pseudonymised",
+			"policy",
+			"dataItems",
+			"erasedAt",
+		},
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", e.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = e.Executor().Exec(
+		stmt,
+		e.CustomerRefId,
+		e.CustomerIdHash,
+		e.Pseudonymised,
+		e.Policy,
+		e.DataItems,
+		DbTime(e.ErasedAt),
+		e.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"update failed",
+			slog.String("table", e.TableName()),
+			slog.Int64("id", e.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (e *CustomerErasureRow) Delete() (err error) {
+	stmt, err := e.DeleteStmt(
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", e.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = e.Executor().Exec(
+		stmt,
+		e.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"delete failed",
+			slog.String("table", e.TableName()),
+			slog.Int64("id", e.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// List returns the erasure receipts, ordered by id, optionally limited to
+// those with a matching customerIdHash if specified
+func (e *CustomerErasureRow) List(limit, offset uint) (erasures []*CustomerErasureRow, err error) {
+	var whereCols []string
+	var whereVals []any
+	if e.CustomerIdHash != "" {
+		whereCols = append(whereCols, "customerIdHash")
+		whereVals = append(whereVals, e.CustomerIdHash)
+	}
+
+	opts := SelectOpts{
+		OrderBy: "id",
+		Limit:   limit,
+		Offset:  offset,
+	}
+	stmt, err := e.SelectStmt(
+		erasureColumns,
+		whereCols,
+		opts,
+	)
+	if err != nil {
+		slog.Error(
+			"list statement generation failed",
+			slog.String("table", e.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := e.Executor().Query(stmt, opts.Args(whereVals...)...)
+	if err != nil {
+		slog.Error("customer erasures query failed", slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		erasure := new(CustomerErasureRow)
+		if err = erasure.SetupDB(e.db); err != nil {
+			return nil, err
+		}
+
+		if err = erasure.scan(rows); err != nil {
+			slog.Error("customer erasure scan failed", slog.String("error", err.Error()))
+			return nil, err
+		}
+
+		erasures = append(erasures, erasure)
+	}
+
+	if err = rows.Err(); err != nil {
+		slog.Error("customer erasures iteration failed", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	return
+}
+
+// verify that CustomerErasureRow conforms to the TableRowHandler interface
+var _ TableRowHandler = (*CustomerErasureRow)(nil)
@@ -3,7 +3,9 @@ package database
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"time"
 )
 
 // customers table specification
@@ -14,16 +16,27 @@ import (
 // an associated deletedAt time. Optionally the associated customerId value
 // can be cleared or changed to an anonymised value as part of marking an
 // entry as deleted.
+// Entries that are no longer referenced are marked with an orphanedAt time
+// by the retention job, and are only garbage collected once they have
+// remained unreferenced for a grace period.
 var customersTableSpec = TableSpec{
 	Name: "customers",
 	Columns: []TableSpecColumn{
 		{Name: "id", Type: "INTEGER", PrimaryKey: true, Identity: true},
 		{Name: "customerId", Type: "VARCHAR", Nullable: true},
 		{Name: "deleted", Type: "BOOLEAN", Default: "false"},
-		{Name: "deletedAt", Type: "VARCHAR", Nullable: true},
+		{Name: "deletedAt", Type: "TIMESTAMPTZ", Nullable: true},
+		{Name: "orphanedAt", Type: "TIMESTAMPTZ", Nullable: true},
+	},
+	Indexes: []TableSpecIndex{
+		// only one active entry may exist per customerId
+		{Columns: []string{"customerId"}, Unique: true, Where: customersActiveWhere},
 	},
 }
 
+// predicate identifying active, i.e. not deleted, customers
+const customersActiveWhere = "deleted = false"
+
 func GetCustomersTableSpec() *TableSpec {
 	return &customersTableSpec
 }
@@ -32,10 +45,11 @@ type CustomersRow struct {
 	// include common table row fields
 	TableRowCommon
 
-	Id         int64  `json:"id"`
-	CustomerId string `json:"customerId"`
-	Deleted    bool   `json:"deleted"`
-	DeletedAt  string `json:"deletedAt"`
+	Id         int64      `json:"id"`
+	CustomerId string     `json:"customerId"`
+	Deleted    bool       `json:"deleted"`
+	DeletedAt  *time.Time `json:"deletedAt,omitempty"`
+	OrphanedAt *time.Time `json:"orphanedAt,omitempty"`
 }
 
 func (r *CustomersRow) Init(customerId string) {
@@ -66,6 +80,7 @@ func (r *CustomersRow) Exists() bool {
 		[]string{
 			"id",
 			"deletedAt",
+			"orphanedAt",
 		},
 		// match columns
 		[]string{
@@ -83,12 +98,13 @@ func (r *CustomersRow) Exists() bool {
 		panic(err)
 	}
 
-	row := r.DB().QueryRow(stmt, r.CustomerId, r.Deleted)
+	row := r.Executor().QueryRow(stmt, r.CustomerId, r.Deleted)
 	// if the entry was found, all fields not used to find the entry will have
 	// been updated to match what is in the DB
 	if err := row.Scan(
 		&r.Id,
 		&r.DeletedAt,
+		&r.OrphanedAt,
 	); err != nil {
 		if err != sql.ErrNoRows {
 			slog.Error(
@@ -110,6 +126,7 @@ func (r *CustomersRow) IdExists() bool {
 			"customerId",
 			"deleted",
 			"deletedAt",
+			"orphanedAt",
 		},
 		// match columns
 		[]string{
@@ -126,13 +143,14 @@ func (r *CustomersRow) IdExists() bool {
 		panic(err)
 	}
 
-	row := r.DB().QueryRow(stmt, r.Id)
+	row := r.Executor().QueryRow(stmt, r.Id)
 	// if the entry was found, all fields not used to find the entry will have
 	// been updated to match what is in the DB
 	if err := row.Scan(
 		&r.CustomerId,
 		&r.Deleted,
 		&r.DeletedAt,
+		&r.OrphanedAt,
 	); err != nil {
 		if err != sql.ErrNoRows {
 			slog.Error(
@@ -164,11 +182,11 @@ func (r *CustomersRow) Insert() (err error) {
 		)
 		return
 	}
-	row := r.DB().QueryRow(
+	row := r.Executor().QueryRow(
 		stmt,
 		r.CustomerId,
 		r.Deleted,
-		r.DeletedAt,
+		nullableTime(r.DeletedAt),
 	)
 	if err = row.Scan(
 		&r.Id,
@@ -178,7 +196,64 @@ func (r *CustomersRow) Insert() (err error) {
 			slog.String("table", r.TableName()),
 			slog.String("customerId", r.CustomerId),
 			slog.Bool("deleted", r.Deleted),
-			slog.String("deletedAt", r.DeletedAt),
+			slog.Any("deletedAt", r.DeletedAt),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// Upsert inserts the customer if no active (non-deleted) entry exists for
+// the customerId, otherwise retrieving the existing entry's id, ensuring
+// that concurrent callers always get the single canonical id
+func (r *CustomersRow) Upsert() (err error) {
+	stmt, err := r.UpsertStmt(
+		[]string{
+			"customerId",
+			"deleted",
+			"deletedAt",
+		},
+		[]string{
+			"customerId",
+		},
+		customersActiveWhere,
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"upsert statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	// only active customers are subject to the unique constraint
+	r.Deleted = false
+	r.DeletedAt = nil
+
+	row := r.Executor().QueryRow(
+		stmt,
+		r.CustomerId,
+		r.Deleted,
+		nullableTime(r.DeletedAt),
+	)
+	err = row.Scan(
+		&r.Id,
+	)
+	if err == sql.ErrNoRows {
+		// an entry already exists, so retrieve it
+		err = nil
+		if !r.Exists() {
+			err = fmt.Errorf("customerId %q conflicts with an entry that could not be found", r.CustomerId)
+		}
+	}
+	if err != nil {
+		slog.Error(
+			"upsert failed",
+			slog.String("table", r.TableName()),
+			slog.String("customerId", r.CustomerId),
 			slog.String("error", err.Error()),
 		)
 	}
@@ -205,11 +280,11 @@ func (r *CustomersRow) Update() (err error) {
 		)
 		return
 	}
-	_, err = r.DB().Exec(
+	_, err = r.Executor().Exec(
 		stmt,
 		r.CustomerId,
 		r.Deleted,
-		r.DeletedAt,
+		nullableTime(r.DeletedAt),
 		r.Id,
 	)
 	if err != nil {
@@ -219,8 +294,16 @@ func (r *CustomersRow) Update() (err error) {
 			slog.Int64("id", r.Id),
 			slog.String("error", err.Error()),
 		)
+		return
 	}
 
+	// the customerId may have been anonymised or marked as deleted
+	if err = r.incrementCacheGeneration(); err != nil {
+		return
+	}
+
+	r.notifyRowChanged(r.Id)
+
 	return
 }
 
@@ -239,7 +322,7 @@ func (r *CustomersRow) Delete() (err error) {
 		return
 	}
 
-	_, err = r.DB().Exec(
+	_, err = r.Executor().Exec(
 		stmt,
 		r.Id,
 	)
@@ -250,10 +333,156 @@ func (r *CustomersRow) Delete() (err error) {
 			slog.Int64("id", r.Id),
 			slog.String("error", err.Error()),
 		)
+		return
 	}
 
+	if err = r.incrementCacheGeneration(); err != nil {
+		return
+	}
+
+	r.notifyRowChanged(r.Id)
+
 	return
 }
 
+// Reclaim clears the orphanedAt mark of an entry that is about to be
+// referenced again, so that it won't be garbage collected, returning false
+// if the entry has already been deleted
+func (r *CustomersRow) Reclaim() (reclaimed bool, err error) {
+	stmt, err := r.UpdateStmt(
+		[]string{
+			"orphanedAt",
+		},
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"reclaim statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := r.Executor().Exec(stmt, nil, r.Id)
+	if err != nil {
+		slog.Error(
+			"reclaim failed",
+			slog.String("table", r.TableName()),
+			slog.Int64("id", r.Id),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	if reclaimed = count > 0; reclaimed {
+		r.OrphanedAt = nil
+	}
+
+	return
+}
+
+// LockActive share locks the entry, as part of the row's transaction, so
+// that it cannot be erased until the transaction completes, returning false
+// if the entry is no longer active, e.g. because it was erased after its id
+// was looked up
+func (r *CustomersRow) LockActive() (active bool, err error) {
+	stmt, err := r.SelectStmt(
+		// select columns
+		[]string{
+			"id",
+		},
+		// match columns
+		[]string{
+			"id",
+			"deleted",
+		},
+		SelectOpts{Share: true},
+	)
+	if err != nil {
+		slog.Error(
+			"lock statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	err = r.Executor().QueryRow(stmt, r.Id, false).Scan(&r.Id)
+	switch err {
+	case nil:
+		return true, nil
+	case sql.ErrNoRows:
+		return false, nil
+	}
+
+	slog.Error(
+		"lock failed",
+		slog.String("table", r.TableName()),
+		slog.Int64("id", r.Id),
+		slog.String("error", err.Error()),
+	)
+
+	return
+}
+
+// Orphans returns the ids of active customers entries that are no longer
+// referenced by any telemetry data, up to limit, or all of them if limit is
+// 0. Erased (deleted) entries are never orphans, as they must be retained
+// to record the erasure and to back the erasure receipts that reference them.
+func (r *CustomersRow) Orphans(limit uint) (ids []int64, err error) {
+	return r.UnreferencedIds(GetTelemetryTableSpec().Name, "customerRefId", customersActiveWhere, limit)
+}
+
+// MarkOrphans marks up to limit unmarked active customers entries that are no
+// longer referenced by any telemetry data as orphaned at the specified
+// time, returning the number marked
+func (r *CustomersRow) MarkOrphans(at time.Time, limit uint) (marked int64, err error) {
+	ids, err := r.MarkUnreferenced(GetTelemetryTableSpec().Name, "customerRefId", customersActiveWhere, "orphanedAt", at, limit)
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	// ensure that any cached ids of the marked entries are discarded, by
+	// this and other processes, so that they must be reclaimed before being
+	// referenced again
+	if err = r.incrementCacheGeneration(); err != nil {
+		return
+	}
+
+	for _, id := range ids {
+		r.notifyRowChanged(id)
+	}
+
+	return int64(len(ids)), nil
+}
+
+// DeleteOrphans deletes up to limit active customers entries that were
+// marked as orphaned before the specified time, and that are still not
+// referenced by any telemetry data, returning the number deleted
+func (r *CustomersRow) DeleteOrphans(before time.Time, limit uint) (deleted int64, err error) {
+	ids, err := r.DeleteUnreferenced(GetTelemetryTableSpec().Name, "customerRefId", customersActiveWhere, "orphanedAt", before, limit)
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	if err = r.incrementCacheGeneration(); err != nil {
+		return
+	}
+
+	for _, id := range ids {
+		r.notifyRowChanged(id)
+	}
+
+	return int64(len(ids)), nil
+}
+
 // verify that CustomersRow conforms to the TableRowHandler interface
 var _ TableRowHandler = (*CustomersRow)(nil)
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 
 	"github.com/SUSE/telemetry-server/app/config"
 	"github.com/SUSE/telemetry-server/app/database/dbmanager"
@@ -15,6 +16,7 @@ import (
 type DbConnection struct {
 	name        string
 	dbMgr       dbmanager.DbManager
+	stmtCache   *StmtCache
 	Placeholder dialect.PlaceholderGenerator
 }
 
@@ -26,11 +28,18 @@ func (d DbConnection) DbMgr() dbmanager.DbManager {
 	return d.dbMgr
 }
 
+func (d DbConnection) StmtCache() *StmtCache {
+	return d.stmtCache
+}
+
 func (d DbConnection) String() string {
 	return fmt.Sprintf("%s:%s", d.name, d.dbMgr.String())
 }
 
 func (d DbConnection) Close() (err error) {
+	// discard any prepared statements
+	d.stmtCache.Reset()
+
 	// close the DB
 	err = d.dbMgr.Close()
 	if err != nil {
@@ -60,6 +69,7 @@ func (d *DbConnection) Setup(name string, dbcfg *config.DBConfig) error {
 
 	d.name = name
 	d.dbMgr = dbMgr
+	d.stmtCache = NewStmtCache()
 
 	switch {
 	case d.dbMgr.Type().IsPostgres():
@@ -76,6 +86,9 @@ func (d *DbConnection) Setup(name string, dbcfg *config.DBConfig) error {
 func (d *DbConnection) Connect() (err error) {
 	slog.Debug("Connecting to DB", slog.String("name", d.name))
 
+	// discard any statements prepared against a previous connection
+	d.stmtCache.Reset()
+
 	// connect to the specified DB
 	err = d.dbMgr.Connect()
 	if err != nil {
@@ -240,8 +253,9 @@ func (d *DbConnection) CheckTableExists(table *TableSpec) (bool, error) {
 	WHERE table_schema = current_schema()
 	  AND table_name = $1;
 	`
-	// query if table exists
-	row := d.DB().QueryRow(existsStmt, table.Name)
+	// query if table exists, matching the name that PostgreSQL will have
+	// folded the unquoted table identifier to
+	row := d.DB().QueryRow(existsStmt, strings.ToLower(table.Name))
 	if err := row.Scan(&name); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			slog.Debug(
@@ -415,6 +429,107 @@ func (d *DbConnection) CreateTableFromSpec(table *TableSpec) (err error) {
 	return
 }
 
+func (d *DbConnection) CreateIndexesFromSpec(table *TableSpec) (err error) {
+	// generate the create index commands
+	indexCmds, err := table.IndexCmds(d)
+	if err != nil {
+		slog.Error(
+			"sql create index statement generation failed",
+			slog.String("db", d.name),
+			slog.String("table", table.Name),
+			slog.String("error", err.Error()),
+		)
+		return fmt.Errorf("generation of create index statements failed: %w", err)
+	}
+
+	if len(indexCmds) == 0 {
+		return
+	}
+
+	// begin a transaction
+	tx, err := d.DB().Begin()
+	if err != nil {
+		return fmt.Errorf(
+			"failed to begin a transaction to create the %q table indexes: %w",
+			table.Name,
+			err,
+		)
+	}
+
+	// defer performing a rollback, which can be safely called even if
+	// the transaction was safely committed
+	defer func() {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) && !errors.Is(err, sql.ErrConnDone) {
+			slog.Warn(
+				"failed to rollback index creation transaction",
+				slog.String("db", d.name),
+				slog.String("table", table.Name),
+				slog.String("error", err.Error()),
+			)
+		}
+	}()
+
+	// acquire an advisory lock for this transaction, ensuring that racing
+	// instances don't attempt to create the same indexes concurrently
+	err = d.AcquireAdvisoryLock(CREATE_TABLE_ADVISORY, tx, false)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to acquire create table advisory lock for db %q: %w",
+			d.name,
+			err,
+		)
+	}
+
+	// defer releaseing the advisory lock
+	defer func() {
+		d.ReleaseAdvisdoryLock(CREATE_TABLE_ADVISORY, tx, false)
+	}()
+
+	for _, indexCmd := range indexCmds {
+		slog.Debug(
+			"generated sql create index command",
+			slog.String("db", d.name),
+			slog.String("table", table.Name),
+			slog.String("indexCmd", indexCmd),
+		)
+
+		if _, err = tx.Exec(indexCmd); err != nil {
+			slog.Error(
+				"create index failed",
+				slog.String("db", d.name),
+				slog.String("table", table.Name),
+				slog.String("indexCmd", indexCmd),
+				slog.String("error", err.Error()),
+			)
+			return fmt.Errorf(
+				"exec of create index for table %q in db %q failed: %w",
+				table.Name,
+				d.name,
+				err,
+			)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf(
+			"commit of create indexes for table %q in db %q failed: %w",
+			table.Name,
+			d.name,
+			err,
+		)
+	}
+
+	slog.Debug(
+		"ensured table indexes exist",
+		slog.String("db", d.name),
+		slog.String("table", table.Name),
+		slog.Int("indexes", len(indexCmds)),
+	)
+
+	return
+}
+
 func (d *DbConnection) EnsureTableSpecsExist(tables []*TableSpec) (err error) {
 	slog.Debug("Updating schemas", slog.String("database", d.name))
 
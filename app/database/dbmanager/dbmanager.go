@@ -66,6 +66,12 @@ func (t DbType) IsSqlite3() (isSqlite3 bool) {
 	return t == DB_TYPE_SQLITE3
 }
 
+// DB driver checks
+func (t DbType) UsesPgxDriver() bool {
+	dbDriver, err := t.DbDriver()
+	return err == nil && dbDriver == "pgx"
+}
+
 var dbDriver2Type = map[string]DbType{
 	"pgx":      DB_TYPE_PGX,
 	"postgres": DB_TYPE_POSTGRES,
@@ -0,0 +1,36 @@
+package dbmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// PgxCopyFrom uses the PostgreSQL COPY FROM protocol to bulk insert the
+// provided rows into the specified table columns, using the supplied raw
+// driver connection, as provided by sql.Conn.Raw(), which must be a pgx
+// stdlib connection.
+func PgxCopyFrom(driverConn any, table string, columns []string, rows [][]any) (copied int64, err error) {
+	stdlibConn, ok := driverConn.(*stdlib.Conn)
+	if !ok {
+		err = fmt.Errorf("unsupported driver connection type %T, not a pgx connection", driverConn)
+		return
+	}
+
+	// PostgreSQL folds unquoted identifiers to lower case, whereas the
+	// identifiers used by CopyFrom are quoted, so match the folded names
+	copyColumns := make([]string, len(columns))
+	for i, column := range columns {
+		copyColumns[i] = strings.ToLower(column)
+	}
+
+	return stdlibConn.Conn().CopyFrom(
+		context.Background(),
+		pgx.Identifier{strings.ToLower(table)},
+		copyColumns,
+		pgx.CopyFromRows(rows),
+	)
+}
@@ -14,3 +14,13 @@ func (dts DbTables) String() string {
 	}
 	return fmt.Sprintf("DbTables<%s>", strings.Join(names, ","))
 }
+
+// Find returns the spec of the named table, or nil if not found
+func (dts DbTables) Find(name string) *TableSpec {
+	for _, t := range dts {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// failedReports table specification
+// The failedReports table holds staged reports that repeatedly failed to
+// be processed, moved out of the reports table once the maximum number of
+// processing attempts has been reached, so that they can be inspected and
+// either requeued for processing or purged by an administrator.
+var failedReportsTableSpec = TableSpec{
+	Name: "failedReports",
+	Columns: []TableSpecColumn{
+		{Name: "id", Type: "INTEGER", PrimaryKey: true, Identity: true},
+		{Name: "clientId", Type: "VARCHAR"},
+		{Name: "reportId", Type: "VARCHAR"},
+		{Name: "data", Type: "TEXT"},
+		{Name: "lastError", Type: "VARCHAR"},
+		{Name: "attempts", Type: "INTEGER"},
+		{Name: "receivedAt", Type: "TIMESTAMPTZ"},
+		{Name: "failedAt", Type: "TIMESTAMPTZ"},
+	},
+}
+
+func GetFailedReportsTableSpec() *TableSpec {
+	return &failedReportsTableSpec
+}
+
+type FailedReportRow struct {
+	TableRowCommon
+
+	Id         int64     `json:"id"`
+	ClientId   string    `json:"clientId"`
+	ReportId   string    `json:"reportId"`
+	Data       any       `json:"data,omitempty"`
+	LastError  string    `json:"lastError"`
+	Attempts   int64     `json:"attempts"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	FailedAt   time.Time `json:"failedAt"`
+}
+
+func (f *FailedReportRow) InitFromStaged(r *ReportStagingTableRow, failedAt time.Time) {
+	f.ClientId = r.ClientId
+	f.ReportId = r.ReportId
+	f.Data = r.Data
+	f.LastError = r.LastError
+	f.Attempts = r.Attempts
+	f.ReceivedAt = r.ReceivedAt
+	f.FailedAt = failedAt
+}
+
+func (f *FailedReportRow) InitId(id int64) {
+	f.Id = id
+}
+
+func (f *FailedReportRow) SetupDB(adb *AppDb) error {
+	f.SetTableSpec(GetFailedReportsTableSpec())
+	return f.TableRowCommon.SetupDB(adb)
+}
+
+func (f *FailedReportRow) TableName() string {
+	return f.TableRowCommon.TableName()
+}
+
+func (f *FailedReportRow) RowId() int64 {
+	return f.Id
+}
+
+func (f *FailedReportRow) String() string {
+	bytes, _ := json.Marshal(f)
+	return string(bytes)
+}
+
+func (f *FailedReportRow) ReportIdentifer() string {
+	return fmt.Sprintf("reportId: %v, clientId: %v, receivedAt: %v", f.ReportId, f.ClientId, f.ReceivedAt)
+}
+
+// DataBytes returns the raw report body, which will have been retrieved
+// as either a []byte or a string depending on the DB driver
+func (f *FailedReportRow) DataBytes() (data []byte, err error) {
+	switch t := f.Data.(type) {
+	case []byte: // sqlite3
+		data = t
+	case string: // postgresql
+		data = []byte(t)
+	default:
+		err = fmt.Errorf("unsupported type: %T", t)
+	}
+	return
+}
+
+func (f *FailedReportRow) Exists() bool {
+	stmt, err := f.SelectStmt(
+		// select columns
+		[]string{
+			"clientId",
+			"reportId",
+			"data",
+			"lastError",
+			"attempts",
+			"receivedAt",
+			"failedAt",
+		},
+		// match columns
+		[]string{
+			"id",
+		},
+		SelectOpts{}, // no special options
+	)
+	if err != nil {
+		slog.Error(
+			"exists statement generation failed",
+			slog.String("table", f.TableName()),
+			slog.String("error", err.Error()),
+		)
+		panic(err)
+	}
+
+	row := f.Executor().QueryRow(stmt, f.Id)
+	// if the entry was found, all fields not used to find the entry will have
+	// been updated to match what is in the DB
+	if err := row.Scan(
+		&f.ClientId,
+		&f.ReportId,
+		&f.Data,
+		&f.LastError,
+		&f.Attempts,
+		&f.ReceivedAt,
+		&f.FailedAt,
+	); err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error(
+				"check for matching entry failed",
+				slog.String("table", f.TableName()),
+				slog.Int64("id", f.Id),
+				slog.String("error", err.Error()),
+			)
+		}
+		return false
+	}
+	return true
+}
+
+// List returns up to limit failed reports, ordered by id and skipping the
+// first offset entries. The report data is not retrieved.
+func (f *FailedReportRow) List(limit, offset uint) (reports []*FailedReportRow, err error) {
+	opts := SelectOpts{
+		OrderBy: "id",
+		Limit:   limit,
+		Offset:  offset,
+	}
+	stmt, err := f.SelectStmt(
+		[]string{
+			"id",
+			"clientId",
+			"reportId",
+			"lastError",
+			"attempts",
+			"receivedAt",
+			"failedAt",
+		},
+		nil,
+		opts,
+	)
+	if err != nil {
+		slog.Error(
+			"list statement generation failed",
+			slog.String("table", f.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := f.Executor().Query(stmt, opts.Args()...)
+	if err != nil {
+		slog.Error("failed reports query failed", slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		report := new(FailedReportRow)
+		if err = report.SetupDB(f.db); err != nil {
+			return nil, err
+		}
+
+		if err = rows.Scan(
+			&report.Id,
+			&report.ClientId,
+			&report.ReportId,
+			&report.LastError,
+			&report.Attempts,
+			&report.ReceivedAt,
+			&report.FailedAt,
+		); err != nil {
+			slog.Error("failed report retrieval failed", slog.String("error", err.Error()))
+			return nil, err
+		}
+
+		reports = append(reports, report)
+	}
+
+	if err = rows.Err(); err != nil {
+		slog.Error("failed reports iteration failed", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	return
+}
+
+func (f *FailedReportRow) insertCols() []string {
+	return []string{
+		"clientId",
+		"reportId",
+		"data",
+		"lastError",
+		"attempts",
+		"receivedAt",
+		"failedAt",
+	}
+}
+
+func (f *FailedReportRow) insertVals() []any {
+	return []any{
+		f.ClientId,
+		f.ReportId,
+		f.Data,
+		f.LastError,
+		f.Attempts,
+		DbTime(f.ReceivedAt),
+		DbTime(f.FailedAt),
+	}
+}
+
+func (f *FailedReportRow) Insert() (err error) {
+	stmt, err := f.InsertStmt(f.insertCols(), "id")
+	if err != nil {
+		slog.Error(
+			"insert statement generation failed",
+			slog.String("table", f.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := f.Executor().QueryRow(stmt, f.insertVals()...)
+	if err = row.Scan(
+		&f.Id,
+	); err != nil {
+		slog.Error(
+			"failed report insert failed",
+			slog.String("report", f.ReportIdentifer()),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (f *FailedReportRow) Update() (err error) {
+	stmt, err := f.UpdateStmt(
+		f.insertCols(),
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", f.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = f.Executor().Exec(stmt, append(f.insertVals(), f.Id)...)
+	if err != nil {
+		slog.Error(
+			"update failed",
+			slog.String("table", f.TableName()),
+			slog.Int64("id", f.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (f *FailedReportRow) Delete() (err error) {
+	stmt, err := f.DeleteStmt(
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", f.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = f.Executor().Exec(stmt, f.Id)
+	if err != nil {
+		slog.Error(
+			"delete failed",
+			slog.String("table", f.TableName()),
+			slog.Int64("id", f.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// Purge deletes all failed reports, returning the number deleted
+func (f *FailedReportRow) Purge() (purged int64, err error) {
+	stmt := "DELETE FROM " + f.TableName()
+
+	result, err := f.Executor().Exec(stmt)
+	if err != nil {
+		slog.Error(
+			"purge failed",
+			slog.String("table", f.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	return result.RowsAffected()
+}
+
+// Requeue moves the failed report back into the reports staging table, in
+// a single transaction, so that it will be processed again, returning the
+// new staging id.
+func (f *FailedReportRow) Requeue(staged *ReportStagingTableRow) (stagingId int64, err error) {
+	// initialise the staged report from the failed one, preserving the
+	// original received time
+	staged.Init(f.ClientId, f.ReportId, f.Data)
+	staged.ReceivedAt = DbTime(f.ReceivedAt)
+
+	insertStmt, err := staged.InsertStmt(staged.insertCols(), "id")
+	if err != nil {
+		slog.Error(
+			"insert statement generation failed",
+			slog.String("table", staged.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	deleteStmt, err := f.DeleteStmt(
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", f.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	TX, err := f.DB().Begin()
+	if err != nil {
+		slog.Error("transaction begin failed", slog.String("error", err.Error()))
+		return
+	}
+
+	defer func() {
+		if err := TX.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			slog.Error("requeue transaction rollback failed", slog.String("error", err.Error()))
+		}
+	}()
+
+	result, err := TX.Exec(deleteStmt, f.Id)
+	if err != nil {
+		slog.Error("failed report delete failed", slog.Int64("id", f.Id), slog.String("error", err.Error()))
+		return
+	}
+
+	// fail if the failed report was concurrently requeued or purged
+	if count, countErr := result.RowsAffected(); countErr != nil || count != 1 {
+		err = fmt.Errorf("failed report %d no longer exists", f.Id)
+		return
+	}
+
+	row := TX.QueryRow(insertStmt, staged.insertVals()...)
+	if err = row.Scan(&staged.Id); err != nil {
+		slog.Error("requeued report insert failed", slog.String("report", staged.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	if err = TX.Commit(); err != nil {
+		slog.Error("requeue transaction commit failed", slog.Int64("id", f.Id), slog.String("error", err.Error()))
+		return
+	}
+
+	stagingId = staged.Id
+
+	return
+}
+
+// verify that FailedReportRow conforms to the TableRowHandler interface
+var _ TableRowHandler = (*FailedReportRow)(nil)
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DbColumnInfo describes a table column as reported by the DB
+type DbColumnInfo struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+}
+
+// DbForeignKeyInfo describes a foreign key as reported by the DB
+type DbForeignKeyInfo struct {
+	Column           string `json:"column"`
+	ReferencedTable  string `json:"referencedTable"`
+	ReferencedColumn string `json:"referencedColumn"`
+}
+
+func (fk DbForeignKeyInfo) String() string {
+	return fmt.Sprintf("%s -> %s(%s)", fk.Column, fk.ReferencedTable, fk.ReferencedColumn)
+}
+
+// TableColumns retrieves the columns of the specified table, using the
+// information_schema for PostgreSQL and pragma table_info for SQLite.
+// Returns an empty list if the table doesn't exist.
+func (d *DbConnection) TableColumns(exec SqlExecutor, table string) (columns []DbColumnInfo, err error) {
+	var stmt string
+	var args []any
+
+	switch {
+	case d.dbMgr.Type().IsPostgres():
+		// PostgreSQL folds unquoted identifiers to lower case
+		stmt = `SELECT column_name, data_type, is_nullable = 'YES' ` +
+			`FROM information_schema.columns ` +
+			`WHERE table_schema = current_schema() AND table_name = $1 ` +
+			`ORDER BY ordinal_position`
+		args = []any{strings.ToLower(table)}
+	case d.dbMgr.Type().IsSqlite3():
+		stmt = `SELECT name, type, "notnull" = 0 FROM pragma_table_info(?) ORDER BY cid`
+		args = []any{table}
+	default:
+		return nil, fmt.Errorf("unsupported db type %q", d.dbMgr.Type())
+	}
+
+	rows, err := exec.Query(stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query columns of table %q: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var column DbColumnInfo
+		if err = rows.Scan(&column.Name, &column.Type, &column.Nullable); err != nil {
+			return nil, fmt.Errorf("failed to retrieve columns of table %q: %w", table, err)
+		}
+		columns = append(columns, column)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve columns of table %q: %w", table, err)
+	}
+
+	return
+}
+
+// TableForeignKeys retrieves the foreign keys of the specified table, using
+// the information_schema for PostgreSQL and pragma foreign_key_list for
+// SQLite.
+func (d *DbConnection) TableForeignKeys(exec SqlExecutor, table string) (foreignKeys []DbForeignKeyInfo, err error) {
+	var stmt string
+	var args []any
+
+	switch {
+	case d.dbMgr.Type().IsPostgres():
+		stmt = `SELECT kcu.column_name, ccu.table_name, ccu.column_name ` +
+			`FROM information_schema.table_constraints tc ` +
+			`JOIN information_schema.key_column_usage kcu ` +
+			`ON tc.constraint_name = kcu.constraint_name AND tc.table_schema = kcu.table_schema ` +
+			`JOIN information_schema.constraint_column_usage ccu ` +
+			`ON tc.constraint_name = ccu.constraint_name AND tc.table_schema = ccu.table_schema ` +
+			`WHERE tc.constraint_type = 'FOREIGN KEY' ` +
+			`AND tc.table_schema = current_schema() AND tc.table_name = $1`
+		args = []any{strings.ToLower(table)}
+	case d.dbMgr.Type().IsSqlite3():
+		stmt = `SELECT "from", "table", "to" FROM pragma_foreign_key_list(?)`
+		args = []any{table}
+	default:
+		return nil, fmt.Errorf("unsupported db type %q", d.dbMgr.Type())
+	}
+
+	rows, err := exec.Query(stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query foreign keys of table %q: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fk DbForeignKeyInfo
+		if err = rows.Scan(&fk.Column, &fk.ReferencedTable, &fk.ReferencedColumn); err != nil {
+			return nil, fmt.Errorf("failed to retrieve foreign keys of table %q: %w", table, err)
+		}
+		foreignKeys = append(foreignKeys, fk)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve foreign keys of table %q: %w", table, err)
+	}
+
+	return
+}
@@ -0,0 +1,572 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SUSE/telemetry/pkg/types"
+)
+
+// schemaVersions table specification
+// The schemaVersions table records the schema migrations that have been
+// applied to an AppDb.
+var schemaVersionsTableSpec = TableSpec{
+	Name: "schemaVersions",
+	Columns: []TableSpecColumn{
+		{Name: "version", Type: "INTEGER", PrimaryKey: true},
+		{Name: "description", Type: "VARCHAR"},
+		{Name: "appliedAt", Type: "TIMESTAMPTZ"},
+	},
+}
+
+func GetSchemaVersionsTableSpec() *TableSpec {
+	return &schemaVersionsTableSpec
+}
+
+// Migration is an ordered schema change that brings an existing DB up to
+// date with the current TableSpecs. Since tables are created from the
+// current TableSpecs before migrations are applied, Up must be idempotent,
+// e.g. only adding a column if it doesn't already exist.
+type Migration struct {
+	Version     int64
+	Description string
+	Up          func(m *MigrationTx) error
+}
+
+type Migrations []Migration
+
+// Latest returns the highest migration version, or 0 if there are none
+func (ms Migrations) Latest() (latest int64) {
+	for _, m := range ms {
+		latest = max(latest, m.Version)
+	}
+	return
+}
+
+// Validate ensures that migration versions are positive and unique
+func (ms Migrations) Validate() error {
+	seen := map[int64]bool{}
+	for _, m := range ms {
+		if m.Version <= 0 {
+			return fmt.Errorf("invalid migration version %d, must be greater than 0", m.Version)
+		}
+		if seen[m.Version] {
+			return fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+		if m.Up == nil {
+			return fmt.Errorf("migration version %d has no Up function", m.Version)
+		}
+		seen[m.Version] = true
+	}
+	return nil
+}
+
+// Sorted returns the migrations ordered by version
+func (ms Migrations) Sorted() Migrations {
+	sorted := slices.Clone(ms)
+	slices.SortFunc(sorted, func(a, b Migration) int {
+		switch {
+		case a.Version < b.Version:
+			return -1
+		case a.Version > b.Version:
+			return 1
+		}
+		return 0
+	})
+	return sorted
+}
+
+// MigrationTx is the transaction within which a migration is applied,
+// providing helpers for common schema changes
+type MigrationTx struct {
+	*sql.Tx
+
+	// private
+	conn *DbConnection
+}
+
+func (m *MigrationTx) Conn() *DbConnection {
+	return m.conn
+}
+
+// ColumnExists checks if the named column exists in the specified table
+func (m *MigrationTx) ColumnExists(table, column string) (exists bool, err error) {
+	columns, err := m.conn.TableColumns(m.Tx, table)
+	if err != nil {
+		return
+	}
+
+	// identifiers are case insensitive for both PostgreSQL and SQLite
+	exists = slices.ContainsFunc(columns, func(c DbColumnInfo) bool {
+		return strings.EqualFold(c.Name, column)
+	})
+
+	return
+}
+
+// AddColumn adds the named column, as defined in the specified TableSpec,
+// to the table if it doesn't already exist
+func (m *MigrationTx) AddColumn(ts *TableSpec, column string) (err error) {
+	ind := slices.IndexFunc(ts.Columns, func(c TableSpecColumn) bool {
+		return c.Name == column
+	})
+	if ind == -1 {
+		return fmt.Errorf("column %q not part of table %q", column, ts.Name)
+	}
+
+	col := ts.Columns[ind]
+	if col.PrimaryKey || col.Identity {
+		return fmt.Errorf("cannot add primary key or identity column %q to table %q", column, ts.Name)
+	}
+
+	exists, err := m.ColumnExists(ts.Name, column)
+	if err != nil {
+		return fmt.Errorf("failed to check if column %q exists in table %q: %w", column, ts.Name, err)
+	}
+	if exists {
+		slog.Debug(
+			"column already exists",
+			slog.String("db", m.conn.name),
+			slog.String("table", ts.Name),
+			slog.String("column", column),
+		)
+		return
+	}
+
+	stmt := "ALTER TABLE " + ts.Name + " ADD COLUMN " + col.Create(m.conn)
+	if _, err = m.Exec(stmt); err != nil {
+		return fmt.Errorf("failed to add column %q to table %q: %w", column, ts.Name, err)
+	}
+
+	slog.Info(
+		"added column",
+		slog.String("db", m.conn.name),
+		slog.String("table", ts.Name),
+		slog.String("column", column),
+	)
+
+	return
+}
+
+// ConvertTimestampColumns converts the named columns, defined with the
+// TIMESTAMPTZ type in the specified TableSpec, from the VARCHAR type that
+// previously held their RFC 3339 timestamp strings, skipping any that have
+// already been converted. Since some of these values, e.g. telemetry data
+// timestamps, were supplied by clients, empty or invalid values don't fail
+// the conversion; they are converted to NULL for nullable columns, and to
+// TimestampFallback otherwise, logging each invalid value with its row id.
+// PostgreSQL columns are altered in place, once any such values have been
+// replaced, whereas SQLite, which cannot change the type of an existing
+// column, has the values rewritten in the driver's timestamp format before
+// the table is rebuilt from its TableSpec.
+func (m *MigrationTx) ConvertTimestampColumns(ts *TableSpec, columns ...string) (err error) {
+	actualColumns, err := m.conn.TableColumns(m.Tx, ts.Name)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve columns of table %q: %w", ts.Name, err)
+	}
+
+	// the primary key column identifies the rows whose values are rewritten
+	keyInd := slices.IndexFunc(ts.Columns, func(c TableSpecColumn) bool {
+		return c.PrimaryKey
+	})
+	if keyInd == -1 {
+		return fmt.Errorf("table %q has no primary key column", ts.Name)
+	}
+	key := ts.Columns[keyInd].Name
+
+	var pending []TableSpecColumn
+	for _, column := range columns {
+		ind := slices.IndexFunc(ts.Columns, func(c TableSpecColumn) bool {
+			return c.Name == column
+		})
+		if ind == -1 {
+			return fmt.Errorf("column %q not part of table %q", column, ts.Name)
+		}
+
+		col := ts.Columns[ind]
+		if !strings.EqualFold(col.Type, "TIMESTAMPTZ") {
+			return fmt.Errorf("column %q of table %q is not a TIMESTAMPTZ column", column, ts.Name)
+		}
+
+		// identifiers are case insensitive for both PostgreSQL and SQLite
+		actualInd := slices.IndexFunc(actualColumns, func(c DbColumnInfo) bool {
+			return strings.EqualFold(c.Name, column)
+		})
+		if actualInd == -1 {
+			return fmt.Errorf("column %q not found in table %q", column, ts.Name)
+		}
+
+		if canonicalColumnType(actualColumns[actualInd].Type) == canonicalColumnType(col.DbType(m.conn)) {
+			slog.Debug(
+				"column already converted",
+				slog.String("db", m.conn.name),
+				slog.String("table", ts.Name),
+				slog.String("column", column),
+			)
+			continue
+		}
+
+		pending = append(pending, col)
+	}
+
+	switch {
+	case m.conn.dbMgr.Type().IsPostgres():
+		for _, col := range pending {
+			if err = m.rewriteTimestamps(ts.Name, key, col, false); err != nil {
+				return fmt.Errorf("failed to convert column %q of table %q: %w", col.Name, ts.Name, err)
+			}
+			stmt := "ALTER TABLE " + ts.Name + " ALTER COLUMN " + col.Name +
+				" TYPE TIMESTAMPTZ USING " + col.Name + "::timestamptz"
+			if _, err = m.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to convert column %q of table %q: %w", col.Name, ts.Name, err)
+			}
+		}
+	case m.conn.dbMgr.Type().IsSqlite3():
+		for _, col := range pending {
+			if err = m.rewriteTimestamps(ts.Name, key, col, true); err != nil {
+				return fmt.Errorf("failed to convert column %q of table %q: %w", col.Name, ts.Name, err)
+			}
+		}
+		if len(pending) > 0 {
+			if err = m.rebuildTable(ts, actualColumns); err != nil {
+				return
+			}
+		}
+	default:
+		return fmt.Errorf("timestamp column conversion not supported for db %q", m.conn.name)
+	}
+
+	if len(pending) == 0 {
+		return
+	}
+
+	names := make([]string, len(pending))
+	for i, col := range pending {
+		names[i] = col.Name
+	}
+
+	slog.Info(
+		"converted timestamp columns",
+		slog.String("db", m.conn.name),
+		slog.String("table", ts.Name),
+		slog.Any("columns", names),
+	)
+
+	return
+}
+
+// TimestampFallback is the time to which ConvertTimestampColumns converts
+// the empty or invalid values of columns that cannot be NULL, and which
+// telemetry data items with invalid timestamps are otherwise stored with,
+// i.e. the Unix epoch, so that such values sort first and are easily
+// identified
+var TimestampFallback = time.Unix(0, 0).UTC()
+
+// timestampRewriteBatchSize is the number of values that rewriteTimestamps
+// retrieves at a time
+const timestampRewriteBatchSize = 1000
+
+// rewriteTimestamps prepares the RFC 3339 timestamp strings held in the
+// table's column for conversion, replacing empty or invalid values with NULL
+// if the column is nullable, or TimestampFallback otherwise, logging each
+// invalid value. If native is true then valid values are also rewritten as
+// the UTC time.Time values they represent, which the SQLite driver stores in
+// its own timestamp format, and replacements are stored as time.Time values,
+// otherwise only replacements are written, as RFC 3339 strings. Rows are
+// identified by the table's key column, an integer primary key.
+func (m *MigrationTx) rewriteTimestamps(table, key string, col TableSpecColumn, native bool) (err error) {
+	type timestampValue struct {
+		id    int64
+		value any
+	}
+
+	// replacement returns the value that replaces an empty or invalid value
+	replacement := func() any {
+		switch {
+		case col.Nullable:
+			return nil
+		case native:
+			return TimestampFallback
+		default:
+			return TimestampFallback.Format(time.RFC3339Nano)
+		}
+	}
+
+	var replaced int64
+
+	// retrieve the next batch of values following the cursor, returning
+	// the number of rows scanned and the id of the last one
+	nextBatch := func(cursor int64) (values []timestampValue, scanned int, lastId int64, err error) {
+		ph := m.conn.Placeholder(1)
+		stmt := "SELECT " + key + ", " + col.Name + " FROM " + table + " WHERE " + key + " > " + ph.Next() +
+			fmt.Sprintf(" ORDER BY %s LIMIT %d", key, timestampRewriteBatchSize)
+
+		rows, err := m.Query(stmt, cursor)
+		if err != nil {
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var value sql.NullString
+			if err = rows.Scan(&lastId, &value); err != nil {
+				return
+			}
+			scanned += 1
+
+			if !value.Valid {
+				// already NULL
+				continue
+			}
+
+			if value.String == "" {
+				replaced += 1
+				values = append(values, timestampValue{id: lastId, value: replacement()})
+				continue
+			}
+
+			timestamp, parseErr := types.TimeStampFromString(value.String)
+			if parseErr != nil {
+				slog.Warn(
+					"replacing invalid timestamp",
+					slog.String("db", m.conn.name),
+					slog.String("table", table),
+					slog.String("column", col.Name),
+					slog.Int64("id", lastId),
+					slog.String("value", value.String),
+					slog.Any("replacement", replacement()),
+				)
+				replaced += 1
+				values = append(values, timestampValue{id: lastId, value: replacement()})
+				continue
+			}
+
+			if native {
+				values = append(values, timestampValue{id: lastId, value: DbTime(timestamp.Time)})
+			}
+		}
+
+		err = rows.Err()
+
+		return
+	}
+
+	ph := m.conn.Placeholder(2)
+	updateStmt := "UPDATE " + table + " SET " + col.Name + " = " + ph.Next() + " WHERE " + key + " = " + ph.Next()
+
+	// keys are positive, so start below the lowest
+	var cursor int64 = -1
+	for {
+		values, scanned, lastId, batchErr := nextBatch(cursor)
+		if batchErr != nil {
+			return batchErr
+		}
+
+		for _, v := range values {
+			if _, err = m.Exec(updateStmt, v.value, v.id); err != nil {
+				return fmt.Errorf("failed to rewrite timestamp for id %d: %w", v.id, err)
+			}
+		}
+
+		if scanned < timestampRewriteBatchSize {
+			break
+		}
+		cursor = lastId
+	}
+
+	if replaced > 0 {
+		slog.Warn(
+			"replaced empty or invalid timestamps",
+			slog.String("db", m.conn.name),
+			slog.String("table", table),
+			slog.String("column", col.Name),
+			slog.Int64("count", replaced),
+		)
+	}
+
+	return
+}
+
+// rebuildTable recreates the table from its TableSpec, copying the values
+// of the columns that it shares with the existing table, since SQLite
+// cannot change the type of an existing column
+func (m *MigrationTx) rebuildTable(ts *TableSpec, actualColumns []DbColumnInfo) (err error) {
+	rebuilt := *ts
+	rebuilt.Name = ts.Name + "_rebuild"
+	// indexes are named after their table, so are created after the rename
+	rebuilt.Indexes = nil
+
+	createCmd, err := rebuilt.CreateCmd(m.conn)
+	if err != nil {
+		return fmt.Errorf("failed to generate create command for table %q: %w", rebuilt.Name, err)
+	}
+
+	indexCmds, err := ts.IndexCmds(m.conn)
+	if err != nil {
+		return fmt.Errorf("failed to generate index commands for table %q: %w", ts.Name, err)
+	}
+
+	var copyCols []string
+	for _, col := range ts.Columns {
+		if slices.ContainsFunc(actualColumns, func(c DbColumnInfo) bool {
+			return strings.EqualFold(c.Name, col.Name)
+		}) {
+			copyCols = append(copyCols, col.Name)
+		}
+	}
+	cols := strings.Join(copyCols, ", ")
+
+	stmts := []string{
+		createCmd,
+		"INSERT INTO " + rebuilt.Name + " (" + cols + ") SELECT " + cols + " FROM " + ts.Name,
+		"DROP TABLE " + ts.Name,
+		"ALTER TABLE " + rebuilt.Name + " RENAME TO " + ts.Name,
+	}
+	stmts = append(stmts, indexCmds...)
+
+	for _, stmt := range stmts {
+		if _, err = m.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to rebuild table %q: %w", ts.Name, err)
+		}
+	}
+
+	slog.Info(
+		"rebuilt table",
+		slog.String("db", m.conn.name),
+		slog.String("table", ts.Name),
+	)
+
+	return
+}
+
+// SchemaVersion returns the highest applied migration version, or 0 if no
+// migrations have been applied
+func (d *DbConnection) SchemaVersion(exec SqlExecutor) (version int64, err error) {
+	var current sql.NullInt64
+
+	row := exec.QueryRow("SELECT MAX(version) FROM " + schemaVersionsTableSpec.Name)
+	if err = row.Scan(&current); err != nil {
+		return
+	}
+
+	version = current.Int64
+
+	return
+}
+
+// applyNextMigration applies the first migration newer than the DB's schema
+// version within a transaction, holding the create table advisory lock to
+// ensure that concurrently starting instances don't race to apply it.
+// Returns the DB's schema version after the attempt.
+func (d *DbConnection) applyNextMigration(migrations Migrations) (version int64, applied bool, err error) {
+	tx, err := d.DB().Begin()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to begin migration transaction: %w", err)
+	}
+
+	// rollback any changes if we fail to commit the transaction
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			slog.Warn(
+				"failed to rollback migration transaction",
+				slog.String("db", d.name),
+				slog.String("error", err.Error()),
+			)
+		}
+	}()
+
+	if err = d.AcquireAdvisoryLock(CREATE_TABLE_ADVISORY, tx, false); err != nil {
+		return 0, false, fmt.Errorf("failed to acquire create table advisory lock: %w", err)
+	}
+	defer d.ReleaseAdvisdoryLock(CREATE_TABLE_ADVISORY, tx, false)
+
+	// determine the current version now that we hold the lock, as another
+	// instance may have applied migrations in the meantime
+	if version, err = d.SchemaVersion(tx); err != nil {
+		return 0, false, fmt.Errorf("failed to determine schema version: %w", err)
+	}
+
+	latest := migrations.Latest()
+	if version > latest {
+		return version, false, fmt.Errorf(
+			"db %q schema version %d is newer than the latest version %d supported by this binary",
+			d.name,
+			version,
+			latest,
+		)
+	}
+
+	ind := slices.IndexFunc(migrations, func(m Migration) bool {
+		return m.Version > version
+	})
+	if ind == -1 {
+		// no migrations remain to be applied
+		return
+	}
+	migration := migrations[ind]
+
+	slog.Info(
+		"applying schema migration",
+		slog.String("db", d.name),
+		slog.Int64("version", migration.Version),
+		slog.String("description", migration.Description),
+	)
+
+	if err = migration.Up(&MigrationTx{Tx: tx, conn: d}); err != nil {
+		return version, false, fmt.Errorf(
+			"schema migration %d (%s) failed: %w",
+			migration.Version,
+			migration.Description,
+			err,
+		)
+	}
+
+	ph := d.Placeholder(3)
+	recordStmt := "INSERT INTO " + schemaVersionsTableSpec.Name +
+		"(version, description, appliedAt) VALUES(" + ph.Next() + ", " + ph.Next() + ", " + ph.Next() + ")"
+	if _, err = tx.Exec(recordStmt, migration.Version, migration.Description, DbNow()); err != nil {
+		return version, false, fmt.Errorf("failed to record schema migration %d: %w", migration.Version, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return version, false, fmt.Errorf("failed to commit schema migration %d: %w", migration.Version, err)
+	}
+
+	return migration.Version, true, nil
+}
+
+// ApplyMigrations applies, in order, any migrations that are newer than the
+// DB's current schema version, failing if the DB's schema version is newer
+// than the latest known migration
+func (d *DbConnection) ApplyMigrations(migrations Migrations) (err error) {
+	if err = migrations.Validate(); err != nil {
+		return fmt.Errorf("invalid migrations for db %q: %w", d.name, err)
+	}
+	sorted := migrations.Sorted()
+
+	for {
+		version, applied, applyErr := d.applyNextMigration(sorted)
+		if applyErr != nil {
+			slog.Error(
+				"schema migration failed",
+				slog.String("db", d.name),
+				slog.Int64("version", version),
+				slog.String("error", applyErr.Error()),
+			)
+			return applyErr
+		}
+
+		if !applied {
+			slog.Info(
+				"schema is up to date",
+				slog.String("db", d.name),
+				slog.Int64("version", version),
+			)
+			return
+		}
+	}
+}
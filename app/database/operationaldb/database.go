@@ -8,18 +8,85 @@ import (
 // Operational DB Tables
 var operationalDbTables = database.DbTables{
 	database.GetReportsStagingTableSpec(),
+	database.GetFailedReportsTableSpec(),
+	database.GetProcessedReportsTableSpec(),
 	database.GetClientsTableSpec(),
+	database.GetCloneSignalsTableSpec(),
+	database.GetTokenRevocationsTableSpec(),
+	database.GetClientActivityTableSpec(),
 }
 
 func GetTables() database.DbTables {
 	return operationalDbTables
 }
 
+// Operational DB schema migrations, in version order; new entries must
+// only ever be appended
+var operationalDbMigrations = database.Migrations{
+	{
+		Version:     1,
+		Description: "add reports staging retry and clients clone detection columns",
+		Up: func(m *database.MigrationTx) (err error) {
+			for _, addition := range []struct {
+				ts      *database.TableSpec
+				columns []string
+			}{
+				{database.GetReportsStagingTableSpec(), []string{"attempts", "lastError"}},
+				{database.GetClientsTableSpec(), []string{"cloneSuspected", "cloneSuspectedAt"}},
+			} {
+				for _, column := range addition.columns {
+					if err = m.AddColumn(addition.ts, column); err != nil {
+						return
+					}
+				}
+			}
+			return
+		},
+	},
+	{
+		Version:     2,
+		Description: "convert clients and reports staging timestamp columns to TIMESTAMPTZ",
+		Up: func(m *database.MigrationTx) (err error) {
+			if err = m.ConvertTimestampColumns(database.GetClientsTableSpec(), "registrationDate"); err != nil {
+				return
+			}
+			return m.ConvertTimestampColumns(database.GetReportsStagingTableSpec(), "receivedAt", "allocatedAt")
+		},
+	},
+	{
+		Version:     3,
+		Description: "add clientActivity entries for existing clients",
+		Up: func(m *database.MigrationTx) (err error) {
+			// existing registrations are treated as first, and last, active
+			// when they registered, so that never active clients can be
+			// identified
+			_, err = m.Exec(
+				`INSERT INTO clientActivity(registrationId, firstSeenAt, lastActiveAt, reportCount, authenticationCount) ` +
+					`SELECT id, registrationDate, registrationDate, 0, 0 FROM clients ` +
+					`WHERE id NOT IN (SELECT registrationId FROM clientActivity)`,
+			)
+			return
+		},
+	},
+	{
+		Version:     4,
+		Description: "add reports staging registrationId column",
+		Up: func(m *database.MigrationTx) (err error) {
+			return m.AddColumn(database.GetReportsStagingTableSpec(), "registrationId")
+		},
+	},
+}
+
+func GetMigrations() database.Migrations {
+	return operationalDbMigrations
+}
+
 // Get a new Operational AppDb instance
 func New(cfg *config.Config) (*database.AppDb, error) {
 	return database.GetDb(
 		"Operational",
 		&cfg.DataBases.Operational,
 		GetTables(),
+		GetMigrations(),
 	)
 }
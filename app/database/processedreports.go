@@ -0,0 +1,462 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// processedReports table specification
+// The processedReports table is a ledger of the reports that have been
+// accepted for processing, recording the response returned to the client
+// so that resubmissions of the same report can be recognised and answered
+// with the original response without processing the report again. Entries
+// are keyed by the registration that submitted the report, rather than the
+// clientId claimed by the report, so that a client cannot retrieve, or
+// block, the reports of other clients. An entry
+// is reserved, as pending, before its report is processed, so that only the
+// request that reserved it processes the report; the processedAt time of a
+// pending entry is the time at which it was reserved.
+var processedReportsTableSpec = TableSpec{
+	Name: "processedReports",
+	Columns: []TableSpecColumn{
+		{Name: "id", Type: "INTEGER", PrimaryKey: true, Identity: true},
+		{Name: "registrationId", Type: "INTEGER"},
+		{Name: "reportId", Type: "VARCHAR"},
+		{Name: "processingId", Type: "INTEGER"},
+		{Name: "processedAt", Type: "TIMESTAMPTZ"},
+		{Name: "pending", Type: "BOOLEAN", Default: "false"},
+	},
+	Extras: []string{
+		"UNIQUE (registrationId, reportId)",
+	},
+}
+
+func GetProcessedReportsTableSpec() *TableSpec {
+	return &processedReportsTableSpec
+}
+
+type ProcessedReportRow struct {
+	TableRowCommon
+
+	Id             int64     `json:"id"`
+	RegistrationId int64     `json:"registrationId"`
+	ReportId       string    `json:"reportId"`
+	ProcessingId   int64     `json:"processingId"`
+	ProcessedAt    time.Time `json:"processedAt"`
+	Pending        bool      `json:"pending"`
+}
+
+func (p *ProcessedReportRow) Init(registrationId int64, reportId string) {
+	p.RegistrationId = registrationId
+	p.ReportId = reportId
+}
+
+func (p *ProcessedReportRow) InitResponse(processingId int64, processedAt time.Time) {
+	p.ProcessingId = processingId
+	p.ProcessedAt = processedAt
+}
+
+func (p *ProcessedReportRow) SetupDB(adb *AppDb) error {
+	p.SetTableSpec(GetProcessedReportsTableSpec())
+	return p.TableRowCommon.SetupDB(adb)
+}
+
+func (p *ProcessedReportRow) TableName() string {
+	return p.TableRowCommon.TableName()
+}
+
+func (p *ProcessedReportRow) RowId() int64 {
+	return p.Id
+}
+
+func (p *ProcessedReportRow) String() string {
+	bytes, _ := json.Marshal(p)
+	return string(bytes)
+}
+
+func (p *ProcessedReportRow) ReportIdentifer() string {
+	return fmt.Sprintf("reportId: %v, registrationId: %v", p.ReportId, p.RegistrationId)
+}
+
+func (p *ProcessedReportRow) Exists() bool {
+	stmt, err := p.SelectStmt(
+		// select columns
+		[]string{
+			"id",
+			"processingId",
+			"processedAt",
+			"pending",
+		},
+		// match columns
+		[]string{
+			"registrationId",
+			"reportId",
+		},
+		SelectOpts{}, // no special options
+	)
+	if err != nil {
+		slog.Error(
+			"exists statement generation failed",
+			slog.String("table", p.TableName()),
+			slog.String("error", err.Error()),
+		)
+		panic(err)
+	}
+
+	row := p.Executor().QueryRow(stmt, p.RegistrationId, p.ReportId)
+	// if the entry was found, all fields not used to find the entry will have
+	// been updated to match what is in the DB
+	if err := row.Scan(
+		&p.Id,
+		&p.ProcessingId,
+		&p.ProcessedAt,
+		&p.Pending,
+	); err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error(
+				"check for matching entry failed",
+				slog.String("table", p.TableName()),
+				slog.String("report", p.ReportIdentifer()),
+				slog.String("error", err.Error()),
+			)
+		}
+		return false
+	}
+	return true
+}
+
+func (p *ProcessedReportRow) Insert() (err error) {
+	stmt, err := p.InsertStmt(
+		[]string{
+			"registrationId",
+			"reportId",
+			"processingId",
+			"processedAt",
+		},
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"insert statement generation failed",
+			slog.String("table", p.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := p.Executor().QueryRow(
+		stmt,
+		p.RegistrationId,
+		p.ReportId,
+		p.ProcessingId,
+		DbTime(p.ProcessedAt),
+	)
+	if err = row.Scan(
+		&p.Id,
+	); err != nil {
+		slog.Error(
+			"insert failed",
+			slog.String("table", p.TableName()),
+			slog.String("report", p.ReportIdentifer()),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (p *ProcessedReportRow) Update() (err error) {
+	stmt, err := p.UpdateStmt(
+		[]string{
+			"processingId",
+			"processedAt",
+		},
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", p.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = p.Executor().Exec(
+		stmt,
+		p.ProcessingId,
+		DbTime(p.ProcessedAt),
+		p.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"update failed",
+			slog.String("table", p.TableName()),
+			slog.String("report", p.ReportIdentifer()),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (p *ProcessedReportRow) Delete() (err error) {
+	stmt, err := p.DeleteStmt(
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", p.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = p.Executor().Exec(
+		stmt,
+		p.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"delete failed",
+			slog.String("table", p.TableName()),
+			slog.Int64("id", p.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// Reserve inserts a pending entry for the report, reserved at the current
+// time, returning false, without an error, if an entry already exists for
+// the report, in which case use Exists() to load it
+func (p *ProcessedReportRow) Reserve() (reserved bool, err error) {
+	stmt, err := p.UpsertStmt(
+		[]string{
+			"registrationId",
+			"reportId",
+			"processingId",
+			"processedAt",
+			"pending",
+		},
+		[]string{
+			"registrationId",
+			"reportId",
+		},
+		"",
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"upsert statement generation failed",
+			slog.String("table", p.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	p.ProcessingId = 0
+	p.ProcessedAt = DbNow()
+	p.Pending = true
+
+	row := p.Executor().QueryRow(
+		stmt,
+		p.RegistrationId,
+		p.ReportId,
+		p.ProcessingId,
+		p.ProcessedAt,
+		p.Pending,
+	)
+	if err = row.Scan(
+		&p.Id,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			// an entry already exists for the report
+			return false, nil
+		}
+		slog.Error(
+			"reserve failed",
+			slog.String("table", p.TableName()),
+			slog.String("report", p.ReportIdentifer()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	return true, nil
+}
+
+// pendingUpdate updates the specified columns only if the entry is still
+// pending with the reservation time at which it was retrieved, returning
+// false if it has since been completed, released or taken over
+func (p *ProcessedReportRow) pendingUpdate(updateCols []string, updateVals ...any) (updated bool, err error) {
+	stmt, err := p.UpdateStmt(
+		updateCols,
+		[]string{
+			"id",
+			"pending",
+			"processedAt",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", p.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := p.Executor().Exec(stmt, append(updateVals, p.Id, true, DbTime(p.ProcessedAt))...)
+	if err != nil {
+		slog.Error("processed report update failed", slog.String("report", p.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		slog.Error("processed report update count unavailable", slog.String("report", p.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	updated = count == 1
+
+	return
+}
+
+// TakeOver reserves a pending entry whose reservation has expired, e.g.
+// because the request processing its report was lost, returning false if
+// the entry has since been completed, released or taken over by another
+// request
+func (p *ProcessedReportRow) TakeOver() (reserved bool, err error) {
+	reservedAt := DbNow()
+	if reserved, err = p.pendingUpdate([]string{"processedAt"}, reservedAt); reserved {
+		p.ProcessedAt = reservedAt
+	}
+
+	return
+}
+
+// Complete records the response returned for the reserved entry's report,
+// returning false if the reservation has since been released or taken over
+func (p *ProcessedReportRow) Complete(processingId int64, processedAt time.Time) (completed bool, err error) {
+	completed, err = p.pendingUpdate(
+		[]string{
+			"processingId",
+			"processedAt",
+			"pending",
+		},
+		processingId,
+		DbTime(processedAt),
+		false,
+	)
+	if completed {
+		p.InitResponse(processingId, processedAt)
+		p.Pending = false
+	}
+
+	return
+}
+
+// Release deletes the reserved entry, e.g. because its report could not be
+// processed, so that a resubmission of the report will be processed again,
+// returning false if the reservation has since been taken over
+func (p *ProcessedReportRow) Release() (released bool, err error) {
+	stmt, err := p.DeleteStmt(
+		[]string{
+			"id",
+			"pending",
+			"processedAt",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", p.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := p.Executor().Exec(stmt, p.Id, true, DbTime(p.ProcessedAt))
+	if err != nil {
+		slog.Error("processed report release failed", slog.String("report", p.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		slog.Error("processed report release count unavailable", slog.String("report", p.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	released = count == 1
+
+	return
+}
+
+// Prune deletes up to limit entries processed before the specified time,
+// including pending entries reserved before then, which would otherwise
+// only be removed if their reports were resubmitted, returning the number
+// deleted
+func (p *ProcessedReportRow) Prune(before time.Time, limit uint) (deleted int64, err error) {
+	opts := SelectOpts{
+		OrderBy: "id",
+		Limit:   limit,
+		Where: []WhereCond{
+			{Column: "processedAt", Op: WHERE_OP_LT},
+		},
+	}
+	stmt, err := p.SelectStmt(
+		[]string{
+			"id",
+		},
+		nil,
+		opts,
+	)
+	if err != nil {
+		slog.Error(
+			"prune statement generation failed",
+			slog.String("table", p.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := p.Executor().Query(stmt, opts.Args(DbTime(before))...)
+	if err != nil {
+		slog.Error("processed reports prune query failed", slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	return p.DeleteIds(ids)
+}
+
+// verify that ProcessedReportRow conforms to the TableRowHandler interface
+var _ TableRowHandler = (*ProcessedReportRow)(nil)
@@ -2,10 +2,10 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
-
-	"github.com/SUSE/telemetry/pkg/types"
+	"time"
 )
 
 var reportsStagingTableSpec = TableSpec{
@@ -15,9 +15,17 @@ var reportsStagingTableSpec = TableSpec{
 		{Name: "clientId", Type: "VARCHAR"},
 		{Name: "reportId", Type: "VARCHAR"},
 		{Name: "data", Type: "TEXT"},
-		{Name: "receivedAt", Type: "VARCHAR"},
+		{Name: "receivedAt", Type: "TIMESTAMPTZ"},
 		{Name: "allocated", Type: "BOOLEAN", Default: "false"},
-		{Name: "allocatedAt", Type: "VARCHAR", Nullable: true},
+		{Name: "allocatedAt", Type: "TIMESTAMPTZ", Nullable: true},
+		{Name: "attempts", Type: "INTEGER", Default: "0"},
+		{Name: "lastError", Type: "VARCHAR", Default: "''"},
+		// the registration that submitted the report, unknown for reports
+		// staged before it was recorded, or requeued failed reports
+		{Name: "registrationId", Type: "INTEGER", Nullable: true},
+	},
+	Indexes: []TableSpecIndex{
+		{Columns: []string{"allocated"}},
 	},
 }
 
@@ -28,20 +36,25 @@ func GetReportsStagingTableSpec() *TableSpec {
 type ReportStagingTableRow struct {
 	TableRowCommon
 
-	Id          int64  `json:"id"`
-	ClientId    string `json:"clientId"`
-	ReportId    string `json:"reportId"`
-	Data        any    `json:"data"`
-	ReceivedAt  string `json:"receivedAt"`
-	Allocated   bool   `json:"allocated"`
-	AllocatedAt string `json:"allocatedAt"`
+	Id         int64     `json:"id"`
+	ClientId   string    `json:"clientId"`
+	ReportId   string    `json:"reportId"`
+	Data       any       `json:"data"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	Allocated  bool      `json:"allocated"`
+	// nil if the report is not allocated
+	AllocatedAt *time.Time `json:"allocatedAt"`
+	Attempts    int64      `json:"attempts"`
+	LastError   string     `json:"lastError"`
+	// 0 if the submitting registration is unknown
+	RegistrationId int64 `json:"registrationId,omitempty"`
 }
 
 func (r *ReportStagingTableRow) Init(clientId, reportId string, data any) {
 	r.ClientId = clientId
 	r.ReportId = reportId
 	r.Data = data
-	r.ReceivedAt = types.Now().String()
+	r.ReceivedAt = DbNow()
 }
 
 func (r *ReportStagingTableRow) SetupDB(adb *AppDb) error {
@@ -73,7 +86,7 @@ func (r *ReportStagingTableRow) Exists() bool {
 		panic(err)
 	}
 
-	row := r.DB().QueryRow(
+	row := r.Executor().QueryRow(
 		stmt,
 		r.ClientId,
 		r.ReportId,
@@ -88,6 +101,25 @@ func (r *ReportStagingTableRow) Exists() bool {
 }
 
 func (r *ReportStagingTableRow) FirstUnallocated() bool {
+	for {
+		found, allocated := r.allocateFirstUnallocated()
+		if !found {
+			return false
+		}
+
+		if allocated {
+			return true
+		}
+
+		// another worker allocated the same report first, so try again
+		slog.Debug("staged report allocated concurrently, retrying", slog.Int64("id", r.Id))
+	}
+}
+
+func (r *ReportStagingTableRow) allocateFirstUnallocated() (found, allocated bool) {
+	opts := SelectOpts{
+		Limit: 1,
+	}
 	queryStmt, err := r.SelectStmt(
 		[]string{
 			"id",
@@ -95,13 +127,12 @@ func (r *ReportStagingTableRow) FirstUnallocated() bool {
 			"reportId",
 			"data",
 			"receivedAt",
+			"attempts",
 		},
 		[]string{
 			"allocated",
 		},
-		SelectOpts{
-			Limit: 1,
-		},
+		opts,
 	)
 	if err != nil {
 		slog.Error(
@@ -112,13 +143,17 @@ func (r *ReportStagingTableRow) FirstUnallocated() bool {
 		panic(err)
 	}
 
+	// only update the entry if it is still unallocated, ensuring that
+	// concurrent workers cannot both allocate the same report
 	updateStmt, err := r.UpdateStmt(
 		[]string{
 			"allocated",
 			"allocatedAt",
+			"attempts",
 		},
 		[]string{
 			"id",
+			"allocated",
 		},
 	)
 	if err != nil {
@@ -130,93 +165,369 @@ func (r *ReportStagingTableRow) FirstUnallocated() bool {
 		panic(err)
 	}
 
-	// begin a transaction
-	TX, err := r.DB().Begin()
-	if err != nil {
-		slog.Error("transaction begin failed", slog.String("error", err.Error()))
-		return false
-	}
-
-	// retrieve the first unallocated report from the table, returning false if none was found
-	row := TX.QueryRow(
+	// retrieve the first unallocated report from the table, returning false if none was found;
+	// no transaction is used since the conditional update below ensures that only one worker
+	// can allocate a given report, and upgrading a read transaction to a write transaction
+	// fails immediately, rather than waiting, for sqlite3 DBs when other writers are active
+	row := r.Executor().QueryRow(
 		queryStmt,
-		false,
+		opts.Args(false)...,
 	)
-	if err := row.Scan(&r.Id, &r.ClientId, &r.ReportId, &r.Data, &r.ReceivedAt); err != nil {
+	if err := row.Scan(&r.Id, &r.ClientId, &r.ReportId, &r.Data, &r.ReceivedAt, &r.Attempts); err != nil {
 		if err == sql.ErrNoRows {
-			slog.Info("no unallocated staged report rows found")
+			slog.Debug("no unallocated staged report rows found")
 		} else {
 			slog.Error("unallocated staged report retrieval failed", slog.String("error", err.Error()))
 		}
 
-		if err := TX.Rollback(); err != nil {
-			slog.Error("empty transaction rollback failed", slog.String("error", err.Error()))
-		}
-
-		return false
+		return
 	}
+	found = true
 
 	slog.Info("unallocated report found", slog.Int64("id", r.Id), slog.String("report", r.ReportIdentifer()))
 
-	// set AllocatedAt to Now, allows for detection of report processing that got lost
+	// set AllocatedAt to Now, allows for detection of report processing that got lost,
+	// and count the allocation as a processing attempt
+	allocatedAt := DbNow()
 	r.Allocated = true
-	r.AllocatedAt = types.Now().String()
+	r.AllocatedAt = &allocatedAt
+	r.Attempts += 1
 
-	_, err = TX.Exec(
+	result, err := r.Executor().Exec(
 		updateStmt,
 		r.Allocated,
-		r.AllocatedAt,
+		nullableTime(r.AllocatedAt),
+		r.Attempts,
 		r.Id,
+		false,
 	)
 	if err != nil {
 		slog.Error("staged report update failed", slog.Int64("id", r.Id), slog.String("error", err.Error()))
 
-		if err := TX.Rollback(); err != nil {
-			slog.Error("update rollback failed", slog.String("error", err.Error()))
+		return false, false
+	}
+
+	// if no rows were updated then another worker allocated the report
+	updated, err := result.RowsAffected()
+	if err != nil || updated != 1 {
+		if err != nil {
+			slog.Error("staged report update count unavailable", slog.Int64("id", r.Id), slog.String("error", err.Error()))
+			found = false
 		}
 
-		return false
+		return
+	}
+
+	allocated = true
+
+	return
+}
+
+// AllocatedRows returns the staged reports that are currently allocated
+// for processing
+func (r *ReportStagingTableRow) AllocatedRows() (reports []*ReportStagingTableRow, err error) {
+	stmt, err := r.SelectStmt(
+		[]string{
+			"id",
+			"clientId",
+			"reportId",
+			"receivedAt",
+			"allocatedAt",
+			"attempts",
+		},
+		[]string{
+			"allocated",
+		},
+		SelectOpts{
+			OrderBy: "id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"allocated rows statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := r.Executor().Query(stmt, true)
+	if err != nil {
+		slog.Error("allocated staged reports query failed", slog.String("error", err.Error()))
+		return
 	}
+	defer rows.Close()
 
-	if err := TX.Commit(); err != nil {
-		slog.Error("staged report transaction commit failed", slog.Int64("id", r.Id), slog.String("error", err.Error()))
+	for rows.Next() {
+		report := new(ReportStagingTableRow)
+		if err = report.SetupDB(r.db); err != nil {
+			return nil, err
+		}
 
-		if err := TX.Rollback(); err != nil {
-			slog.Error("failed to rollback update transaction: %s", slog.String("error", err.Error()))
+		if err = rows.Scan(
+			&report.Id,
+			&report.ClientId,
+			&report.ReportId,
+			&report.ReceivedAt,
+			&report.AllocatedAt,
+			&report.Attempts,
+		); err != nil {
+			slog.Error("allocated staged report retrieval failed", slog.String("error", err.Error()))
+			return nil, err
 		}
+		report.Allocated = true
 
-		return false
+		reports = append(reports, report)
 	}
 
-	return true
+	if err = rows.Err(); err != nil {
+		slog.Error("allocated staged reports iteration failed", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	return
 }
 
-func (r *ReportStagingTableRow) Insert() (stagingId int64, err error) {
-	stmt, err := r.InsertStmt(
+// conditionalUpdate updates the specified columns only if the report is
+// still allocated at the time it was retrieved, returning false if the
+// report has since been deleted or re-allocated
+func (r *ReportStagingTableRow) conditionalUpdate(updateCols []string, updateVals ...any) (updated bool, err error) {
+	stmt, err := r.UpdateStmt(
+		updateCols,
+		[]string{
+			"id",
+			"allocatedAt",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := r.Executor().Exec(stmt, append(updateVals, r.Id, nullableTime(r.AllocatedAt))...)
+	if err != nil {
+		slog.Error("staged report update failed", slog.String("report", r.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		slog.Error("staged report update count unavailable", slog.String("report", r.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	updated = count == 1
+
+	return
+}
+
+// Release returns an allocated report to the unallocated state so that it
+// can be processed again, returning false if the report's allocation has
+// changed since it was retrieved
+func (r *ReportStagingTableRow) Release() (released bool, err error) {
+	released, err = r.conditionalUpdate(
+		[]string{
+			"allocated",
+			"allocatedAt",
+		},
+		false,
+		nil,
+	)
+	if released {
+		r.Allocated = false
+		r.AllocatedAt = nil
+	}
+
+	return
+}
+
+// RecordError saves the error that caused the most recent processing
+// attempt to fail, returning false if the report's allocation has changed
+// since it was retrieved
+func (r *ReportStagingTableRow) RecordError(procErr error) (recorded bool, err error) {
+	lastError := procErr.Error()
+	recorded, err = r.conditionalUpdate(
+		[]string{
+			"lastError",
+		},
+		lastError,
+	)
+	if recorded {
+		r.LastError = lastError
+	}
+
+	return
+}
+
+// MoveToFailed moves an allocated report into the failedReports table, in
+// a single transaction, so that it will no longer be considered for
+// processing, returning false if the report's allocation has changed since
+// it was retrieved. The report's processed reports ledger entry, completed
+// when the report was staged, is deleted in the same transaction, so that a
+// resubmission of the report is processed rather than being answered as
+// already processed, provided the registration that submitted it is known.
+func (r *ReportStagingTableRow) MoveToFailed(failed *FailedReportRow) (moved bool, err error) {
+	queryStmt, err := r.SelectStmt(
 		[]string{
-			"clientId",
-			"reportId",
 			"data",
-			"receivedAt",
+			"lastError",
+			"registrationId",
+		},
+		[]string{
+			"id",
+			"allocatedAt",
 		},
-		"id",
+		SelectOpts{}, // no special options
 	)
+	if err != nil {
+		slog.Error(
+			"query statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	insertStmt, err := failed.InsertStmt(failed.insertCols(), "id")
 	if err != nil {
 		slog.Error(
 			"insert statement generation failed",
+			slog.String("table", failed.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	deleteStmt, err := r.DeleteStmt(
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
 			slog.String("table", r.TableName()),
 			slog.String("error", err.Error()),
 		)
 		return
 	}
 
-	row := r.DB().QueryRow(
-		stmt,
+	processed := new(ProcessedReportRow)
+	if err = processed.SetupDB(r.db); err != nil {
+		slog.Error("ProcessedReportRow.SetupDB failed", slog.String("error", err.Error()))
+		return
+	}
+
+	ledgerStmt, err := processed.DeleteStmt(
+		[]string{
+			"registrationId",
+			"reportId",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", processed.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	TX, err := r.DB().Begin()
+	if err != nil {
+		slog.Error("transaction begin failed", slog.String("error", err.Error()))
+		return
+	}
+
+	defer func() {
+		if err := TX.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			slog.Error("failed report transaction rollback failed", slog.String("error", err.Error()))
+		}
+	}()
+
+	// retrieve the report contents, provided it is still allocated at the
+	// time it was retrieved
+	var registrationId sql.NullInt64
+	row := TX.QueryRow(queryStmt, r.Id, nullableTime(r.AllocatedAt))
+	if err = row.Scan(&r.Data, &r.LastError, &registrationId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		} else {
+			slog.Error("staged report retrieval failed", slog.String("report", r.ReportIdentifer()), slog.String("error", err.Error()))
+		}
+		return
+	}
+
+	failed.InitFromStaged(r, DbNow())
+
+	row = TX.QueryRow(insertStmt, failed.insertVals()...)
+	if err = row.Scan(&failed.Id); err != nil {
+		slog.Error("failed report insert failed", slog.String("report", r.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	if _, err = TX.Exec(deleteStmt, r.Id); err != nil {
+		slog.Error("staged report delete failed", slog.String("report", r.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	r.RegistrationId = registrationId.Int64
+	if registrationId.Valid {
+		if _, err = TX.Exec(ledgerStmt, r.RegistrationId, r.ReportId); err != nil {
+			slog.Error("processed report delete failed", slog.String("report", r.ReportIdentifer()), slog.String("error", err.Error()))
+			return
+		}
+	}
+
+	if err = TX.Commit(); err != nil {
+		slog.Error("failed report transaction commit failed", slog.String("report", r.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	moved = true
+
+	return
+}
+
+func (r *ReportStagingTableRow) insertCols() []string {
+	return []string{
+		"clientId",
+		"reportId",
+		"data",
+		"receivedAt",
+		"registrationId",
+	}
+}
+
+func (r *ReportStagingTableRow) insertVals() []any {
+	return []any{
 		r.ClientId,
 		r.ReportId,
 		r.Data,
-		r.ReceivedAt,
-	)
+		DbTime(r.ReceivedAt),
+		sql.NullInt64{
+			Int64: r.RegistrationId,
+			Valid: r.RegistrationId != 0,
+		},
+	}
+}
+
+func (r *ReportStagingTableRow) Insert() (stagingId int64, err error) {
+	stmt, err := r.InsertStmt(r.insertCols(), "id")
+	if err != nil {
+		slog.Error(
+			"insert statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := r.Executor().QueryRow(stmt, r.insertVals()...)
 	if err = row.Scan(
 		&r.Id,
 	); err != nil {
@@ -233,6 +544,43 @@ func (r *ReportStagingTableRow) Insert() (stagingId int64, err error) {
 	return
 }
 
+// DeleteAllocated deletes the report provided it is still allocated at the
+// time it was retrieved, returning false if the report's allocation has
+// changed since it was retrieved, e.g. because its lease expired and it was
+// released and allocated by another worker
+func (r *ReportStagingTableRow) DeleteAllocated() (deleted bool, err error) {
+	stmt, err := r.DeleteStmt(
+		[]string{
+			"id",
+			"allocatedAt",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := r.Executor().Exec(stmt, r.Id, nullableTime(r.AllocatedAt))
+	if err != nil {
+		slog.Error("report delete failed", slog.String("report", r.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		slog.Error("report delete count unavailable", slog.String("report", r.ReportIdentifer()), slog.String("error", err.Error()))
+		return
+	}
+
+	deleted = count == 1
+
+	return
+}
+
 func (r *ReportStagingTableRow) Delete() (err error) {
 	stmt, err := r.DeleteStmt(
 		[]string{
@@ -248,7 +596,7 @@ func (r *ReportStagingTableRow) Delete() (err error) {
 		return
 	}
 
-	_, err = r.DB().Exec(stmt, r.Id)
+	_, err = r.Executor().Exec(stmt, r.Id)
 	if err != nil {
 		slog.Error("report delete failed", slog.String("report", r.ReportIdentifer()), slog.String("error", err.Error()))
 		return err
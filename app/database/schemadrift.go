@@ -0,0 +1,180 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// canonical names for equivalent column types, as reported by PostgreSQL's
+// information_schema or as declared in a TableSpec or SQLite schema
+var canonicalColumnTypes = map[string]string{
+	"int":                         "integer",
+	"int4":                        "integer",
+	"int8":                        "bigint",
+	"bool":                        "boolean",
+	"character varying":           "varchar",
+	"timestamp with time zone":    "timestamptz",
+	"timestamp without time zone": "timestamp",
+}
+
+func canonicalColumnType(colType string) string {
+	colType = strings.ToLower(strings.TrimSpace(colType))
+	if canonical, found := canonicalColumnTypes[colType]; found {
+		return canonical
+	}
+	return colType
+}
+
+// SchemaColumnMismatch describes a column whose definition in the DB
+// differs from its TableSpec definition
+type SchemaColumnMismatch struct {
+	Column           string `json:"column"`
+	ExpectedType     string `json:"expectedType"`
+	ActualType       string `json:"actualType"`
+	ExpectedNullable bool   `json:"expectedNullable"`
+	ActualNullable   bool   `json:"actualNullable"`
+}
+
+// SchemaTableDrift describes the differences between a table in the DB
+// and its TableSpec
+type SchemaTableDrift struct {
+	Table              string                 `json:"table"`
+	Missing            bool                   `json:"missing,omitempty"`
+	MissingColumns     []string               `json:"missingColumns,omitempty"`
+	ExtraColumns       []string               `json:"extraColumns,omitempty"`
+	MismatchedColumns  []SchemaColumnMismatch `json:"mismatchedColumns,omitempty"`
+	MissingForeignKeys []string               `json:"missingForeignKeys,omitempty"`
+	ExtraForeignKeys   []string               `json:"extraForeignKeys,omitempty"`
+}
+
+func (t *SchemaTableDrift) HasDrift() bool {
+	return t.Missing ||
+		len(t.MissingColumns) > 0 ||
+		len(t.ExtraColumns) > 0 ||
+		len(t.MismatchedColumns) > 0 ||
+		len(t.MissingForeignKeys) > 0 ||
+		len(t.ExtraForeignKeys) > 0
+}
+
+// SchemaDriftReport describes the differences between an AppDb's tables and
+// their TableSpecs, listing only those tables that have drifted
+type SchemaDriftReport struct {
+	Db     string             `json:"db"`
+	Tables []SchemaTableDrift `json:"tables"`
+}
+
+func (r *SchemaDriftReport) HasDrift() bool {
+	return len(r.Tables) > 0
+}
+
+// checkTableDrift compares the specified table in the DB with its TableSpec
+func (d *DbConnection) checkTableDrift(ts *TableSpec) (drift SchemaTableDrift, err error) {
+	drift.Table = ts.Name
+
+	columns, err := d.TableColumns(d.DB(), ts.Name)
+	if err != nil {
+		return
+	}
+	if len(columns) == 0 {
+		drift.Missing = true
+		return
+	}
+
+	// identifiers are case insensitive for both PostgreSQL and SQLite
+	actualColumns := make(map[string]DbColumnInfo, len(columns))
+	for _, column := range columns {
+		actualColumns[strings.ToLower(column.Name)] = column
+	}
+
+	expectedColumns := make(map[string]bool, len(ts.Columns))
+	for _, col := range ts.Columns {
+		expectedColumns[strings.ToLower(col.Name)] = true
+
+		actual, found := actualColumns[strings.ToLower(col.Name)]
+		if !found {
+			drift.MissingColumns = append(drift.MissingColumns, col.Name)
+			continue
+		}
+
+		// primary key columns are never nullable
+		expectedNullable := col.Nullable && !col.PrimaryKey
+		if canonicalColumnType(col.DbType(d)) != canonicalColumnType(actual.Type) ||
+			expectedNullable != actual.Nullable {
+			drift.MismatchedColumns = append(drift.MismatchedColumns, SchemaColumnMismatch{
+				Column:           col.Name,
+				ExpectedType:     col.DbType(d),
+				ActualType:       actual.Type,
+				ExpectedNullable: expectedNullable,
+				ActualNullable:   actual.Nullable,
+			})
+		}
+	}
+
+	for _, column := range columns {
+		if !expectedColumns[strings.ToLower(column.Name)] {
+			drift.ExtraColumns = append(drift.ExtraColumns, column.Name)
+		}
+	}
+
+	foreignKeys, err := d.TableForeignKeys(d.DB(), ts.Name)
+	if err != nil {
+		return
+	}
+
+	actualForeignKeys := make(map[string]bool, len(foreignKeys))
+	for _, fk := range foreignKeys {
+		actualForeignKeys[strings.ToLower(fk.String())] = true
+	}
+
+	expectedForeignKeys := make(map[string]bool, len(ts.ForeignKeys))
+	for _, tsfk := range ts.ForeignKeys {
+		fk := DbForeignKeyInfo{
+			Column:           tsfk.Column,
+			ReferencedTable:  tsfk.ReferencedTable,
+			ReferencedColumn: tsfk.ReferencedColumn,
+		}
+		expectedForeignKeys[strings.ToLower(fk.String())] = true
+
+		if !actualForeignKeys[strings.ToLower(fk.String())] {
+			drift.MissingForeignKeys = append(drift.MissingForeignKeys, fk.String())
+		}
+	}
+
+	for _, fk := range foreignKeys {
+		if !expectedForeignKeys[strings.ToLower(fk.String())] {
+			drift.ExtraForeignKeys = append(drift.ExtraForeignKeys, fk.String())
+		}
+	}
+
+	return
+}
+
+// CheckSchemaDrift introspects the connected DB, comparing its tables with
+// the AppDb's TableSpecs, and reports any missing, extra or mismatched
+// columns and foreign keys
+func (adb *AppDb) CheckSchemaDrift() (report *SchemaDriftReport, err error) {
+	report = &SchemaDriftReport{
+		Db:     adb.name,
+		Tables: []SchemaTableDrift{},
+	}
+
+	for _, ts := range adb.tables() {
+		drift, err := adb.Conn().checkTableDrift(ts)
+		if err != nil {
+			slog.Error(
+				"schema drift check failed",
+				slog.String("db", adb.name),
+				slog.String("table", ts.Name),
+				slog.String("error", err.Error()),
+			)
+			return nil, fmt.Errorf("schema drift check of table %q failed: %w", ts.Name, err)
+		}
+
+		if drift.HasDrift() {
+			report.Tables = append(report.Tables, drift)
+		}
+	}
+
+	return
+}
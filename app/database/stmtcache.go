@@ -0,0 +1,183 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// StmtCache is a per DbConnection cache of generated SQL statements, keyed
+// by table, operation and column lists, and of the associated prepared
+// statements, keyed by the generated SQL, which are prepared on first use
+type StmtCache struct {
+	queries sync.Map // statement key ==> SQL
+	known   sync.Map // SQL ==> statement key
+	stmts   sync.Map // SQL ==> *sql.Stmt
+}
+
+func NewStmtCache() *StmtCache {
+	return new(StmtCache)
+}
+
+// stmtKey generates a cache key from an operation, table and list of
+// statement specific components, such as column lists
+func stmtKey(op, table string, parts ...any) string {
+	key := op + ":" + table
+	for _, part := range parts {
+		switch p := part.(type) {
+		case []string:
+			key += ":" + strings.Join(p, ",")
+		default:
+			key += fmt.Sprintf(":%v", p)
+		}
+	}
+	return key
+}
+
+// Query returns the SQL statement associated with the key, generating it
+// with the build function if not already cached
+func (c *StmtCache) Query(key string, build func() (string, error)) (query string, err error) {
+	if cached, found := c.queries.Load(key); found {
+		return cached.(string), nil
+	}
+
+	if query, err = build(); err != nil {
+		return
+	}
+
+	cached, _ := c.queries.LoadOrStore(key, query)
+	query = cached.(string)
+	c.known.Store(query, key)
+
+	return
+}
+
+// Stmt returns a prepared statement for the specified SQL, preparing it
+// against the DB if needed. Only SQL statements that were generated via the
+// cache are prepared, with nil being returned for other statements.
+func (c *StmtCache) Stmt(db *sql.DB, query string) (stmt *sql.Stmt, err error) {
+	if cached, found := c.stmts.Load(query); found {
+		return cached.(*sql.Stmt), nil
+	}
+
+	if _, known := c.known.Load(query); !known {
+		return
+	}
+
+	if stmt, err = db.Prepare(query); err != nil {
+		slog.Error(
+			"statement prepare failed",
+			slog.String("query", query),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	// if another caller prepared the same statement concurrently use that
+	// one instead, closing the one we prepared
+	cached, loaded := c.stmts.LoadOrStore(query, stmt)
+	if loaded {
+		stmt.Close()
+		stmt = cached.(*sql.Stmt)
+	}
+
+	return
+}
+
+// Prepared returns the number of currently prepared statements
+func (c *StmtCache) Prepared() (count int) {
+	c.stmts.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+	return
+}
+
+// Reset closes all prepared statements and discards all cached entries
+func (c *StmtCache) Reset() {
+	if c == nil {
+		return
+	}
+
+	c.stmts.Range(func(query, cached any) bool {
+		if err := cached.(*sql.Stmt).Close(); err != nil {
+			slog.Debug(
+				"prepared statement close failed",
+				slog.String("query", query.(string)),
+				slog.String("error", err.Error()),
+			)
+		}
+		c.stmts.Delete(query)
+		return true
+	})
+
+	c.queries.Range(func(key, _ any) bool {
+		c.queries.Delete(key)
+		return true
+	})
+
+	c.known.Range(func(query, _ any) bool {
+		c.known.Delete(query)
+		return true
+	})
+}
+
+// cachedExecutor is an SqlExecutor that uses prepared statements from the
+// cache for SQL statements that were generated via the cache, as part of
+// the specified transaction if any, falling back to executing other SQL
+// statements directly
+type cachedExecutor struct {
+	cache *StmtCache
+	db    *sql.DB
+	tx    *Tx
+}
+
+// executor returns the transaction, if any, or the DB
+func (e *cachedExecutor) executor() SqlExecutor {
+	if e.tx != nil {
+		return e.tx
+	}
+	return e.db
+}
+
+// stmt returns a prepared statement for the SQL, bound to the transaction
+// if any, or nil if the SQL statement isn't cacheable
+func (e *cachedExecutor) stmt(query string) *sql.Stmt {
+	stmt, err := e.cache.Stmt(e.db, query)
+	if err != nil || stmt == nil {
+		return nil
+	}
+
+	// transaction specific statements are closed when the transaction ends
+	if e.tx != nil {
+		return e.tx.Stmt(stmt)
+	}
+
+	return stmt
+}
+
+func (e *cachedExecutor) Exec(query string, args ...any) (sql.Result, error) {
+	if stmt := e.stmt(query); stmt != nil {
+		return stmt.Exec(args...)
+	}
+	return e.executor().Exec(query, args...)
+}
+
+func (e *cachedExecutor) Query(query string, args ...any) (*sql.Rows, error) {
+	if stmt := e.stmt(query); stmt != nil {
+		return stmt.Query(args...)
+	}
+	return e.executor().Query(query, args...)
+}
+
+func (e *cachedExecutor) QueryRow(query string, args ...any) *sql.Row {
+	if stmt := e.stmt(query); stmt != nil {
+		return stmt.QueryRow(args...)
+	}
+	return e.executor().QueryRow(query, args...)
+}
+
+// verify that cachedExecutor conforms to the SqlExecutor interface
+var _ SqlExecutor = (*cachedExecutor)(nil)
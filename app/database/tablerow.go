@@ -1,14 +1,21 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/database/dbmanager"
 )
 
 type TableRowCommon struct {
 	// private db settings
 	db        *AppDb
+	tx        *Tx
 	tableSpec *TableSpec
 }
 
@@ -51,6 +58,74 @@ func (t *TableRowCommon) DB() *sql.DB {
 	return t.db.Conn().DB()
 }
 
+// SetTx associates the row with a caller supplied transaction, which must
+// have been started against the row's DB, such that subsequent operations
+// on the row will be performed as part of that transaction. A nil tx will
+// revert to performing operations directly against the DB.
+func (t *TableRowCommon) SetTx(tx *Tx) (err error) {
+	// SetupDB should have already been called
+	if t.db == nil {
+		return fmt.Errorf("SetupDB should be called before calling SetTx")
+	}
+
+	if err = checkTx(tx, t.db); err != nil {
+		return
+	}
+
+	t.tx = tx
+
+	return
+}
+
+func (t *TableRowCommon) Tx() *Tx {
+	return t.tx
+}
+
+// Executor returns an SqlExecutor that performs operations as part of the
+// transaction associated with the row, if any, or otherwise against the
+// row's DB, using cached prepared statements for any SQL statements that
+// were generated by the row's statement builders
+func (t *TableRowCommon) Executor() SqlExecutor {
+	return &cachedExecutor{
+		cache: t.db.Conn().StmtCache(),
+		db:    t.DB(),
+		tx:    t.tx,
+	}
+}
+
+// notifyRowChanged notifies the AppDb's row change hooks that the specified
+// row has changed, both immediately and, if part of a transaction, once the
+// transaction has been committed, so that hooks invalidating cached values
+// cannot be undone by a concurrent lookup of the uncommitted row
+func (t *TableRowCommon) notifyRowChanged(id int64) {
+	notify := func() {
+		t.db.notifyRowChanged(t.TableName(), id)
+	}
+
+	notify()
+	if t.tx != nil {
+		t.tx.OnCommit(notify)
+	}
+}
+
+// incrementCacheGeneration increments the cache generation of the row's
+// table, as part of the row's transaction if any, so that other processes
+// caching the table's rows will discard them
+func (t *TableRowCommon) incrementCacheGeneration() (err error) {
+	generation := new(CacheGenerationRow)
+	if err = generation.SetupDB(t.db); err != nil {
+		return
+	}
+
+	if err = generation.SetTx(t.tx); err != nil {
+		return
+	}
+
+	generation.Init(t.TableName())
+
+	return generation.Increment()
+}
+
 func (t *TableRowCommon) TableName() string {
 	return t.GetTableSpec().Name
 }
@@ -79,35 +154,217 @@ func (t *TableRowCommon) Columns(inputColumns ...string) (columns []string, err
 	return
 }
 
+// SelectOpts customises the generated SELECT statement. The Limit and
+// Offset are bound as placeholders, following any Where placeholders, such
+// that the statement can be cached independently of their values, and must
+// be appended to the query's args via Args().
 type SelectOpts struct {
 	Count      bool
 	Distinct   bool
 	Limit      uint
+	Offset     uint // only applied if Limit is also specified
 	OrderBy    string
 	Descending bool
+
+	// foreign key columns whose referenced tables will be LEFT JOINed, such
+	// that their columns can be selected, matched and ordered by using
+	// qualified "table.column" names
+	Joins []string
+
+	// additional conditions, ANDed with the whereCols matches, whose
+	// placeholders follow those of the whereCols
+	Where []WhereCond
+
+	// lock the selected rows against concurrent updates until the end of
+	// the transaction, which only applies to PostgreSQL, as SQLite
+	// serialises write transactions
+	Share bool
+}
+
+// WhereCond is a condition comparing a column with a placeholder value
+type WhereCond struct {
+	Column string
+	Op     string
+}
+
+// supported WhereCond operators
+const (
+	WHERE_OP_EQ   = "="
+	WHERE_OP_NE   = "<>"
+	WHERE_OP_LT   = "<"
+	WHERE_OP_LE   = "<="
+	WHERE_OP_GT   = ">"
+	WHERE_OP_GE   = ">="
+	WHERE_OP_LIKE = "LIKE"
+)
+
+var whereOps = []string{
+	WHERE_OP_EQ,
+	WHERE_OP_NE,
+	WHERE_OP_LT,
+	WHERE_OP_LE,
+	WHERE_OP_GT,
+	WHERE_OP_GE,
+	WHERE_OP_LIKE,
+}
+
+// LIKE patterns use a backslash to escape wildcard characters
+const likeEscape = `\`
+
+// LikeEscape escapes the LIKE wildcard characters in the value so that it
+// is matched literally when used as part of a WHERE_OP_LIKE pattern
+func LikeEscape(value string) string {
+	return strings.NewReplacer(
+		likeEscape, likeEscape+likeEscape,
+		"%", likeEscape+"%",
+		"_", likeEscape+"_",
+	).Replace(value)
+}
+
+// Args appends the LIMIT and OFFSET values, if a Limit was specified, to
+// the provided query args
+func (o SelectOpts) Args(args ...any) []any {
+	if o.Limit > 0 {
+		args = append(args, o.Limit, o.Offset)
+	}
+	return args
+}
+
+// cacheKey returns the options with the Limit and Offset values, which are
+// bound as placeholders, replaced by an indication of whether a Limit was
+// specified, so that they don't contribute to the statement cache key
+func (o SelectOpts) cacheKey() SelectOpts {
+	if o.Limit > 0 {
+		o.Limit = 1
+	}
+	o.Offset = 0
+	return o
 }
 
 func (t *TableRowCommon) SelectStmt(selectCols, whereCols []string, opts SelectOpts) (stmt string, err error) {
+	return t.db.Conn().StmtCache().Query(
+		stmtKey("SELECT", t.TableName(), selectCols, whereCols, opts.cacheKey()),
+		func() (string, error) {
+			return t.selectStmt(selectCols, whereCols, opts)
+		},
+	)
+}
+
+// selectJoins determines the tables referenced by the specified foreign key
+// columns, returning the associated JOIN clauses and the joined tables'
+// specs, indexed by table name
+func (t *TableRowCommon) selectJoins(joinCols []string) (joins string, joined map[string]*TableSpec, err error) {
+	joined = map[string]*TableSpec{}
+
+	for _, joinCol := range joinCols {
+		ind := slices.IndexFunc(t.tableSpec.ForeignKeys, func(fk TableSpecForeignKey) bool {
+			return fk.Column == joinCol
+		})
+		if ind == -1 {
+			return "", nil, fmt.Errorf("column %q of table %q is not a foreign key", joinCol, t.TableName())
+		}
+		fk := t.tableSpec.ForeignKeys[ind]
+
+		refSpec := t.db.tables().Find(fk.ReferencedTable)
+		if refSpec == nil {
+			return "", nil, fmt.Errorf("table %q referenced by column %q not found", fk.ReferencedTable, joinCol)
+		}
+		if _, found := joined[refSpec.Name]; found {
+			return "", nil, fmt.Errorf("table %q joined more than once", refSpec.Name)
+		}
+		joined[refSpec.Name] = refSpec
+
+		joins += fmt.Sprintf(
+			" LEFT JOIN %s ON %s.%s = %s.%s",
+			refSpec.Name,
+			t.TableName(), fk.Column,
+			refSpec.Name, fk.ReferencedColumn,
+		)
+	}
+
+	return
+}
+
+// selectColumn validates the column, which may be qualified with the name
+// of a joined table, qualifying unqualified columns with the table's name
+// if any tables are joined to avoid ambiguity
+func (t *TableRowCommon) selectColumn(column string, joined map[string]*TableSpec) (string, error) {
+	table, name, qualified := strings.Cut(column, ".")
+	if !qualified {
+		name = column
+		table = t.TableName()
+	}
+
+	spec := t.tableSpec
+	if table != t.TableName() {
+		if spec = joined[table]; spec == nil {
+			return "", fmt.Errorf("table %q of column %q is not joined", table, column)
+		}
+	}
+
+	if err := spec.CheckColumnNames([]string{name}); err != nil {
+		return "", err
+	}
+
+	if len(joined) == 0 {
+		return name, nil
+	}
+
+	return table + "." + name, nil
+}
+
+// selectColumns validates and, if needed, qualifies the columns
+func (t *TableRowCommon) selectColumns(columns []string, joined map[string]*TableSpec) (resolved []string, err error) {
+	for _, column := range columns {
+		col, err := t.selectColumn(column, joined)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, col)
+	}
+	return
+}
+
+func (t *TableRowCommon) selectStmt(selectCols, whereCols []string, opts SelectOpts) (stmt string, err error) {
+	// determine the joined tables so that their columns can be validated
+	joins, joined, err := t.selectJoins(opts.Joins)
+	if err != nil {
+		return "", fmt.Errorf("invalid join column: %w", err)
+	}
+
 	switch len(selectCols) {
 	case 0:
 		return "", fmt.Errorf("no select columns specified")
 	default:
 		// ensure selectCols are valid
-		if err = t.tableSpec.CheckColumnNames(selectCols); err != nil {
+		if selectCols, err = t.selectColumns(selectCols, joined); err != nil {
 			return "", fmt.Errorf("invalid select column: %w", err)
 		}
 	}
 
 	if len(whereCols) > 0 {
 		// ensure whereCols are valid
-		if err = t.tableSpec.CheckColumnNames(whereCols); err != nil {
+		if whereCols, err = t.selectColumns(whereCols, joined); err != nil {
 			return "", fmt.Errorf("invalid where column: %w", err)
 		}
 	}
 
-	if len(opts.OrderBy) > 0 {
-		// ensure whereCols are valid
-		if err = t.tableSpec.CheckColumnNames([]string{opts.OrderBy}); err != nil {
+	// ensure where conditions are valid
+	conds := make([]WhereCond, len(opts.Where))
+	for i, cond := range opts.Where {
+		if !slices.Contains(whereOps, cond.Op) {
+			return "", fmt.Errorf("invalid where operator %q for column %q", cond.Op, cond.Column)
+		}
+		if cond.Column, err = t.selectColumn(cond.Column, joined); err != nil {
+			return "", fmt.Errorf("invalid where condition column: %w", err)
+		}
+		conds[i] = cond
+	}
+
+	orderBy := opts.OrderBy
+	if len(orderBy) > 0 {
+		// ensure orderBy is valid
+		if orderBy, err = t.selectColumn(orderBy, joined); err != nil {
 			return "", fmt.Errorf("invalid orderby column: %w", err)
 		}
 	}
@@ -142,15 +399,20 @@ func (t *TableRowCommon) SelectStmt(selectCols, whereCols []string, opts SelectO
 		stmt += ")"
 	}
 
-	// add the table
-	stmt += " FROM " + t.TableName()
+	// add the table, and any joined tables
+	stmt += " FROM " + t.TableName() + joins
 
-	// if where columns were specified
-	if len(whereCols) > 0 {
-		stmt += " WHERE "
+	// instantiate placeholder generator for the required where columns,
+	// conditions and, if limited, the limit and offset values
+	phCount := len(whereCols) + len(conds)
+	if opts.Limit > 0 {
+		phCount += 2
+	}
+	ph := t.db.Conn().Placeholder(phCount)
 
-		// instantiate placeholder generator for required column count
-		ph := t.db.Conn().Placeholder(len(whereCols))
+	// if where columns or conditions were specified
+	if len(whereCols) > 0 || len(conds) > 0 {
+		stmt += " WHERE "
 
 		// add where conditions
 		for i, whereCol := range whereCols {
@@ -161,19 +423,36 @@ func (t *TableRowCommon) SelectStmt(selectCols, whereCols []string, opts SelectO
 			// add where clause with appropriate placeholder
 			stmt += whereCol + " = " + ph.Next()
 		}
+
+		// add additional where conditions
+		for i, cond := range conds {
+			if i > 0 || len(whereCols) > 0 {
+				stmt += " AND "
+			}
+
+			stmt += cond.Column + " " + cond.Op + " " + ph.Next()
+			if cond.Op == WHERE_OP_LIKE {
+				stmt += " ESCAPE '" + likeEscape + "'"
+			}
+		}
 	}
 
 	// add an order by directive if specified
-	if opts.OrderBy != "" {
-		stmt += fmt.Sprintf(" ORDER BY %s", opts.OrderBy)
+	if orderBy != "" {
+		stmt += fmt.Sprintf(" ORDER BY %s", orderBy)
 		if opts.Descending {
 			stmt += " DESC"
 		}
 	}
 
-	// add a limit count if specified
+	// add limit and offset placeholders if a limit was specified
 	if opts.Limit > 0 {
-		stmt += fmt.Sprintf(" LIMIT %d", opts.Limit)
+		stmt += " LIMIT " + ph.Next() + " OFFSET " + ph.Next()
+	}
+
+	// add a share lock directive if requested and supported
+	if opts.Share && t.db.Conn().DbMgr().Type().IsPostgres() {
+		stmt += " FOR SHARE"
 	}
 
 	slog.Debug("Generated SELECT statement", slog.String("stmt", stmt))
@@ -182,6 +461,15 @@ func (t *TableRowCommon) SelectStmt(selectCols, whereCols []string, opts SelectO
 }
 
 func (t *TableRowCommon) InsertStmt(insertCols []string, returning string) (stmt string, err error) {
+	return t.db.Conn().StmtCache().Query(
+		stmtKey("INSERT", t.TableName(), insertCols, returning),
+		func() (string, error) {
+			return t.insertStmt(insertCols, returning)
+		},
+	)
+}
+
+func (t *TableRowCommon) insertStmt(insertCols []string, returning string) (stmt string, err error) {
 	switch len(insertCols) {
 	case 0:
 		return "", fmt.Errorf("no insert columns specified")
@@ -239,12 +527,257 @@ func (t *TableRowCommon) InsertStmt(insertCols []string, returning string) (stmt
 	return
 }
 
+func (t *TableRowCommon) UpsertStmt(insertCols, conflictCols []string, conflictWhere, returning string) (stmt string, err error) {
+	return t.db.Conn().StmtCache().Query(
+		stmtKey("UPSERT", t.TableName(), insertCols, conflictCols, conflictWhere, returning),
+		func() (string, error) {
+			return t.upsertStmt(insertCols, conflictCols, conflictWhere, returning)
+		},
+	)
+}
+
+// upsertStmt generates an insert statement that does nothing if the new
+// row conflicts with an existing row on the unique conflict columns, with
+// the optional conflictWhere predicate identifying a partial unique index.
+// If a returning column is specified, no row is returned when a conflict
+// occurs, in which case the caller should retrieve the existing row.
+func (t *TableRowCommon) upsertStmt(insertCols, conflictCols []string, conflictWhere, returning string) (stmt string, err error) {
+	if len(conflictCols) == 0 {
+		return "", fmt.Errorf("no conflict columns specified")
+	}
+
+	// ensure conflictCols are valid
+	if err = t.tableSpec.CheckColumnNames(conflictCols); err != nil {
+		return "", fmt.Errorf("invalid conflict column: %w", err)
+	}
+
+	// generate the base insert statement, without any returning column
+	if stmt, err = t.insertStmt(insertCols, ""); err != nil {
+		return
+	}
+
+	// both PostgreSQL and SQLite (3.24 or later) support targeting the
+	// unique index on the conflict columns, so that violations of other
+	// constraints still fail the insert rather than being ignored
+	switch {
+	case t.db.Conn().DbMgr().Type().IsPostgres(), t.db.Conn().DbMgr().Type().IsSqlite3():
+		stmt += " ON CONFLICT (" + strings.Join(conflictCols, ", ") + ")"
+		if conflictWhere != "" {
+			stmt += " WHERE " + conflictWhere
+		}
+		stmt += " DO NOTHING"
+	default:
+		return "", fmt.Errorf("upsert not supported for db type %q", t.db.Conn().DbMgr().Type())
+	}
+
+	// if requested add the returning column directive
+	if returning != "" {
+		// ensure returning is a valid column
+		if err = t.tableSpec.CheckColumnNames([]string{returning}); err != nil {
+			return "", fmt.Errorf("invalid returning column: %w", err)
+		}
+		stmt += " RETURNING " + returning
+	}
+
+	slog.Debug("Generated UPSERT statement", slog.String("stmt", stmt))
+
+	return
+}
+
+// maximum number of placeholders used in a single bulk insert statement,
+// ensuring that neither the SQLite nor PostgreSQL limits are exceeded
+const bulkInsertMaxParams = 32766
+
+func (t *TableRowCommon) BulkInsertStmt(insertCols []string, numRows int) (stmt string, err error) {
+	switch len(insertCols) {
+	case 0:
+		return "", fmt.Errorf("no insert columns specified")
+	default:
+		// ensure insertCols are valid
+		if err = t.tableSpec.CheckColumnNames(insertCols); err != nil {
+			return "", fmt.Errorf("invalid insert column: %w", err)
+		}
+	}
+
+	if numRows <= 0 {
+		return "", fmt.Errorf("invalid bulk insert row count %d", numRows)
+	}
+
+	if len(insertCols)*numRows > bulkInsertMaxParams {
+		return "", fmt.Errorf(
+			"bulk insert of %d rows of %d columns exceeds maximum of %d values",
+			numRows,
+			len(insertCols),
+			bulkInsertMaxParams,
+		)
+	}
+
+	// start an insert statement
+	stmt = "INSERT INTO " + t.TableName() + "("
+
+	// add the insert columns
+	for i, insertCol := range insertCols {
+		if i > 0 {
+			stmt += ", "
+		}
+		stmt += insertCol
+	}
+
+	// end insert columns list and start value placeholders lists
+	stmt += ") VALUES"
+
+	// instantiate placeholder generator for required value count
+	ph := t.db.Conn().Placeholder(len(insertCols) * numRows)
+
+	// add a value placeholders list for each row
+	for row := 0; row < numRows; row++ {
+		if row > 0 {
+			stmt += ","
+		}
+		stmt += " ("
+		for i := 0; i < len(insertCols); i++ {
+			if i > 0 {
+				stmt += ", "
+			}
+
+			// add appropriate placeholder
+			stmt += ph.Next()
+		}
+		stmt += ")"
+	}
+
+	slog.Debug("Generated bulk INSERT statement", slog.String("stmt", stmt))
+
+	return
+}
+
+// BulkInsert inserts the provided rows of values for the specified columns,
+// as part of the row's transaction if any, returning the number of rows
+// inserted. When the pgx driver is active the COPY FROM protocol is used,
+// otherwise as few multi-row INSERT statements as possible are used.
+func (t *TableRowCommon) BulkInsert(insertCols []string, rows [][]any) (inserted int64, err error) {
+	if len(rows) == 0 {
+		return
+	}
+
+	for i, row := range rows {
+		if len(row) != len(insertCols) {
+			return 0, fmt.Errorf(
+				"bulk insert row %d has %d values, expected %d",
+				i,
+				len(row),
+				len(insertCols),
+			)
+		}
+	}
+
+	if t.db.Conn().DbMgr().Type().UsesPgxDriver() {
+		return t.bulkInsertCopy(insertCols, rows)
+	}
+
+	// insert the rows in batches that don't exceed the placeholder limit
+	batchSize := max(bulkInsertMaxParams/max(len(insertCols), 1), 1)
+	for start := 0; start < len(rows); start += batchSize {
+		batch := rows[start:min(start+batchSize, len(rows))]
+
+		stmt, stmtErr := t.BulkInsertStmt(insertCols, len(batch))
+		if stmtErr != nil {
+			slog.Error(
+				"bulk insert statement generation failed",
+				slog.String("table", t.TableName()),
+				slog.String("error", stmtErr.Error()),
+			)
+			return inserted, stmtErr
+		}
+
+		vals := make([]any, 0, len(batch)*len(insertCols))
+		for _, row := range batch {
+			vals = append(vals, row...)
+		}
+
+		result, execErr := t.Executor().Exec(stmt, vals...)
+		if execErr != nil {
+			slog.Error(
+				"bulk insert failed",
+				slog.String("table", t.TableName()),
+				slog.Int("rows", len(batch)),
+				slog.String("error", execErr.Error()),
+			)
+			return inserted, execErr
+		}
+
+		count, countErr := result.RowsAffected()
+		if countErr != nil {
+			return inserted, countErr
+		}
+		inserted += count
+	}
+
+	return
+}
+
+// bulkInsertCopy uses COPY FROM to insert the rows, using the connection
+// associated with the row's transaction if any
+func (t *TableRowCommon) bulkInsertCopy(insertCols []string, rows [][]any) (inserted int64, err error) {
+	copyFrom := func(driverConn any) (copyErr error) {
+		inserted, copyErr = dbmanager.PgxCopyFrom(driverConn, t.TableName(), insertCols, rows)
+		return
+	}
+
+	if t.tx != nil {
+		err = t.tx.Raw(copyFrom)
+	} else {
+		conn, connErr := t.DB().Conn(context.Background())
+		if connErr != nil {
+			return 0, connErr
+		}
+		defer conn.Close()
+
+		err = conn.Raw(copyFrom)
+	}
+
+	if err != nil {
+		slog.Error(
+			"bulk copy failed",
+			slog.String("table", t.TableName()),
+			slog.Int("rows", len(rows)),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
 func (t *TableRowCommon) UpdateStmt(updateCols, whereCols []string) (stmt string, err error) {
-	switch len(updateCols) {
+	return t.db.Conn().StmtCache().Query(
+		stmtKey("UPDATE", t.TableName(), updateCols, whereCols),
+		func() (string, error) {
+			return t.updateStmt(nil, updateCols, whereCols)
+		},
+	)
+}
+
+// IncrementStmt generates an UPDATE statement that atomically increments
+// the incrementCols by 1, in addition to setting any updateCols, for the
+// rows matching the whereCols, avoiding a read-modify-write of the values
+func (t *TableRowCommon) IncrementStmt(incrementCols, updateCols, whereCols []string) (stmt string, err error) {
+	return t.db.Conn().StmtCache().Query(
+		stmtKey("INCREMENT", t.TableName(), incrementCols, updateCols, whereCols),
+		func() (string, error) {
+			return t.updateStmt(incrementCols, updateCols, whereCols)
+		},
+	)
+}
+
+func (t *TableRowCommon) updateStmt(incrementCols, updateCols, whereCols []string) (stmt string, err error) {
+	switch len(incrementCols) + len(updateCols) {
 	case 0:
 		return "", fmt.Errorf("no update columns specified")
 	default:
-		// ensure updateCols are valid
+		// ensure incrementCols and updateCols are valid
+		if err = t.tableSpec.CheckColumnNames(incrementCols); err != nil {
+			return "", fmt.Errorf("invalid increment column: %w", err)
+		}
 		if err = t.tableSpec.CheckColumnNames(updateCols); err != nil {
 			return "", fmt.Errorf("invalid update column: %w", err)
 		}
@@ -263,9 +796,18 @@ func (t *TableRowCommon) UpdateStmt(updateCols, whereCols []string) (stmt string
 	// instantiate placeholder generator for required column count
 	ph := t.db.Conn().Placeholder(len(updateCols) + len(whereCols))
 
+	// add increment assignments
+	for i, incrementCol := range incrementCols {
+		if i > 0 {
+			stmt += ", "
+		}
+
+		stmt += incrementCol + " = " + incrementCol + " + 1"
+	}
+
 	// add update assignments
 	for i, updateCol := range updateCols {
-		if i > 0 {
+		if i > 0 || len(incrementCols) > 0 {
 			stmt += ", "
 		}
 
@@ -294,6 +836,15 @@ func (t *TableRowCommon) UpdateStmt(updateCols, whereCols []string) (stmt string
 }
 
 func (t *TableRowCommon) DeleteStmt(whereCols []string) (stmt string, err error) {
+	return t.db.Conn().StmtCache().Query(
+		stmtKey("DELETE", t.TableName(), whereCols),
+		func() (string, error) {
+			return t.deleteStmt(whereCols)
+		},
+	)
+}
+
+func (t *TableRowCommon) deleteStmt(whereCols []string) (stmt string, err error) {
 	switch len(whereCols) {
 	case 0:
 		return "", fmt.Errorf("no delete where columns specified")
@@ -325,6 +876,169 @@ func (t *TableRowCommon) DeleteStmt(whereCols []string) (stmt string, err error)
 	return
 }
 
+// DeleteIds deletes the rows with the specified ids, in batches that don't
+// exceed the placeholder limit, returning the number deleted
+func (t *TableRowCommon) DeleteIds(ids []int64) (deleted int64, err error) {
+	for start := 0; start < len(ids); start += bulkInsertMaxParams {
+		batch := ids[start:min(start+bulkInsertMaxParams, len(ids))]
+
+		stmt := "DELETE FROM " + t.TableName() + " WHERE id IN ("
+		ph := t.db.Conn().Placeholder(len(batch))
+		vals := make([]any, len(batch))
+		for i, id := range batch {
+			if i > 0 {
+				stmt += ", "
+			}
+			stmt += ph.Next()
+			vals[i] = id
+		}
+		stmt += ")"
+
+		slog.Debug("Generated DELETE ids statement", slog.String("stmt", stmt))
+
+		result, err := t.Executor().Exec(stmt, vals...)
+		if err != nil {
+			slog.Error(
+				"delete ids failed",
+				slog.String("table", t.TableName()),
+				slog.Int("ids", len(batch)),
+				slog.String("error", err.Error()),
+			)
+			return deleted, err
+		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += count
+	}
+
+	return
+}
+
+// UnreferencedIds returns, in id order, up to limit ids of rows that are
+// not referenced by the refColumn of any refTable row, and that match the
+// where condition if not empty, or all such ids if limit is 0
+func (t *TableRowCommon) UnreferencedIds(refTable, refColumn, where string, limit uint) (ids []int64, err error) {
+	stmt := "SELECT id FROM " + t.TableName() +
+		" WHERE " + t.unreferencedCond(refTable, refColumn, where) +
+		" ORDER BY id"
+
+	// the limit is bound as a placeholder, like the SelectStmt limit
+	var args []any
+	if limit > 0 {
+		stmt += " LIMIT " + t.db.Conn().Placeholder(1).Next()
+		args = append(args, limit)
+	}
+
+	slog.Debug("Generated unreferenced ids SELECT statement", slog.String("stmt", stmt))
+
+	rows, err := t.Executor().Query(stmt, args...)
+	if err != nil {
+		slog.Error(
+			"unreferenced ids query failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	return scanIds(rows)
+}
+
+// unreferencedCond returns a condition matching the table's rows that are
+// not referenced by the refColumn of any refTable row, and that match the
+// where condition if not empty
+func (t *TableRowCommon) unreferencedCond(refTable, refColumn, where string) string {
+	cond := "NOT EXISTS (SELECT 1 FROM " + refTable +
+		" WHERE " + refTable + "." + refColumn + " = " + t.TableName() + ".id)"
+	if where != "" {
+		cond += " AND " + where
+	}
+
+	return cond
+}
+
+// MarkUnreferenced sets the markColumn of up to limit unmarked rows, that
+// are not referenced by the refColumn of any refTable row, and that match
+// the where condition if not empty, to the specified time, returning their
+// ids
+func (t *TableRowCommon) MarkUnreferenced(refTable, refColumn, where, markColumn string, at time.Time, limit uint) (ids []int64, err error) {
+	if err = t.tableSpec.CheckColumnNames([]string{markColumn}); err != nil {
+		return nil, fmt.Errorf("invalid mark column: %w", err)
+	}
+
+	ph := t.db.Conn().Placeholder(2)
+	stmt := "UPDATE " + t.TableName() + " SET " + markColumn + " = " + ph.Next() +
+		" WHERE id IN (SELECT id FROM " + t.TableName() +
+		" WHERE " + markColumn + " IS NULL AND " + t.unreferencedCond(refTable, refColumn, where) +
+		" ORDER BY id LIMIT " + ph.Next() + ")" +
+		" RETURNING id"
+
+	slog.Debug("Generated mark unreferenced UPDATE statement", slog.String("stmt", stmt))
+
+	rows, err := t.Executor().Query(stmt, DbTime(at), limit)
+	if err != nil {
+		slog.Error(
+			"mark unreferenced failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	return scanIds(rows)
+}
+
+// DeleteUnreferenced deletes up to limit rows whose markColumn was set by
+// MarkUnreferenced before the specified time, and which are still not
+// referenced by the refColumn of any refTable row and still match the where
+// condition if not empty, returning their ids
+func (t *TableRowCommon) DeleteUnreferenced(refTable, refColumn, where, markColumn string, before time.Time, limit uint) (ids []int64, err error) {
+	if err = t.tableSpec.CheckColumnNames([]string{markColumn}); err != nil {
+		return nil, fmt.Errorf("invalid mark column: %w", err)
+	}
+
+	// the reference check is repeated by the delete itself so that rows
+	// referenced since being marked are never deleted
+	ph := t.db.Conn().Placeholder(2)
+	stmt := "DELETE FROM " + t.TableName() +
+		" WHERE id IN (SELECT id FROM " + t.TableName() +
+		" WHERE " + markColumn + " < " + ph.Next() + " AND " + t.unreferencedCond(refTable, refColumn, where) +
+		" ORDER BY id LIMIT " + ph.Next() + ")" +
+		" RETURNING id"
+
+	slog.Debug("Generated delete unreferenced DELETE statement", slog.String("stmt", stmt))
+
+	rows, err := t.Executor().Query(stmt, DbTime(before), limit)
+	if err != nil {
+		slog.Error(
+			"delete unreferenced failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	return scanIds(rows)
+}
+
+// scanIds retrieves the ids returned by the query, closing the rows
+func scanIds(rows *sql.Rows) (ids []int64, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
 type TableRowHandler interface {
 	// Set the associated TableSpec
 	SetTableSpec(ts *TableSpec)
@@ -335,6 +1049,9 @@ type TableRowHandler interface {
 	// Setup DB access
 	SetupDB(*AppDb) error
 
+	// Associate row with a transaction
+	SetTx(*Tx) error
+
 	// Retrieve the TableName
 	TableName() string
 
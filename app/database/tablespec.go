@@ -11,10 +11,8 @@ type TableSpec struct {
 	Name        string
 	Columns     []TableSpecColumn
 	ForeignKeys []TableSpecForeignKey
+	Indexes     []TableSpecIndex
 	Extras      []string
-
-	// TODO: add a sync.Map to hold sql.Prepare()'d statements to
-	// eliminate repeated generation of the same SQL statements
 }
 
 func (ts *TableSpec) CreateCmd(db *DbConnection) (string, error) {
@@ -59,6 +57,31 @@ func (ts *TableSpec) CreateCmd(db *DbConnection) (string, error) {
 	return table, nil
 }
 
+// IndexCmds generates the create index commands for the table's indexes
+func (ts *TableSpec) IndexCmds(db *DbConnection) (cmds []string, err error) {
+	for _, idx := range ts.Indexes {
+		if len(idx.Columns) == 0 {
+			return nil, fmt.Errorf(
+				"index %q of table %q has no columns",
+				idx.IndexName(ts.Name),
+				ts.Name,
+			)
+		}
+
+		if err = ts.CheckColumnNames(idx.Columns); err != nil {
+			return nil, fmt.Errorf(
+				"index %q column not found: %w",
+				idx.IndexName(ts.Name),
+				err,
+			)
+		}
+
+		cmds = append(cmds, idx.Create(db, ts.Name))
+	}
+
+	return
+}
+
 func (ts *TableSpec) ColumnName(ind int) (name string, err error) {
 	switch {
 	case ind < 0:
@@ -14,9 +14,19 @@ type TableSpecColumn struct {
 	Unique     bool
 }
 
+// DbType returns the column's type as declared for the DB, mapping the
+// dialect-aware TIMESTAMPTZ type to TIMESTAMP for SQLite DBs, where values
+// are stored as ISO 8601 text that the driver converts to and from time.Time
+func (c *TableSpecColumn) DbType(db *DbConnection) string {
+	if strings.EqualFold(c.Type, "TIMESTAMPTZ") && db.dbMgr.Type().IsSqlite3() {
+		return "TIMESTAMP"
+	}
+	return c.Type
+}
+
 func (c *TableSpecColumn) Create(db *DbConnection) string {
 	elements := []string{
-		c.Name, c.Type,
+		c.Name, c.DbType(db),
 	}
 	if !c.Nullable {
 		elements = append(elements, "NOT")
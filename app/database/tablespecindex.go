@@ -0,0 +1,58 @@
+package database
+
+import (
+	"strings"
+)
+
+type TableSpecIndex struct {
+	// optional, defaults to idx_<table>_<columns>, or uidx_<table>_<columns>
+	// for unique indexes
+	Name    string
+	Columns []string
+	Unique  bool
+	// optional predicate for partial indexes
+	Where string
+}
+
+func (idx *TableSpecIndex) IndexName(table string) string {
+	if idx.Name != "" {
+		return idx.Name
+	}
+
+	// index names must be unique across all tables in PostgreSQL, and
+	// making an existing index unique requires a different name, since
+	// the existing index would otherwise satisfy IF NOT EXISTS
+	prefix := "idx_"
+	if idx.Unique {
+		prefix = "uidx_"
+	}
+
+	return prefix + table + "_" + strings.Join(idx.Columns, "_")
+}
+
+func (idx *TableSpecIndex) Create(db *DbConnection, table string) string {
+	elements := []string{"CREATE"}
+
+	if idx.Unique {
+		elements = append(elements, "UNIQUE")
+	}
+
+	// both PostgreSQL and SQLite support IF NOT EXISTS and partial indexes
+	elements = append(
+		elements,
+		"INDEX",
+		"IF",
+		"NOT",
+		"EXISTS",
+		idx.IndexName(table),
+		"ON",
+		table,
+		"("+strings.Join(idx.Columns, ", ")+")",
+	)
+
+	if idx.Where != "" {
+		elements = append(elements, "WHERE", idx.Where)
+	}
+
+	return strings.Join(elements, " ")
+}
@@ -3,14 +3,29 @@ package database
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"time"
 )
 
+// TAG_SET_SEP separates, and delimits, the sorted tags of a tagSet
+const TAG_SET_SEP = "|"
+
+// tagSets table specification
+// The tagSets table records the distinct sets of tags associated with
+// telemetry data, which are referenced by the tagSetId foreign key of the
+// telemetry data table. Entries that are no longer referenced are marked
+// with an orphanedAt time by the retention job, and are only garbage
+// collected once they have remained unreferenced for a grace period.
 var tagSetsTableSpec = TableSpec{
 	Name: "tagSets",
 	Columns: []TableSpecColumn{
 		{Name: "id", Type: "INTEGER", PrimaryKey: true, Identity: true},
 		{Name: "tagSet", Type: "VARCHAR"},
+		{Name: "orphanedAt", Type: "TIMESTAMPTZ", Nullable: true},
+	},
+	Indexes: []TableSpecIndex{
+		{Columns: []string{"tagSet"}, Unique: true},
 	},
 }
 
@@ -21,8 +36,9 @@ func GetTagSetsTableSpec() *TableSpec {
 type TagSetRow struct {
 	TableRowCommon
 
-	Id     int64  `json:"id"`
-	TagSet string `json:"tagSet"`
+	Id         int64      `json:"id"`
+	TagSet     string     `json:"tagSet"`
+	OrphanedAt *time.Time `json:"orphanedAt,omitempty"`
 }
 
 func (t *TagSetRow) Init(tagSet string) {
@@ -47,6 +63,7 @@ func (t *TagSetRow) Exists() bool {
 	stmt, err := t.SelectStmt(
 		[]string{
 			"id",
+			"orphanedAt",
 		},
 		[]string{
 			"tagSet",
@@ -62,8 +79,8 @@ func (t *TagSetRow) Exists() bool {
 		panic(err)
 	}
 
-	row := t.DB().QueryRow(stmt, t.TagSet)
-	if err := row.Scan(&t.Id); err != nil {
+	row := t.Executor().QueryRow(stmt, t.TagSet)
+	if err := row.Scan(&t.Id, &t.OrphanedAt); err != nil {
 		if err != sql.ErrNoRows {
 			slog.Error("tagSet existence check failed", slog.String("tagSet", t.TagSet), slog.String("error", err.Error()))
 		}
@@ -72,6 +89,36 @@ func (t *TagSetRow) Exists() bool {
 	return true
 }
 
+func (t *TagSetRow) IdExists() bool {
+	stmt, err := t.SelectStmt(
+		[]string{
+			"tagSet",
+			"orphanedAt",
+		},
+		[]string{
+			"id",
+		},
+		SelectOpts{}, // no special options
+	)
+	if err != nil {
+		slog.Error(
+			"exists statement generation failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		panic(err)
+	}
+
+	row := t.Executor().QueryRow(stmt, t.Id)
+	if err := row.Scan(&t.TagSet, &t.OrphanedAt); err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error("tagSet existence check failed", slog.Int64("id", t.Id), slog.String("error", err.Error()))
+		}
+		return false
+	}
+	return true
+}
+
 func (t *TagSetRow) Insert() (err error) {
 	stmt, err := t.InsertStmt(
 		[]string{
@@ -87,7 +134,7 @@ func (t *TagSetRow) Insert() (err error) {
 		)
 		return
 	}
-	row := t.DB().QueryRow(
+	row := t.Executor().QueryRow(
 		stmt,
 		t.TagSet,
 	)
@@ -105,6 +152,55 @@ func (t *TagSetRow) Insert() (err error) {
 	return
 }
 
+// Upsert inserts the tagSet if it doesn't already exist, otherwise
+// retrieving the existing entry's id, ensuring that concurrent callers
+// always get the single canonical id
+func (t *TagSetRow) Upsert() (err error) {
+	stmt, err := t.UpsertStmt(
+		[]string{
+			"tagSet",
+		},
+		[]string{
+			"tagSet",
+		},
+		"",
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"upsert statement generation failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := t.Executor().QueryRow(
+		stmt,
+		t.TagSet,
+	)
+	err = row.Scan(
+		&t.Id,
+	)
+	if err == sql.ErrNoRows {
+		// an entry already exists, so retrieve it
+		err = nil
+		if !t.Exists() {
+			err = fmt.Errorf("tagSet %q conflicts with an entry that could not be found", t.TagSet)
+		}
+	}
+	if err != nil {
+		slog.Error(
+			"upsert failed",
+			slog.String("table", t.TableName()),
+			slog.String("tagSet", t.TagSet),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
 func (t *TagSetRow) Update() (err error) {
 	stmt, err := t.UpdateStmt(
 		[]string{
@@ -123,7 +219,7 @@ func (t *TagSetRow) Update() (err error) {
 		return
 	}
 
-	_, err = t.DB().Exec(
+	_, err = t.Executor().Exec(
 		stmt,
 		t.TagSet,
 		t.Id,
@@ -135,8 +231,15 @@ func (t *TagSetRow) Update() (err error) {
 			slog.String("tagSet", t.TagSet),
 			slog.String("error", err.Error()),
 		)
+		return
+	}
+
+	if err = t.incrementCacheGeneration(); err != nil {
+		return
 	}
 
+	t.notifyRowChanged(t.Id)
+
 	return
 }
 
@@ -155,7 +258,7 @@ func (t *TagSetRow) Delete() (err error) {
 		return
 	}
 
-	_, err = t.DB().Exec(
+	_, err = t.Executor().Exec(
 		stmt,
 		t.Id,
 	)
@@ -166,10 +269,110 @@ func (t *TagSetRow) Delete() (err error) {
 			slog.Int64("id", t.Id),
 			slog.String("error", err.Error()),
 		)
+		return
 	}
 
+	if err = t.incrementCacheGeneration(); err != nil {
+		return
+	}
+
+	t.notifyRowChanged(t.Id)
+
 	return
 }
 
+// Reclaim clears the orphanedAt mark of an entry that is about to be
+// referenced again, so that it won't be garbage collected, returning false
+// if the entry has already been deleted
+func (t *TagSetRow) Reclaim() (reclaimed bool, err error) {
+	stmt, err := t.UpdateStmt(
+		[]string{
+			"orphanedAt",
+		},
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"reclaim statement generation failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := t.Executor().Exec(stmt, nil, t.Id)
+	if err != nil {
+		slog.Error(
+			"reclaim failed",
+			slog.String("table", t.TableName()),
+			slog.Int64("id", t.Id),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	if reclaimed = count > 0; reclaimed {
+		t.OrphanedAt = nil
+	}
+
+	return
+}
+
+// Orphans returns the ids of tagSets entries that are no longer referenced
+// by any telemetry data, up to limit, or all of them if limit is 0
+func (t *TagSetRow) Orphans(limit uint) (ids []int64, err error) {
+	return t.UnreferencedIds(GetTelemetryTableSpec().Name, "tagSetId", "", limit)
+}
+
+// MarkOrphans marks up to limit unmarked tagSets entries that are no longer
+// referenced by any telemetry data as orphaned at the specified time,
+// returning the number marked
+func (t *TagSetRow) MarkOrphans(at time.Time, limit uint) (marked int64, err error) {
+	ids, err := t.MarkUnreferenced(GetTelemetryTableSpec().Name, "tagSetId", "", "orphanedAt", at, limit)
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	// ensure that any cached ids of the marked entries are discarded, by
+	// this and other processes, so that they must be reclaimed before being
+	// referenced again
+	if err = t.incrementCacheGeneration(); err != nil {
+		return
+	}
+
+	for _, id := range ids {
+		t.notifyRowChanged(id)
+	}
+
+	return int64(len(ids)), nil
+}
+
+// DeleteOrphans deletes up to limit tagSets entries that were marked as
+// orphaned before the specified time, and that are still not referenced by
+// any telemetry data, returning the number deleted
+func (t *TagSetRow) DeleteOrphans(before time.Time, limit uint) (deleted int64, err error) {
+	ids, err := t.DeleteUnreferenced(GetTelemetryTableSpec().Name, "tagSetId", "", "orphanedAt", before, limit)
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	if err = t.incrementCacheGeneration(); err != nil {
+		return
+	}
+
+	for _, id := range ids {
+		t.notifyRowChanged(id)
+	}
+
+	return int64(len(ids)), nil
+}
+
 // verify that TagSetRow conforms to the TableRowHandler interface
 var _ TableRowHandler = (*TagSetRow)(nil)
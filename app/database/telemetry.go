@@ -4,8 +4,10 @@ import (
 	"database/sql"
 	"encoding/json"
 	"log/slog"
+	"time"
 
 	telemetrylib "github.com/SUSE/telemetry/pkg/lib"
+	"github.com/SUSE/telemetry/pkg/types"
 )
 
 var telemetryTableSpec = TableSpec{
@@ -17,13 +19,16 @@ var telemetryTableSpec = TableSpec{
 		{Name: "telemetryId", Type: "VARCHAR"},
 		{Name: "telemetryType", Type: "VARCHAR"},
 		{Name: "tagSetId", Type: "INTEGER", Nullable: true},
-		{Name: "timestamp", Type: "VARCHAR"},
+		{Name: "timestamp", Type: "TIMESTAMPTZ"},
 		{Name: "dataItem", Type: "TEXT"},
 	},
 	ForeignKeys: []TableSpecForeignKey{
 		{Column: "tagSetId", ReferencedTable: "tagSets", ReferencedColumn: "id"},
 		{Column: "customerRefId", ReferencedTable: "customers", ReferencedColumn: "id"},
 	},
+	Indexes: []TableSpecIndex{
+		{Columns: []string{"clientId", "telemetryId", "timestamp"}},
+	},
 }
 
 func GetTelemetryTableSpec() *TableSpec {
@@ -34,14 +39,14 @@ type TelemetryDataRow struct {
 	TableRowCommon
 
 	// public table fields
-	Id            int64  `json:"id"`
-	ClientId      string `json:"clientId"`
-	CustomerRefId int64  `json:"customerRefId"`
-	TelemetryId   string `json:"telemetryId"`
-	TelemetryType string `json:"telemetryType"`
-	Timestamp     string `json:"timestamp"`
-	TagSetId      int64  `json:"tagSetId"`
-	DataItem      []byte `json:"dataItem"`
+	Id            int64     `json:"id"`
+	ClientId      string    `json:"clientId"`
+	CustomerRefId int64     `json:"customerRefId"`
+	TelemetryId   string    `json:"telemetryId"`
+	TelemetryType string    `json:"telemetryType"`
+	Timestamp     time.Time `json:"timestamp"`
+	TagSetId      int64     `json:"tagSetId"`
+	DataItem      []byte    `json:"dataItem"`
 }
 
 type TelemetryDataRowHandler interface {
@@ -68,13 +73,43 @@ func (t *TelemetryDataRow) Init(
 	t.CustomerRefId = customerRefId
 	t.TelemetryId = dItm.Header.TelemetryId
 	t.TelemetryType = dItm.Header.TelemetryType
-	t.Timestamp = dItm.Header.TelemetryTimeStamp
 	t.TagSetId = tagSetId
 	t.DataItem = []byte(dItm.TelemetryData)
 
+	t.Timestamp = t.itemTimestamp(dItm, bHdr)
+
 	return
 }
 
+// itemTimestamp returns the data item's timestamp, which is supplied by the
+// client, falling back to the bundle's timestamp, or failing that to the
+// TimestampFallback, if it is not a valid RFC 3339 timestamp, so that such
+// items are still stored, deterministically, as they were before timestamps
+// were stored in native timestamp columns
+func (t *TelemetryDataRow) itemTimestamp(dItm *telemetrylib.TelemetryDataItem, bHdr *telemetrylib.TelemetryBundleHeader) time.Time {
+	timestamp, err := types.TimeStampFromString(dItm.Header.TelemetryTimeStamp)
+	if err == nil {
+		return DbTime(timestamp.Time)
+	}
+
+	fallback := TimestampFallback
+	if bundleTimestamp, bundleErr := types.TimeStampFromString(bHdr.BundleTimeStamp); bundleErr == nil {
+		fallback = DbTime(bundleTimestamp.Time)
+	}
+
+	slog.Warn(
+		"invalid telemetry timestamp replaced",
+		slog.String("clientId", bHdr.BundleClientId),
+		slog.String("bundleId", bHdr.BundleId),
+		slog.String("telemetryId", dItm.Header.TelemetryId),
+		slog.String("timestamp", dItm.Header.TelemetryTimeStamp),
+		slog.Time("replacement", fallback),
+		slog.String("error", err.Error()),
+	)
+
+	return fallback
+}
+
 func (t *TelemetryDataRow) SetupDB(adb *AppDb) (err error) {
 	// save DB reference
 	t.SetTableSpec(GetTelemetryTableSpec())
@@ -122,11 +157,11 @@ func (t *TelemetryDataRow) Exists() bool {
 		panic(err)
 	}
 
-	row := t.DB().QueryRow(
+	row := t.Executor().QueryRow(
 		stmt,
 		t.ClientId,
 		t.TelemetryId,
-		t.Timestamp,
+		DbTime(t.Timestamp),
 	)
 	// if the entry was found, all fields not used to find the entry will have
 	// been updated to match what is in the DB
@@ -143,7 +178,7 @@ func (t *TelemetryDataRow) Exists() bool {
 				slog.String("table", t.TableName()),
 				slog.String("clientId", t.ClientId),
 				slog.String("telemetryId", t.TelemetryId),
-				slog.String("timestamp", t.Timestamp),
+				slog.Time("timestamp", t.Timestamp),
 				slog.String("error", err.Error()),
 			)
 		}
@@ -152,38 +187,168 @@ func (t *TelemetryDataRow) Exists() bool {
 	return true
 }
 
-func (t *TelemetryDataRow) Insert() (err error) {
-	stmt, err := t.InsertStmt(
-		[]string{
-			"clientId",
-			"customerRefId",
-			"telemetryId",
-			"telemetryType",
-			"timestamp",
-			"tagSetId",
-			"dataItem",
-		},
-		"id",
-	)
+// TelemetryDataKey is the set of fields that uniquely identify a
+// telemetry data item
+type TelemetryDataKey struct {
+	ClientId    string
+	TelemetryId string
+	// the normalised timestamp, formatted as an RFC 3339 string, since
+	// time.Time values cannot be reliably compared using ==
+	Timestamp string
+}
+
+// telemetryDataKeyTimestamp formats a timestamp for use in a
+// TelemetryDataKey
+func telemetryDataKeyTimestamp(timestamp time.Time) string {
+	return DbTime(timestamp).Format(time.RFC3339Nano)
+}
+
+func (t *TelemetryDataRow) Key() TelemetryDataKey {
+	return TelemetryDataKey{
+		ClientId:    t.ClientId,
+		TelemetryId: t.TelemetryId,
+		Timestamp:   telemetryDataKeyTimestamp(t.Timestamp),
+	}
+}
+
+// ExistingKeys determines which of the specified rows already exist in the
+// DB, using as few queries as possible, returning a set of their keys
+func (t *TelemetryDataRow) ExistingKeys(rows []*TelemetryDataRow) (existing map[TelemetryDataKey]bool, err error) {
+	existing = make(map[TelemetryDataKey]bool)
+
+	// group the rows' telemetryIds by clientId, so that candidate matches
+	// can be retrieved using the (clientId, telemetryId, timestamp) index
+	var clientIds []string
+	telemetryIds := map[string][]any{}
+	for _, row := range rows {
+		if _, found := telemetryIds[row.ClientId]; !found {
+			clientIds = append(clientIds, row.ClientId)
+		}
+		telemetryIds[row.ClientId] = append(telemetryIds[row.ClientId], row.TelemetryId)
+	}
+
+	// query for candidate matches in batches that, along with the clientId,
+	// don't exceed the placeholder limit
+	for _, clientId := range clientIds {
+		ids := telemetryIds[clientId]
+		for start := 0; start < len(ids); start += bulkInsertMaxParams - 1 {
+			batch := ids[start:min(start+bulkInsertMaxParams-1, len(ids))]
+
+			stmt := t.ExistingKeysStmt(len(batch))
+			slog.Debug("Generated existing keys SELECT statement", slog.String("stmt", stmt))
+
+			if err = t.scanExistingKeys(existing, stmt, append([]any{clientId}, batch...)); err != nil {
+				slog.Error(
+					"existing entries query failed",
+					slog.String("table", t.TableName()),
+					slog.String("clientId", clientId),
+					slog.String("error", err.Error()),
+				)
+				return nil, err
+			}
+		}
+	}
+
+	return
+}
+
+// ExistingKeysStmt generates the statement used by ExistingKeys to retrieve
+// the keys of the entries matching a clientId and the specified number of
+// telemetryIds. Since the number of telemetryIds varies, the statement is
+// not cached.
+func (t *TelemetryDataRow) ExistingKeysStmt(count int) (stmt string) {
+	ph := t.db.Conn().Placeholder(count + 1)
+
+	stmt = "SELECT clientId, telemetryId, timestamp FROM " + t.TableName() +
+		" WHERE clientId = " + ph.Next() + " AND telemetryId IN ("
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			stmt += ", "
+		}
+		stmt += ph.Next()
+	}
+	stmt += ")"
+
+	return
+}
+
+func (t *TelemetryDataRow) scanExistingKeys(existing map[TelemetryDataKey]bool, stmt string, vals []any) (err error) {
+	rows, err := t.Executor().Query(stmt, vals...)
 	if err != nil {
-		slog.Error(
-			"insert statement generation failed",
-			slog.String("table", t.TableName()),
-			slog.String("error", err.Error()),
-		)
 		return
 	}
+	defer rows.Close()
 
-	row := t.DB().QueryRow(
-		stmt,
+	for rows.Next() {
+		var key TelemetryDataKey
+		var timestamp time.Time
+		if err = rows.Scan(&key.ClientId, &key.TelemetryId, &timestamp); err != nil {
+			return
+		}
+		key.Timestamp = telemetryDataKeyTimestamp(timestamp)
+		existing[key] = true
+	}
+
+	return rows.Err()
+}
+
+func (t *TelemetryDataRow) insertCols() []string {
+	return []string{
+		"clientId",
+		"customerRefId",
+		"telemetryId",
+		"telemetryType",
+		"timestamp",
+		"tagSetId",
+		"dataItem",
+	}
+}
+
+func (t *TelemetryDataRow) insertVals() []any {
+	return []any{
 		t.ClientId,
 		t.CustomerRefId,
 		t.TelemetryId,
 		t.TelemetryType,
-		t.Timestamp,
+		DbTime(t.Timestamp),
 		t.TagSetId,
 		t.DataItem,
-	)
+	}
+}
+
+// InsertRows bulk inserts the specified rows, returning the number of rows
+// inserted. Unlike Insert, the ids of the inserted rows are not retrieved.
+func (t *TelemetryDataRow) InsertRows(rows []*TelemetryDataRow) (inserted int64, err error) {
+	vals := make([][]any, len(rows))
+	for i, row := range rows {
+		vals[i] = row.insertVals()
+	}
+
+	inserted, err = t.BulkInsert(t.insertCols(), vals)
+	if err != nil {
+		slog.Error(
+			"bulk insert failed",
+			slog.String("table", t.TableName()),
+			slog.Int("rows", len(rows)),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (t *TelemetryDataRow) Insert() (err error) {
+	stmt, err := t.InsertStmt(t.insertCols(), "id")
+	if err != nil {
+		slog.Error(
+			"insert statement generation failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := t.Executor().QueryRow(stmt, t.insertVals()...)
 	if err = row.Scan(
 		&t.Id,
 	); err != nil {
@@ -192,7 +357,7 @@ func (t *TelemetryDataRow) Insert() (err error) {
 			slog.String("table", t.TableName()),
 			slog.String("clientId", t.ClientId),
 			slog.String("telemetryId", t.TelemetryId),
-			slog.String("timestamp", t.Timestamp),
+			slog.Time("timestamp", t.Timestamp),
 			slog.String("error", err.Error()),
 		)
 	}
@@ -224,13 +389,13 @@ func (t *TelemetryDataRow) Update() (err error) {
 		return
 	}
 
-	_, err = t.DB().Exec(
+	_, err = t.Executor().Exec(
 		stmt,
 		t.ClientId,
 		t.CustomerRefId,
 		t.TelemetryId,
 		t.TelemetryType,
-		t.Timestamp,
+		DbTime(t.Timestamp),
 		t.TagSetId,
 		t.DataItem,
 		t.Id,
@@ -261,7 +426,7 @@ func (t *TelemetryDataRow) Delete() (err error) {
 		return
 	}
 
-	_, err = t.DB().Exec(
+	_, err = t.Executor().Exec(
 		stmt,
 		t.Id,
 	)
@@ -276,5 +441,262 @@ func (t *TelemetryDataRow) Delete() (err error) {
 	return
 }
 
+// DeleteForCustomer deletes the telemetry data entries referencing the
+// row's customerRefId, returning the number deleted
+func (t *TelemetryDataRow) DeleteForCustomer() (deleted int64, err error) {
+	stmt, err := t.DeleteStmt(
+		[]string{
+			"customerRefId",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := t.Executor().Exec(stmt, t.CustomerRefId)
+	if err != nil {
+		slog.Error(
+			"telemetry data delete failed",
+			slog.Int64("customerRefId", t.CustomerRefId),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	return result.RowsAffected()
+}
+
+// ReassignCustomer changes the telemetry data entries referencing the row's
+// customerRefId to reference the specified customerRefId instead, returning
+// the number changed
+func (t *TelemetryDataRow) ReassignCustomer(customerRefId int64) (updated int64, err error) {
+	stmt, err := t.UpdateStmt(
+		[]string{
+			"customerRefId",
+		},
+		[]string{
+			"customerRefId",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	result, err := t.Executor().Exec(stmt, customerRefId, t.CustomerRefId)
+	if err != nil {
+		slog.Error(
+			"telemetry data customer reassignment failed",
+			slog.Int64("customerRefId", t.CustomerRefId),
+			slog.Int64("newCustomerRefId", customerRefId),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	return result.RowsAffected()
+}
+
+// CountReferencing returns the number of telemetry data entries whose
+// column, a foreign key column, references the specified id
+func (t *TelemetryDataRow) CountReferencing(column string, id int64) (count int64, err error) {
+	stmt, err := t.SelectStmt(
+		[]string{
+			"id",
+		},
+		[]string{
+			column,
+		},
+		SelectOpts{
+			Count: true,
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"count statement generation failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	if err = t.Executor().QueryRow(stmt, id).Scan(&count); err != nil {
+		slog.Error(
+			"telemetry data reference count failed",
+			slog.String("column", column),
+			slog.Int64("id", id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// TelemetryDataQuery specifies the telemetry data entries to be retrieved
+// by Query; empty values match all entries
+type TelemetryDataQuery struct {
+	ClientId      string
+	CustomerId    string
+	TelemetryType string
+	// tagSets containing the tag; matching is case insensitive for SQLite
+	// DBs, so callers should confirm exact matches if needed
+	Tag string
+	// only entries with timestamps at, or after, this time will be
+	// retrieved, unless zero
+	After time.Time
+	// only entries with timestamps before this time will be retrieved,
+	// unless zero
+	Before time.Time
+	// only entries with ids greater than this will be retrieved
+	AfterId int64
+	// maximum number of entries to retrieve, 0 for no limit
+	Limit uint
+	// retrieve the dataItem bodies
+	IncludeData bool
+}
+
+// TelemetryDataEntry is a telemetry data entry, with the tagSet and
+// customerId referenced by the entry resolved
+type TelemetryDataEntry struct {
+	Id            int64
+	ClientId      string
+	CustomerRefId int64
+	CustomerId    string
+	TelemetryId   string
+	TelemetryType string
+	Timestamp     time.Time
+	TagSetId      int64
+	TagSet        string
+	DataItem      []byte
+}
+
+// Query retrieves the entries matching the query, in id order, calling fn
+// for each entry until it returns false or an error
+func (t *TelemetryDataRow) Query(q *TelemetryDataQuery, fn func(*TelemetryDataEntry) (bool, error)) (err error) {
+	selectCols := []string{
+		"id",
+		"clientId",
+		"customerRefId",
+		"customers.customerId",
+		"telemetryId",
+		"telemetryType",
+		"timestamp",
+		"tagSetId",
+		"tagSets.tagSet",
+	}
+	if q.IncludeData {
+		selectCols = append(selectCols, "dataItem")
+	}
+
+	var whereCols []string
+	var whereArgs []any
+	if q.ClientId != "" {
+		whereCols = append(whereCols, "clientId")
+		whereArgs = append(whereArgs, q.ClientId)
+	}
+	if q.CustomerId != "" {
+		whereCols = append(whereCols, "customers.customerId")
+		whereArgs = append(whereArgs, q.CustomerId)
+	}
+	if q.TelemetryType != "" {
+		whereCols = append(whereCols, "telemetryType")
+		whereArgs = append(whereArgs, q.TelemetryType)
+	}
+
+	conds := []WhereCond{
+		{Column: "id", Op: WHERE_OP_GT},
+	}
+	condArgs := []any{q.AfterId}
+	if q.Tag != "" {
+		conds = append(conds, WhereCond{Column: "tagSets.tagSet", Op: WHERE_OP_LIKE})
+		condArgs = append(condArgs, "%"+TAG_SET_SEP+LikeEscape(q.Tag)+TAG_SET_SEP+"%")
+	}
+	if !q.After.IsZero() {
+		conds = append(conds, WhereCond{Column: "timestamp", Op: WHERE_OP_GE})
+		condArgs = append(condArgs, DbTime(q.After))
+	}
+	if !q.Before.IsZero() {
+		conds = append(conds, WhereCond{Column: "timestamp", Op: WHERE_OP_LT})
+		condArgs = append(condArgs, DbTime(q.Before))
+	}
+
+	opts := SelectOpts{
+		Joins: []string{
+			"customerRefId",
+			"tagSetId",
+		},
+		Where:   conds,
+		OrderBy: "id",
+		Limit:   q.Limit,
+	}
+	stmt, err := t.SelectStmt(
+		selectCols,
+		whereCols,
+		opts,
+	)
+	if err != nil {
+		slog.Error(
+			"query statement generation failed",
+			slog.String("table", t.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := t.Executor().Query(stmt, opts.Args(append(whereArgs, condArgs...)...)...)
+	if err != nil {
+		slog.Error("telemetry data query failed", slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry TelemetryDataEntry
+		var customerId, tagSet sql.NullString
+		var tagSetId sql.NullInt64
+		dest := []any{
+			&entry.Id,
+			&entry.ClientId,
+			&entry.CustomerRefId,
+			&customerId,
+			&entry.TelemetryId,
+			&entry.TelemetryType,
+			&entry.Timestamp,
+			&tagSetId,
+			&tagSet,
+		}
+		if q.IncludeData {
+			dest = append(dest, &entry.DataItem)
+		}
+		if err = rows.Scan(dest...); err != nil {
+			slog.Error("telemetry data retrieval failed", slog.String("error", err.Error()))
+			return
+		}
+		entry.CustomerId = customerId.String
+		entry.TagSetId = tagSetId.Int64
+		entry.TagSet = tagSet.String
+
+		more, err := fn(&entry)
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		slog.Error("telemetry data iteration failed", slog.String("error", err.Error()))
+	}
+
+	return
+}
+
 // validate that TelemetryDataRow implements TelemetryDataRowHandler interface
 var _ TelemetryDataRowHandler = (*TelemetryDataRow)(nil)
@@ -10,17 +10,90 @@ var telemetryDbTables = database.DbTables{
 	database.GetCustomersTableSpec(),
 	database.GetTagSetsTableSpec(),
 	database.GetTelemetryTableSpec(),
+	database.GetCustomerErasuresTableSpec(),
+	database.GetCacheGenerationsTableSpec(),
 }
 
 func GetTables() database.DbTables {
 	return telemetryDbTables
 }
 
+// Telemetry DB schema migrations, in version order; new entries must
+// only ever be appended
+var telemetryDbMigrations = database.Migrations{
+	{
+		Version:     1,
+		Description: "merge duplicate tagSets and customers entries before adding unique indexes",
+		Up:          mergeDuplicateTagSetsAndCustomers,
+	},
+	{
+		Version:     2,
+		Description: "add tagSets and customers orphanedAt columns",
+		Up: func(m *database.MigrationTx) (err error) {
+			if err = m.AddColumn(database.GetTagSetsTableSpec(), "orphanedAt"); err != nil {
+				return
+			}
+			return m.AddColumn(database.GetCustomersTableSpec(), "orphanedAt")
+		},
+	},
+	{
+		Version:     3,
+		Description: "convert telemetryData and customers timestamp columns to TIMESTAMPTZ",
+		Up: func(m *database.MigrationTx) (err error) {
+			if err = m.ConvertTimestampColumns(database.GetTelemetryTableSpec(), "timestamp"); err != nil {
+				return
+			}
+			return m.ConvertTimestampColumns(database.GetCustomersTableSpec(), "deletedAt")
+		},
+	},
+}
+
+// mergeDuplicateTagSetsAndCustomers merges any duplicate tagSets entries,
+// and active customers entries, that were created by concurrent lookups,
+// repointing telemetry data at the lowest id entry, so that the unique
+// indexes can be created
+func mergeDuplicateTagSetsAndCustomers(m *database.MigrationTx) (err error) {
+	stmts := []string{
+		// repoint telemetry data at the canonical tagSets entry
+		`UPDATE telemetryData SET tagSetId = (` +
+			`SELECT MIN(t2.id) FROM tagSets t1 JOIN tagSets t2 ON t1.tagSet = t2.tagSet ` +
+			`WHERE t1.id = telemetryData.tagSetId) ` +
+			`WHERE tagSetId IN (` +
+			`SELECT t1.id FROM tagSets t1 JOIN tagSets t2 ON t1.tagSet = t2.tagSet AND t2.id < t1.id)`,
+		`DELETE FROM tagSets WHERE id IN (` +
+			`SELECT t1.id FROM tagSets t1 JOIN tagSets t2 ON t1.tagSet = t2.tagSet AND t2.id < t1.id)`,
+
+		// repoint telemetry data at the canonical active customers entry
+		`UPDATE telemetryData SET customerRefId = (` +
+			`SELECT MIN(c2.id) FROM customers c1 JOIN customers c2 ON c1.customerId = c2.customerId ` +
+			`AND c2.deleted = false WHERE c1.id = telemetryData.customerRefId) ` +
+			`WHERE customerRefId IN (` +
+			`SELECT c1.id FROM customers c1 JOIN customers c2 ON c1.customerId = c2.customerId ` +
+			`AND c1.deleted = false AND c2.deleted = false AND c2.id < c1.id)`,
+		`DELETE FROM customers WHERE id IN (` +
+			`SELECT c1.id FROM customers c1 JOIN customers c2 ON c1.customerId = c2.customerId ` +
+			`AND c1.deleted = false AND c2.deleted = false AND c2.id < c1.id)`,
+	}
+
+	for _, stmt := range stmts {
+		if _, err = m.Exec(stmt); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func GetMigrations() database.Migrations {
+	return telemetryDbMigrations
+}
+
 // Get a new Telemetry AppDb instance
 func New(cfg *config.Config) (*database.AppDb, error) {
 	return database.GetDb(
 		"Telemetry",
 		&cfg.DataBases.Telemetry,
 		GetTables(),
+		GetMigrations(),
 	)
 }
@@ -0,0 +1,28 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DbTime normalises a time for storage in a TIMESTAMPTZ column, converting
+// it to UTC, so that the text stored by SQLite DBs sorts chronologically,
+// and rounding it to the microsecond resolution of PostgreSQL, so that the
+// stored value matches the original for both DB types
+func DbTime(t time.Time) time.Time {
+	return t.Round(time.Microsecond).UTC()
+}
+
+// DbNow returns the current time, normalised for storage by DbTime
+func DbNow() time.Time {
+	return DbTime(time.Now())
+}
+
+// nullableTime normalises a time for storage in a nullable TIMESTAMPTZ
+// column, storing a nil time as NULL
+func nullableTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: DbTime(*t), Valid: true}
+}
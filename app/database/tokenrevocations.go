@@ -0,0 +1,355 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// tokenRevocations table specification
+// The tokenRevocations table records auth tokens that have been revoked,
+// either individually, identified by their jti, or collectively, as all
+// tokens issued before the issuedBefore time. Entries are only needed until
+// the tokens they revoke would have expired anyway, after which they can be
+// purged.
+var tokenRevocationsTableSpec = TableSpec{
+	Name: "tokenRevocations",
+	Columns: []TableSpecColumn{
+		{Name: "id", Type: "INTEGER", PrimaryKey: true, Identity: true},
+		{Name: "jti", Type: "VARCHAR", Nullable: true},
+		{Name: "issuedBefore", Type: "TIMESTAMPTZ", Nullable: true},
+		{Name: "revokedAt", Type: "TIMESTAMPTZ"},
+		{Name: "expiresAt", Type: "TIMESTAMPTZ"},
+	},
+	Indexes: []TableSpecIndex{
+		{Columns: []string{"jti"}, Unique: true},
+	},
+}
+
+func GetTokenRevocationsTableSpec() *TableSpec {
+	return &tokenRevocationsTableSpec
+}
+
+type TokenRevocationRow struct {
+	TableRowCommon
+
+	Id           int64      `json:"id"`
+	Jti          string     `json:"jti,omitempty"`
+	IssuedBefore *time.Time `json:"issuedBefore,omitempty"`
+	RevokedAt    time.Time  `json:"revokedAt"`
+	ExpiresAt    time.Time  `json:"expiresAt"`
+}
+
+// InitJti initialises the entry to revoke the token with the specified jti
+func (r *TokenRevocationRow) InitJti(jti string, revokedAt, expiresAt time.Time) {
+	r.Jti = jti
+	r.RevokedAt = revokedAt
+	r.ExpiresAt = expiresAt
+}
+
+// InitIssuedBefore initialises the entry to revoke all tokens issued before
+// the specified time
+func (r *TokenRevocationRow) InitIssuedBefore(issuedBefore, revokedAt, expiresAt time.Time) {
+	r.IssuedBefore = &issuedBefore
+	r.RevokedAt = revokedAt
+	r.ExpiresAt = expiresAt
+}
+
+func (r *TokenRevocationRow) SetupDB(adb *AppDb) error {
+	r.SetTableSpec(GetTokenRevocationsTableSpec())
+	return r.TableRowCommon.SetupDB(adb)
+}
+
+func (r *TokenRevocationRow) TableName() string {
+	return r.TableRowCommon.TableName()
+}
+
+func (r *TokenRevocationRow) RowId() int64 {
+	return r.Id
+}
+
+func (r *TokenRevocationRow) String() string {
+	bytes, _ := json.Marshal(r)
+	return string(bytes)
+}
+
+// nullable returns empty strings as NULL values
+func nullable(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+func (r *TokenRevocationRow) Exists() bool {
+	stmt, err := r.SelectStmt(
+		// select columns
+		[]string{
+			"jti",
+			"issuedBefore",
+			"revokedAt",
+			"expiresAt",
+		},
+		// match columns
+		[]string{
+			"id",
+		},
+		SelectOpts{}, // no special options
+	)
+	if err != nil {
+		slog.Error(
+			"exists statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		panic(err)
+	}
+
+	var jti sql.NullString
+	row := r.Executor().QueryRow(stmt, r.Id)
+	if err := row.Scan(
+		&jti,
+		&r.IssuedBefore,
+		&r.RevokedAt,
+		&r.ExpiresAt,
+	); err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error(
+				"check for matching entry failed",
+				slog.String("table", r.TableName()),
+				slog.Int64("id", r.Id),
+				slog.String("error", err.Error()),
+			)
+		}
+		return false
+	}
+	r.Jti = jti.String
+
+	return true
+}
+
+func (r *TokenRevocationRow) Insert() (err error) {
+	stmt, err := r.InsertStmt(
+		[]string{
+			"jti",
+			"issuedBefore",
+			"revokedAt",
+			"expiresAt",
+		},
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"insert statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := r.Executor().QueryRow(
+		stmt,
+		nullable(r.Jti),
+		nullableTime(r.IssuedBefore),
+		DbTime(r.RevokedAt),
+		DbTime(r.ExpiresAt),
+	)
+	if err = row.Scan(
+		&r.Id,
+	); err != nil {
+		slog.Error(
+			"insert failed",
+			slog.String("table", r.TableName()),
+			slog.String("jti", r.Jti),
+			slog.Any("issuedBefore", r.IssuedBefore),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// Upsert inserts the entry if no entry already exists for its jti, in which
+// case the token has already been revoked and the entry is left unchanged
+func (r *TokenRevocationRow) Upsert() (err error) {
+	stmt, err := r.UpsertStmt(
+		[]string{
+			"jti",
+			"issuedBefore",
+			"revokedAt",
+			"expiresAt",
+		},
+		[]string{
+			"jti",
+		},
+		"",
+		"id",
+	)
+	if err != nil {
+		slog.Error(
+			"upsert statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	row := r.Executor().QueryRow(
+		stmt,
+		nullable(r.Jti),
+		nullableTime(r.IssuedBefore),
+		DbTime(r.RevokedAt),
+		DbTime(r.ExpiresAt),
+	)
+	err = row.Scan(
+		&r.Id,
+	)
+	if err == sql.ErrNoRows {
+		// the token has already been revoked
+		err = nil
+	}
+	if err != nil {
+		slog.Error(
+			"upsert failed",
+			slog.String("table", r.TableName()),
+			slog.String("jti", r.Jti),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (r *TokenRevocationRow) Update() (err error) {
+	stmt, err := r.UpdateStmt(
+		[]string{
+			"jti",
+			"issuedBefore",
+			"revokedAt",
+			"expiresAt",
+		},
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"update statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = r.Executor().Exec(
+		stmt,
+		nullable(r.Jti),
+		nullableTime(r.IssuedBefore),
+		DbTime(r.RevokedAt),
+		DbTime(r.ExpiresAt),
+		r.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"update failed",
+			slog.String("table", r.TableName()),
+			slog.Int64("id", r.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+func (r *TokenRevocationRow) Delete() (err error) {
+	stmt, err := r.DeleteStmt(
+		[]string{
+			"id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"delete statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	_, err = r.Executor().Exec(
+		stmt,
+		r.Id,
+	)
+	if err != nil {
+		slog.Error(
+			"delete failed",
+			slog.String("table", r.TableName()),
+			slog.Int64("id", r.Id),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// List returns all token revocation entries
+func (r *TokenRevocationRow) List() (revocations []*TokenRevocationRow, err error) {
+	stmt, err := r.SelectStmt(
+		[]string{
+			"id",
+			"jti",
+			"issuedBefore",
+			"revokedAt",
+			"expiresAt",
+		},
+		nil,
+		SelectOpts{
+			OrderBy: "id",
+		},
+	)
+	if err != nil {
+		slog.Error(
+			"list statement generation failed",
+			slog.String("table", r.TableName()),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	rows, err := r.Executor().Query(stmt)
+	if err != nil {
+		slog.Error("token revocations query failed", slog.String("error", err.Error()))
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		revocation := new(TokenRevocationRow)
+		if err = revocation.SetupDB(r.db); err != nil {
+			return nil, err
+		}
+
+		var jti sql.NullString
+		if err = rows.Scan(
+			&revocation.Id,
+			&jti,
+			&revocation.IssuedBefore,
+			&revocation.RevokedAt,
+			&revocation.ExpiresAt,
+		); err != nil {
+			slog.Error("token revocation retrieval failed", slog.String("error", err.Error()))
+			return nil, err
+		}
+		revocation.Jti = jti.String
+
+		revocations = append(revocations, revocation)
+	}
+
+	if err = rows.Err(); err != nil {
+		slog.Error("token revocations iteration failed", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	return
+}
+
+// verify that TokenRevocationRow conforms to the TableRowHandler interface
+var _ TableRowHandler = (*TokenRevocationRow)(nil)
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// SqlExecutor is the set of statement execution methods common to both
+// *sql.DB and *sql.Tx, allowing table rows to operate either directly
+// against the DB or as part of a caller supplied transaction
+type SqlExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// verify that *sql.DB and *sql.Tx conform to the SqlExecutor interface
+var _ SqlExecutor = (*sql.DB)(nil)
+var _ SqlExecutor = (*sql.Tx)(nil)
+
+// Tx is a struct tracking a transaction against an AppDb, using a
+// dedicated connection so that driver specific operations, such as
+// COPY FROM, can be performed as part of the transaction
+type Tx struct {
+	*sql.Tx
+
+	// private
+	adb      *AppDb
+	conn     *sql.Conn
+	onCommit []func()
+}
+
+// Begin starts a new transaction against the AppDb
+func (adb *AppDb) Begin() (tx *Tx, err error) {
+	ctx := context.Background()
+
+	conn, err := adb.Conn().DB().Conn(ctx)
+	if err != nil {
+		slog.Error(
+			"transaction connection acquisition failed",
+			slog.String("db", adb.name),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	sqlTx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error(
+			"transaction begin failed",
+			slog.String("db", adb.name),
+			slog.String("error", err.Error()),
+		)
+		conn.Close()
+		return
+	}
+
+	tx = &Tx{
+		Tx:   sqlTx,
+		adb:  adb,
+		conn: conn,
+	}
+
+	return
+}
+
+// Raw provides access to the transaction's underlying driver connection
+func (tx *Tx) Raw(f func(driverConn any) error) error {
+	return tx.conn.Raw(f)
+}
+
+// release returns the transaction's dedicated connection to the pool
+func (tx *Tx) release() {
+	if err := tx.conn.Close(); err != nil && !errors.Is(err, sql.ErrConnDone) {
+		slog.Error(
+			"transaction connection release failed",
+			slog.String("db", tx.adb.name),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// OnCommit registers a function to be called once the transaction has
+// been successfully committed
+func (tx *Tx) OnCommit(f func()) {
+	tx.onCommit = append(tx.onCommit, f)
+}
+
+// Commit commits the transaction, releasing its dedicated connection, and
+// then calls any registered OnCommit functions
+func (tx *Tx) Commit() (err error) {
+	defer tx.release()
+
+	if err = tx.Tx.Commit(); err != nil {
+		return
+	}
+
+	for _, f := range tx.onCommit {
+		f()
+	}
+
+	return
+}
+
+func (tx *Tx) AppDb() *AppDb {
+	return tx.adb
+}
+
+// Rollback aborts the transaction, ignoring the error that is returned
+// if the transaction has already been committed or rolled back, allowing
+// it to be safely deferred, and releases its dedicated connection
+func (tx *Tx) Rollback() (err error) {
+	defer tx.release()
+
+	if err = tx.Tx.Rollback(); err != nil {
+		if errors.Is(err, sql.ErrTxDone) {
+			return nil
+		}
+		slog.Error(
+			"transaction rollback failed",
+			slog.String("db", tx.adb.name),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return
+}
+
+// checkTx verifies that the transaction, if specified, was started against
+// the specified AppDb
+func checkTx(tx *Tx, adb *AppDb) error {
+	if tx != nil && tx.adb != adb {
+		return fmt.Errorf(
+			"transaction for db %q cannot be used with db %q",
+			tx.adb.name,
+			adb.name,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationSfxMap = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": time.Hour * 24,
+	"w": time.Hour * 24 * 7,
+}
+
+func validDurationSuffixes() (sfxs string) {
+	for k := range durationSfxMap {
+		sfxs += k
+	}
+	return
+}
+
+// configDuration is a helper function that converts a config duration
+// setting into a time.Duration, using the specified default if no value
+// was provided.
+func configDuration(setting, cfgDuration, defDuration string) (timeDuration time.Duration, err error) {
+	// support s for seconds, m for minutes, h for hours, d for days and
+	// w for weeks, with no suffix meaning seconds
+
+	// strip off surrounding whitespace
+	stripped := strings.TrimSpace(cfgDuration)
+
+	// use the default duration if none specified
+	if stripped == "" {
+		stripped = defDuration
+	}
+
+	sfx := strings.TrimLeft(stripped, " +-0123456789")
+	digits := strings.TrimSpace(strings.TrimSuffix(stripped, sfx))
+
+	slog.Debug(
+		"timeDuration",
+		slog.String("setting", setting),
+		slog.String("cfgDuration", cfgDuration),
+		slog.String("stripped", stripped),
+		slog.String("digits", digits),
+		slog.String("sfx", sfx),
+	)
+
+	// convert the digits to an int64
+	durationCount, err := strconv.ParseInt(digits, 0, 64)
+	if err != nil {
+		return
+	}
+
+	// duration must be > 0
+	if durationCount <= 0 {
+		err = fmt.Errorf(
+			"invalid %s value '%s', must be greater than 0",
+			setting,
+			cfgDuration,
+		)
+		return
+	}
+
+	// assume seconds if no suffix specified
+	if sfx == "" {
+		sfx = "s"
+	}
+
+	// determine the suffix multiplier
+	sfxMult, ok := durationSfxMap[sfx]
+	if !ok {
+		err = fmt.Errorf(
+			"invalid %s suffix '%s', must be one of [%s]",
+			setting,
+			sfx,
+			validDurationSuffixes(),
+		)
+		return
+	}
+
+	timeDuration = time.Duration(durationCount) * sfxMult
+
+	return
+}
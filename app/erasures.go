@@ -0,0 +1,215 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/SUSE/telemetry-server/app/config"
+	"github.com/SUSE/telemetry-server/app/database"
+	"github.com/google/uuid"
+)
+
+// customer erasure policies, determining what happens to an erased
+// customer's telemetry data
+const (
+	// the customer's telemetry data is deleted
+	ERASURE_POLICY_PURGE = "purge"
+	// the customer's telemetry data is retained, but reassigned to the
+	// anonymous customer
+	ERASURE_POLICY_DETACH = "detach"
+)
+
+// errCustomerNotFound is returned when erasing a customerId that has no
+// active customers entry, e.g. because it has already been erased
+var errCustomerNotFound = errors.New("customer not found")
+
+// errErasureSecretMissing is returned when erasing customers, or looking up
+// their erasure receipts, without an erasure secret having been configured
+var errErasureSecretMissing = errors.New("erasure.secret must be configured to erase customers")
+
+// checkErasurePolicy validates the erasure policy
+func checkErasurePolicy(setting, policy string) error {
+	switch policy {
+	case ERASURE_POLICY_PURGE, ERASURE_POLICY_DETACH:
+		return nil
+	}
+	return fmt.Errorf(
+		"invalid %s value %q, must be one of %q or %q",
+		setting,
+		policy,
+		ERASURE_POLICY_PURGE,
+		ERASURE_POLICY_DETACH,
+	)
+}
+
+// customerEraser erases customers from the telemetry DB, recording a
+// receipt for each erasure, using the configured policy and pseudonymise
+// settings unless overridden for an individual erasure
+type customerEraser struct {
+	app          *App
+	policy       string
+	pseudonymise bool
+	secret       []byte
+}
+
+func newCustomerEraser(a *App, ec *config.ErasureConfig) (ce *customerEraser, err error) {
+	ce = new(customerEraser)
+	ce.app = a
+	ce.pseudonymise = ec.Pseudonymise
+
+	ce.policy = ec.Policy
+	if ce.policy == "" {
+		ce.policy = config.DEF_ERASURE_POLICY
+	}
+	if err = checkErasurePolicy("erasure.policy", ce.policy); err != nil {
+		return nil, err
+	}
+
+	// the secret is only needed by services that erase customers
+	if ec.Secret != "" {
+		if ce.secret, err = base64.StdEncoding.DecodeString(ec.Secret); err != nil {
+			return nil, fmt.Errorf("invalid erasure.secret value, must be a valid base64 encoded value: %w", err)
+		}
+	}
+
+	return
+}
+
+// customerIdHash returns the hex encoded HMAC-SHA256 of the customerId,
+// keyed by the erasure secret, which is recorded in erasure receipts, such
+// that the erasure of a given customerId can be verified, without the
+// customerId being recoverable from the receipt by enumerating candidates
+func (ce *customerEraser) customerIdHash(customerId string) (string, error) {
+	if len(ce.secret) == 0 {
+		return "", errErasureSecretMissing
+	}
+
+	mac := hmac.New(sha256.New, ce.secret)
+	mac.Write([]byte(customerId))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// customerIdPseudonym returns a random pseudonym to replace the customerId
+// of a pseudonymised customers entry, which has no relation to the erased
+// customerId
+func customerIdPseudonym() string {
+	return "erased-" + uuid.NewString()
+}
+
+// erase marks the active customers entry of the customerId as deleted,
+// purging or detaching its telemetry data according to the policy, and
+// optionally replacing its customerId with a random pseudonym, returning
+// the receipt recorded for the erasure
+func (ce *customerEraser) erase(customerId, policy string, pseudonymise bool) (receipt *database.CustomerErasureRow, err error) {
+	a := ce.app
+
+	hash, err := ce.customerIdHash(customerId)
+	if err != nil {
+		return
+	}
+
+	tx, err := a.TelemetryDB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin customer erasure transaction: %w", err)
+	}
+
+	// rollback any changes if we fail to commit the transaction
+	defer tx.Rollback()
+
+	customer := new(database.CustomersRow)
+	if err = customer.SetupDB(a.TelemetryDB); err != nil {
+		return nil, fmt.Errorf("customersRow.SetupDB() failed: %w", err)
+	}
+	if err = customer.SetTx(tx); err != nil {
+		return nil, fmt.Errorf("customersRow.SetTx() failed: %w", err)
+	}
+
+	// only the active entry can be erased
+	customer.Init(customerId)
+	customer.Deleted = false
+	if !customer.Exists() {
+		return nil, errCustomerNotFound
+	}
+
+	// mark the entry as deleted before its telemetry data is purged or
+	// detached, so that reports that locked the entry before it was marked
+	// have stored their data by then, while later reports will no longer
+	// find it active and will look up the customer again
+	erasedAt := database.DbNow()
+
+	customer.Deleted = true
+	customer.DeletedAt = &erasedAt
+	if pseudonymise {
+		customer.CustomerId = customerIdPseudonym()
+	}
+	if err = customer.Update(); err != nil {
+		return nil, fmt.Errorf("failed to mark customer %d deleted: %w", customer.Id, err)
+	}
+
+	data := new(database.TelemetryDataRow)
+	if err = data.SetupDB(a.TelemetryDB); err != nil {
+		return nil, fmt.Errorf("telemetryDataRow.SetupDB() failed: %w", err)
+	}
+	if err = data.SetTx(tx); err != nil {
+		return nil, fmt.Errorf("telemetryDataRow.SetTx() failed: %w", err)
+	}
+	data.CustomerRefId = customer.Id
+
+	var dataItems int64
+	switch policy {
+	case ERASURE_POLICY_PURGE:
+		if dataItems, err = data.DeleteForCustomer(); err != nil {
+			return nil, fmt.Errorf("failed to purge telemetry data of customer %d: %w", customer.Id, err)
+		}
+	case ERASURE_POLICY_DETACH:
+		var anonymousRefId int64
+		if anonymousRefId, err = a.GetCustomerRefId(tx, ANONYMOUS_CUSTOMER_ID); err != nil {
+			return nil, fmt.Errorf("failed to retrieve anonymous customer: %w", err)
+		}
+		if dataItems, err = data.ReassignCustomer(anonymousRefId); err != nil {
+			return nil, fmt.Errorf("failed to detach telemetry data of customer %d: %w", customer.Id, err)
+		}
+	default:
+		return nil, checkErasurePolicy("policy", policy)
+	}
+
+	receipt = new(database.CustomerErasureRow)
+	if err = receipt.SetupDB(a.TelemetryDB); err != nil {
+		return nil, fmt.Errorf("customerErasureRow.SetupDB() failed: %w", err)
+	}
+	if err = receipt.SetTx(tx); err != nil {
+		return nil, fmt.Errorf("customerErasureRow.SetTx() failed: %w", err)
+	}
+	receipt.Init(customer.Id, hash, pseudonymise, policy, dataItems, erasedAt)
+	if err = receipt.Insert(); err != nil {
+		return nil, fmt.Errorf("failed to record erasure receipt of customer %d: %w", customer.Id, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit customer erasure: %w", err)
+	}
+
+	return
+}
+
+// listErasures returns up to limit erasure receipts, starting at offset,
+// optionally limited to those of the specified customerId
+func (a *App) listErasures(customerId string, limit, offset uint) (receipts []*database.CustomerErasureRow, err error) {
+	receipt := new(database.CustomerErasureRow)
+	if err = receipt.SetupDB(a.TelemetryDB); err != nil {
+		return nil, fmt.Errorf("customerErasureRow.SetupDB() failed: %w", err)
+	}
+
+	if customerId = strings.TrimSpace(customerId); customerId != "" {
+		if receipt.CustomerIdHash, err = a.erasures.customerIdHash(customerId); err != nil {
+			return
+		}
+	}
+
+	return receipt.List(limit, offset)
+}
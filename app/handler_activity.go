@@ -0,0 +1,113 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/database"
+)
+
+// default and maximum number of client activity entries returned per request
+const (
+	activityDefLimit uint = 100
+	activityMaxLimit uint = 1000
+)
+
+// getDaysAgo retrieves the named query parameter, specifying a number of
+// days, returning the time that many days ago, or the zero time if the
+// parameter wasn't specified
+func getDaysAgo(ar *AppRequest, param string) (t time.Time, err error) {
+	value := ar.GetQueryParam(param)
+	if value == "" {
+		return
+	}
+
+	days, err := strconv.ParseUint(value, 10, 0)
+	if err != nil || days == 0 {
+		return t, fmt.Errorf("invalid %s value %q, must be a positive number of days", param, value)
+	}
+
+	return time.Now().AddDate(0, 0, -int(days)), nil
+}
+
+// ListClientActivity is responsible for handling requests to list the
+// activity of client registrations, optionally filtered to those that have,
+// or haven't, been active within a number of days, or that are using a
+// specific client version
+func (a *App) ListClientActivity(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	limit, offset, err := ar.GetPagination(activityDefLimit, activityMaxLimit)
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	q := database.ClientActivityQuery{
+		Limit:  limit,
+		Offset: offset,
+	}
+	if q.InactiveSince, err = getDaysAgo(ar, "inactiveDays"); err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+	if q.ActiveSince, err = getDaysAgo(ar, "activeDays"); err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+	q.ClientVersion = ar.GetQueryParam("clientVersion")
+
+	activities, total, err := a.listClientActivity(&q)
+	if err != nil {
+		ar.Log.Error("client activity listing failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve client activity")
+		return
+	}
+
+	// ensure an empty list is returned rather than null
+	if activities == nil {
+		activities = []*database.ClientActivityEntry{}
+	}
+
+	payload := struct {
+		Clients []*database.ClientActivityEntry `json:"clients"`
+		Total   uint                            `json:"total"`
+		Limit   uint                            `json:"limit"`
+		Offset  uint                            `json:"offset"`
+	}{
+		Clients: activities,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
+
+// GetClientActivity is responsible for handling requests to retrieve the
+// activity of the client registration identified by the id path variable
+func (a *App) GetClientActivity(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	id, err := ar.GetVarInt64("id")
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	activity, err := a.lookupClientActivity(id)
+	if err != nil {
+		ar.Log.Error("client activity lookup failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve client activity")
+		return
+	}
+	if activity == nil {
+		ar.ErrorResponse(http.StatusNotFound, "client activity not found")
+		return
+	}
+
+	ar.JsonResponse(http.StatusOK, activity)
+}
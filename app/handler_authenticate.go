@@ -8,6 +8,7 @@ import (
 
 	"github.com/SUSE/telemetry-server/app/database"
 	"github.com/SUSE/telemetry/pkg/restapi"
+	"github.com/SUSE/telemetry/pkg/types"
 )
 
 // RegisterClient is responsible for handling client registrations
@@ -70,27 +71,39 @@ func (a *App) AuthenticateClient(ar *AppRequest) {
 		return
 	}
 
-	// TODO: return existing token if remaining duration is >= half of
-	// a new tokens duration
-
-	// create a new token for the client
-	client.AuthToken, err = a.AuthManager.CreateToken()
-	if err != nil {
-		ar.ErrorResponse(http.StatusInternalServerError, "failed to create new authtoken for client")
+	// detect interleaved authentications of the registration by cloned
+	// systems, before recording the authentication in the client's activity
+	if err = a.clones.authenticated(client); err != nil {
+		ar.Log.Warn("clone detection failed", slog.String("error", err.Error()))
+	}
+	if err = a.recordClientAuthentication(ar, client.Id); err != nil {
+		ar.Log.Warn("client activity recording failed", slog.String("error", err.Error()))
 	}
 
-	// update token stored in the DB
-	err = client.Update()
-	if err != nil {
-		ar.ErrorResponse(http.StatusInternalServerError, "failed to client authtoken")
-		return
+	// return the existing token if enough of its lifetime remains,
+	// otherwise create and store a new token for the client
+	if a.AuthManager.TokenReusable(client.AuthToken, client.Id) {
+		ar.Log.Debug("Reusing existing authtoken", slog.Int64("registrationId", client.Id))
+	} else {
+		client.AuthToken, err = a.AuthManager.CreateToken(client.Id)
+		if err != nil {
+			ar.ErrorResponse(http.StatusInternalServerError, "failed to create new authtoken for client")
+			return
+		}
+
+		// update token stored in the DB
+		err = client.Update()
+		if err != nil {
+			ar.ErrorResponse(http.StatusInternalServerError, "failed to client authtoken")
+			return
+		}
 	}
 
 	// initialise a client registration response
 	caResp := restapi.ClientAuthenticationResponse{
 		RegistrationId:   client.Id,
 		AuthToken:        client.AuthToken,
-		RegistrationDate: client.RegistrationDate,
+		RegistrationDate: types.TelemetryTimeStamp{Time: client.RegistrationDate}.String(),
 	}
 	ar.Log.Debug("Response", slog.Any("caResp", caResp))
 
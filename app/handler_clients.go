@@ -0,0 +1,212 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/database"
+	"github.com/SUSE/telemetry/pkg/types"
+)
+
+// RevokeClient is responsible for handling requests to revoke the client
+// registration identified by the request's id path variable, such that the
+// client's authtoken is rejected and it will need to register again
+func (a *App) RevokeClient(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	id, err := ar.GetVarInt64("id")
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	client := new(database.ClientsRow)
+	if err = client.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("clientsRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+	client.InitRegistrationId(id)
+
+	if !client.Exists() {
+		ar.ErrorResponse(http.StatusNotFound, "client registration not found")
+		return
+	}
+
+	if err = a.revokeRegistrations([]int64{client.Id}); err != nil {
+		ar.Log.Error("client revocation failed", slog.Int64("id", client.Id), slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to revoke client registration")
+		return
+	}
+
+	ar.Log.Info(
+		"Client registration revoked",
+		slog.Int64("id", client.Id),
+		slog.String("clientId", client.ClientId),
+	)
+
+	payload := struct {
+		Revoked []int64 `json:"revoked"`
+	}{
+		Revoked: []int64{client.Id},
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
+
+// RevokeClientsByClientId is responsible for handling requests to revoke
+// all client registrations using the clientId specified by the request's
+// clientId query parameter, e.g. registrations of cloned systems
+func (a *App) RevokeClientsByClientId(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	clientId := ar.GetQueryParam("clientId")
+	if clientId == "" {
+		ar.ErrorResponse(http.StatusBadRequest, "missing clientId query parameter")
+		return
+	}
+
+	client := new(database.ClientsRow)
+	if err := client.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("clientsRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+	client.ClientId = clientId
+
+	ids, err := client.RegistrationIdsForClientId()
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve client registrations")
+		return
+	}
+
+	if len(ids) == 0 {
+		ar.ErrorResponse(http.StatusNotFound, "no client registrations found")
+		return
+	}
+
+	if err = a.revokeRegistrations(ids); err != nil {
+		ar.Log.Error("client revocation failed", slog.String("clientId", clientId), slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to revoke client registrations")
+		return
+	}
+
+	ar.Log.Info(
+		"Client registrations revoked",
+		slog.String("clientId", clientId),
+		slog.Any("ids", ids),
+	)
+
+	payload := struct {
+		Revoked []int64 `json:"revoked"`
+	}{
+		Revoked: ids,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
+
+// default and maximum number of clients returned per request
+const (
+	clientsDefLimit uint = 100
+	clientsMaxLimit uint = 1000
+)
+
+// getTimeParam retrieves the named query parameter as an RFC3339 timestamp,
+// returning the zero time if the parameter wasn't specified
+func getTimeParam(ar *AppRequest, param string) (t time.Time, err error) {
+	value := ar.GetQueryParam(param)
+	if value == "" {
+		return
+	}
+
+	ts, err := types.TimeStampFromString(value)
+	if err != nil {
+		return t, fmt.Errorf("invalid %s value %q, must be an RFC3339 timestamp", param, value)
+	}
+
+	return ts.Time, nil
+}
+
+// ListClients is responsible for handling requests to list the registered
+// clients, optionally filtered by clientId, systemUUID and registration
+// date range, without exposing their authtokens
+func (a *App) ListClients(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	limit, offset, err := ar.GetPagination(clientsDefLimit, clientsMaxLimit)
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter := clientsFilter{
+		ClientId:   ar.GetQueryParam("clientId"),
+		SystemUUID: ar.GetQueryParam("systemUUID"),
+	}
+	if filter.RegisteredAfter, err = getTimeParam(ar, "registeredAfter"); err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.RegisteredBefore, err = getTimeParam(ar, "registeredBefore"); err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	clients, err := a.listClients(&filter, limit, offset)
+	if err != nil {
+		ar.Log.Error("client listing failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve clients")
+		return
+	}
+
+	// ensure an empty list is returned rather than null
+	if clients == nil {
+		clients = []*database.ClientsRow{}
+	}
+
+	payload := struct {
+		Clients []*database.ClientsRow `json:"clients"`
+		Limit   uint                   `json:"limit"`
+		Offset  uint                   `json:"offset"`
+	}{
+		Clients: clients,
+		Limit:   limit,
+		Offset:  offset,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
+
+// GetClient is responsible for handling requests to retrieve the client
+// registration identified by the request's id path variable, without
+// exposing its authtoken
+func (a *App) GetClient(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	id, err := ar.GetVarInt64("id")
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	client := new(database.ClientsRow)
+	if err = client.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("clientsRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+	client.InitRegistrationId(id)
+
+	if !client.Exists() {
+		ar.ErrorResponse(http.StatusNotFound, "client registration not found")
+		return
+	}
+
+	// never expose the client's authToken
+	client.AuthToken = ""
+
+	ar.JsonResponse(http.StatusOK, client)
+}
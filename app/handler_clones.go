@@ -0,0 +1,198 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/SUSE/telemetry-server/app/database"
+)
+
+// default and maximum number of suspected clones returned per request
+const (
+	clonesDefLimit uint = 100
+	clonesMaxLimit uint = 1000
+)
+
+// lookupSuspectedClone retrieves the client identified by the request's id
+// path variable, generating an appropriate error response and returning nil
+// if it could not be found or is not a suspected clone
+func (a *App) lookupSuspectedClone(ar *AppRequest) *database.ClientsRow {
+	id, err := ar.GetVarInt64("id")
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	client := new(database.ClientsRow)
+	if err = client.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("clientsRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return nil
+	}
+	client.InitRegistrationId(id)
+
+	if !client.Exists() || !client.CloneSuspected {
+		ar.ErrorResponse(http.StatusNotFound, "suspected clone not found")
+		return nil
+	}
+
+	// never expose the client's authToken
+	client.AuthToken = ""
+
+	return client
+}
+
+// ListSuspectedClones is responsible for handling requests to list the
+// client registrations that have been flagged as suspected clones
+func (a *App) ListSuspectedClones(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	limit, offset, err := ar.GetPagination(clonesDefLimit, clonesMaxLimit)
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	client := new(database.ClientsRow)
+	if err = client.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("clientsRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+
+	clients, err := client.ListCloneSuspected(limit, offset)
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve suspected clones")
+		return
+	}
+
+	// ensure an empty list is returned rather than null
+	if clients == nil {
+		clients = []*database.ClientsRow{}
+	}
+
+	payload := struct {
+		Clients []*database.ClientsRow `json:"clients"`
+		Limit   uint                   `json:"limit"`
+		Offset  uint                   `json:"offset"`
+	}{
+		Clients: clients,
+		Limit:   limit,
+		Offset:  offset,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
+
+// GetSuspectedClone is responsible for handling requests to inspect a
+// suspected clone, including the clone signals recorded for it
+func (a *App) GetSuspectedClone(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	client := a.lookupSuspectedClone(ar)
+	if client == nil {
+		return
+	}
+
+	cs := new(database.CloneSignalRow)
+	if err := cs.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("cloneSignalRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+	cs.RegistrationId = client.Id
+
+	signals, err := cs.ListForRegistration()
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve clone signals")
+		return
+	}
+
+	// ensure an empty list is returned rather than null
+	if signals == nil {
+		signals = []*database.CloneSignalRow{}
+	}
+
+	payload := struct {
+		Client  *database.ClientsRow       `json:"client"`
+		Signals []*database.CloneSignalRow `json:"signals"`
+	}{
+		Client:  client,
+		Signals: signals,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
+
+// ClearSuspectedClone is responsible for handling requests to clear the
+// suspected clone flag of a client registration, once an administrator has
+// reviewed it, discarding the clone signals recorded for it
+func (a *App) ClearSuspectedClone(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	client := a.lookupSuspectedClone(ar)
+	if client == nil {
+		return
+	}
+
+	tx, err := a.OperationalDB.Begin()
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+
+	// rollback any changes if we fail to commit the transaction
+	defer tx.Rollback()
+
+	cs := new(database.CloneSignalRow)
+	if err = cs.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("cloneSignalRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+	if err = cs.SetTx(tx); err != nil {
+		ar.Log.Error("cloneSignalRow.SetTx() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+	cs.RegistrationId = client.Id
+
+	discarded, err := cs.DeleteForRegistration()
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to discard clone signals")
+		return
+	}
+
+	if err = client.SetTx(tx); err != nil {
+		ar.Log.Error("clientsRow.SetTx() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+	if err = client.SetCloneSuspected(false, database.DbNow()); err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to clear suspected clone")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		ar.Log.Error("suspected clone clearing commit failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to clear suspected clone")
+		return
+	}
+
+	ar.Log.Info(
+		"Suspected clone cleared",
+		slog.Int64("id", client.Id),
+		slog.String("clientId", client.ClientId),
+		slog.Int64("discardedSignals", discarded),
+	)
+
+	payload := struct {
+		Id               int64 `json:"id"`
+		DiscardedSignals int64 `json:"discardedSignals"`
+	}{
+		Id:               client.Id,
+		DiscardedSignals: discarded,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
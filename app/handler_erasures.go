@@ -0,0 +1,154 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SUSE/telemetry-server/app/database"
+)
+
+// default and maximum number of erasure receipts returned per request
+const (
+	erasuresDefLimit uint = 100
+	erasuresMaxLimit uint = 1000
+)
+
+// EraseCustomer is responsible for handling requests to erase the customer
+// specified by the request's customerId query parameter, marking it deleted
+// and purging or detaching its telemetry data according to the optional
+// policy query parameter, optionally replacing its customerId with a random
+// pseudonym if the pseudonymise query parameter is true; the configured
+// erasure settings are used for unspecified parameters. Responds with the
+// recorded erasure receipt.
+func (a *App) EraseCustomer(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	customerId := strings.TrimSpace(ar.GetQueryParam("customerId"))
+	if customerId == "" {
+		ar.ErrorResponse(http.StatusBadRequest, "missing customerId query parameter")
+		return
+	}
+
+	// the anonymous customer is shared by all customers that don't
+	// identify themselves, and is where detached telemetry data is kept
+	if strings.ToUpper(customerId) == ANONYMOUS_CUSTOMER_ID {
+		ar.ErrorResponse(http.StatusBadRequest, "the anonymous customer cannot be erased")
+		return
+	}
+
+	policy := a.erasures.policy
+	if param := ar.GetQueryParam("policy"); param != "" {
+		if err := checkErasurePolicy("policy", param); err != nil {
+			ar.ErrorResponse(http.StatusBadRequest, err.Error())
+			return
+		}
+		policy = param
+	}
+
+	pseudonymise := a.erasures.pseudonymise
+	if param := ar.GetQueryParam("pseudonymise"); param != "" {
+		var err error
+		if pseudonymise, err = strconv.ParseBool(param); err != nil {
+			ar.ErrorResponse(http.StatusBadRequest, fmt.Sprintf("invalid pseudonymise value %q", param))
+			return
+		}
+	}
+
+	receipt, err := a.erasures.erase(customerId, policy, pseudonymise)
+	if err != nil {
+		if errors.Is(err, errCustomerNotFound) {
+			ar.ErrorResponse(http.StatusNotFound, "customer not found")
+			return
+		}
+		if errors.Is(err, errErasureSecretMissing) {
+			ar.ErrorResponse(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		ar.Log.Error("customer erasure failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to erase customer")
+		return
+	}
+
+	ar.Log.Info(
+		"Customer erased",
+		slog.Int64("receipt", receipt.Id),
+		slog.Int64("customerRefId", receipt.CustomerRefId),
+		slog.String("policy", receipt.Policy),
+		slog.Bool("pseudonymised", receipt.Pseudonymised),
+		slog.Int64("dataItems", receipt.DataItems),
+	)
+
+	ar.JsonResponse(http.StatusOK, receipt)
+}
+
+// ListErasures is responsible for handling requests to list the customer
+// erasure receipts, optionally limited to those of the customer specified
+// by the request's customerId query parameter
+func (a *App) ListErasures(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	limit, offset, err := ar.GetPagination(erasuresDefLimit, erasuresMaxLimit)
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	receipts, err := a.listErasures(ar.GetQueryParam("customerId"), limit, offset)
+	if err != nil {
+		if errors.Is(err, errErasureSecretMissing) {
+			ar.ErrorResponse(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		ar.Log.Error("erasure receipt listing failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve erasure receipts")
+		return
+	}
+
+	// ensure an empty list is returned rather than null
+	if receipts == nil {
+		receipts = []*database.CustomerErasureRow{}
+	}
+
+	payload := struct {
+		Erasures []*database.CustomerErasureRow `json:"erasures"`
+		Limit    uint                           `json:"limit"`
+		Offset   uint                           `json:"offset"`
+	}{
+		Erasures: receipts,
+		Limit:    limit,
+		Offset:   offset,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
+
+// GetErasure is responsible for handling requests to retrieve the customer
+// erasure receipt identified by the request's id path variable
+func (a *App) GetErasure(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	id, err := ar.GetVarInt64("id")
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	receipt := new(database.CustomerErasureRow)
+	if err = receipt.SetupDB(a.TelemetryDB); err != nil {
+		ar.Log.Error("customerErasureRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+	receipt.Id = id
+
+	if !receipt.Exists() {
+		ar.ErrorResponse(http.StatusNotFound, "erasure receipt not found")
+		return
+	}
+
+	ar.JsonResponse(http.StatusOK, receipt)
+}
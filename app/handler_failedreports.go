@@ -0,0 +1,209 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/SUSE/telemetry-server/app/database"
+)
+
+// default and maximum number of failed reports returned per request
+const (
+	failedReportsDefLimit uint = 100
+	failedReportsMaxLimit uint = 1000
+)
+
+// lookupFailedReport retrieves the failed report identified by the request's
+// id path variable, generating an appropriate error response and returning
+// nil if it could not be found
+func (a *App) lookupFailedReport(ar *AppRequest) *database.FailedReportRow {
+	id, err := ar.GetVarInt64("id")
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	failed := new(database.FailedReportRow)
+	if err = failed.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("FailedReportRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return nil
+	}
+	failed.InitId(id)
+
+	if !failed.Exists() {
+		ar.ErrorResponse(http.StatusNotFound, "failed report not found")
+		return nil
+	}
+
+	return failed
+}
+
+// ListFailedReports is responsible for handling requests to list the
+// reports that have been moved to the failedReports table
+func (a *App) ListFailedReports(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	limit, offset, err := ar.GetPagination(failedReportsDefLimit, failedReportsMaxLimit)
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	failed := new(database.FailedReportRow)
+	if err = failed.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("FailedReportRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+
+	reports, err := failed.List(limit, offset)
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve failed reports")
+		return
+	}
+
+	// ensure an empty list is returned rather than null
+	if reports == nil {
+		reports = []*database.FailedReportRow{}
+	}
+
+	payload := struct {
+		FailedReports []*database.FailedReportRow `json:"failedReports"`
+		Limit         uint                        `json:"limit"`
+		Offset        uint                        `json:"offset"`
+	}{
+		FailedReports: reports,
+		Limit:         limit,
+		Offset:        offset,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
+
+// GetFailedReport is responsible for handling requests to inspect a failed
+// report, including the raw report body
+func (a *App) GetFailedReport(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	failed := a.lookupFailedReport(ar)
+	if failed == nil {
+		return
+	}
+
+	// return the report body as a string, since it may not be valid JSON
+	data, err := failed.DataBytes()
+	if err != nil {
+		ar.Log.Error("failed report data retrieval failed", slog.Int64("id", failed.Id), slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve failed report data")
+		return
+	}
+	failed.Data = string(data)
+
+	ar.JsonResponse(http.StatusOK, failed)
+}
+
+// RequeueFailedReport is responsible for handling requests to move a failed
+// report back into the reports staging table so that it will be processed
+// again
+func (a *App) RequeueFailedReport(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	failed := a.lookupFailedReport(ar)
+	if failed == nil {
+		return
+	}
+
+	staged := new(database.ReportStagingTableRow)
+	if err := staged.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("ReportStagingTableRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+
+	stagingId, err := failed.Requeue(staged)
+	if err != nil {
+		ar.Log.Error("failed report requeue failed", slog.Int64("id", failed.Id), slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to requeue failed report")
+		return
+	}
+
+	ar.Log.Info(
+		"Failed report requeued",
+		slog.Int64("id", failed.Id),
+		slog.Int64("stagingId", stagingId),
+		slog.String("report", failed.ReportIdentifer()),
+	)
+
+	// wake the staging workers, if running, to process the requeued report
+	a.StagingWorkers.Notify()
+
+	payload := struct {
+		Id        int64 `json:"id"`
+		StagingId int64 `json:"stagingId"`
+	}{
+		Id:        failed.Id,
+		StagingId: stagingId,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
+
+// PurgeFailedReport is responsible for handling requests to delete a failed
+// report
+func (a *App) PurgeFailedReport(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	failed := a.lookupFailedReport(ar)
+	if failed == nil {
+		return
+	}
+
+	if err := failed.Delete(); err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to purge failed report")
+		return
+	}
+
+	ar.Log.Info(
+		"Failed report purged",
+		slog.Int64("id", failed.Id),
+		slog.String("report", failed.ReportIdentifer()),
+	)
+
+	payload := struct {
+		Purged int64 `json:"purged"`
+	}{
+		Purged: 1,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
+
+// PurgeFailedReports is responsible for handling requests to delete all
+// failed reports
+func (a *App) PurgeFailedReports(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	failed := new(database.FailedReportRow)
+	if err := failed.SetupDB(a.OperationalDB); err != nil {
+		ar.Log.Error("FailedReportRow.SetupDB() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+
+	purged, err := failed.Purge()
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to purge failed reports")
+		return
+	}
+
+	ar.Log.Info("Failed reports purged", slog.Int64("purged", purged))
+
+	payload := struct {
+		Purged int64 `json:"purged"`
+	}{
+		Purged: purged,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
@@ -0,0 +1,20 @@
+package app
+
+import (
+	"net/http"
+)
+
+// JWKS is responsible for handling requests for the JSON Web Key Set of
+// public keys that client tokens may be verified with, allowing other
+// services to validate tokens without being able to issue them
+func (a *App) JWKS(ar *AppRequest) {
+	ar.Log.Debug("Processing")
+
+	jwks, err := a.AuthManager.JWKS()
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to generate JWKS")
+		return
+	}
+
+	ar.JsonResponse(http.StatusOK, jwks)
+}
@@ -12,30 +12,32 @@ import (
 	"github.com/SUSE/telemetry/pkg/types"
 )
 
-func (a *App) duplicateClientCheck(ar *AppRequest, crReq *restapi.ClientRegistrationRequest) (err error) {
+func (a *App) duplicateClientCheck(ar *AppRequest, crReq *restapi.ClientRegistrationRequest) (dup *database.ClientsRow, err error) {
 	// check if the supplied registration's clientId already exists, e.g. a new
 	// client generated the same UUID value that an existing client is using, and
-	// log a warning.
+	// log a warning, returning the existing registration.
 	// NOTE: risk of duplicate UUID values being generated by independent client
 	// systems is low, and will be further reduced for systems registered with the
 	// SCC, which will assign clientId values that are unique with respect to all
 	// other registered clients at that time.
-	dup := new(database.ClientsRow)
+	dup = new(database.ClientsRow)
 	if err = dup.SetupDB(a.OperationalDB); err != nil {
 		err = fmt.Errorf("clientsRow.SetupDB() for dup check failed: %w", err)
-		return
+		return nil, err
 	}
 	dup.InitClientId(crReq)
-	if dup.ClientIdExists() {
-		ar.Log.Warn(
-			"Duplicate clientId value detected for registration",
-			slog.Int64("id", dup.Id),
-			slog.String("clientId", dup.ClientId),
-			slog.String("systemUUID", dup.SystemUUID),
-			slog.String("timestamp", dup.ClientTimestamp),
-		)
+	if !dup.ClientIdExists() {
+		return nil, nil
 	}
 
+	ar.Log.Warn(
+		"Duplicate clientId value detected for registration",
+		slog.Int64("id", dup.Id),
+		slog.String("clientId", dup.ClientId),
+		slog.String("systemUUID", dup.SystemUUID),
+		slog.String("timestamp", dup.ClientTimestamp),
+	)
+
 	return
 }
 
@@ -84,14 +86,34 @@ func (a *App) RegisterClient(ar *AppRequest) {
 	// init with request supplied values
 	client.InitRegistration(&crReq)
 
-	// check if the supplied registration already exists, e.g. cloned system
+	// check if the supplied registration already exists, e.g. cloned system,
+	// permitting suspected clones that are being forced to register again to
+	// obtain a registration of their own
 	if client.RegistrationExists() {
-		ar.ErrorResponse(http.StatusConflict, "specified registration already exists")
-		return
+		if !client.Exists() || !a.clones.forceReregister(client) {
+			ar.ErrorResponse(http.StatusConflict, "specified registration already exists")
+			return
+		}
+
+		ar.Log.Warn(
+			"Re-registering suspected clone",
+			slog.Int64("id", client.Id),
+			slog.String("clientId", client.ClientId),
+		)
+
+		// start afresh with just the request supplied values
+		client = new(database.ClientsRow)
+		if err = client.SetupDB(a.OperationalDB); err != nil {
+			ar.Log.Error("clientsRow.SetupDB() failed", slog.String("error", err.Error()))
+			ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+			return
+		}
+		client.InitRegistration(&crReq)
 	}
 
 	// check for a duplicate clientId
-	if err = a.duplicateClientCheck(ar, &crReq); err != nil {
+	dup, err := a.duplicateClientCheck(ar, &crReq)
+	if err != nil {
 		ar.Log.Error("duplicate clientId check failed", slog.String("error", err.Error()))
 		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
 		return
@@ -101,15 +123,26 @@ func (a *App) RegisterClient(ar *AppRequest) {
 	// register the client
 	//
 
-	// generate an authToken for the new client registration
-	client.AuthToken, err = a.AuthManager.CreateToken()
+	// record the registration date
+	client.RegistrationDate = database.DbNow()
+
+	// the authToken is bound to the registration id, which is only known
+	// once the client record has been inserted, so insert the record and
+	// store its authToken within a single transaction
+	tx, err := a.OperationalDB.Begin()
 	if err != nil {
-		ar.ErrorResponse(http.StatusInternalServerError, "failed to create authtoken for client")
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
 		return
 	}
 
-	// record the registration date
-	client.RegistrationDate = types.Now().String()
+	// rollback any changes if we fail to commit the transaction
+	defer tx.Rollback()
+
+	if err = client.SetTx(tx); err != nil {
+		ar.Log.Error("clientsRow.SetTx() failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
 
 	// insert the new client record
 	err = client.Insert()
@@ -118,14 +151,83 @@ func (a *App) RegisterClient(ar *AppRequest) {
 		return
 	}
 
+	// generate an authToken for the new client registration
+	client.AuthToken, err = a.AuthManager.CreateToken(client.Id)
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to create authtoken for client")
+		return
+	}
+
+	if err = client.Update(); err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to register new client")
+		return
+	}
+
+	// a duplicate clientId with a different systemUUID suggests that the
+	// new registration is from a cloned system
+	if dup != nil && dup.SystemUUID != client.SystemUUID {
+		if err = a.clones.duplicateClientId(client, dup); err != nil {
+			ar.Log.Error("clone signal recording failed", slog.String("error", err.Error()))
+			ar.ErrorResponse(http.StatusInternalServerError, "failed to register new client")
+			return
+		}
+	}
+
+	// start tracking the new registration's activity
+	if err = a.newClientActivity(ar, client); err != nil {
+		ar.Log.Error("client activity creation failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to register new client")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		ar.Log.Error("client registration commit failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to register new client")
+		return
+	}
+
 	// initialise a client registration response
 	crResp := restapi.ClientRegistrationResponse{
 		RegistrationId:   client.Id,
 		AuthToken:        client.AuthToken,
-		RegistrationDate: client.RegistrationDate,
+		RegistrationDate: types.TelemetryTimeStamp{Time: client.RegistrationDate}.String(),
 	}
 	ar.Log.Debug("Response", slog.Any("crResp", crResp))
 
 	// respond success with the client registration response
 	ar.JsonResponse(http.StatusOK, crResp)
 }
+
+// DeregisterClient is responsible for handling requests from registered
+// clients to remove their registration, after which their authtoken will
+// no longer be accepted
+func (a *App) DeregisterClient(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	// only the client holding the registration's current authtoken may
+	// remove it
+	client := a.authorizeClient(ar)
+	if client == nil {
+		return
+	}
+
+	if err := a.revokeRegistrations([]int64{client.Id}); err != nil {
+		ar.Log.Error("client deregistration failed", slog.Int64("registrationId", client.Id), slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to deregister client")
+		return
+	}
+
+	ar.Log.Info(
+		"Client deregistered",
+		slog.Int64("registrationId", client.Id),
+		slog.String("clientId", client.ClientId),
+	)
+
+	payload := struct {
+		RegistrationId int64 `json:"registrationId"`
+	}{
+		RegistrationId: client.Id,
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
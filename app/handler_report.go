@@ -6,7 +6,6 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"strconv"
 
 	"github.com/SUSE/telemetry-server/app/database"
 	telemetrylib "github.com/SUSE/telemetry/pkg/lib"
@@ -15,9 +14,11 @@ import (
 )
 
 // Telemetry reports can be processed immediately or
-// staged for later processing. This variable is used
-// to control the default mode of operation, which is
-// currently disabled by default.
+// staged for later processing by the staging workers.
+// This variable is used to control the default mode of
+// operation, which is currently disabled by default,
+// and can be overridden by the staging.enabled config
+// setting.
 var stageTelemetryReports bool = false
 
 // Enable telemetry report staging by default
@@ -33,71 +34,12 @@ func DisableTelemetryReportStaging() {
 func (a *App) ReportTelemetry(ar *AppRequest) {
 	ar.Log.Info("Processing")
 
-	// retrieve required headers
-	hdrRegistrationId := ar.GetRegistrationId()
-	token := ar.GetAuthToken()
-
-	// missing registrationId or token suggests client needs to register
-	if (hdrRegistrationId == "") || (token == "") {
-		// client needs to register
-		ar.SetWwwAuthRegister()
-		ar.ErrorResponse(http.StatusUnauthorized, "Client registration required")
-		return
-	}
-
-	// verify that a valid authtoken has been provided
-	if err := a.AuthManager.VerifyToken(token); err != nil {
-		// client needs to re-authenticate
-		ar.SetWwwAuthReauth()
-		ar.ErrorResponse(http.StatusUnauthorized, "Invalid Authorization")
-		return
-	}
-
-	ar.Log.Debug(
-		"Bearer Authorization Valid",
-		slog.String("token", token),
-	)
-
-	// verify that the provided registration id is a valid number
-	registrationId, err := strconv.ParseInt(hdrRegistrationId, 0, 64)
-	if err != nil {
-		// client needs to register
-		ar.SetWwwAuthRegister()
-		ar.ErrorResponse(http.StatusUnauthorized, "Invalid Registration Id")
-		return
-	}
-
-	// verify that the request is from a registered client
-	client := new(database.ClientsRow)
-	if err = client.SetupDB(a.OperationalDB); err != nil {
-		ar.Log.Error("clientsRow.SetupDB() failed", slog.String("error", err.Error()))
-		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+	// verify that the request is from an authorized, registered, client
+	client := a.authorizeClient(ar)
+	if client == nil {
 		return
 	}
 
-	client.InitRegistrationId(registrationId)
-	if !client.Exists() {
-		// client needs to register
-		ar.SetWwwAuthRegister()
-		ar.ErrorResponse(http.StatusUnauthorized, "Invalid Registration Id")
-		return
-	}
-
-	// verify that the provided authtoken matches last authtoken issued to the client
-	if client.AuthToken != token {
-		// TODO detect cloned clients, where InstID matches ClientId, but authtoken will
-		// will be stale
-		// client needs to re-authenticate
-		ar.SetWwwAuthReauth()
-		ar.ErrorResponse(http.StatusUnauthorized, "Invalid Authorization")
-		return
-	}
-
-	ar.Log.Debug(
-		"Client Authorized",
-		slog.Int64("registrationId", registrationId),
-	)
-
 	// handle payload compression
 	reader, err := ar.getReader()
 	if err != nil {
@@ -140,12 +82,37 @@ func (a *App) ReportTelemetry(ar *AppRequest) {
 	}
 	ar.Log.Debug("Checksums verified")
 
+	// reserve the report in the processed reports ledger, so that it is
+	// only processed once. If the report has already been processed, e.g.
+	// resubmitted by a client retrying after a failed response, respond with
+	// the original response, without processing the report again.
+	reservation, trResp, err := a.ReserveProcessedReport(client.Id, &trReq.TelemetryReport.Header)
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to access DB")
+		return
+	}
+	if trResp != nil {
+		ar.Log.Info(
+			"Report already processed",
+			slog.String("reportId", trReq.TelemetryReport.Header.ReportId),
+			slog.String("reportClientId", trReq.TelemetryReport.Header.ReportClientId),
+			slog.Int64("processingId", trResp.ProcessingId),
+		)
+		ar.JsonResponse(http.StatusOK, trResp)
+		return
+	}
+	if reservation == nil {
+		ar.ErrorResponse(http.StatusConflict, "report is already being processed")
+		return
+	}
+
 	// telemetry reports can be either handled inline or staged
 	// for later processing
 	var stagingId int64 = 0
-	if !stageTelemetryReports {
+	if !a.StagingEnabled() {
 		err = a.ProcessTelemetryReport(&trReq.TelemetryReport)
 		if err != nil {
+			a.ReleaseProcessedReport(reservation)
 			ar.ErrorResponse(
 				http.StatusBadRequest,
 				fmt.Errorf("report processing failed: %w", err).Error(),
@@ -156,38 +123,43 @@ func (a *App) ReportTelemetry(ar *AppRequest) {
 		// save the report into the operational db, obtaining the staging
 		// db's entry id if successful
 		stagingId, err = a.StageTelemetryReport(
+			client.Id,
 			reqBody,
 			&trReq.TelemetryReport.Header,
 		)
 		if err != nil {
+			a.ReleaseProcessedReport(reservation)
 			ar.ErrorResponse(http.StatusBadRequest, err.Error())
 			return
 		}
 
-		// process pending reports
-		err = a.ProcessStagedReports()
-		if err != nil {
-			// err is a joined slice of multiple errors for which err.Error()
-			// will return a multiline string, one error per line, so prepend
-			// a summary error and fail request with combined error
-			ar.ErrorResponse(
-				http.StatusBadRequest,
-				fmt.Errorf("staged report processing failed:\n%w", err).Error(),
-			)
-			return
-		}
+		// wake a staging worker to process the newly staged report
+		a.StagingWorkers.Notify()
 	}
 
 	// initialise a telemetry report response, stagingId will be 0 if we
 	// processed the report inline, otherwise it will be the id of the
 	// entry in the staging table, which will be processed at a later time.
-	trResp := restapi.NewTelemetryReportResponse(stagingId, types.Now())
+	// The processed time is normalised as it will be recorded, so that any
+	// resubmissions are answered with an identical response.
+	trResp = restapi.NewTelemetryReportResponse(stagingId, types.TelemetryTimeStamp{Time: database.DbNow()})
+
+	// record the report as processed so that resubmissions are recognised
+	a.CompleteProcessedReport(reservation, trResp)
+
+	// record the report against the client's activity
+	if err = a.recordClientReport(ar, client.Id); err != nil {
+		ar.Log.Warn("client activity recording failed", slog.String("error", err.Error()))
+	}
 	ar.Log.Debug("Response", slog.Any("trResp", trResp))
 
 	// respond success with the telemetry report response
 	ar.JsonResponse(http.StatusOK, trResp)
 }
 
+// ProcessTelemetryReport stores the data items contained in the report's
+// bundles in the telemetry DB, using a single transaction such that either
+// all, or none, of the report's data items will be stored.
 func (a *App) ProcessTelemetryReport(report *telemetrylib.TelemetryReport) error {
 	numBundles := len(report.TelemetryBundles)
 	var totalItems int
@@ -199,8 +171,21 @@ func (a *App) ProcessTelemetryReport(report *telemetrylib.TelemetryReport) error
 		slog.Int("numBundles", numBundles),
 	)
 
+	tx, err := a.TelemetryDB.Begin()
+	if err != nil {
+		return fmt.Errorf(
+			"failed to begin transaction for report %q: %w",
+			report.Header.ReportId,
+			err,
+		)
+	}
+
+	// rollback any changes if we fail to commit the transaction
+	defer tx.Rollback()
+
 	// process available bundles, extracting the data items and
-	// storing them in the telemetry DB
+	// adding them to a batch to be stored in the telemetry DB
+	batch := a.newTelemetryBatch(tx)
 	for _, bundle := range report.TelemetryBundles {
 		numItems := len(bundle.TelemetryDataItems)
 
@@ -219,9 +204,9 @@ func (a *App) ProcessTelemetryReport(report *telemetrylib.TelemetryReport) error
 				slog.String("telemetryType", item.Header.TelemetryType),
 			)
 
-			if err := a.StoreTelemetry(&item, &bundle.Header); err != nil {
+			if err := batch.Add(&item, &bundle.Header); err != nil {
 				slog.Error(
-					"Failed to store telemetry data item",
+					"Failed to prepare telemetry data item",
 					slog.String("telemetryId", item.Header.TelemetryId),
 					slog.String("telemetryType", item.Header.TelemetryType),
 					slog.String("bundleId", bundle.Header.BundleId),
@@ -229,7 +214,7 @@ func (a *App) ProcessTelemetryReport(report *telemetrylib.TelemetryReport) error
 					slog.String("error", err.Error()),
 				)
 				return fmt.Errorf(
-					"failed to store telemetry item %q from bundle %q in report %q: %w",
+					"failed to prepare telemetry item %q from bundle %q in report %q: %w",
 					item.Header.TelemetryId,
 					bundle.Header.BundleId,
 					report.Header.ReportId,
@@ -242,6 +227,34 @@ func (a *App) ProcessTelemetryReport(report *telemetrylib.TelemetryReport) error
 		totalItems += numItems
 	}
 
+	// store the report's data items
+	if _, err = batch.Store(); err != nil {
+		slog.Error(
+			"Failed to store telemetry data items",
+			slog.String("reportId", report.Header.ReportId),
+			slog.Int("totalItems", totalItems),
+			slog.String("error", err.Error()),
+		)
+		return fmt.Errorf(
+			"failed to store telemetry items from report %q: %w",
+			report.Header.ReportId,
+			err,
+		)
+	}
+
+	if err = tx.Commit(); err != nil {
+		slog.Error(
+			"Failed to commit telemetry report transaction",
+			slog.String("reportId", report.Header.ReportId),
+			slog.String("error", err.Error()),
+		)
+		return fmt.Errorf(
+			"failed to commit transaction for report %q: %w",
+			report.Header.ReportId,
+			err,
+		)
+	}
+
 	slog.Info(
 		"Successfully processed telemetry report",
 		slog.String("reportId", report.Header.ReportId),
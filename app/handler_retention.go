@@ -0,0 +1,23 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// PreviewRetention is responsible for handling requests to preview the
+// telemetry data retention purge, responding with a report of the expired
+// telemetry data, and orphaned tagSets and customers entries, that would be
+// removed by the configured retention rules, without deleting anything
+func (a *App) PreviewRetention(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	report, err := a.Retention.Purge(true)
+	if err != nil {
+		ar.Log.Error("retention preview failed", slog.String("error", err.Error()))
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to preview retention purge")
+		return
+	}
+
+	ar.JsonResponse(http.StatusOK, report)
+}
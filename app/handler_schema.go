@@ -0,0 +1,45 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/SUSE/telemetry-server/app/database"
+)
+
+// SchemaDrift is responsible for handling requests to report differences
+// between the connected DBs and the table specs expected by the server,
+// allowing operators to detect manual DDL changes
+func (a *App) SchemaDrift(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	adbs := []*database.AppDb{
+		a.TelemetryDB,
+		a.OperationalDB,
+	}
+
+	payload := struct {
+		Drift bool                          `json:"drift"`
+		Dbs   []*database.SchemaDriftReport `json:"dbs"`
+	}{
+		Dbs: []*database.SchemaDriftReport{},
+	}
+
+	for _, adb := range adbs {
+		report, err := adb.CheckSchemaDrift()
+		if err != nil {
+			ar.Log.Error(
+				"schema drift check failed",
+				slog.String("database", adb.Name()),
+				slog.String("error", err.Error()),
+			)
+			ar.ErrorResponse(http.StatusInternalServerError, "failed to check DB schemas")
+			return
+		}
+
+		payload.Drift = payload.Drift || report.HasDrift()
+		payload.Dbs = append(payload.Dbs, report)
+	}
+
+	ar.JsonResponse(http.StatusOK, payload)
+}
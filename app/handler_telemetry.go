@@ -0,0 +1,173 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// default and maximum number of telemetry data items returned per request
+const (
+	telemetryDefLimit uint = 100
+	telemetryMaxLimit uint = 1000
+)
+
+// telemetryDataStream incrementally writes a telemetry data query response,
+// such that the dataItem bodies of a page don't need to be held in memory
+type telemetryDataStream struct {
+	ar      *AppRequest
+	started bool
+}
+
+// write writes the data, flushing it to the client if possible
+func (s *telemetryDataStream) write(data []byte) (err error) {
+	if _, err = s.ar.Write(data); err != nil {
+		return
+	}
+	if flusher, ok := s.ar.W.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return
+}
+
+// item writes the item, starting the response if needed
+func (s *telemetryDataStream) item(item *telemetryDataItem) error {
+	content, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to marshal telemetry data %d: %w", item.Id, err)
+	}
+
+	prefix := ","
+	if !s.started {
+		s.ar.ContentTypeJSON()
+		s.ar.Status(http.StatusOK)
+		s.started = true
+		prefix = `{"items":[`
+	}
+
+	return s.write(append([]byte(prefix), content...))
+}
+
+// finish completes the response with the next page's cursor
+func (s *telemetryDataStream) finish(nextCursor string) error {
+	if !s.started {
+		s.ar.ContentTypeJSON()
+		s.ar.Status(http.StatusOK)
+		s.started = true
+		if err := s.write([]byte(`{"items":[`)); err != nil {
+			return err
+		}
+	}
+
+	content, err := json.Marshal(nextCursor)
+	if err != nil {
+		return err
+	}
+
+	return s.write([]byte(`],"nextCursor":` + string(content) + `}`))
+}
+
+// formatCursor returns the cursor value returned to clients, which is empty
+// if there are no more pages
+func formatCursor(cursor int64) string {
+	if cursor == 0 {
+		return ""
+	}
+	return strconv.FormatInt(cursor, 10)
+}
+
+// QueryTelemetryData is responsible for handling requests to query the stored
+// telemetry data, filtered by clientId, customerId, telemetryType, tag and
+// timestamp range, using cursor pagination. If the includeData query
+// parameter is true the dataItem bodies are included, and the response is
+// streamed as the items are retrieved.
+func (a *App) QueryTelemetryData(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	limit, offset, err := ar.GetPagination(telemetryDefLimit, telemetryMaxLimit)
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+	if offset != 0 {
+		ar.ErrorResponse(http.StatusBadRequest, "offset not supported, use the cursor query parameter")
+		return
+	}
+
+	var cursor int64
+	if param := ar.GetQueryParam("cursor"); param != "" {
+		if cursor, err = strconv.ParseInt(param, 10, 64); err != nil || cursor <= 0 {
+			ar.ErrorResponse(http.StatusBadRequest, fmt.Sprintf("invalid cursor value %q", param))
+			return
+		}
+	}
+
+	includeData := false
+	if param := ar.GetQueryParam("includeData"); param != "" {
+		if includeData, err = strconv.ParseBool(param); err != nil {
+			ar.ErrorResponse(http.StatusBadRequest, fmt.Sprintf("invalid includeData value %q", param))
+			return
+		}
+	}
+
+	filter := telemetryDataFilter{
+		ClientId:      ar.GetQueryParam("clientId"),
+		CustomerId:    ar.GetQueryParam("customerId"),
+		TelemetryType: ar.GetQueryParam("telemetryType"),
+		Tag:           ar.GetQueryParam("tag"),
+	}
+	if filter.After, err = getTimeParam(ar, "after"); err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.Before, err = getTimeParam(ar, "before"); err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// without dataItem bodies the page is small enough to be collected,
+	// so that any failure can be reported with an appropriate response
+	if !includeData {
+		items := []*telemetryDataItem{}
+		nextCursor, err := a.queryTelemetryData(&filter, cursor, limit, false, func(item *telemetryDataItem) error {
+			items = append(items, item)
+			return nil
+		})
+		if err != nil {
+			ar.Log.Error("telemetry data query failed", slog.String("error", err.Error()))
+			ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve telemetry data")
+			return
+		}
+
+		payload := struct {
+			Items      []*telemetryDataItem `json:"items"`
+			NextCursor string               `json:"nextCursor"`
+		}{
+			Items:      items,
+			NextCursor: formatCursor(nextCursor),
+		}
+
+		ar.JsonResponse(http.StatusOK, payload)
+		return
+	}
+
+	stream := &telemetryDataStream{ar: ar}
+	nextCursor, err := a.queryTelemetryData(&filter, cursor, limit, true, stream.item)
+	if err == nil {
+		err = stream.finish(formatCursor(nextCursor))
+	}
+	if err != nil {
+		ar.Log.Error("telemetry data query failed", slog.String("error", err.Error()))
+
+		// once streaming has started the response can only be abandoned,
+		// leaving the client with an incomplete response
+		if !stream.started {
+			ar.ErrorResponse(http.StatusInternalServerError, "failed to retrieve telemetry data")
+		}
+		return
+	}
+
+	ar.Log.Info("Response", slog.Int("code", http.StatusOK))
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/SUSE/telemetry/pkg/types"
+)
+
+// RevokeToken is responsible for handling requests to revoke the auth token
+// identified by the request's jti path variable
+func (a *App) RevokeToken(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	jti := ar.Vars["jti"]
+	if jti == "" {
+		ar.ErrorResponse(http.StatusBadRequest, "missing token jti")
+		return
+	}
+
+	revocation, err := a.revokeToken(jti)
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to revoke token")
+		return
+	}
+
+	ar.Log.Info("Token revoked", "jti", jti)
+
+	ar.JsonResponse(http.StatusOK, revocation)
+}
+
+// RevokeTokensIssuedBefore is responsible for handling requests to revoke
+// all auth tokens issued before the time specified by the request's
+// issuedBefore query parameter
+func (a *App) RevokeTokensIssuedBefore(ar *AppRequest) {
+	ar.Log.Info("Processing", ar.R.Method, ar.R.URL)
+
+	param := ar.GetQueryParam("issuedBefore")
+	if param == "" {
+		ar.ErrorResponse(http.StatusBadRequest, "missing issuedBefore query parameter")
+		return
+	}
+
+	issuedBefore, err := types.TimeStampFromString(param)
+	if err != nil {
+		ar.ErrorResponse(http.StatusBadRequest, "invalid issuedBefore value, must be an RFC3339 timestamp")
+		return
+	}
+
+	revocation, err := a.revokeTokensIssuedBefore(issuedBefore.Time)
+	if err != nil {
+		ar.ErrorResponse(http.StatusInternalServerError, "failed to revoke tokens")
+		return
+	}
+
+	ar.Log.Info("Tokens revoked", "issuedBefore", revocation.IssuedBefore)
+
+	ar.JsonResponse(http.StatusOK, revocation)
+}
@@ -0,0 +1,210 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/config"
+	"github.com/SUSE/telemetry-server/app/database"
+)
+
+// idCaches tracks the caches of the telemetry DB tagSets and customers
+// table ids, which rarely change once added, only being deleted by erasure
+// or retention, but are looked up for every stored telemetry data item.
+// Changes made by this process invalidate the affected cached ids via the
+// row change hook, while changes made by other processes are detected by
+// polling the telemetry DB's cache generations every refresh interval,
+// discarding all cached ids of a table whose generation has changed.
+type idCaches struct {
+	adb     *database.AppDb
+	refresh time.Duration
+	caches  map[string]*lruCache[string, int64]
+
+	mutex       sync.Mutex
+	checkedAt   time.Time
+	checking    bool
+	generations map[string]int64
+	// incremented whenever a table's cached ids are discarded, so that ids
+	// looked up before then are not subsequently cached
+	epochs map[string]uint64
+}
+
+// cacheSize determines the cache size to use for the specified config
+// setting, where 0 selects the default and negative values disable caching
+func cacheSize(size, defSize int) int {
+	switch {
+	case size == 0:
+		return defSize
+	case size < 0:
+		return 0
+	}
+	return size
+}
+
+func newIdCaches(adb *database.AppDb, cc *config.IdCacheConfig) (*idCaches, error) {
+	refresh, err := configDuration(
+		"idCache.refresh",
+		cc.Refresh,
+		config.DEF_ID_CACHE_REFRESH,
+	)
+	if err != nil {
+		slog.Error(
+			"config idCache.refresh invalid",
+			slog.String("idCache.refresh", cc.Refresh),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	return &idCaches{
+		adb:     adb,
+		refresh: refresh,
+		caches: map[string]*lruCache[string, int64]{
+			database.GetTagSetsTableSpec().Name: newLRUCache[string, int64](
+				cacheSize(cc.TagSets, config.DEF_ID_CACHE_TAGSETS),
+			),
+			database.GetCustomersTableSpec().Name: newLRUCache[string, int64](
+				cacheSize(cc.Customers, config.DEF_ID_CACHE_CUSTOMERS),
+			),
+		},
+		epochs: map[string]uint64{},
+	}, nil
+}
+
+// loadGenerations retrieves the telemetry DB's cache generations
+func (c *idCaches) loadGenerations() (generations map[string]int64, err error) {
+	row := new(database.CacheGenerationRow)
+	if err = row.SetupDB(c.adb); err != nil {
+		return nil, fmt.Errorf("cacheGenerationRow.SetupDB() failed: %w", err)
+	}
+
+	if generations, err = row.List(); err != nil {
+		return nil, fmt.Errorf("failed to retrieve cache generations: %w", err)
+	}
+
+	return
+}
+
+// discard discards all cached ids of the table, must be called with the
+// mutex held
+func (c *idCaches) discard(table string) {
+	c.caches[table].RemoveFunc(func(_ string, _ int64) bool {
+		return true
+	})
+	c.epochs[table]++
+}
+
+// check polls the cache generations if they haven't been checked within
+// the refresh interval, discarding the cached ids of tables whose generation
+// has changed, or of all tables if the generations cannot be retrieved. Only
+// one caller polls at a time, and the generations are retrieved without the
+// mutex held, so that concurrent lookups aren't stalled behind the DB query,
+// continuing to use the cached ids until the poll completes.
+func (c *idCaches) check() {
+	c.mutex.Lock()
+	if c.checking || time.Since(c.checkedAt) < c.refresh {
+		c.mutex.Unlock()
+		return
+	}
+	c.checking = true
+	c.checkedAt = time.Now()
+	c.mutex.Unlock()
+
+	generations, err := c.loadGenerations()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.checking = false
+
+	if err != nil {
+		slog.Warn(
+			"Cache generations check failed, discarding cached ids",
+			slog.String("error", err.Error()),
+		)
+		for table := range c.caches {
+			c.discard(table)
+		}
+		c.generations = nil
+		return
+	}
+
+	for table := range c.caches {
+		if c.generations == nil || generations[table] != c.generations[table] {
+			slog.Debug(
+				"cache generation changed, discarding cached ids",
+				slog.String("table", table),
+				slog.Int64("generation", generations[table]),
+			)
+			c.discard(table)
+		}
+	}
+
+	c.generations = generations
+}
+
+// Get returns the id cached for the key in the specified table's cache, if
+// any, after checking for changes made by other processes, along with the
+// table's current epoch, which must be passed to a subsequent Add
+func (c *idCaches) Get(table, key string) (id int64, found bool, epoch uint64) {
+	c.check()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	id, found = c.caches[table].Get(key)
+
+	return id, found, c.epochs[table]
+}
+
+// Add caches the id for the key in the specified table's cache, unless the
+// table's cached ids have been discarded since the epoch was retrieved, as
+// the id may have been looked up before the change that triggered that
+func (c *idCaches) Add(table, key string, id int64, epoch uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.epochs[table] != epoch {
+		return
+	}
+
+	c.caches[table].Add(key, id)
+}
+
+// rowChanged is a database.RowChangeHook that invalidates cached ids when
+// the associated telemetry DB rows are changed, advancing the table's epoch
+// so that ids looked up before the change are not subsequently cached
+func (c *idCaches) rowChanged(table string, id int64) {
+	cache, found := c.caches[table]
+	if !found {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// the cached key may have changed, so match on the cached id
+	removed := cache.RemoveFunc(func(_ string, refId int64) bool {
+		return refId == id
+	})
+	c.epochs[table]++
+	if removed > 0 {
+		slog.Debug(
+			"invalidated cached id",
+			slog.String("table", table),
+			slog.Int64("id", id),
+		)
+	}
+}
+
+// afterCommit calls f once the transaction, if any, has been committed,
+// ensuring that ids are only cached once they are visible to others
+func afterCommit(tx *database.Tx, f func()) {
+	if tx == nil {
+		f()
+		return
+	}
+	tx.OnCommit(f)
+}
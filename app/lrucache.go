@@ -0,0 +1,105 @@
+package app
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache is a bounded, concurrency safe, least recently used cache. A
+// cache with a capacity that is not positive is disabled, never retaining
+// any entries.
+type lruCache[K comparable, V any] struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[K]*list.Element
+	order    *list.List // most recently used at the front
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRUCache[K comparable, V any](capacity int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		capacity: capacity,
+		entries:  make(map[K]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the value cached for the key, if any, marking it as the
+// most recently used entry
+func (c *lruCache[K, V]) Get(key K) (value V, found bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		return
+	}
+	c.order.MoveToFront(elem)
+
+	return elem.Value.(*lruEntry[K, V]).value, true
+}
+
+// Add caches the value for the key, evicting the least recently used
+// entry if the cache is full
+func (c *lruCache[K, V]) Add(key K, value V) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		elem.Value.(*lruEntry[K, V]).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// Remove removes the entry for the key, if present
+func (c *lruCache[K, V]) Remove(key K) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// RemoveFunc removes all entries for which the match function returns
+// true, returning the number of entries removed
+func (c *lruCache[K, V]) RemoveFunc(match func(key K, value V) bool) (removed int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, elem := range c.entries {
+		if match(key, elem.Value.(*lruEntry[K, V]).value) {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+			removed++
+		}
+	}
+
+	return
+}
+
+// Len returns the number of cached entries
+func (c *lruCache[K, V]) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.order.Len()
+}
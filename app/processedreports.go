@@ -0,0 +1,320 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/config"
+	"github.com/SUSE/telemetry-server/app/database"
+	telemetrylib "github.com/SUSE/telemetry/pkg/lib"
+	"github.com/SUSE/telemetry/pkg/restapi"
+	"github.com/SUSE/telemetry/pkg/types"
+)
+
+// ProcessedReportsLedger is a struct managing the processed reports ledger,
+// whose pending entries remain reserved for the request processing their
+// report for the reservation duration, after which the request is considered
+// lost and a resubmission of the report may take over the reservation, and
+// a background job that periodically prunes entries that have exceeded the
+// maximum age, in bounded batches, including pending entries whose reports
+// were never resubmitted after their requests were lost
+type ProcessedReportsLedger struct {
+	app           *App
+	reservation   time.Duration
+	maxAge        time.Duration
+	pruneInterval time.Duration
+	batchSize     uint
+
+	// private
+	mutex   sync.Mutex
+	running bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewProcessedReportsLedger(a *App, pc *config.ProcessedReportsConfig) (l *ProcessedReportsLedger, err error) {
+	l = new(ProcessedReportsLedger)
+	l.app = a
+
+	l.reservation, err = configDuration(
+		"processedReports.reservation",
+		pc.Reservation,
+		config.DEF_PROCESSED_REPORTS_RESERVATION,
+	)
+	if err != nil {
+		slog.Error(
+			"config processedReports.reservation invalid",
+			slog.String("processedReports.reservation", pc.Reservation),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	l.maxAge, err = configDuration(
+		"processedReports.maxAge",
+		pc.MaxAge,
+		config.DEF_PROCESSED_REPORTS_MAX_AGE,
+	)
+	if err != nil {
+		slog.Error(
+			"config processedReports.maxAge invalid",
+			slog.String("processedReports.maxAge", pc.MaxAge),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	l.pruneInterval, err = configDuration(
+		"processedReports.pruneInterval",
+		pc.PruneInterval,
+		config.DEF_PROCESSED_REPORTS_PRUNE_INTERVAL,
+	)
+	if err != nil {
+		slog.Error(
+			"config processedReports.pruneInterval invalid",
+			slog.String("processedReports.pruneInterval", pc.PruneInterval),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	// pending entries are pruned once they exceed the maximum age, so it
+	// must exceed the reservation for reservations to remain valid
+	if l.maxAge <= l.reservation {
+		return nil, fmt.Errorf(
+			"invalid processedReports.maxAge value %q, must exceed processedReports.reservation %q",
+			l.maxAge,
+			l.reservation,
+		)
+	}
+
+	switch {
+	case pc.BatchSize < 0:
+		return nil, fmt.Errorf(
+			"invalid processedReports.batchSize value '%d', must not be negative",
+			pc.BatchSize,
+		)
+	case pc.BatchSize == 0:
+		l.batchSize = uint(config.DEF_PROCESSED_REPORTS_BATCH_SIZE)
+	default:
+		l.batchSize = uint(pc.BatchSize)
+	}
+
+	return
+}
+
+func (l *ProcessedReportsLedger) Running() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.running
+}
+
+// Start launches the background job that periodically prunes the ledger
+func (l *ProcessedReportsLedger) Start() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.running {
+		return
+	}
+
+	l.done = make(chan struct{})
+
+	l.wg.Add(1)
+	go l.pruner()
+
+	l.running = true
+
+	slog.Info(
+		"Started processed reports ledger pruning",
+		slog.Duration("interval", l.pruneInterval),
+		slog.Duration("maxAge", l.maxAge),
+		slog.Uint64("batchSize", uint64(l.batchSize)),
+	)
+}
+
+// Stop signals the background job to exit, waiting for any in progress
+// prune to complete
+func (l *ProcessedReportsLedger) Stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.running {
+		return
+	}
+
+	close(l.done)
+	l.wg.Wait()
+	l.running = false
+
+	slog.Info("Stopped processed reports ledger pruning")
+}
+
+func (l *ProcessedReportsLedger) pruner() {
+	defer l.wg.Done()
+
+	slog.Debug("Processed reports ledger pruning started")
+
+	ticker := time.NewTicker(l.pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		// prune immediately on startup, and then every interval
+		if _, err := l.Prune(); err != nil {
+			slog.Error("Processed reports ledger pruning failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-l.done:
+			slog.Debug("Processed reports ledger pruning stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune deletes the ledger entries that have exceeded the maximum age,
+// returning the number deleted
+func (l *ProcessedReportsLedger) Prune() (pruned int64, err error) {
+	pruned, err = l.app.PruneProcessedReports(time.Now().Add(-l.maxAge), l.batchSize)
+	if pruned > 0 {
+		slog.Info(
+			"Pruned processed reports ledger entries",
+			slog.Int64("count", pruned),
+			slog.Duration("maxAge", l.maxAge),
+		)
+	}
+
+	return
+}
+
+// processedReportResponse reconstructs the telemetry report response that
+// was originally returned for a processed report ledger entry
+func processedReportResponse(processed *database.ProcessedReportRow) (trResp *restapi.TelemetryReportResponse) {
+	return restapi.NewTelemetryReportResponse(
+		processed.ProcessingId,
+		types.TelemetryTimeStamp{Time: processed.ProcessedAt},
+	)
+}
+
+// ReserveProcessedReport reserves a pending processed reports ledger entry
+// for the specified report, submitted by the specified registration, such
+// that only the caller will process it. If the report has already been
+// processed, e.g. resubmitted by a client retrying after a failed response,
+// the response that was originally returned for it is returned instead. If
+// the report is currently being processed by another request, neither is
+// returned.
+func (a *App) ReserveProcessedReport(registrationId int64, rHeader *telemetrylib.TelemetryReportHeader) (reservation *database.ProcessedReportRow, trResp *restapi.TelemetryReportResponse, err error) {
+	processed := new(database.ProcessedReportRow)
+	if err = processed.SetupDB(a.OperationalDB); err != nil {
+		slog.Error("ProcessedReportRow.SetupDB failed", slog.String("error", err.Error()))
+		return
+	}
+
+	processed.Init(registrationId, rHeader.ReportId)
+
+	reserved, err := processed.Reserve()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reserve processed report: %w", err)
+	}
+	if reserved {
+		return processed, nil, nil
+	}
+
+	// the entry may have been released, or pruned, since the reservation
+	// was attempted, in which case the report is treated as in progress so
+	// that the client will resubmit it
+	if !processed.Exists() {
+		return
+	}
+
+	if !processed.Pending {
+		return nil, processedReportResponse(processed), nil
+	}
+
+	// take over the reservation if the request processing the report has
+	// been lost
+	if time.Since(processed.ProcessedAt) < a.ProcessedReports.reservation {
+		return
+	}
+
+	if reserved, err = processed.TakeOver(); err != nil {
+		return nil, nil, fmt.Errorf("failed to take over processed report reservation: %w", err)
+	}
+	if reserved {
+		slog.Warn(
+			"Took over expired processed report reservation",
+			slog.String("report", processed.ReportIdentifer()),
+		)
+		return processed, nil, nil
+	}
+
+	return
+}
+
+// CompleteProcessedReport records the response being returned for the
+// reserved report in the processed reports ledger, so that resubmissions of
+// the report are answered with it. Since the report has already been
+// processed, failures are only logged, as the response must still be
+// returned.
+func (a *App) CompleteProcessedReport(reservation *database.ProcessedReportRow, trResp *restapi.TelemetryReportResponse) {
+	completed, err := reservation.Complete(trResp.ProcessingId, trResp.ProcessedAt.Time)
+	switch {
+	case err != nil:
+		slog.Error(
+			"Processed report completion failed",
+			slog.String("report", reservation.ReportIdentifer()),
+			slog.String("error", err.Error()),
+		)
+	case !completed:
+		slog.Warn(
+			"Processed report reservation lost before completion",
+			slog.String("report", reservation.ReportIdentifer()),
+		)
+	}
+}
+
+// ReleaseProcessedReport releases the reservation of a report that could
+// not be processed, so that a resubmission of the report will be processed
+func (a *App) ReleaseProcessedReport(reservation *database.ProcessedReportRow) {
+	released, err := reservation.Release()
+	switch {
+	case err != nil:
+		slog.Error(
+			"Processed report release failed",
+			slog.String("report", reservation.ReportIdentifer()),
+			slog.String("error", err.Error()),
+		)
+	case !released:
+		slog.Warn(
+			"Processed report reservation lost before release",
+			slog.String("report", reservation.ReportIdentifer()),
+		)
+	}
+}
+
+// PruneProcessedReports deletes processed reports ledger entries that were
+// completed, or reserved if still pending, before the specified time, in
+// batches of up to batchSize, returning the number deleted
+func (a *App) PruneProcessedReports(before time.Time, batchSize uint) (pruned int64, err error) {
+	processed := new(database.ProcessedReportRow)
+	if err = processed.SetupDB(a.OperationalDB); err != nil {
+		return 0, fmt.Errorf("processedReportRow.SetupDB() failed: %w", err)
+	}
+
+	for {
+		deleted, err := processed.Prune(before, batchSize)
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune processed reports: %w", err)
+		}
+		pruned += deleted
+
+		// all expired entries have been pruned
+		if deleted == 0 || deleted < int64(batchSize) {
+			return pruned, nil
+		}
+	}
+}
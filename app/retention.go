@@ -0,0 +1,596 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/config"
+	"github.com/SUSE/telemetry-server/app/database"
+	"github.com/SUSE/telemetry/pkg/types"
+)
+
+// retentionRule is a validated retention rule, specifying the maximum age
+// of telemetry data of a telemetryType, optionally limited to telemetry
+// data with a specific tag
+type retentionRule struct {
+	telemetryType string
+	tag           string
+	maxAge        time.Duration
+	// the configured maxAge setting, for reporting purposes
+	maxAgeSetting string
+}
+
+// RetentionRuleResult reports the telemetry data expired by a retention rule
+type RetentionRuleResult struct {
+	TelemetryType string `json:"telemetryType"`
+	Tag           string `json:"tag,omitempty"`
+	MaxAge        string `json:"maxAge"`
+	// telemetry data with timestamps before this time has expired
+	Cutoff    string `json:"cutoff"`
+	DataItems int64  `json:"dataItems"`
+}
+
+// RetentionReport reports the telemetry data, and tagSets and customers
+// entries, removed by a retention purge, or that would be removed for a dry
+// run
+type RetentionReport struct {
+	DryRun    bool                   `json:"dryRun"`
+	StartedAt string                 `json:"startedAt"`
+	Rules     []*RetentionRuleResult `json:"rules"`
+	DataItems int64                  `json:"dataItems"`
+	TagSets   int64                  `json:"tagSets"`
+	Customers int64                  `json:"customers"`
+}
+
+// RetentionManager is a struct managing a background job that periodically
+// purges telemetry data that has exceeded the maximum age specified by its
+// retention rule, in bounded batches, and then garbage collects any tagSets
+// and customers entries that have remained unreferenced for the orphan grace
+// period
+type RetentionManager struct {
+	app               *App
+	interval          time.Duration
+	batchSize         uint
+	rules             []*retentionRule
+	orphanGracePeriod time.Duration
+
+	// private
+	mutex   sync.Mutex
+	running bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewRetentionManager(a *App, rc *config.RetentionConfig) (m *RetentionManager, err error) {
+	m = new(RetentionManager)
+	m.app = a
+
+	m.interval, err = configDuration(
+		"retention.interval",
+		rc.Interval,
+		config.DEF_RETENTION_INTERVAL,
+	)
+	if err != nil {
+		slog.Error(
+			"config retention.interval invalid",
+			slog.String("retention.interval", rc.Interval),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	switch {
+	case rc.BatchSize < 0:
+		return nil, fmt.Errorf(
+			"invalid retention.batchSize value '%d', must not be negative",
+			rc.BatchSize,
+		)
+	case rc.BatchSize == 0:
+		m.batchSize = uint(config.DEF_RETENTION_BATCH_SIZE)
+	default:
+		m.batchSize = uint(rc.BatchSize)
+	}
+
+	m.orphanGracePeriod, err = configDuration(
+		"retention.orphanGracePeriod",
+		rc.OrphanGracePeriod,
+		config.DEF_RETENTION_ORPHAN_GRACE_PERIOD,
+	)
+	if err != nil {
+		slog.Error(
+			"config retention.orphanGracePeriod invalid",
+			slog.String("retention.orphanGracePeriod", rc.OrphanGracePeriod),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	// orphaned entries must not be deleted before every server instance
+	// has observed that they have been marked, otherwise ids cached before
+	// then could be used to reference deleted entries
+	if m.orphanGracePeriod <= a.idCaches.refresh {
+		return nil, fmt.Errorf(
+			"invalid retention.orphanGracePeriod value %q, must exceed the idCache.refresh interval of %s",
+			rc.OrphanGracePeriod,
+			a.idCaches.refresh,
+		)
+	}
+
+	for i, rule := range rc.Rules {
+		setting := fmt.Sprintf("retention.rules[%d]", i)
+
+		if rule.TelemetryType == "" {
+			return nil, fmt.Errorf("invalid %s, telemetryType must be specified", setting)
+		}
+
+		if rule.MaxAge == "" {
+			return nil, fmt.Errorf("invalid %s, maxAge must be specified", setting)
+		}
+		maxAge, err := configDuration(setting+".maxAge", rule.MaxAge, "")
+		if err != nil {
+			slog.Error(
+				"config "+setting+".maxAge invalid",
+				slog.String(setting+".maxAge", rule.MaxAge),
+				slog.String("error", err.Error()),
+			)
+			return nil, err
+		}
+
+		if slices.ContainsFunc(m.rules, func(r *retentionRule) bool {
+			return r.telemetryType == rule.TelemetryType && r.tag == rule.Tag
+		}) {
+			return nil, fmt.Errorf(
+				"invalid %s, duplicates the rule for telemetryType %q and tag %q",
+				setting,
+				rule.TelemetryType,
+				rule.Tag,
+			)
+		}
+
+		m.rules = append(m.rules, &retentionRule{
+			telemetryType: rule.TelemetryType,
+			tag:           rule.Tag,
+			maxAge:        maxAge,
+			maxAgeSetting: rule.MaxAge,
+		})
+	}
+
+	return
+}
+
+func (m *RetentionManager) Running() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.running
+}
+
+// Start launches the background job that periodically purges expired
+// telemetry data
+func (m *RetentionManager) Start() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.running {
+		return
+	}
+
+	m.done = make(chan struct{})
+
+	m.wg.Add(1)
+	go m.purger()
+
+	m.running = true
+
+	slog.Info(
+		"Started telemetry data retention job",
+		slog.Duration("interval", m.interval),
+		slog.Uint64("batchSize", uint64(m.batchSize)),
+		slog.Int("rules", len(m.rules)),
+	)
+}
+
+// Stop signals the background job to exit, waiting for any in progress
+// purge to complete its current batch
+func (m *RetentionManager) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.running {
+		return
+	}
+
+	close(m.done)
+	m.wg.Wait()
+	m.running = false
+
+	slog.Info("Stopped telemetry data retention job")
+}
+
+func (m *RetentionManager) stopping() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *RetentionManager) purger() {
+	defer m.wg.Done()
+
+	slog.Debug("Telemetry data retention job started")
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		// purge immediately on startup, and then every interval
+		if _, err := m.purge(false, m.stopping); err != nil {
+			slog.Error("Telemetry data retention purge failed", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-m.done:
+			slog.Debug("Telemetry data retention job stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ruleFor returns the retention rule applicable to telemetry data of the
+// telemetryType with the specified tags, or nil if it should be retained
+// indefinitely. Rules for a matching tag take precedence over the rule for
+// the telemetryType alone, with the longest maxAge applying if telemetry
+// data matches multiple tag rules.
+func (m *RetentionManager) ruleFor(telemetryType string, tags []string) *retentionRule {
+	var typeRule, tagRule *retentionRule
+	for _, rule := range m.rules {
+		if rule.telemetryType != telemetryType {
+			continue
+		}
+
+		switch {
+		case rule.tag == "":
+			typeRule = rule
+		case slices.Contains(tags, rule.tag):
+			if tagRule == nil || rule.maxAge > tagRule.maxAge {
+				tagRule = rule
+			}
+		}
+	}
+
+	if tagRule != nil {
+		return tagRule
+	}
+	return typeRule
+}
+
+// Purge deletes the telemetry data that has exceeded the maximum age of its
+// retention rule, and then the tagSets and customers entries that are no
+// longer referenced, returning a report of what was removed. If dryRun is
+// true nothing is deleted, and the report details what would be removed.
+func (m *RetentionManager) Purge(dryRun bool) (report *RetentionReport, err error) {
+	return m.purge(dryRun, func() bool { return false })
+}
+
+// retentionRefs counts the expired telemetry data referencing tagSets and
+// customers entries, to determine which would become orphaned
+type retentionRefs struct {
+	tagSets   map[int64]int64
+	customers map[int64]int64
+}
+
+func (m *RetentionManager) purge(dryRun bool, stop func() bool) (report *RetentionReport, err error) {
+	now := time.Now()
+	report = &RetentionReport{
+		DryRun:    dryRun,
+		StartedAt: types.TelemetryTimeStamp{Time: now}.String(),
+		Rules:     []*RetentionRuleResult{},
+	}
+
+	cutoffs := make(map[*retentionRule]time.Time, len(m.rules))
+	results := make(map[*retentionRule]*RetentionRuleResult, len(m.rules))
+	// the latest cutoff of each telemetry type's rules, since newer
+	// entries cannot have expired
+	typeCutoffs := make(map[string]time.Time)
+	var telemetryTypes []string
+	for _, rule := range m.rules {
+		cutoffs[rule] = now.Add(-rule.maxAge)
+		if cutoffs[rule].After(typeCutoffs[rule.telemetryType]) {
+			typeCutoffs[rule.telemetryType] = cutoffs[rule]
+		}
+		results[rule] = &RetentionRuleResult{
+			TelemetryType: rule.telemetryType,
+			Tag:           rule.tag,
+			MaxAge:        rule.maxAgeSetting,
+			Cutoff:        types.TelemetryTimeStamp{Time: cutoffs[rule]}.String(),
+		}
+		report.Rules = append(report.Rules, results[rule])
+
+		if !slices.Contains(telemetryTypes, rule.telemetryType) {
+			telemetryTypes = append(telemetryTypes, rule.telemetryType)
+		}
+	}
+
+	refs := retentionRefs{
+		tagSets:   make(map[int64]int64),
+		customers: make(map[int64]int64),
+	}
+
+	for _, telemetryType := range telemetryTypes {
+		var cursor int64
+		for {
+			if stop() {
+				slog.Info("Telemetry data retention purge interrupted")
+				return
+			}
+
+			var scanned uint
+			var expired []int64
+			query := database.TelemetryDataQuery{
+				TelemetryType: telemetryType,
+				Before:        typeCutoffs[telemetryType],
+				AfterId:       cursor,
+				Limit:         m.batchSize,
+			}
+
+			if err = m.queryTelemetryData(&query, func(entry *database.TelemetryDataEntry) (bool, error) {
+				scanned += 1
+				cursor = entry.Id
+
+				rule := m.ruleFor(entry.TelemetryType, splitTagSet(entry.TagSet))
+				if rule == nil {
+					return true, nil
+				}
+
+				if !entry.Timestamp.Before(cutoffs[rule]) {
+					return true, nil
+				}
+
+				expired = append(expired, entry.Id)
+				results[rule].DataItems += 1
+				if dryRun {
+					if entry.TagSetId != 0 {
+						refs.tagSets[entry.TagSetId] += 1
+					}
+					refs.customers[entry.CustomerRefId] += 1
+				}
+
+				return true, nil
+			}); err != nil {
+				return nil, fmt.Errorf("failed to query %q telemetry data: %w", telemetryType, err)
+			}
+
+			if dryRun {
+				report.DataItems += int64(len(expired))
+			} else if len(expired) > 0 {
+				deleted, err := m.deleteTelemetryData(expired)
+				if err != nil {
+					return nil, err
+				}
+				report.DataItems += deleted
+			}
+
+			// all entries of the telemetryType have been scanned
+			if scanned < m.batchSize {
+				break
+			}
+		}
+	}
+
+	if dryRun {
+		err = m.previewOrphans(report, &refs)
+	} else {
+		err = m.deleteOrphans(report, now, stop)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info(
+		"Telemetry data retention purge completed",
+		slog.Bool("dryRun", report.DryRun),
+		slog.Int64("dataItems", report.DataItems),
+		slog.Int64("tagSets", report.TagSets),
+		slog.Int64("customers", report.Customers),
+	)
+	for _, result := range report.Rules {
+		slog.Info(
+			"Telemetry data retention rule applied",
+			slog.Bool("dryRun", report.DryRun),
+			slog.String("telemetryType", result.TelemetryType),
+			slog.String("tag", result.Tag),
+			slog.String("maxAge", result.MaxAge),
+			slog.Int64("dataItems", result.DataItems),
+		)
+	}
+
+	return
+}
+
+// queryTelemetryData retrieves the telemetry data entries matching the
+// query, calling fn for each of them
+func (m *RetentionManager) queryTelemetryData(query *database.TelemetryDataQuery, fn func(*database.TelemetryDataEntry) (bool, error)) (err error) {
+	row := new(database.TelemetryDataRow)
+	if err = row.SetupDB(m.app.TelemetryDB); err != nil {
+		return fmt.Errorf("telemetryDataRow.SetupDB() failed: %w", err)
+	}
+
+	return row.Query(query, fn)
+}
+
+// deleteTelemetryData deletes the specified telemetry data entries in a
+// single transaction, returning the number deleted
+func (m *RetentionManager) deleteTelemetryData(ids []int64) (deleted int64, err error) {
+	tx, err := m.app.TelemetryDB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin telemetry data purge transaction: %w", err)
+	}
+
+	// rollback any changes if we fail to commit the transaction
+	defer tx.Rollback()
+
+	row := new(database.TelemetryDataRow)
+	if err = row.SetupDB(m.app.TelemetryDB); err != nil {
+		return 0, fmt.Errorf("telemetryDataRow.SetupDB() failed: %w", err)
+	}
+	if err = row.SetTx(tx); err != nil {
+		return 0, fmt.Errorf("telemetryDataRow.SetTx() failed: %w", err)
+	}
+
+	if deleted, err = row.DeleteIds(ids); err != nil {
+		return 0, fmt.Errorf("failed to purge expired telemetry data: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit telemetry data purge: %w", err)
+	}
+
+	return
+}
+
+// orphanDeleter is implemented by the tables whose orphaned entries are
+// garbage collected
+type orphanDeleter interface {
+	SetupDB(*database.AppDb) error
+	SetTx(*database.Tx) error
+	TableName() string
+	Orphans(limit uint) ([]int64, error)
+	MarkOrphans(at time.Time, limit uint) (int64, error)
+	DeleteOrphans(before time.Time, limit uint) (int64, error)
+}
+
+// deleteOrphans garbage collects the tagSets and customers entries that
+// have remained unreferenced by any telemetry data for the orphan grace
+// period, and then marks newly unreferenced entries as orphaned, in batches,
+// updating the report. Marking entries invalidates any cached ids for them,
+// and lookups reclaim marked entries, so the grace period ensures that
+// entries are no longer in use by ingest requests when they are deleted.
+func (m *RetentionManager) deleteOrphans(report *RetentionReport, now time.Time, stop func() bool) (err error) {
+	if report.TagSets, err = m.deleteTableOrphans(new(database.TagSetRow), now, stop); err != nil {
+		return
+	}
+
+	report.Customers, err = m.deleteTableOrphans(new(database.CustomersRow), now, stop)
+
+	return
+}
+
+func (m *RetentionManager) deleteTableOrphans(row orphanDeleter, now time.Time, stop func() bool) (deleted int64, err error) {
+	if err = row.SetupDB(m.app.TelemetryDB); err != nil {
+		return 0, fmt.Errorf("%s row SetupDB() failed: %w", row.TableName(), err)
+	}
+
+	cutoff := now.Add(-m.orphanGracePeriod)
+	deleted, err = m.orphanBatches(row, "garbage collection", stop, func() (int64, error) {
+		return row.DeleteOrphans(cutoff, m.batchSize)
+	})
+	if err != nil {
+		return
+	}
+
+	marked, err := m.orphanBatches(row, "orphan marking", stop, func() (int64, error) {
+		return row.MarkOrphans(now, m.batchSize)
+	})
+	if marked > 0 {
+		slog.Info(
+			"Marked orphaned entries for garbage collection",
+			slog.String("table", row.TableName()),
+			slog.Int64("count", marked),
+			slog.Duration("gracePeriod", m.orphanGracePeriod),
+		)
+	}
+
+	return
+}
+
+// orphanBatches repeatedly calls batch, each time in a new transaction,
+// until it processes fewer than batchSize entries, returning the total
+func (m *RetentionManager) orphanBatches(row orphanDeleter, operation string, stop func() bool, batch func() (int64, error)) (total int64, err error) {
+	for !stop() {
+		count, err := m.orphanBatch(row, operation, batch)
+		if err != nil {
+			return total, err
+		}
+		total += count
+
+		// all entries have been processed
+		if count < int64(m.batchSize) {
+			break
+		}
+	}
+
+	return
+}
+
+func (m *RetentionManager) orphanBatch(row orphanDeleter, operation string, batch func() (int64, error)) (count int64, err error) {
+	tx, err := m.app.TelemetryDB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin %s %s transaction: %w", row.TableName(), operation, err)
+	}
+
+	// rollback any changes if we fail to commit the transaction
+	defer tx.Rollback()
+
+	if err = row.SetTx(tx); err != nil {
+		return 0, fmt.Errorf("%s row SetTx() failed: %w", row.TableName(), err)
+	}
+
+	if count, err = batch(); err != nil {
+		return 0, fmt.Errorf("%s %s failed: %w", row.TableName(), operation, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit %s %s: %w", row.TableName(), operation, err)
+	}
+
+	return
+}
+
+// previewOrphans determines the number of tagSets and customers entries
+// that would be garbage collected, once their grace period has elapsed, i.e.
+// those already orphaned and those only referenced by expired telemetry
+// data, updating the report
+func (m *RetentionManager) previewOrphans(report *RetentionReport, refs *retentionRefs) (err error) {
+	if report.TagSets, err = m.previewTableOrphans(new(database.TagSetRow), "tagSetId", refs.tagSets); err != nil {
+		return
+	}
+
+	report.Customers, err = m.previewTableOrphans(new(database.CustomersRow), "customerRefId", refs.customers)
+
+	return
+}
+
+func (m *RetentionManager) previewTableOrphans(row orphanDeleter, refColumn string, expiredRefs map[int64]int64) (count int64, err error) {
+	if err = row.SetupDB(m.app.TelemetryDB); err != nil {
+		return 0, fmt.Errorf("%s row SetupDB() failed: %w", row.TableName(), err)
+	}
+
+	orphans, err := row.Orphans(0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve orphaned %s entries: %w", row.TableName(), err)
+	}
+	count = int64(len(orphans))
+
+	data := new(database.TelemetryDataRow)
+	if err = data.SetupDB(m.app.TelemetryDB); err != nil {
+		return 0, fmt.Errorf("telemetryDataRow.SetupDB() failed: %w", err)
+	}
+
+	for id, expired := range expiredRefs {
+		references, err := data.CountReferencing(refColumn, id)
+		if err != nil {
+			return 0, fmt.Errorf("failed to count telemetry data referencing %s entry %d: %w", row.TableName(), id, err)
+		}
+		if references == expired {
+			count += 1
+		}
+	}
+
+	return
+}
@@ -5,12 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/SUSE/telemetry-server/app/database"
 	telemetrylib "github.com/SUSE/telemetry/pkg/lib"
 )
 
-func (a *App) StageTelemetryReport(reqBody []byte, rHeader *telemetrylib.TelemetryReportHeader) (stagingId int64, err error) {
+func (a *App) StageTelemetryReport(registrationId int64, reqBody []byte, rHeader *telemetrylib.TelemetryReportHeader) (stagingId int64, err error) {
 	// Stores the report body in the operational database's reports table
 
 	// create a ReportStagingTableRow struct
@@ -26,6 +27,7 @@ func (a *App) StageTelemetryReport(reqBody []byte, rHeader *telemetrylib.Telemet
 		rHeader.ReportId,
 		reqBody,
 	)
+	reportStagingRow.RegistrationId = registrationId
 
 	stagingId, err = reportStagingRow.Insert()
 	if err != nil {
@@ -35,37 +37,147 @@ func (a *App) StageTelemetryReport(reqBody []byte, rHeader *telemetrylib.Telemet
 	return
 }
 
-func (a *App) ProcessStagedReports() error {
-	var errs []error
-
+// ProcessNextStagedReport allocates the first unallocated staged report,
+// processing it and deleting it if successful. Returns found as false if
+// no unallocated staged reports were available.
+func (a *App) ProcessNextStagedReport() (found bool, err error) {
 	reportRow := new(database.ReportStagingTableRow)
-	reportRow.SetupDB(a.OperationalDB)
+	if err = reportRow.SetupDB(a.OperationalDB); err != nil {
+		slog.Error("ReportStagingTableRow.SetupDB failed", slog.String("error", err.Error()))
+		return
+	}
+
+	if !reportRow.FirstUnallocated() {
+		return
+	}
+	found = true
+
+	err = a.ProcessStagedReport(reportRow)
+	if err != nil {
+		slog.Error(
+			"report processing failed",
+			slog.Int64("id", reportRow.Id),
+			slog.String("reportId", reportRow.ReportId),
+			slog.String("error", err.Error()),
+		)
 
-	for reportRow.FirstUnallocated() {
-		err := a.ProcessStagedReport(reportRow)
-		if err != nil {
+		// record the failure so that it is available for inspection if the
+		// report ends up being moved to the failedReports table
+		if _, recErr := reportRow.RecordError(err); recErr != nil {
 			slog.Error(
-				"report processing failed",
+				"recording of report processing failure failed",
 				slog.Int64("id", reportRow.Id),
-				slog.String("reportId", reportRow.ReportId),
-				slog.String("error", err.Error()),
+				slog.String("error", recErr.Error()),
+			)
+		}
+
+		err = fmt.Errorf("staged report processing failed: %w", err)
+		return
+	}
+
+	// only delete the report if this worker still holds its allocation
+	deleted, err := reportRow.DeleteAllocated()
+	if err != nil {
+		slog.Error(
+			"delete of processed report failed",
+			slog.Int64("id", reportRow.Id),
+			slog.String("reportId", reportRow.ReportId),
+			slog.String("error", err.Error()),
+		)
+		err = fmt.Errorf("staged report deletion failed: %w", err)
+		return
+	}
+	if !deleted {
+		// the lease expired while the report was being processed, and it
+		// has since been released, and possibly allocated by another worker,
+		// which is responsible for it now
+		slog.Warn(
+			"staged report lease lost during processing",
+			slog.Int64("id", reportRow.Id),
+			slog.String("reportId", reportRow.ReportId),
+		)
+	}
+
+	return
+}
+
+// ReapStagedReports detects staged reports that have remained allocated
+// for longer than the specified lease duration, which indicates that their
+// processing either failed or was lost, and makes them available for
+// processing again. Reports that have already been attempted maxAttempts
+// times are instead moved to the failedReports dead-letter table.
+func (a *App) ReapStagedReports(lease time.Duration, maxAttempts int64) (released, deadLettered int, err error) {
+	reportRow := new(database.ReportStagingTableRow)
+	if err = reportRow.SetupDB(a.OperationalDB); err != nil {
+		slog.Error("ReportStagingTableRow.SetupDB failed", slog.String("error", err.Error()))
+		return
+	}
+
+	allocated, err := reportRow.AllocatedRows()
+	if err != nil {
+		return
+	}
+
+	expiry := time.Now().Add(-lease)
+
+	var errs []error
+	for _, report := range allocated {
+		if report.AllocatedAt == nil {
+			// treat a missing allocation time as expired
+			slog.Warn(
+				"staged report allocatedAt missing",
+				slog.Int64("id", report.Id),
 			)
-			errs = append(errs, fmt.Errorf("staged report processing failed: %w", err))
+		} else if report.AllocatedAt.After(expiry) {
+			// lease has not yet expired
 			continue
 		}
-		err = reportRow.Delete()
-		if err != nil {
-			slog.Error(
-				"delete of processed report failed",
-				slog.Int64("id", reportRow.Id),
-				slog.String("reportId", reportRow.ReportId),
-				slog.String("error", err.Error()),
+
+		if report.Attempts >= maxAttempts {
+			failed := new(database.FailedReportRow)
+			if setupErr := failed.SetupDB(a.OperationalDB); setupErr != nil {
+				errs = append(errs, fmt.Errorf("failed to setup failed report: %w", setupErr))
+				continue
+			}
+
+			moved, moveErr := report.MoveToFailed(failed)
+			if moveErr != nil {
+				errs = append(errs, fmt.Errorf("failed to dead-letter staged report %d: %w", report.Id, moveErr))
+				continue
+			}
+			if moved {
+				slog.Warn(
+					"staged report dead-lettered",
+					slog.Int64("id", report.Id),
+					slog.Int64("failedId", failed.Id),
+					slog.String("report", report.ReportIdentifer()),
+					slog.Int64("attempts", report.Attempts),
+					slog.String("lastError", failed.LastError),
+				)
+				deadLettered++
+			}
+			continue
+		}
+
+		ok, releaseErr := report.Release()
+		if releaseErr != nil {
+			errs = append(errs, fmt.Errorf("failed to release staged report %d: %w", report.Id, releaseErr))
+			continue
+		}
+		if ok {
+			slog.Info(
+				"staged report lease expired, released for reprocessing",
+				slog.Int64("id", report.Id),
+				slog.String("report", report.ReportIdentifer()),
+				slog.Int64("attempts", report.Attempts),
 			)
-			errs = append(errs, fmt.Errorf("staged report deletion failed: %w", err))
+			released++
 		}
 	}
 
-	return errors.Join(errs...)
+	err = errors.Join(errs...)
+
+	return
 }
 
 func (a *App) ProcessStagedReport(reportRow *database.ReportStagingTableRow) (err error) {
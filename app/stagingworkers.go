@@ -0,0 +1,282 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/config"
+)
+
+// StagingWorkerPool is a struct tracking a pool of background workers
+// that process reports staged in the operational DB's reports table
+type StagingWorkerPool struct {
+	app          *App
+	numWorkers   int
+	pollInterval time.Duration
+	lease        time.Duration
+	reapInterval time.Duration
+	maxAttempts  int64
+
+	// private
+	mutex   sync.Mutex
+	running bool
+	wake    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewStagingWorkerPool(a *App, sc *config.StagingConfig) (p *StagingWorkerPool, err error) {
+	p = new(StagingWorkerPool)
+	p.app = a
+
+	switch {
+	case sc.Workers < 0:
+		return nil, fmt.Errorf(
+			"invalid staging.workers value '%d', must not be negative",
+			sc.Workers,
+		)
+	case sc.Workers == 0:
+		p.numWorkers = config.DEF_STAGING_WORKERS
+	default:
+		p.numWorkers = sc.Workers
+	}
+
+	p.pollInterval, err = configDuration(
+		"staging.pollInterval",
+		sc.PollInterval,
+		config.DEF_STAGING_POLL_INTERVAL,
+	)
+	if err != nil {
+		slog.Error(
+			"config staging.pollInterval invalid",
+			slog.String("staging.pollInterval", sc.PollInterval),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	p.lease, err = configDuration(
+		"staging.lease",
+		sc.Lease,
+		config.DEF_STAGING_LEASE,
+	)
+	if err != nil {
+		slog.Error(
+			"config staging.lease invalid",
+			slog.String("staging.lease", sc.Lease),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	p.reapInterval, err = configDuration(
+		"staging.reapInterval",
+		sc.ReapInterval,
+		config.DEF_STAGING_REAP_INTERVAL,
+	)
+	if err != nil {
+		slog.Error(
+			"config staging.reapInterval invalid",
+			slog.String("staging.reapInterval", sc.ReapInterval),
+			slog.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	switch {
+	case sc.MaxAttempts < 0:
+		return nil, fmt.Errorf(
+			"invalid staging.maxAttempts value '%d', must not be negative",
+			sc.MaxAttempts,
+		)
+	case sc.MaxAttempts == 0:
+		p.maxAttempts = int64(config.DEF_STAGING_MAX_ATTEMPTS)
+	default:
+		p.maxAttempts = int64(sc.MaxAttempts)
+	}
+
+	return
+}
+
+func (p *StagingWorkerPool) NumWorkers() int {
+	return p.numWorkers
+}
+
+func (p *StagingWorkerPool) Running() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.running
+}
+
+// Start launches the configured number of background workers
+func (p *StagingWorkerPool) Start() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.running {
+		return
+	}
+
+	// wake is buffered so that a notification sent while all workers are
+	// busy will be picked up when the next worker becomes idle
+	p.wake = make(chan struct{}, p.numWorkers)
+	p.done = make(chan struct{})
+
+	for i := 0; i < p.numWorkers; i++ {
+		p.wg.Add(1)
+		go p.worker(i)
+	}
+
+	p.wg.Add(1)
+	go p.reaper()
+
+	p.running = true
+
+	slog.Info(
+		"Started staged report workers",
+		slog.Int("workers", p.numWorkers),
+		slog.Duration("pollInterval", p.pollInterval),
+		slog.Duration("lease", p.lease),
+		slog.Int64("maxAttempts", p.maxAttempts),
+	)
+}
+
+// Stop signals the background workers to exit, waiting for any reports
+// that are currently being processed to complete
+func (p *StagingWorkerPool) Stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.running {
+		return
+	}
+
+	close(p.done)
+	p.wg.Wait()
+	p.running = false
+
+	slog.Info("Stopped staged report workers")
+}
+
+// Notify wakes an idle worker to check for newly staged reports, without
+// waiting for the poll interval to expire
+func (p *StagingWorkerPool) Notify() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.running {
+		return
+	}
+
+	p.notify()
+}
+
+func (p *StagingWorkerPool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+		// all workers already have a pending notification
+	}
+}
+
+func (p *StagingWorkerPool) stopping() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *StagingWorkerPool) worker(id int) {
+	defer p.wg.Done()
+
+	slog.Debug("Staged report worker started", slog.Int("worker", id))
+
+	timer := time.NewTimer(p.pollInterval)
+	defer timer.Stop()
+
+	for {
+		// process staged reports until none remain or we are stopping
+		for !p.stopping() {
+			found, err := p.app.ProcessNextStagedReport()
+			if err != nil {
+				slog.Error(
+					"Staged report worker failed to process report",
+					slog.Int("worker", id),
+					slog.String("error", err.Error()),
+				)
+			}
+			if !found {
+				break
+			}
+		}
+
+		// reset the poll timer, draining it if it has already fired
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(p.pollInterval)
+
+		// wait until woken, the poll interval expires, or we are stopped
+		select {
+		case <-p.done:
+			slog.Debug("Staged report worker stopped", slog.Int("worker", id))
+			return
+		case <-p.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// Reap releases staged reports whose allocation lease has expired so that
+// they can be processed again, moving those that have exceeded the maximum
+// number of processing attempts to the failedReports table
+func (p *StagingWorkerPool) Reap() (released, deadLettered int, err error) {
+	released, deadLettered, err = p.reap()
+
+	// wake the workers to process any released reports
+	if released > 0 {
+		p.Notify()
+	}
+
+	return
+}
+
+func (p *StagingWorkerPool) reap() (released, deadLettered int, err error) {
+	released, deadLettered, err = p.app.ReapStagedReports(p.lease, p.maxAttempts)
+	if err != nil {
+		slog.Error("Staged report reaping failed", slog.String("error", err.Error()))
+	}
+
+	return
+}
+
+func (p *StagingWorkerPool) reaper() {
+	defer p.wg.Done()
+
+	slog.Debug("Staged report reaper started")
+
+	ticker := time.NewTicker(p.reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			slog.Debug("Staged report reaper stopped")
+			return
+		case <-ticker.C:
+			// Stop() holds the mutex while waiting for the reaper to
+			// exit so wake the workers without acquiring it
+			if released, _, _ := p.reap(); released > 0 {
+				p.notify()
+			}
+		}
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"slices"
 	"strings"
+
+	"github.com/SUSE/telemetry-server/app/database"
 )
 
-const tagSetSep = "|"
+const tagSetSep = database.TAG_SET_SEP
 
 func uniqueSortTags(tags []string) []string {
 	// only need to sort if 2 or more tags present
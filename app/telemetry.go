@@ -1,6 +1,7 @@
 package app
 
 import (
+	"fmt"
 	"log/slog"
 	"strings"
 
@@ -12,19 +13,48 @@ const (
 	ANONYMOUS_CUSTOMER_ID = "ANONYMOUS"
 )
 
-func (a *App) GetTagSetId(tagSet string) (tagSetId int64, err error) {
+// maximum number of times a customer is looked up again because the entry
+// found by the previous lookup was erased before it could be locked
+const customerLockAttempts = 3
 
+// GetTagSetId retrieves the id of the specified tagSet, adding it if it
+// doesn't already exist, as part of the specified transaction, if any
+func (a *App) GetTagSetId(tx *database.Tx, tagSet string) (tagSetId int64, err error) {
 	tsRow := new(database.TagSetRow)
 	if err = tsRow.SetupDB(a.TelemetryDB); err != nil {
 		slog.Error("TagSetRow.SetupDB failed", slog.String("error", err.Error()))
 		return
 	}
 
+	if err = tsRow.SetTx(tx); err != nil {
+		slog.Error("TagSetRow.SetTx failed", slog.String("error", err.Error()))
+		return
+	}
+
+	// cached ids are invalidated if the tagSet entry is changed, or marked
+	// as orphaned for garbage collection, by this or another process
+	tagSetsTable := tsRow.TableName()
+	cachedId, found, epoch := a.idCaches.Get(tagSetsTable, tagSet)
+	if found {
+		return cachedId, nil
+	}
+
 	tsRow.Init(tagSet)
 
-	// if the tagSet entry doesn't already exist, add it
-	if !tsRow.Exists() {
-		err = tsRow.Insert()
+	// reclaim an existing entry that has been marked as orphaned, so that it
+	// won't be garbage collected, unless it has already been deleted
+	found = tsRow.Exists()
+	if found && tsRow.OrphanedAt != nil {
+		if found, err = tsRow.Reclaim(); err != nil {
+			slog.Error("tagSet reclaim failed", slog.String("tagSet", tsRow.TagSet), slog.String("error", err.Error()))
+			return
+		}
+	}
+
+	// if the tagSet entry doesn't already exist, add it, or retrieve the
+	// entry added concurrently by another caller
+	if !found {
+		err = tsRow.Upsert()
 		if err != nil {
 			slog.Error("tagSet insert failed", slog.String("tagSet", tsRow.TagSet), slog.String("error", err.Error()))
 		} else {
@@ -35,18 +65,18 @@ func (a *App) GetTagSetId(tagSet string) (tagSetId int64, err error) {
 	// save the tagSet's reference id if either already present or successfully inserted
 	if err == nil {
 		tagSetId = tsRow.Id
+		afterCommit(tx, func() {
+			a.idCaches.Add(tagSetsTable, tagSet, tagSetId, epoch)
+		})
 	}
 
 	return
 }
 
-func (a *App) GetCustomerRefId(customerId string) (customerRefId int64, err error) {
-	cRow := new(database.CustomersRow)
-	if err = cRow.SetupDB(a.TelemetryDB); err != nil {
-		slog.Error("CustomersRow.SetupDB failed", slog.String("error", err.Error()))
-		return
-	}
-
+// GetCustomerRefId retrieves the reference id of the specified customer id,
+// adding it if it doesn't already exist, as part of the specified transaction,
+// if any
+func (a *App) GetCustomerRefId(tx *database.Tx, customerId string) (customerRefId int64, err error) {
 	// determine actual customer id value to use
 	realCustomerId := strings.TrimSpace(customerId)
 	switch {
@@ -59,15 +89,47 @@ func (a *App) GetCustomerRefId(customerId string) (customerRefId int64, err erro
 		slog.Debug(
 			"Using modified customer id",
 			slog.String("original", customerId),
-			slog.String("updated", customerId),
+			slog.String("updated", realCustomerId),
 		)
 	}
 
+	cRow := new(database.CustomersRow)
+	if err = cRow.SetupDB(a.TelemetryDB); err != nil {
+		slog.Error("CustomersRow.SetupDB failed", slog.String("error", err.Error()))
+		return
+	}
+
+	if err = cRow.SetTx(tx); err != nil {
+		slog.Error("CustomersRow.SetTx failed", slog.String("error", err.Error()))
+		return
+	}
+
+	// cached ids are invalidated if the customer entry is changed, e.g.
+	// erased, or marked as orphaned for garbage collection, by this or
+	// another process, such as the telemetry-admin
+	customersTable := cRow.TableName()
+	cachedId, found, epoch := a.idCaches.Get(customersTable, realCustomerId)
+	if found {
+		return cachedId, nil
+	}
+
+	// only match the active entry, as deleted entries must never be reused
 	cRow.Init(realCustomerId)
 
-	// if the customerId entry doesn't already exist, add it
-	if !cRow.Exists() {
-		err = cRow.Insert()
+	// reclaim an existing entry that has been marked as orphaned, so that it
+	// won't be garbage collected, unless it has already been deleted
+	found = cRow.Exists()
+	if found && cRow.OrphanedAt != nil {
+		if found, err = cRow.Reclaim(); err != nil {
+			slog.Error("customerId reclaim failed", slog.String("customerId", cRow.CustomerId), slog.String("error", err.Error()))
+			return
+		}
+	}
+
+	// if an active customerId entry doesn't already exist, add it, or
+	// retrieve the entry added concurrently by another caller
+	if !found {
+		err = cRow.Upsert()
 		if err != nil {
 			slog.Error("customerId insert failed", slog.String("customerId", cRow.CustomerId), slog.String("error", err.Error()))
 		} else {
@@ -78,12 +140,39 @@ func (a *App) GetCustomerRefId(customerId string) (customerRefId int64, err erro
 	// save the customerId's reference id if either already present or successfully inserted
 	if err == nil {
 		customerRefId = cRow.Id
+		afterCommit(tx, func() {
+			a.idCaches.Add(customersTable, realCustomerId, customerRefId, epoch)
+		})
 	}
 
 	return
 }
 
-func (a *App) StoreTelemetry(
+// telemetryBatch is a struct tracking the telemetry data items from a
+// report that are to be stored together using a bulk insert, as part of
+// the specified transaction, if any
+type telemetryBatch struct {
+	app            *App
+	tx             *database.Tx
+	tagSetIds      map[string]int64
+	customerRefIds map[string]int64
+	keys           map[database.TelemetryDataKey]bool
+	rows           []*database.TelemetryDataRow
+}
+
+func (a *App) newTelemetryBatch(tx *database.Tx) *telemetryBatch {
+	return &telemetryBatch{
+		app:            a,
+		tx:             tx,
+		tagSetIds:      make(map[string]int64),
+		customerRefIds: make(map[string]int64),
+		keys:           make(map[database.TelemetryDataKey]bool),
+	}
+}
+
+// Add prepares a row for the data item, looking up the associated tagSet
+// and customer reference ids only once per batch
+func (b *telemetryBatch) Add(
 	dItm *telemetrylib.TelemetryDataItem,
 	bHdr *telemetrylib.TelemetryBundleHeader,
 ) (err error) {
@@ -91,75 +180,175 @@ func (a *App) StoreTelemetry(
 	tagSet := createTagSet(append(dItm.Header.TelemetryAnnotations, bHdr.BundleAnnotations...))
 
 	// get the associated tagSet's id, creating a new one if needed
-	tagSetId, err := a.GetTagSetId(tagSet)
-	if err != nil {
+	tagSetId, found := b.tagSetIds[tagSet]
+	if !found {
+		tagSetId, err = b.app.GetTagSetId(b.tx, tagSet)
+		if err != nil {
+			slog.Error(
+				"failed to retrieve tagSetId",
+				slog.String("tagSet", tagSet),
+				slog.String("err", err.Error()),
+			)
+			return
+		}
+		b.tagSetIds[tagSet] = tagSetId
+	}
+
+	// get the associated customer's reference id, creating a new one if needed
+	customerRefId, found := b.customerRefIds[bHdr.BundleCustomerId]
+	if !found {
+		customerRefId, err = b.app.GetCustomerRefId(b.tx, bHdr.BundleCustomerId)
+		if err != nil {
+			slog.Error(
+				"failed to retrieve customerRefId",
+				slog.String("customerId", bHdr.BundleCustomerId),
+				slog.String("err", err.Error()),
+			)
+			return
+		}
+		b.customerRefIds[bHdr.BundleCustomerId] = customerRefId
+	}
+
+	tdRow := new(database.TelemetryDataRow)
+	if err = tdRow.SetupDB(b.app.TelemetryDB); err != nil {
+		slog.Error("TelemetryDataRow.SetupDB failed", slog.String("error", err.Error()))
+		return
+	}
+
+	if err = tdRow.Init(dItm, bHdr, tagSetId, customerRefId); err != nil {
 		slog.Error(
-			"failed to retrieve tagSetId",
-			slog.String("tagSet", tagSet),
-			slog.String("err", err.Error()),
+			"unstructured tdRow init failed",
+			slog.String("telemetryId", dItm.Header.TelemetryId),
+			slog.String("error", err.Error()),
 		)
 		return
 	}
 
-	// get the associated tagSet's id, creating a new one if needed
-	customerRefId, err := a.GetCustomerRefId(bHdr.BundleCustomerId)
-	if err != nil {
-		slog.Error(
-			"failed to retrieve customerRefId",
-			slog.String("customerId", bHdr.BundleCustomerId),
-			slog.String("err", err.Error()),
+	// skip data items that appear multiple times in the batch
+	if b.keys[tdRow.Key()] {
+		slog.Debug(
+			"duplicate data item in batch skipped",
+			slog.String("telemetryId", tdRow.TelemetryId),
 		)
 		return
 	}
+	b.keys[tdRow.Key()] = true
 
-	// store the telemetry
-	err = a.StoreTelemetryData(dItm, bHdr, tagSetId, customerRefId)
-	if err != nil {
-		slog.Error(
-			"telemetry store failed",
-			slog.String("telemetryId", dItm.Header.TelemetryId),
-			slog.String("error", err.Error()))
+	b.rows = append(b.rows, tdRow)
+
+	return
+}
+
+// lockCustomers share locks the customers entries referenced by the batch,
+// so that they cannot be erased until the batch's transaction completes,
+// looking up again any customer whose entry has been erased since it was
+// looked up, e.g. by another process while its id was cached, so that data
+// items are never stored for an erased customer
+func (b *telemetryBatch) lockCustomers() (err error) {
+	cRow := new(database.CustomersRow)
+	if err = cRow.SetupDB(b.app.TelemetryDB); err != nil {
+		slog.Error("CustomersRow.SetupDB failed", slog.String("error", err.Error()))
+		return
+	}
+
+	if err = cRow.SetTx(b.tx); err != nil {
+		slog.Error("CustomersRow.SetTx failed", slog.String("error", err.Error()))
+		return
+	}
+
+	for customerId, customerRefId := range b.customerRefIds {
+		for attempt := 1; ; attempt++ {
+			cRow.Id = customerRefId
+			active, err := cRow.LockActive()
+			if err != nil {
+				return fmt.Errorf("failed to lock customer %d: %w", customerRefId, err)
+			}
+			if active {
+				break
+			}
+
+			if attempt == customerLockAttempts {
+				return fmt.Errorf("customer %q erased during lookup %d times", customerId, attempt)
+			}
+
+			slog.Info(
+				"customer erased since lookup, looking up again",
+				slog.String("customerId", customerId),
+				slog.Int64("customerRefId", customerRefId),
+			)
+
+			// discard the erased entry's cached id
+			b.app.idCaches.rowChanged(cRow.TableName(), customerRefId)
+
+			erasedRefId := customerRefId
+			if customerRefId, err = b.app.GetCustomerRefId(b.tx, customerId); err != nil {
+				return err
+			}
+
+			for _, row := range b.rows {
+				if row.CustomerRefId == erasedRefId {
+					row.CustomerRefId = customerRefId
+				}
+			}
+		}
+
+		b.customerRefIds[customerId] = customerRefId
 	}
+
 	return
 }
 
-func (a *App) StoreTelemetryData(
-	dItm *telemetrylib.TelemetryDataItem,
-	bHdr *telemetrylib.TelemetryBundleHeader,
-	tagSetId int64,
-	customerRefId int64,
-) (err error) {
+// Store bulk inserts the batch's data items that don't already exist in
+// the DB, returning the number of data items inserted
+func (b *telemetryBatch) Store() (stored int64, err error) {
+	if len(b.rows) == 0 {
+		return
+	}
+
+	if err = b.lockCustomers(); err != nil {
+		slog.Error("customer lock failed", slog.String("error", err.Error()))
+		return
+	}
+
 	tdRow := new(database.TelemetryDataRow)
+	if err = tdRow.SetupDB(b.app.TelemetryDB); err != nil {
+		slog.Error("TelemetryDataRow.SetupDB failed", slog.String("error", err.Error()))
+		return
+	}
 
-	tdRow.SetupDB(a.TelemetryDB)
+	if err = tdRow.SetTx(b.tx); err != nil {
+		slog.Error("TelemetryDataRow.SetTx failed", slog.String("error", err.Error()))
+		return
+	}
 
-	err = tdRow.Init(dItm, bHdr, tagSetId, customerRefId)
+	existing, err := tdRow.ExistingKeys(b.rows)
 	if err != nil {
-		slog.Error(
-			"unstructured tdRow init failed",
-			slog.String("telemetryId", dItm.Header.TelemetryId),
-			slog.String("error", err.Error()),
-		)
 		return
 	}
 
-	if !tdRow.Exists() {
-		if err := tdRow.Insert(); err != nil {
-			slog.Error(
-				"unstructured tdRow insert failed",
-				slog.String("tableName", tdRow.TableName()),
-				slog.String("telemetryId", dItm.Header.TelemetryId),
-				slog.String("error", err.Error()),
+	newRows := make([]*database.TelemetryDataRow, 0, len(b.rows))
+	for _, row := range b.rows {
+		if existing[row.Key()] {
+			slog.Debug(
+				"data item already stored",
+				slog.String("telemetryId", row.TelemetryId),
 			)
-			return err
+			continue
 		}
+		newRows = append(newRows, row)
+	}
 
-		slog.Info(
-			"unstructured tdRow insert success",
-			slog.String("tableName", tdRow.TableName()),
-			slog.String("telemetryId", dItm.Header.TelemetryId),
-		)
+	stored, err = tdRow.InsertRows(newRows)
+	if err != nil {
+		return
 	}
 
+	slog.Info(
+		"unstructured telemetry bulk insert success",
+		slog.String("tableName", tdRow.TableName()),
+		slog.Int64("stored", stored),
+		slog.Int("skipped", len(b.rows)-len(newRows)),
+	)
+
 	return
 }
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/database"
+)
+
+// telemetryDataItem is a stored telemetry data item, with its tagSet and
+// customerId references resolved
+type telemetryDataItem struct {
+	Id            int64           `json:"id"`
+	ClientId      string          `json:"clientId"`
+	CustomerId    string          `json:"customerId"`
+	TelemetryId   string          `json:"telemetryId"`
+	TelemetryType string          `json:"telemetryType"`
+	Timestamp     time.Time       `json:"timestamp"`
+	Tags          []string        `json:"tags"`
+	DataItem      json.RawMessage `json:"dataItem,omitempty"`
+}
+
+// telemetryDataFilter selects stored telemetry data items; zero values match
+// all items
+type telemetryDataFilter struct {
+	ClientId      string
+	CustomerId    string
+	TelemetryType string
+	Tag           string
+	// timestamp at, or after, this time
+	After time.Time
+	// timestamp before this time
+	Before time.Time
+}
+
+// splitTagSet returns the tags of the tagSet
+func splitTagSet(tagSet string) []string {
+	tags := strings.Trim(tagSet, tagSetSep)
+	if tags == "" {
+		return []string{}
+	}
+	return strings.Split(tags, tagSetSep)
+}
+
+// match checks whether the entry is selected by the filter's tag, which
+// the DB matches case insensitively for SQLite DBs
+func (f *telemetryDataFilter) match(tags []string) bool {
+	return f.Tag == "" || slices.Contains(tags, f.Tag)
+}
+
+// queryTelemetryData retrieves up to limit of the filter selected telemetry
+// data items following the cursor, the id of the last item of the previous
+// page or 0 for the first page, in id order, calling emit for each item.
+// Since the tag cannot be reliably matched by the DB, entries are retrieved
+// in batches until the page is filled. Returns the cursor for
+// the next page, or 0 if there are no more items.
+func (a *App) queryTelemetryData(filter *telemetryDataFilter, cursor int64, limit uint, includeData bool, emit func(*telemetryDataItem) error) (nextCursor int64, err error) {
+	row := new(database.TelemetryDataRow)
+	if err = row.SetupDB(a.TelemetryDB); err != nil {
+		return 0, fmt.Errorf("telemetryDataRow.SetupDB() failed: %w", err)
+	}
+
+	var emitted uint
+	for {
+		var scanned uint
+		query := database.TelemetryDataQuery{
+			ClientId:      filter.ClientId,
+			CustomerId:    filter.CustomerId,
+			TelemetryType: filter.TelemetryType,
+			Tag:           filter.Tag,
+			After:         filter.After,
+			Before:        filter.Before,
+			AfterId:       cursor,
+			Limit:         limit,
+			IncludeData:   includeData,
+		}
+
+		err = row.Query(&query, func(entry *database.TelemetryDataEntry) (bool, error) {
+			scanned += 1
+			cursor = entry.Id
+
+			tags := splitTagSet(entry.TagSet)
+			if !filter.match(tags) {
+				return true, nil
+			}
+
+			item := &telemetryDataItem{
+				Id:            entry.Id,
+				ClientId:      entry.ClientId,
+				CustomerId:    entry.CustomerId,
+				TelemetryId:   entry.TelemetryId,
+				TelemetryType: entry.TelemetryType,
+				Timestamp:     entry.Timestamp,
+				Tags:          tags,
+			}
+			if includeData {
+				item.DataItem = json.RawMessage(entry.DataItem)
+			}
+			if err := emit(item); err != nil {
+				return false, err
+			}
+
+			// stop once the page has been filled
+			emitted += 1
+			return emitted < limit, nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to query telemetry data: %w", err)
+		}
+
+		switch {
+		case emitted == limit:
+			// more items may follow the filled page
+			return cursor, nil
+		case scanned < limit:
+			// all matching entries have been scanned
+			return 0, nil
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/SUSE/telemetry-server/app/database"
+)
+
+// TokenRevocations determines whether a token, identified by its jti and
+// issue time, has been revoked
+type TokenRevocations interface {
+	IsRevoked(jti string, issuedAt time.Time) (bool, error)
+}
+
+// tokenRevocationRetry is the maximum interval after which a failed reload
+// of the token revocations is retried
+const tokenRevocationRetry = 5 * time.Second
+
+// tokenRevocationCache is a TokenRevocations implementation that caches the
+// unexpired entries of the operational DB's tokenRevocations table, reloading
+// them once they are older than the refresh interval, so that revocations
+// made via other server instances are eventually observed. Reloads are
+// performed by a single caller without the mutex held, so that checks aren't
+// stalled behind the DB query, and failed reloads are retried after a delay
+// rather than by every check.
+type tokenRevocationCache struct {
+	adb     *database.AppDb
+	refresh time.Duration
+
+	mutex        sync.Mutex
+	loadedAt     time.Time
+	jtis         map[string]bool
+	issuedBefore time.Time
+
+	// incremented by Invalidate, so that reloads started before then aren't
+	// considered current
+	generation uint64
+	// closed once the in progress reload, if any, completes
+	reloading chan struct{}
+	// the generation of the in progress reload
+	reloadGeneration uint64
+	// failed reloads are not retried until this time, with the failure
+	// being reported if no revocations have been loaded
+	retryAt time.Time
+	loadErr error
+}
+
+func newTokenRevocationCache(adb *database.AppDb, refresh time.Duration) *tokenRevocationCache {
+	return &tokenRevocationCache{
+		adb:     adb,
+		refresh: refresh,
+	}
+}
+
+// load retrieves the unexpired token revocations from the DB, returning the
+// revoked jtis and the time before which all tokens were revoked
+func (c *tokenRevocationCache) load(now time.Time) (jtis map[string]bool, issuedBefore time.Time, err error) {
+	row := new(database.TokenRevocationRow)
+	if err = row.SetupDB(c.adb); err != nil {
+		return nil, issuedBefore, fmt.Errorf("tokenRevocationRow.SetupDB() failed: %w", err)
+	}
+
+	revocations, err := row.List()
+	if err != nil {
+		return nil, issuedBefore, fmt.Errorf("failed to retrieve token revocations: %w", err)
+	}
+
+	jtis = map[string]bool{}
+	for _, revocation := range revocations {
+		if tokenRevocationExpired(revocation, now) {
+			continue
+		}
+
+		if revocation.Jti != "" {
+			jtis[revocation.Jti] = true
+		}
+
+		if revocation.IssuedBefore != nil && revocation.IssuedBefore.After(issuedBefore) {
+			issuedBefore = *revocation.IssuedBefore
+		}
+	}
+
+	return
+}
+
+// Invalidate discards the cached revocations, such that they will be
+// reloaded by the next check
+func (c *tokenRevocationCache) Invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.loadedAt = time.Time{}
+	c.retryAt = time.Time{}
+	c.generation++
+}
+
+// reload reloads the cached revocations, must be called with the mutex
+// held, which is released while the DB is queried
+func (c *tokenRevocationCache) reload(now time.Time) {
+	done := make(chan struct{})
+	generation := c.generation
+	c.reloading = done
+	c.reloadGeneration = generation
+	c.mutex.Unlock()
+
+	jtis, issuedBefore, err := c.load(now)
+
+	c.mutex.Lock()
+	c.reloading = nil
+	close(done)
+
+	if err != nil {
+		c.loadErr = err
+		c.retryAt = now.Add(min(c.refresh, tokenRevocationRetry))
+		if c.jtis != nil {
+			slog.Warn(
+				"Token revocations reload failed, using previously loaded revocations",
+				slog.Time("loadedAt", c.loadedAt),
+				slog.Time("retryAt", c.retryAt),
+				slog.String("error", err.Error()),
+			)
+		}
+		return
+	}
+
+	c.jtis = jtis
+	c.issuedBefore = issuedBefore
+	c.loadErr = nil
+	c.retryAt = time.Time{}
+
+	// revocations may have been made since an invalidated reload started
+	if generation == c.generation {
+		c.loadedAt = now
+	}
+}
+
+// IsRevoked checks if the token has been revoked, reloading the cached
+// revocations if they are stale. If they cannot be reloaded the previously
+// loaded revocations are used, failing only if none have been loaded.
+func (c *tokenRevocationCache) IsRevoked(jti string, issuedAt time.Time) (revoked bool, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for {
+		now := time.Now()
+		if now.Sub(c.loadedAt) < c.refresh || now.Before(c.retryAt) {
+			break
+		}
+
+		// another caller is reloading the revocations, which can be used
+		// in the meantime if they're current, or waited for otherwise
+		if c.reloading != nil {
+			if c.jtis != nil && c.reloadGeneration == c.generation {
+				break
+			}
+			done := c.reloading
+			c.mutex.Unlock()
+			<-done
+			c.mutex.Lock()
+			continue
+		}
+
+		c.reload(now)
+		if c.loadErr == nil {
+			break
+		}
+	}
+
+	if c.jtis == nil {
+		return false, c.loadErr
+	}
+
+	revoked = issuedAt.Before(c.issuedBefore) || (jti != "" && c.jtis[jti])
+
+	return
+}
+
+// tokenRevocationExpired checks if the tokens revoked by the entry would
+// have expired anyway, such that the entry is no longer needed
+func tokenRevocationExpired(revocation *database.TokenRevocationRow, now time.Time) bool {
+	return !revocation.ExpiresAt.After(now)
+}
+
+// purgeExpiredTokenRevocations deletes token revocation entries that are no
+// longer needed, returning the number deleted
+func (a *App) purgeExpiredTokenRevocations() (purged int64, err error) {
+	row := new(database.TokenRevocationRow)
+	if err = row.SetupDB(a.OperationalDB); err != nil {
+		return 0, fmt.Errorf("tokenRevocationRow.SetupDB() failed: %w", err)
+	}
+
+	revocations, err := row.List()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve token revocations: %w", err)
+	}
+
+	now := time.Now()
+	for _, revocation := range revocations {
+		if !tokenRevocationExpired(revocation, now) {
+			continue
+		}
+
+		if err = revocation.Delete(); err != nil {
+			return purged, fmt.Errorf("failed to purge token revocation %d: %w", revocation.Id, err)
+		}
+		purged++
+	}
+
+	return
+}
+
+// recordTokenRevocation stores the token revocation entry, purging any
+// entries that are no longer needed, and invalidates the cached revocations
+// so that the revocation takes effect immediately for this server instance
+func (a *App) recordTokenRevocation(revocation *database.TokenRevocationRow) (err error) {
+	if err = revocation.SetupDB(a.OperationalDB); err != nil {
+		return fmt.Errorf("tokenRevocationRow.SetupDB() failed: %w", err)
+	}
+
+	if revocation.Jti != "" {
+		err = revocation.Upsert()
+	} else {
+		err = revocation.Insert()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record token revocation: %w", err)
+	}
+
+	if a.revoked != nil {
+		a.revoked.Invalidate()
+	}
+
+	if purged, err := a.purgeExpiredTokenRevocations(); err != nil {
+		slog.Warn("Expired token revocations purge failed", slog.String("error", err.Error()))
+	} else if purged > 0 {
+		slog.Info("Purged expired token revocations", slog.Int64("purged", purged))
+	}
+
+	return
+}
+
+// revokeToken revokes the token with the specified jti. Since the token's
+// expiry is unknown, the revocation is retained for the maximum lifetime of
+// a token.
+func (a *App) revokeToken(jti string) (revocation *database.TokenRevocationRow, err error) {
+	now := database.DbNow()
+
+	revocation = new(database.TokenRevocationRow)
+	revocation.InitJti(
+		jti,
+		now,
+		now.Add(a.AuthManager.Duration()),
+	)
+
+	if err = a.recordTokenRevocation(revocation); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// revokeTokensIssuedBefore revokes all tokens issued before the specified
+// time, retaining the revocation until all such tokens would have expired
+func (a *App) revokeTokensIssuedBefore(issuedBefore time.Time) (revocation *database.TokenRevocationRow, err error) {
+	// token issue times have a precision of one second, so truncate the
+	// time to avoid revoking tokens issued after it within the same second
+	issuedBefore = issuedBefore.Truncate(time.Second)
+
+	revocation = new(database.TokenRevocationRow)
+	revocation.InitIssuedBefore(
+		issuedBefore,
+		database.DbNow(),
+		issuedBefore.Add(a.AuthManager.Duration()),
+	)
+
+	if err = a.recordTokenRevocation(revocation); err != nil {
+		return nil, err
+	}
+
+	return
+}
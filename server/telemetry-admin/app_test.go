@@ -1,16 +1,27 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/SUSE/telemetry-server/app"
 	"github.com/SUSE/telemetry-server/app/config"
+	"github.com/SUSE/telemetry-server/app/database"
+	"github.com/SUSE/telemetry-server/app/database/telemetrydb"
+	telemetrylib "github.com/SUSE/telemetry/pkg/lib"
 	"github.com/SUSE/telemetry/pkg/types"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -55,6 +66,18 @@ logging:
   level: debug
 auth:
   secret: VGVzdGluZ1NlY3JldAo=
+erasure:
+  secret: VGVzdGluZ0VyYXN1cmVTZWNyZXQK
+idCache:
+  refresh: 1s
+retention:
+  batchSize: 2
+  rules:
+  - telemetryType: SLE-SERVER-Retained
+    maxAge: 30d
+  - telemetryType: SLE-SERVER-Retained
+    tag: keep=long
+    maxAge: 520w
 `
 
 	formattedContents := fmt.Sprintf(content, s.path, s.path)
@@ -70,7 +93,6 @@ auth:
 	s.app, s.router = InitializeApp(s.config, true)
 
 	// setup the client entry in the clients table
-	s.authToken, _ = s.app.AuthManager.CreateToken()
 	s.clientReg = types.ClientRegistration{
 		ClientId:   "1b504dca-bd71-424f-87f6-21eb7f5745db",
 		SystemUUID: "3f97d439-5212-4688-af22-ad0559a626cb",
@@ -92,12 +114,23 @@ auth:
 		s.clientReg.ClientId,
 		s.clientReg.SystemUUID,
 		s.clientReg.Timestamp,
-		"2024-07-01T00:00:00.000000000Z",
-		s.authToken,
+		database.DbTime(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)),
+		"",
 	)
 	if err := row.Scan(&s.regId); err != nil {
 		panic(fmt.Errorf("failed to setup test client entry in clients table: %s", err.Error()))
 	}
+
+	// tokens are bound to the registration id, so can only be created
+	// once the client entry exists
+	s.authToken, err = s.app.AuthManager.CreateToken(s.regId)
+	require.NoError(s.T(), err)
+	_, err = s.app.OperationalDB.Conn().DB().Exec(
+		`UPDATE clients SET authToken = ? WHERE id = ?`,
+		s.authToken,
+		s.regId,
+	)
+	require.NoError(s.T(), err)
 }
 
 func (s *AppTestSuite) TearDownTest() {
@@ -121,6 +154,1127 @@ func (t *AppTestSuite) TestHealthCheckHandler() {
 	assert.Equal(t.T(), http.StatusOK, rr.Code)
 }
 
+func (t *AppTestSuite) serveRequest(method, path string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, nil)
+	t.Require().NoError(err)
+
+	rr := httptest.NewRecorder()
+	t.router.ServeHTTP(rr, req)
+
+	return rr
+}
+
+// createFailedReport stages a report that cannot be processed and moves it
+// to the failedReports table
+func (t *AppTestSuite) createFailedReport(reportId string) {
+	_, err := t.app.StageTelemetryReport(
+		t.regId,
+		[]byte(`{"invalid": json`),
+		&telemetrylib.TelemetryReportHeader{
+			ReportId:       reportId,
+			ReportClientId: uuid.NewString(),
+		},
+	)
+	t.Require().NoError(err, "staging a report should succeed")
+
+	found, err := t.app.ProcessNextStagedReport()
+	t.Require().True(found, "staged report should have been found")
+	t.Require().Error(err, "staged report processing should have failed")
+
+	_, deadLettered, err := t.app.ReapStagedReports(0, 1)
+	t.Require().NoError(err, "reaping should succeed")
+	t.Require().Equal(1, deadLettered, "staged report should have been dead-lettered")
+}
+
+type failedReportResp struct {
+	Id        int64  `json:"id"`
+	ReportId  string `json:"reportId"`
+	Data      string `json:"data"`
+	LastError string `json:"lastError"`
+	Attempts  int64  `json:"attempts"`
+}
+
+// Verify the handling of the failed reports admin endpoints
+func (t *AppTestSuite) TestFailedReportsHandlers() {
+	reportIds := []string{uuid.NewString(), uuid.NewString(), uuid.NewString()}
+	for _, reportId := range reportIds {
+		t.createFailedReport(reportId)
+	}
+
+	// list the failed reports, using pagination
+	var list struct {
+		FailedReports []failedReportResp `json:"failedReports"`
+		Limit         uint               `json:"limit"`
+		Offset        uint               `json:"offset"`
+	}
+	rr := t.serveRequest("GET", "/admin/reports/failed?limit=2&offset=1")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &list))
+	t.Equal(uint(2), list.Limit)
+	t.Equal(uint(1), list.Offset)
+	t.Require().Len(list.FailedReports, 2)
+	t.Equal(reportIds[1], list.FailedReports[0].ReportId)
+	t.Equal(reportIds[2], list.FailedReports[1].ReportId)
+	t.Empty(list.FailedReports[0].Data, "listed reports should not include data")
+
+	// invalid pagination is rejected
+	rr = t.serveRequest("GET", "/admin/reports/failed?limit=0")
+	t.Equal(http.StatusBadRequest, rr.Code)
+
+	// inspect the first failed report
+	rr = t.serveRequest("GET", "/admin/reports/failed")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &list))
+	t.Require().Len(list.FailedReports, 3)
+	firstId := list.FailedReports[0].Id
+
+	var report failedReportResp
+	rr = t.serveRequest("GET", fmt.Sprintf("/admin/reports/failed/%d", firstId))
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &report))
+	t.Equal(reportIds[0], report.ReportId)
+	t.Equal(`{"invalid": json`, report.Data)
+	t.Equal(int64(1), report.Attempts)
+	t.NotEmpty(report.LastError)
+
+	// requeue the first failed report
+	var requeue struct {
+		Id        int64 `json:"id"`
+		StagingId int64 `json:"stagingId"`
+	}
+	rr = t.serveRequest("POST", fmt.Sprintf("/admin/reports/failed/%d/requeue", firstId))
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &requeue))
+	t.Equal(firstId, requeue.Id)
+	t.NotZero(requeue.StagingId)
+
+	var stagedReportId string
+	var attempts int64
+	row := t.app.OperationalDB.Conn().DB().QueryRow(
+		`SELECT reportId, attempts FROM reports WHERE id = ?`,
+		requeue.StagingId,
+	)
+	t.Require().NoError(row.Scan(&stagedReportId, &attempts), "requeued report should be staged")
+	t.Equal(reportIds[0], stagedReportId)
+	t.Equal(int64(0), attempts, "requeued report attempts should be reset")
+
+	rr = t.serveRequest("GET", fmt.Sprintf("/admin/reports/failed/%d", firstId))
+	t.Equal(http.StatusNotFound, rr.Code, "requeued report should no longer be failed")
+
+	// purge the second failed report
+	rr = t.serveRequest("DELETE", fmt.Sprintf("/admin/reports/failed/%d", list.FailedReports[1].Id))
+	t.Require().Equal(http.StatusOK, rr.Code)
+
+	rr = t.serveRequest("DELETE", fmt.Sprintf("/admin/reports/failed/%d", list.FailedReports[1].Id))
+	t.Equal(http.StatusNotFound, rr.Code, "purged report should no longer exist")
+
+	// purge all remaining failed reports
+	var purge struct {
+		Purged int64 `json:"purged"`
+	}
+	rr = t.serveRequest("DELETE", "/admin/reports/failed")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &purge))
+	t.Equal(int64(1), purge.Purged)
+
+	rr = t.serveRequest("GET", "/admin/reports/failed")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &list))
+	t.Empty(list.FailedReports)
+}
+
+func (t *AppTestSuite) TestSchemaDriftHandler() {
+	// Test that manual DDL changes are reported as schema drift
+
+	type driftResponse struct {
+		Drift bool                          `json:"drift"`
+		Dbs   []*database.SchemaDriftReport `json:"dbs"`
+	}
+
+	var resp driftResponse
+	rr := t.serveRequest("GET", "/admin/schema/drift")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+	t.False(resp.Drift, "newly created DBs should match the table specs")
+	t.Len(resp.Dbs, 2)
+
+	// manually alter the clients and tagSets tables
+	opDb := t.app.OperationalDB.Conn().DB()
+	_, err := opDb.Exec(`ALTER TABLE clients ADD COLUMN notes VARCHAR`)
+	t.Require().NoError(err)
+	_, err = opDb.Exec(`ALTER TABLE clients DROP COLUMN systemUUID`)
+	t.Require().NoError(err)
+
+	telDb := t.app.TelemetryDB.Conn().DB()
+	_, err = telDb.Exec(`DROP TABLE tagSets`)
+	t.Require().NoError(err)
+	_, err = telDb.Exec(`CREATE TABLE tagSets(id INTEGER NOT NULL PRIMARY KEY, tagSet TEXT NOT NULL)`)
+	t.Require().NoError(err)
+
+	rr = t.serveRequest("GET", "/admin/schema/drift")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+	t.True(resp.Drift, "manual DDL changes should be reported")
+
+	drifted := map[string]database.SchemaTableDrift{}
+	for _, report := range resp.Dbs {
+		for _, table := range report.Tables {
+			drifted[table.Table] = table
+		}
+	}
+	t.Require().Len(drifted, 2, "only the altered tables should have drifted")
+
+	clients := drifted["clients"]
+	t.Equal([]string{"systemUUID"}, clients.MissingColumns)
+	t.Equal([]string{"notes"}, clients.ExtraColumns)
+
+	tagSets := drifted["tagSets"]
+	t.Require().Len(tagSets.MismatchedColumns, 1)
+	t.Equal("tagSet", tagSets.MismatchedColumns[0].Column)
+	t.Equal("TEXT", tagSets.MismatchedColumns[0].ActualType)
+}
+
+func (t *AppTestSuite) TestSuspectedClonesHandlers() {
+	// Test listing, inspecting and clearing suspected clones
+
+	type clonesResponse struct {
+		Clients []map[string]any `json:"clients"`
+	}
+
+	var list clonesResponse
+	rr := t.serveRequest("GET", "/admin/clients/clones")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &list))
+	t.Empty(list.Clients)
+
+	clonePath := fmt.Sprintf("/admin/clients/clones/%d", t.regId)
+	rr = t.serveRequest("GET", clonePath)
+	t.Equal(http.StatusNotFound, rr.Code, "clients that aren't suspected clones should not be found")
+
+	// flag the test client as a suspected clone with a couple of signals
+	opDb := t.app.OperationalDB.Conn().DB()
+	_, err := opDb.Exec(
+		`UPDATE clients SET cloneSuspected = true, cloneSuspectedAt = ? WHERE id = ?`,
+		database.DbTime(time.Date(2024, 7, 2, 0, 0, 0, 0, time.UTC)),
+		t.regId,
+	)
+	t.Require().NoError(err)
+	detectedAt := database.DbTime(time.Date(2024, 7, 2, 0, 0, 0, 0, time.UTC))
+	for _, signal := range []string{database.CLONE_SIGNAL_STALE_TOKEN, database.CLONE_SIGNAL_INTERLEAVED_AUTH} {
+		_, err = opDb.Exec(
+			`INSERT INTO cloneSignals(registrationId, signal, details, detectedAt, lastDetectedAt) VALUES(?, ?, '', ?, ?)`,
+			t.regId,
+			signal,
+			detectedAt,
+			detectedAt,
+		)
+		t.Require().NoError(err)
+	}
+
+	rr = t.serveRequest("GET", "/admin/clients/clones")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &list))
+	t.Require().Len(list.Clients, 1)
+	t.Equal(float64(t.regId), list.Clients[0]["id"])
+	t.Equal(true, list.Clients[0]["cloneSuspected"])
+	t.NotContains(rr.Body.String(), t.authToken, "authTokens should not be exposed")
+
+	var clone struct {
+		Client  map[string]any             `json:"client"`
+		Signals []*database.CloneSignalRow `json:"signals"`
+	}
+	rr = t.serveRequest("GET", clonePath)
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &clone))
+	t.Equal(t.clientReg.ClientId, clone.Client["clientId"])
+	t.NotContains(rr.Body.String(), t.authToken, "authTokens should not be exposed")
+	t.Require().Len(clone.Signals, 2)
+	t.Equal(database.CLONE_SIGNAL_STALE_TOKEN, clone.Signals[0].Signal)
+	t.Equal(database.CLONE_SIGNAL_INTERLEAVED_AUTH, clone.Signals[1].Signal)
+
+	var cleared struct {
+		Id               int64 `json:"id"`
+		DiscardedSignals int64 `json:"discardedSignals"`
+	}
+	rr = t.serveRequest("DELETE", clonePath)
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &cleared))
+	t.Equal(t.regId, cleared.Id)
+	t.Equal(int64(2), cleared.DiscardedSignals)
+
+	rr = t.serveRequest("GET", clonePath)
+	t.Equal(http.StatusNotFound, rr.Code, "cleared clients should no longer be suspected clones")
+
+	var suspected bool
+	t.Require().NoError(opDb.QueryRow(`SELECT cloneSuspected FROM clients WHERE id = ?`, t.regId).Scan(&suspected))
+	t.False(suspected)
+}
+
+func (t *AppTestSuite) TestClientsHandlers() {
+	// Test browsing client registrations, filtering by clientId, systemUUID
+	// and registration date range, without exposing authtokens
+
+	type clientsResponse struct {
+		Clients []database.ClientsRow `json:"clients"`
+	}
+
+	opDb := t.app.OperationalDB.Conn().DB()
+	addRegistration := func(clientId, systemUUID string, registrationDate time.Time) (id int64) {
+		row := opDb.QueryRow(
+			`INSERT INTO clients(clientId, systemUUID, clientTimestamp, registrationDate, authToken) `+
+				`VALUES(?, ?, ?, ?, 'secret-token') RETURNING id`,
+			clientId,
+			systemUUID,
+			t.clientReg.Timestamp,
+			database.DbTime(registrationDate),
+		)
+		t.Require().NoError(row.Scan(&id))
+		return
+	}
+
+	otherId := "8d3f2b1c-5e4a-4b7d-9c0e-1f2a3b4c5d6e"
+	august := addRegistration(otherId, "4c1d2e3f-5a6b-4c7d-8e9f-0a1b2c3d4e5f", time.Date(2024, 8, 15, 12, 0, 0, 500000000, time.UTC))
+	september := addRegistration(otherId, "6e5d4c3b-2a1f-4e0d-9c8b-7a6f5e4d3c2b", time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC))
+
+	ids := func(query string) (ids []int64) {
+		rr := t.serveRequest("GET", "/admin/clients"+query)
+		t.Require().Equal(http.StatusOK, rr.Code, query)
+		t.NotContains(rr.Body.String(), "authToken", "authtokens should be redacted")
+		t.NotContains(rr.Body.String(), "secret-token", "authtokens should be redacted")
+
+		var resp clientsResponse
+		t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+		t.Require().NotNil(resp.Clients, "an empty list should be returned rather than null")
+		for _, client := range resp.Clients {
+			ids = append(ids, client.Id)
+		}
+		return
+	}
+
+	t.Equal([]int64{t.regId, august, september}, ids(""))
+	t.Equal([]int64{august, september}, ids("?clientId="+otherId))
+	t.Equal([]int64{t.regId}, ids("?systemUUID="+t.clientReg.SystemUUID))
+	t.Equal([]int64{september}, ids("?clientId="+otherId+"&systemUUID=6e5d4c3b-2a1f-4e0d-9c8b-7a6f5e4d3c2b"))
+	t.Empty(ids("?clientId=unknown"))
+	t.Equal([]int64{august, september}, ids("?registeredAfter=2024-08-01T00:00:00Z"))
+	t.Equal([]int64{t.regId, august}, ids("?registeredBefore=2024-09-01T00:00:00Z"))
+	t.Equal([]int64{august}, ids("?registeredAfter=2024-08-15T12:00:00Z&registeredBefore=2024-09-01T00:00:00Z"))
+	t.Equal([]int64{august}, ids("?limit=1&offset=1"))
+	t.Equal([]int64{september}, ids("?registeredAfter=2024-07-02T00:00:00Z&limit=1&offset=1"))
+
+	for _, query := range []string{"?registeredAfter=yesterday", "?registeredBefore=2024-09-01", "?limit=0"} {
+		rr := t.serveRequest("GET", "/admin/clients"+query)
+		t.Equal(http.StatusBadRequest, rr.Code, query)
+	}
+
+	rr := t.serveRequest("GET", fmt.Sprintf("/admin/clients/%d", t.regId))
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.NotContains(rr.Body.String(), "authToken", "authtokens should be redacted")
+	var client database.ClientsRow
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &client))
+	t.Equal(t.regId, client.Id)
+	t.Equal(t.clientReg.ClientId, client.ClientId)
+	t.Equal(t.clientReg.SystemUUID, client.SystemUUID)
+
+	rr = t.serveRequest("GET", fmt.Sprintf("/admin/clients/%d", september+1))
+	t.Equal(http.StatusNotFound, rr.Code)
+}
+
+func (t *AppTestSuite) TestRevokeClientHandlers() {
+	// Test revoking client registrations by id and by clientId
+
+	type revokeResponse struct {
+		Revoked []int64 `json:"revoked"`
+	}
+
+	opDb := t.app.OperationalDB.Conn().DB()
+	addRegistration := func(clientId, systemUUID string) (id int64) {
+		row := opDb.QueryRow(
+			`INSERT INTO clients(clientId, systemUUID, clientTimestamp, registrationDate, authToken) `+
+				`VALUES(?, ?, ?, ?, '') RETURNING id`,
+			clientId,
+			systemUUID,
+			t.clientReg.Timestamp,
+			database.DbTime(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)),
+		)
+		t.Require().NoError(row.Scan(&id))
+		return
+	}
+
+	clonedId := "c6a1f1f8-1c8e-4a8e-9d55-0a4c1c1e7f01"
+	clone1 := addRegistration(clonedId, "9a0e43a3-6c2b-4bb8-8f0b-3b1f3f4e0a11")
+	clone2 := addRegistration(clonedId, "3f0a6f0e-0a2d-4e8c-b9a8-2e5c6b7d8e22")
+	_, err := opDb.Exec(
+		`INSERT INTO cloneSignals(registrationId, relatedRegistrationId, signal, details, detectedAt, lastDetectedAt) VALUES(?, ?, ?, '', ?, ?)`,
+		clone2,
+		clone1,
+		database.CLONE_SIGNAL_DUPLICATE_CLIENT_ID,
+		database.DbTime(time.Date(2024, 7, 2, 0, 0, 0, 0, time.UTC)),
+		database.DbTime(time.Date(2024, 7, 2, 0, 0, 0, 0, time.UTC)),
+	)
+	t.Require().NoError(err)
+
+	var resp revokeResponse
+	rr := t.serveRequest("DELETE", fmt.Sprintf("/admin/clients/%d", t.regId))
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+	t.Equal([]int64{t.regId}, resp.Revoked)
+
+	rr = t.serveRequest("DELETE", fmt.Sprintf("/admin/clients/%d", t.regId))
+	t.Equal(http.StatusNotFound, rr.Code, "revoked registration should no longer exist")
+
+	rr = t.serveRequest("DELETE", "/admin/clients?clientId="+clonedId)
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+	t.Equal([]int64{clone1, clone2}, resp.Revoked)
+
+	rr = t.serveRequest("DELETE", "/admin/clients?clientId="+clonedId)
+	t.Equal(http.StatusNotFound, rr.Code)
+
+	var count int
+	t.Require().NoError(opDb.QueryRow(`SELECT COUNT(*) FROM clients`).Scan(&count))
+	t.Zero(count, "all registrations should have been revoked")
+	t.Require().NoError(opDb.QueryRow(`SELECT COUNT(*) FROM cloneSignals`).Scan(&count))
+	t.Zero(count, "revoked registrations' clone signals should have been removed")
+}
+
+func (t *AppTestSuite) TestClientActivityHandlers() {
+	// Test querying client activity, filtering by inactivity, activity and
+	// client version
+
+	type activityEntry struct {
+		RegistrationId int64  `json:"registrationId"`
+		ClientId       string `json:"clientId"`
+		ReportCount    int64  `json:"reportCount"`
+		ClientVersion  string `json:"clientVersion"`
+		LastActiveAt   string `json:"lastActiveAt"`
+	}
+	type activityResponse struct {
+		Clients []activityEntry `json:"clients"`
+		Total   uint            `json:"total"`
+	}
+
+	opDb := t.app.OperationalDB.Conn().DB()
+	daysAgo := func(days int) time.Time {
+		return database.DbTime(time.Now().AddDate(0, 0, -days))
+	}
+
+	// the test client was last seen reporting 100 days ago
+	_, err := opDb.Exec(
+		`INSERT INTO clientActivity(registrationId, firstSeenAt, lastReportAt, reportCount, authenticationCount, clientVersion, lastActiveAt) `+
+			`VALUES(?, ?, ?, 5, 1, '1.0.0', ?)`,
+		t.regId,
+		daysAgo(200),
+		daysAgo(100),
+		daysAgo(100),
+	)
+	t.Require().NoError(err)
+
+	// another client registered 10 days ago and authenticated yesterday
+	var otherId int64
+	t.Require().NoError(opDb.QueryRow(
+		`INSERT INTO clients(clientId, systemUUID, clientTimestamp, registrationDate, authToken) `+
+			`VALUES(?, ?, ?, ?, '') RETURNING id`,
+		"5b7b8a44-0c5e-4d4e-9a53-5c1f9a9e2f10",
+		"e2a8f8b0-37c1-4a7e-8f4e-7d8c6b1e2a33",
+		t.clientReg.Timestamp,
+		daysAgo(10),
+	).Scan(&otherId))
+	_, err = opDb.Exec(
+		`INSERT INTO clientActivity(registrationId, firstSeenAt, lastAuthenticatedAt, reportCount, authenticationCount, clientVersion, lastActiveAt) `+
+			`VALUES(?, ?, ?, 0, 2, '2.0.0', ?)`,
+		otherId,
+		daysAgo(10),
+		daysAgo(1),
+		daysAgo(1),
+	)
+	t.Require().NoError(err)
+
+	list := func(query string) (resp activityResponse) {
+		rr := t.serveRequest("GET", "/admin/clients/activity"+query)
+		t.Require().Equal(http.StatusOK, rr.Code, query)
+		t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+		return
+	}
+
+	resp := list("")
+	t.Equal(uint(2), resp.Total)
+	t.Require().Len(resp.Clients, 2)
+	t.Equal(t.regId, resp.Clients[0].RegistrationId)
+	t.Equal(t.clientReg.ClientId, resp.Clients[0].ClientId)
+	t.Equal(int64(5), resp.Clients[0].ReportCount)
+	t.Equal(otherId, resp.Clients[1].RegistrationId)
+
+	resp = list("?inactiveDays=90")
+	t.Require().Len(resp.Clients, 1)
+	t.Equal(t.regId, resp.Clients[0].RegistrationId)
+
+	resp = list("?inactiveDays=120")
+	t.Empty(resp.Clients)
+	t.NotNil(resp.Clients, "an empty list should be returned rather than null")
+
+	resp = list("?activeDays=7")
+	t.Require().Len(resp.Clients, 1)
+	t.Equal(otherId, resp.Clients[0].RegistrationId)
+
+	resp = list("?clientVersion=1.0.0")
+	t.Require().Len(resp.Clients, 1)
+	t.Equal(t.regId, resp.Clients[0].RegistrationId)
+
+	resp = list("?limit=1&offset=1")
+	t.Equal(uint(2), resp.Total)
+	t.Require().Len(resp.Clients, 1)
+	t.Equal(otherId, resp.Clients[0].RegistrationId)
+
+	for _, query := range []string{"?inactiveDays=0", "?inactiveDays=soon", "?activeDays=-1"} {
+		rr := t.serveRequest("GET", "/admin/clients/activity"+query)
+		t.Equal(http.StatusBadRequest, rr.Code, query)
+	}
+
+	var entry activityEntry
+	rr := t.serveRequest("GET", fmt.Sprintf("/admin/clients/%d/activity", otherId))
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &entry))
+	t.Equal(otherId, entry.RegistrationId)
+	t.Equal("2.0.0", entry.ClientVersion)
+	t.Equal(daysAgo(1).Format(time.DateOnly), entry.LastActiveAt[:10], "last active should be the last authentication")
+
+	rr = t.serveRequest("GET", fmt.Sprintf("/admin/clients/%d/activity", otherId+1))
+	t.Equal(http.StatusNotFound, rr.Code)
+}
+
+// storeTelemetry stores the specified data items, grouped into bundles for
+// each client, in the telemetry DB
+func (t *AppTestSuite) storeTelemetry(bundles ...telemetrylib.TelemetryBundle) {
+	report := telemetrylib.TelemetryReport{
+		Header: telemetrylib.TelemetryReportHeader{
+			ReportId:        uuid.NewString(),
+			ReportTimeStamp: types.Now().String(),
+			ReportClientId:  uuid.NewString(),
+		},
+		TelemetryBundles: bundles,
+	}
+	t.Require().NoError(t.app.ProcessTelemetryReport(&report))
+}
+
+func (t *AppTestSuite) TestTelemetryDataHandler() {
+	// Test querying stored telemetry data, filtering by clientId, customerId,
+	// telemetryType, tag and timestamp range, with cursor pagination
+
+	type telemetryItem struct {
+		Id          int64           `json:"id"`
+		ClientId    string          `json:"clientId"`
+		CustomerId  string          `json:"customerId"`
+		TelemetryId string          `json:"telemetryId"`
+		Tags        []string        `json:"tags"`
+		DataItem    json.RawMessage `json:"dataItem"`
+	}
+	type telemetryResponse struct {
+		Items      []telemetryItem `json:"items"`
+		NextCursor string          `json:"nextCursor"`
+	}
+
+	names := map[string]string{}
+	newItem := func(name, telemetryType, timestamp string, tags ...string) telemetrylib.TelemetryDataItem {
+		telemetryId := uuid.NewString()
+		names[telemetryId] = name
+		return telemetrylib.TelemetryDataItem{
+			Header: telemetrylib.TelemetryDataItemHeader{
+				TelemetryId:          telemetryId,
+				TelemetryTimeStamp:   timestamp,
+				TelemetryType:        telemetryType,
+				TelemetryAnnotations: tags,
+			},
+			TelemetryData: json.RawMessage(`{"name":"` + name + `"}`),
+		}
+	}
+	newBundle := func(clientId, customerId string, tags []string, items ...telemetrylib.TelemetryDataItem) telemetrylib.TelemetryBundle {
+		return telemetrylib.TelemetryBundle{
+			Header: telemetrylib.TelemetryBundleHeader{
+				BundleId:          uuid.NewString(),
+				BundleTimeStamp:   types.Now().String(),
+				BundleClientId:    clientId,
+				BundleCustomerId:  customerId,
+				BundleAnnotations: tags,
+			},
+			TelemetryDataItems: items,
+		}
+	}
+
+	clientA := uuid.NewString()
+	clientB := uuid.NewString()
+	t.storeTelemetry(
+		newBundle(clientA, "CUST-A", []string{"site=lab"},
+			newItem("i1", "SLE-SERVER-Test", "2024-07-01T00:00:00Z", "role=db"),
+			newItem("i2", "SLE-SERVER-Test", "2024-07-02T00:00:00.5Z", "role_db"),
+			newItem("i3", "SLE-SERVER-Other", "2024-07-03T00:00:00Z"),
+		),
+		newBundle(clientB, "CUST-B", nil,
+			newItem("i4", "SLE-SERVER-Test", "2024-07-04T00:00:00Z", "Role=DB"),
+			newItem("i5", "SLE-SERVER-Test", "2024-07-05T00:00:00Z"),
+		),
+	)
+
+	query := func(params url.Values) (resp telemetryResponse) {
+		rr := t.serveRequest("GET", "/admin/telemetry?"+params.Encode())
+		t.Require().Equal(http.StatusOK, rr.Code, params.Encode())
+		t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &resp), rr.Body.String())
+		t.Require().NotNil(resp.Items, "an empty list should be returned rather than null")
+		return
+	}
+	itemNames := func(resp telemetryResponse) (found []string) {
+		for _, item := range resp.Items {
+			found = append(found, names[item.TelemetryId])
+		}
+		return
+	}
+
+	resp := query(url.Values{})
+	t.Equal([]string{"i1", "i2", "i3", "i4", "i5"}, itemNames(resp))
+	t.Empty(resp.NextCursor)
+	t.Equal(clientA, resp.Items[0].ClientId)
+	t.Equal("CUST-A", resp.Items[0].CustomerId, "customerId should be resolved")
+	t.Equal([]string{"role=db", "site=lab"}, resp.Items[0].Tags, "tags should be resolved")
+	t.Equal([]string{"site=lab"}, resp.Items[2].Tags)
+	t.Equal([]string{}, resp.Items[4].Tags)
+	t.Nil(resp.Items[0].DataItem, "dataItem should only be included if requested")
+
+	t.Equal([]string{"i4", "i5"}, itemNames(query(url.Values{"clientId": {clientB}})))
+	t.Equal([]string{"i1", "i2", "i3"}, itemNames(query(url.Values{"customerId": {"CUST-A"}})))
+	t.Equal([]string{"i3"}, itemNames(query(url.Values{"telemetryType": {"SLE-SERVER-Other"}})))
+	t.Equal([]string{"i1", "i2", "i3"}, itemNames(query(url.Values{"tag": {"site=lab"}})))
+	t.Equal([]string{"i1"}, itemNames(query(url.Values{"tag": {"role=db"}})), "tags should match exactly")
+	t.Equal([]string{"i2"}, itemNames(query(url.Values{"tag": {"role_db"}})), "tags should match literally")
+	t.Empty(itemNames(query(url.Values{"tag": {"role"}})))
+	t.Equal([]string{"i4"}, itemNames(query(url.Values{"tag": {"Role=DB"}, "customerId": {"CUST-B"}})))
+	t.Equal([]string{"i2", "i3"}, itemNames(query(url.Values{
+		"after":  {"2024-07-02T00:00:00Z"},
+		"before": {"2024-07-04T00:00:00Z"},
+	})))
+
+	// page through all the items
+	var pages [][]string
+	params := url.Values{"limit": {"2"}}
+	for {
+		resp = query(params)
+		pages = append(pages, itemNames(resp))
+		if resp.NextCursor == "" {
+			break
+		}
+		params.Set("cursor", resp.NextCursor)
+	}
+	t.Equal([][]string{{"i1", "i2"}, {"i3", "i4"}, {"i5"}}, pages)
+
+	// page through items selected by a filter that isn't applied by the DB
+	pages = nil
+	params = url.Values{"limit": {"1"}, "after": {"2024-07-03T00:00:00Z"}}
+	for {
+		resp = query(params)
+		pages = append(pages, itemNames(resp))
+		if resp.NextCursor == "" {
+			break
+		}
+		params.Set("cursor", resp.NextCursor)
+	}
+	t.Equal([][]string{{"i3"}, {"i4"}, {"i5"}, nil}, pages)
+
+	// dataItem bodies are streamed when requested
+	resp = query(url.Values{"includeData": {"true"}, "clientId": {clientA}})
+	t.Require().Len(resp.Items, 3)
+	for _, item := range resp.Items {
+		t.JSONEq(`{"name":"`+names[item.TelemetryId]+`"}`, string(item.DataItem))
+	}
+	t.Empty(resp.NextCursor)
+
+	resp = query(url.Values{"includeData": {"true"}, "clientId": {uuid.NewString()}})
+	t.Empty(resp.Items)
+
+	for _, params := range []string{"cursor=abc", "cursor=0", "includeData=maybe", "offset=1", "after=yesterday", "limit=1001"} {
+		rr := t.serveRequest("GET", "/admin/telemetry?"+params)
+		t.Equal(http.StatusBadRequest, rr.Code, params)
+	}
+}
+
+func (t *AppTestSuite) TestCustomerErasureHandlers() {
+	// Test erasing customers, purging or detaching their telemetry data,
+	// and retrieving the recorded erasure receipts
+
+	newBundle := func(clientId, customerId string, count int) telemetrylib.TelemetryBundle {
+		bundle := telemetrylib.TelemetryBundle{
+			Header: telemetrylib.TelemetryBundleHeader{
+				BundleId:         uuid.NewString(),
+				BundleTimeStamp:  types.Now().String(),
+				BundleClientId:   clientId,
+				BundleCustomerId: customerId,
+			},
+		}
+		for range count {
+			bundle.TelemetryDataItems = append(bundle.TelemetryDataItems, telemetrylib.TelemetryDataItem{
+				Header: telemetrylib.TelemetryDataItemHeader{
+					TelemetryId:        uuid.NewString(),
+					TelemetryTimeStamp: types.Now().String(),
+					TelemetryType:      "SLE-SERVER-Test",
+				},
+				TelemetryData: json.RawMessage(`{"customer":"` + customerId + `"}`),
+			})
+		}
+		return bundle
+	}
+
+	telDb := t.app.TelemetryDB.Conn().DB()
+	customerRefIds := func(clientId string) (refIds []int64) {
+		rows, err := telDb.Query(fmt.Sprintf(
+			`SELECT DISTINCT customerRefId FROM telemetryData WHERE clientId = '%s' ORDER BY customerRefId`,
+			clientId,
+		))
+		t.Require().NoError(err)
+		defer rows.Close()
+		for rows.Next() {
+			var refId int64
+			t.Require().NoError(rows.Scan(&refId))
+			refIds = append(refIds, refId)
+		}
+		t.Require().NoError(rows.Err())
+		return
+	}
+	customerHash := func(customerId string) string {
+		secret, err := base64.StdEncoding.DecodeString(t.config.Erasure.Secret)
+		t.Require().NoError(err)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(customerId))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	erase := func(params string) (receipt database.CustomerErasureRow) {
+		rr := t.serveRequest("POST", "/admin/customers/erasures?"+params)
+		t.Require().Equal(http.StatusOK, rr.Code, params)
+		t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &receipt))
+		return
+	}
+
+	clientA := uuid.NewString()
+	clientB := uuid.NewString()
+	clientC := uuid.NewString()
+	t.storeTelemetry(
+		newBundle(clientA, "CUST-A", 2),
+		newBundle(clientB, "CUST-B", 1),
+		newBundle(clientC, "CUST-C", 1),
+	)
+	refIdsA := customerRefIds(clientA)
+	refIdsB := customerRefIds(clientB)
+	t.Require().Len(refIdsA, 1)
+	t.Require().Len(refIdsB, 1)
+
+	// purge, the configured default, without pseudonymisation
+	receipt := erase("customerId=CUST-A")
+	t.NotZero(receipt.Id)
+	t.Equal(refIdsA[0], receipt.CustomerRefId)
+	t.Equal(customerHash("CUST-A"), receipt.CustomerIdHash)
+	t.Equal(app.ERASURE_POLICY_PURGE, receipt.Policy)
+	t.False(receipt.Pseudonymised)
+	t.Equal(int64(2), receipt.DataItems)
+	t.NotEmpty(receipt.ErasedAt)
+	t.Empty(customerRefIds(clientA), "telemetry data should be purged")
+
+	customer := new(database.CustomersRow)
+	t.Require().NoError(customer.SetupDB(t.app.TelemetryDB))
+	customer.Id = receipt.CustomerRefId
+	t.Require().True(customer.IdExists())
+	t.True(customer.Deleted)
+	t.Require().NotNil(customer.DeletedAt)
+	t.Equal(receipt.ErasedAt, *customer.DeletedAt)
+	t.Equal("CUST-A", customer.CustomerId, "customerId should only be replaced if pseudonymised")
+
+	rr := t.serveRequest("POST", "/admin/customers/erasures?customerId=CUST-A")
+	t.Equal(http.StatusNotFound, rr.Code, "an erased customer cannot be erased again")
+
+	// new telemetry for an erased customer uses a new customers entry
+	t.storeTelemetry(newBundle(clientA, "CUST-A", 1))
+	newRefIdsA := customerRefIds(clientA)
+	t.Require().Len(newRefIdsA, 1)
+	t.NotEqual(refIdsA[0], newRefIdsA[0], "deleted customers entries should not be reused")
+
+	// detach with pseudonymisation
+	receipt = erase("customerId=CUST-B&policy=detach&pseudonymise=true")
+	t.Equal(refIdsB[0], receipt.CustomerRefId)
+	t.Equal(app.ERASURE_POLICY_DETACH, receipt.Policy)
+	t.True(receipt.Pseudonymised)
+	t.Equal(int64(1), receipt.DataItems)
+
+	customer.Id = receipt.CustomerRefId
+	t.Require().True(customer.IdExists())
+	t.True(customer.Deleted)
+	t.NotEqual("CUST-B", customer.CustomerId, "customerId should be pseudonymised")
+	t.NotEqual(receipt.CustomerIdHash, customer.CustomerId, "pseudonym should not be derived from the customerId")
+
+	detachedRefIds := customerRefIds(clientB)
+	t.Require().Len(detachedRefIds, 1, "telemetry data should be retained")
+	customer.Id = detachedRefIds[0]
+	t.Require().True(customer.IdExists())
+	t.Equal(app.ANONYMOUS_CUSTOMER_ID, customer.CustomerId, "telemetry data should be detached")
+
+	// a customer erased by another process, bypassing this process's
+	// cache invalidation, must not be reused either, once the cache
+	// generations have been checked
+	refIdsC := customerRefIds(clientC)
+	t.Require().Len(refIdsC, 1)
+	otherDb, err := telemetrydb.New(t.app.Config)
+	t.Require().NoError(err)
+	t.Require().NoError(otherDb.Connect())
+	defer otherDb.Close()
+	otherCustomer := new(database.CustomersRow)
+	t.Require().NoError(otherCustomer.SetupDB(otherDb))
+	otherCustomer.Id = refIdsC[0]
+	t.Require().True(otherCustomer.IdExists())
+	otherCustomer.Deleted = true
+	t.Require().NoError(otherCustomer.Update())
+	time.Sleep(time.Second)
+	t.storeTelemetry(newBundle(clientC, "CUST-C", 1))
+	newRefIdsC := customerRefIds(clientC)
+	t.Require().Len(newRefIdsC, 2)
+	t.Equal(refIdsC[0], newRefIdsC[0])
+	t.NotEqual(refIdsC[0], newRefIdsC[1], "cached deleted customers entries should not be reused")
+
+	for _, params := range []string{
+		"",
+		"customerId=",
+		"customerId=anonymous",
+		"customerId=CUST-C&policy=shred",
+		"customerId=CUST-C&pseudonymise=maybe",
+	} {
+		rr = t.serveRequest("POST", "/admin/customers/erasures?"+params)
+		t.Equal(http.StatusBadRequest, rr.Code, params)
+	}
+	rr = t.serveRequest("POST", "/admin/customers/erasures?customerId=CUST-UNKNOWN")
+	t.Equal(http.StatusNotFound, rr.Code)
+
+	// receipts can be listed, optionally for a specific customerId
+	type erasuresResponse struct {
+		Erasures []database.CustomerErasureRow `json:"erasures"`
+		Limit    uint                          `json:"limit"`
+		Offset   uint                          `json:"offset"`
+	}
+	list := func(params string) (resp erasuresResponse) {
+		rr := t.serveRequest("GET", "/admin/customers/erasures?"+params)
+		t.Require().Equal(http.StatusOK, rr.Code, params)
+		t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+		t.Require().NotNil(resp.Erasures, "an empty list should be returned rather than null")
+		return
+	}
+
+	resp := list("")
+	t.Require().Len(resp.Erasures, 2)
+	t.Equal(customerHash("CUST-A"), resp.Erasures[0].CustomerIdHash)
+	t.Equal(customerHash("CUST-B"), resp.Erasures[1].CustomerIdHash)
+
+	resp = list("customerId=CUST-B")
+	t.Require().Len(resp.Erasures, 1)
+	t.Equal(receipt.Id, resp.Erasures[0].Id)
+
+	resp = list("customerId=CUST-C")
+	t.Empty(resp.Erasures)
+
+	resp = list("limit=1&offset=1")
+	t.Require().Len(resp.Erasures, 1)
+	t.Equal(receipt.Id, resp.Erasures[0].Id)
+
+	var fetched database.CustomerErasureRow
+	rr = t.serveRequest("GET", fmt.Sprintf("/admin/customers/erasures/%d", receipt.Id))
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &fetched))
+	t.Equal(receipt.CustomerIdHash, fetched.CustomerIdHash)
+	t.Equal(receipt.DataItems, fetched.DataItems)
+	t.Equal(receipt.ErasedAt, fetched.ErasedAt)
+
+	rr = t.serveRequest("GET", "/admin/customers/erasures/999999")
+	t.Equal(http.StatusNotFound, rr.Code)
+}
+
+func (t *AppTestSuite) TestCustomerErasureSecretRequired() {
+	// Test that customers cannot be erased, or their erasure receipts looked
+	// up, without an erasure secret
+	t.Require().NoError(t.app.Shutdown())
+	t.config.Erasure.Secret = ""
+	t.app, t.router = InitializeApp(t.config, true)
+
+	rr := t.serveRequest("POST", "/admin/customers/erasures?customerId=CUST-A")
+	t.Equal(http.StatusServiceUnavailable, rr.Code)
+
+	rr = t.serveRequest("GET", "/admin/customers/erasures?customerId=CUST-A")
+	t.Equal(http.StatusServiceUnavailable, rr.Code)
+
+	rr = t.serveRequest("GET", "/admin/customers/erasures")
+	t.Equal(http.StatusOK, rr.Code, "receipts can still be listed")
+}
+
+func (t *AppTestSuite) TestRetentionOrphanGracePeriod() {
+	// Test that an orphan grace period that doesn't exceed the idCache
+	// refresh interval is rejected
+	_, err := app.NewRetentionManager(t.app, &config.RetentionConfig{OrphanGracePeriod: "1s"})
+	t.Error(err)
+
+	_, err = app.NewRetentionManager(t.app, &config.RetentionConfig{OrphanGracePeriod: "2s"})
+	t.NoError(err)
+}
+
+func (t *AppTestSuite) TestRetention() {
+	// Test previewing and purging expired telemetry data, and garbage
+	// collecting the orphaned tagSets and customers entries
+
+	newItem := func(telemetryType, timestamp string, tags ...string) telemetrylib.TelemetryDataItem {
+		return telemetrylib.TelemetryDataItem{
+			Header: telemetrylib.TelemetryDataItemHeader{
+				TelemetryId:          uuid.NewString(),
+				TelemetryTimeStamp:   timestamp,
+				TelemetryType:        telemetryType,
+				TelemetryAnnotations: tags,
+			},
+			TelemetryData: json.RawMessage(`{"retention":true}`),
+		}
+	}
+	newBundle := func(customerId string, tags []string, items ...telemetrylib.TelemetryDataItem) telemetrylib.TelemetryBundle {
+		return telemetrylib.TelemetryBundle{
+			Header: telemetrylib.TelemetryBundleHeader{
+				BundleId:          uuid.NewString(),
+				BundleTimeStamp:   types.Now().String(),
+				BundleClientId:    uuid.NewString(),
+				BundleCustomerId:  customerId,
+				BundleAnnotations: tags,
+			},
+			TelemetryDataItems: items,
+		}
+	}
+
+	telDb := t.app.TelemetryDB.Conn().DB()
+	count := func(table string) (count int64) {
+		t.Require().NoError(telDb.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&count))
+		return
+	}
+
+	t.storeTelemetry(
+		newBundle("CUST-R1", nil,
+			newItem("SLE-SERVER-Retained", "2024-01-01T00:00:00Z"),
+			newItem("SLE-SERVER-Retained", "2024-01-02T00:00:00Z", "keep=long"),
+			newItem("SLE-SERVER-Retained", types.Now().String()),
+			newItem("SLE-SERVER-Test", "2024-01-03T00:00:00Z"),
+		),
+		newBundle("CUST-R2", []string{"site=gone"},
+			newItem("SLE-SERVER-Retained", "2024-01-04T00:00:00Z"),
+			newItem("SLE-SERVER-Retained", "2024-01-05T00:00:00Z"),
+		),
+	)
+	t.Require().Equal(int64(6), count("telemetryData"))
+	tagSets := count("tagSets")
+	customers := count("customers")
+
+	// a dry run reports what would be removed without removing it
+	var report app.RetentionReport
+	rr := t.serveRequest("GET", "/admin/retention/preview")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &report))
+	t.True(report.DryRun)
+	t.Equal(int64(3), report.DataItems)
+	t.Equal(int64(1), report.TagSets, "the site=gone tagSet should be orphaned")
+	t.Equal(int64(1), report.Customers, "the CUST-R2 customer should be orphaned")
+	t.Require().Len(report.Rules, 2)
+	t.Equal("30d", report.Rules[0].MaxAge)
+	t.Equal(int64(3), report.Rules[0].DataItems)
+	t.Equal("keep=long", report.Rules[1].Tag)
+	t.Equal(int64(0), report.Rules[1].DataItems)
+
+	t.Equal(int64(6), count("telemetryData"), "a dry run should not delete telemetry data")
+	t.Equal(tagSets, count("tagSets"))
+	t.Equal(customers, count("customers"))
+
+	// a purge removes the expired telemetry data, marking the orphaned
+	// entries, which are only removed once their grace period has elapsed
+	purged, err := t.app.Retention.Purge(false)
+	t.Require().NoError(err)
+	t.False(purged.DryRun)
+	t.Equal(report.DataItems, purged.DataItems)
+	t.Zero(purged.TagSets)
+	t.Zero(purged.Customers)
+	t.Equal(int64(3), count("telemetryData"))
+	t.Equal(tagSets, count("tagSets"))
+	t.Equal(customers, count("customers"))
+	t.Equal(int64(1), count("tagSets WHERE orphanedAt IS NOT NULL"))
+	t.Equal(int64(1), count("customers WHERE orphanedAt IS NOT NULL"))
+
+	// age the orphaned marks beyond the grace period
+	expired := database.DbTime(time.Now().Add(-2 * time.Hour))
+	for _, table := range []string{"tagSets", "customers"} {
+		_, err = telDb.Exec(`UPDATE `+table+` SET orphanedAt = ? WHERE orphanedAt IS NOT NULL`, expired)
+		t.Require().NoError(err)
+	}
+
+	purged, err = t.app.Retention.Purge(false)
+	t.Require().NoError(err)
+	t.Zero(purged.DataItems)
+	t.Equal(report.TagSets, purged.TagSets)
+	t.Equal(report.Customers, purged.Customers)
+	t.Equal(tagSets-1, count("tagSets"))
+	t.Equal(customers-1, count("customers"))
+
+	purged, err = t.app.Retention.Purge(false)
+	t.Require().NoError(err)
+	t.Zero(purged.DataItems)
+	t.Zero(purged.TagSets)
+	t.Zero(purged.Customers)
+
+	// telemetry referencing garbage collected entries can still be stored
+	t.storeTelemetry(
+		newBundle("CUST-R2", []string{"site=gone"},
+			newItem("SLE-SERVER-Retained", types.Now().String()),
+		),
+	)
+	t.Equal(int64(4), count("telemetryData"))
+	t.Equal(tagSets, count("tagSets"))
+	t.Equal(customers, count("customers"))
+
+	// orphaned entries referenced again before their grace period elapses
+	// are reclaimed, rather than garbage collected
+	t.storeTelemetry(
+		newBundle("CUST-R3", []string{"site=reclaimed"},
+			newItem("SLE-SERVER-Retained", "2024-01-06T00:00:00Z"),
+		),
+	)
+	purged, err = t.app.Retention.Purge(false)
+	t.Require().NoError(err)
+	t.Equal(int64(1), purged.DataItems)
+	t.Equal(int64(1), count("tagSets WHERE orphanedAt IS NOT NULL"))
+	t.Equal(int64(1), count("customers WHERE orphanedAt IS NOT NULL"))
+
+	t.storeTelemetry(
+		newBundle("CUST-R3", []string{"site=reclaimed"},
+			newItem("SLE-SERVER-Retained", types.Now().String()),
+		),
+	)
+	t.Zero(count("tagSets WHERE orphanedAt IS NOT NULL"))
+	t.Zero(count("customers WHERE orphanedAt IS NOT NULL"))
+
+	purged, err = t.app.Retention.Purge(false)
+	t.Require().NoError(err)
+	t.Zero(purged.TagSets)
+	t.Zero(purged.Customers)
+	t.Equal(tagSets+1, count("tagSets"))
+	t.Equal(customers+1, count("customers"))
+}
+
+func (t *AppTestSuite) TestRetentionRetainsErasedCustomers() {
+	// Test that an erased customer, whose telemetry data was purged, is not
+	// garbage collected as an orphan, so that its erasure receipt remains
+	// valid
+
+	clientId := uuid.NewString()
+	t.storeTelemetry(telemetrylib.TelemetryBundle{
+		Header: telemetrylib.TelemetryBundleHeader{
+			BundleId:         uuid.NewString(),
+			BundleTimeStamp:  types.Now().String(),
+			BundleClientId:   clientId,
+			BundleCustomerId: "CUST-ERASED",
+		},
+		TelemetryDataItems: []telemetrylib.TelemetryDataItem{
+			{
+				Header: telemetrylib.TelemetryDataItemHeader{
+					TelemetryId:        uuid.NewString(),
+					TelemetryTimeStamp: types.Now().String(),
+					TelemetryType:      "SLE-SERVER-Test",
+				},
+				TelemetryData: json.RawMessage(`{"erased":true}`),
+			},
+		},
+	})
+
+	var receipt database.CustomerErasureRow
+	rr := t.serveRequest("POST", "/admin/customers/erasures?customerId=CUST-ERASED&policy=purge")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &receipt))
+	t.Require().Equal(int64(1), receipt.DataItems)
+
+	telDb := t.app.TelemetryDB.Conn().DB()
+	customers := func(where string) (count int64) {
+		t.Require().NoError(telDb.QueryRow(
+			`SELECT COUNT(*) FROM customers WHERE id = ? AND `+where, receipt.CustomerRefId,
+		).Scan(&count))
+		return
+	}
+
+	report, err := t.app.Retention.Purge(true)
+	t.Require().NoError(err)
+	t.Zero(report.Customers, "an erased customer should not be reported as an orphan")
+
+	_, err = t.app.Retention.Purge(false)
+	t.Require().NoError(err)
+	t.Zero(customers("orphanedAt IS NOT NULL"), "an erased customer should not be marked orphaned")
+
+	// even if marked orphaned before being erased, it is never deleted
+	_, err = telDb.Exec(
+		`UPDATE customers SET orphanedAt = ? WHERE id = ?`,
+		database.DbTime(time.Now().Add(-2*time.Hour)), receipt.CustomerRefId,
+	)
+	t.Require().NoError(err)
+
+	purged, err := t.app.Retention.Purge(false)
+	t.Require().NoError(err)
+	t.Zero(purged.Customers)
+	t.Equal(int64(1), customers("deleted = true"), "the erased customer should be retained")
+
+	rr = t.serveRequest("GET", fmt.Sprintf("/admin/customers/erasures/%d", receipt.Id))
+	t.Equal(http.StatusOK, rr.Code)
+}
+
+func (t *AppTestSuite) TestTokenRevocationHandlers() {
+	// Test revoking tokens by jti and by issue time
+
+	opDb := t.app.OperationalDB.Conn().DB()
+	countRevocations := func() (count int) {
+		t.Require().NoError(opDb.QueryRow(`SELECT COUNT(*) FROM tokenRevocations`).Scan(&count))
+		return
+	}
+
+	claims, err := t.app.AuthManager.ParseToken(t.authToken)
+	t.Require().NoError(err)
+	t.Require().NoError(t.app.AuthManager.VerifyToken(t.authToken, t.regId))
+
+	var revocation database.TokenRevocationRow
+	rr := t.serveRequest("POST", "/admin/tokens/"+claims.ID+"/revoke")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &revocation))
+	t.Equal(claims.ID, revocation.Jti)
+	t.Empty(revocation.IssuedBefore)
+	t.Equal(1, countRevocations())
+
+	err = t.app.AuthManager.VerifyToken(t.authToken, t.regId)
+	t.ErrorIs(err, app.ErrTokenRevoked, "revoked token should be rejected")
+
+	// revoking an already revoked token should not add another entry
+	rr = t.serveRequest("POST", "/admin/tokens/"+claims.ID+"/revoke")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Equal(1, countRevocations())
+
+	// tokens other than the revoked one remain valid
+	newToken, err := t.app.AuthManager.CreateToken(t.regId)
+	t.Require().NoError(err)
+	t.Require().NoError(t.app.AuthManager.VerifyToken(newToken, t.regId))
+
+	rr = t.serveRequest("POST", "/admin/tokens/revoke")
+	t.Equal(http.StatusBadRequest, rr.Code, "issuedBefore should be required")
+	rr = t.serveRequest("POST", "/admin/tokens/revoke?issuedBefore=yesterday")
+	t.Equal(http.StatusBadRequest, rr.Code, "issuedBefore should be a timestamp")
+
+	// revoke all tokens issued up to, and including, the current second
+	issuedBefore := types.TelemetryTimeStamp{Time: time.Now().Add(time.Second)}.String()
+	rr = t.serveRequest("POST", "/admin/tokens/revoke?issuedBefore="+issuedBefore)
+	t.Require().Equal(http.StatusOK, rr.Code)
+	revocation = database.TokenRevocationRow{}
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &revocation))
+	t.Empty(revocation.Jti)
+	t.NotEmpty(revocation.IssuedBefore)
+	t.Equal(2, countRevocations())
+
+	err = t.app.AuthManager.VerifyToken(newToken, t.regId)
+	t.ErrorIs(err, app.ErrTokenRevoked, "tokens issued before the cutoff should be rejected")
+}
+
 func TestAppTestSuite(t *testing.T) {
 	suite.Run(t, new(AppTestSuite))
 }
@@ -35,6 +35,94 @@ func (rw *routerWrapper) getVersion(w http.ResponseWriter, r *http.Request) {
 	rw.app.Version(app.QuietAppRequest(w, r, mux.Vars(r)))
 }
 
+func (rw *routerWrapper) listFailedReports(w http.ResponseWriter, r *http.Request) {
+	rw.app.ListFailedReports(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) getFailedReport(w http.ResponseWriter, r *http.Request) {
+	rw.app.GetFailedReport(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) requeueFailedReport(w http.ResponseWriter, r *http.Request) {
+	rw.app.RequeueFailedReport(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) purgeFailedReport(w http.ResponseWriter, r *http.Request) {
+	rw.app.PurgeFailedReport(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) purgeFailedReports(w http.ResponseWriter, r *http.Request) {
+	rw.app.PurgeFailedReports(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) schemaDrift(w http.ResponseWriter, r *http.Request) {
+	rw.app.SchemaDrift(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) listSuspectedClones(w http.ResponseWriter, r *http.Request) {
+	rw.app.ListSuspectedClones(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) getSuspectedClone(w http.ResponseWriter, r *http.Request) {
+	rw.app.GetSuspectedClone(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) clearSuspectedClone(w http.ResponseWriter, r *http.Request) {
+	rw.app.ClearSuspectedClone(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) listClients(w http.ResponseWriter, r *http.Request) {
+	rw.app.ListClients(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) getClient(w http.ResponseWriter, r *http.Request) {
+	rw.app.GetClient(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) revokeClient(w http.ResponseWriter, r *http.Request) {
+	rw.app.RevokeClient(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) revokeClientsByClientId(w http.ResponseWriter, r *http.Request) {
+	rw.app.RevokeClientsByClientId(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) listClientActivity(w http.ResponseWriter, r *http.Request) {
+	rw.app.ListClientActivity(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) getClientActivity(w http.ResponseWriter, r *http.Request) {
+	rw.app.GetClientActivity(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) queryTelemetryData(w http.ResponseWriter, r *http.Request) {
+	rw.app.QueryTelemetryData(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) eraseCustomer(w http.ResponseWriter, r *http.Request) {
+	rw.app.EraseCustomer(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) listErasures(w http.ResponseWriter, r *http.Request) {
+	rw.app.ListErasures(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) getErasure(w http.ResponseWriter, r *http.Request) {
+	rw.app.GetErasure(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) previewRetention(w http.ResponseWriter, r *http.Request) {
+	rw.app.PreviewRetention(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) revokeToken(w http.ResponseWriter, r *http.Request) {
+	rw.app.RevokeToken(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
+func (rw *routerWrapper) revokeTokensIssuedBefore(w http.ResponseWriter, r *http.Request) {
+	rw.app.RevokeTokensIssuedBefore(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
 // options is a struct of the options
 type options struct {
 	Config string `json:"config"`
@@ -87,6 +175,28 @@ func SetupRouterWrapper(router *mux.Router, app *app.App) {
 	router.HandleFunc("/healthz", wrapper.healthCheck).Methods("GET", "HEAD")
 	router.HandleFunc("/live", wrapper.liveCheck).Methods("GET", "HEAD")
 	router.HandleFunc("/version", wrapper.getVersion).Methods("GET", "HEAD")
+	router.HandleFunc("/admin/reports/failed", wrapper.listFailedReports).Methods("GET")
+	router.HandleFunc("/admin/reports/failed", wrapper.purgeFailedReports).Methods("DELETE")
+	router.HandleFunc("/admin/reports/failed/{id:[0-9]+}", wrapper.getFailedReport).Methods("GET")
+	router.HandleFunc("/admin/reports/failed/{id:[0-9]+}", wrapper.purgeFailedReport).Methods("DELETE")
+	router.HandleFunc("/admin/reports/failed/{id:[0-9]+}/requeue", wrapper.requeueFailedReport).Methods("POST")
+	router.HandleFunc("/admin/schema/drift", wrapper.schemaDrift).Methods("GET")
+	router.HandleFunc("/admin/clients", wrapper.listClients).Methods("GET")
+	router.HandleFunc("/admin/clients/{id:[0-9]+}", wrapper.getClient).Methods("GET")
+	router.HandleFunc("/admin/clients", wrapper.revokeClientsByClientId).Methods("DELETE").Queries("clientId", "{clientId}")
+	router.HandleFunc("/admin/clients/{id:[0-9]+}", wrapper.revokeClient).Methods("DELETE")
+	router.HandleFunc("/admin/clients/activity", wrapper.listClientActivity).Methods("GET")
+	router.HandleFunc("/admin/clients/{id:[0-9]+}/activity", wrapper.getClientActivity).Methods("GET")
+	router.HandleFunc("/admin/clients/clones", wrapper.listSuspectedClones).Methods("GET")
+	router.HandleFunc("/admin/clients/clones/{id:[0-9]+}", wrapper.getSuspectedClone).Methods("GET")
+	router.HandleFunc("/admin/clients/clones/{id:[0-9]+}", wrapper.clearSuspectedClone).Methods("DELETE")
+	router.HandleFunc("/admin/telemetry", wrapper.queryTelemetryData).Methods("GET")
+	router.HandleFunc("/admin/customers/erasures", wrapper.eraseCustomer).Methods("POST")
+	router.HandleFunc("/admin/customers/erasures", wrapper.listErasures).Methods("GET")
+	router.HandleFunc("/admin/customers/erasures/{id:[0-9]+}", wrapper.getErasure).Methods("GET")
+	router.HandleFunc("/admin/retention/preview", wrapper.previewRetention).Methods("GET")
+	router.HandleFunc("/admin/tokens/revoke", wrapper.revokeTokensIssuedBefore).Methods("POST")
+	router.HandleFunc("/admin/tokens/{jti}/revoke", wrapper.revokeToken).Methods("POST")
 }
 
 func InitializeApp(cfg *config.Config, debug bool) (a *app.App, router *mux.Router) {
@@ -5,7 +5,9 @@ import (
 	"compress/gzip"
 	"compress/zlib"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,13 +15,18 @@ import (
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/SUSE/telemetry-server/app"
 	"github.com/SUSE/telemetry-server/app/config"
+	"github.com/SUSE/telemetry-server/app/database"
+	"github.com/SUSE/telemetry-server/app/database/operationaldb"
+	"github.com/SUSE/telemetry-server/app/database/telemetrydb"
 	"github.com/SUSE/telemetry/pkg/restapi"
 	"github.com/SUSE/telemetry/pkg/types"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
@@ -67,6 +74,8 @@ logging:
   level: debug
 auth:
   secret: VGVzdGluZ1NlY3JldAo=
+idCache:
+  refresh: 1s
 `
 
 	formattedContents := fmt.Sprintf(content, s.path, s.path)
@@ -82,7 +91,6 @@ auth:
 	s.app, s.router = InitializeApp(s.config, true)
 
 	// setup the client entry in the clients table
-	s.authToken, _ = s.app.AuthManager.CreateToken()
 	s.clientReg = types.ClientRegistration{
 		ClientId:   "1b504dca-bd71-424f-87f6-21eb7f5745db",
 		SystemUUID: "3f97d439-5212-4688-af22-ad0559a626cb",
@@ -105,11 +113,22 @@ auth:
 		s.clientReg.SystemUUID,
 		s.clientReg.Timestamp,
 		"2024-07-01T00:00:00.000000000Z",
-		s.authToken,
+		"",
 	)
 	if err := row.Scan(&s.regId); err != nil {
 		panic(fmt.Errorf("failed to setup test client entry in clients table: %s", err.Error()))
 	}
+
+	// tokens are bound to the registration id, so can only be created
+	// once the client entry exists
+	s.authToken, err = s.app.AuthManager.CreateToken(s.regId)
+	require.NoError(s.T(), err)
+	_, err = s.app.OperationalDB.Conn().DB().Exec(
+		`UPDATE clients SET authToken = ? WHERE id = ?`,
+		s.authToken,
+		s.regId,
+	)
+	require.NoError(s.T(), err)
 }
 
 func (s *AppTestSuite) TearDownTest() {
@@ -295,6 +314,1155 @@ func (t *AppTestSuite) TestReportTelemetryCompressedPayloadDeflate() {
 
 }
 
+func (t *AppTestSuite) countTableEntries(adb *database.AppDb, table string) (count int, err error) {
+	row := adb.Conn().DB().QueryRow(`SELECT COUNT(id) FROM ` + table)
+	err = row.Scan(&count)
+	return
+}
+
+func (t *AppTestSuite) TestStartBackgroundJobs() {
+	// Test that the background jobs are only started when requested, as
+	// only the telemetry-server runs them, and are stopped on shutdown
+
+	t.app.Config.Staging.Enabled = true
+	t.app.Config.Retention.Enabled = true
+
+	t.False(t.app.StagingWorkers.Running())
+	t.False(t.app.ProcessedReports.Running())
+	t.False(t.app.Retention.Running())
+
+	t.app.StartBackgroundJobs()
+
+	t.True(t.app.StagingWorkers.Running())
+	t.True(t.app.ProcessedReports.Running())
+	t.True(t.app.Retention.Running())
+
+	t.Require().NoError(t.app.Shutdown())
+
+	t.False(t.app.StagingWorkers.Running())
+	t.False(t.app.ProcessedReports.Running())
+	t.False(t.app.Retention.Running())
+}
+
+func (t *AppTestSuite) TestReportTelemetryStaged() {
+	// Test that staged reports are processed by the staging workers
+	// rather than inline as part of handling the request
+
+	// enable staging and start the staging workers
+	t.app.Config.Staging.Enabled = true
+	t.app.StagingWorkers.Start()
+	defer t.app.StagingWorkers.Stop()
+
+	body, err := createReportPayload("TestCustomer")
+	t.NoError(err, "creating a report payload should succeed")
+
+	rr, err := postToReportTelemetryHandler(body, "", true, t)
+	t.NoError(err, "posting telemetry should succeed")
+	t.Equal(http.StatusOK, rr.Code)
+
+	// staged reports respond with the staging id as the processing id
+	var trResp restapi.TelemetryReportResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &trResp)
+	t.Require().NoError(err, "report response json.Unmarshal() failed")
+	t.NotZero(trResp.ProcessingId, "staged report processingId should be non-zero")
+
+	// the staged report should be processed and removed by a worker
+	t.Eventually(
+		func() bool {
+			count, err := t.countTableEntries(t.app.OperationalDB, "reports")
+			return err == nil && count == 0
+		},
+		5*time.Second,
+		10*time.Millisecond,
+		"staged report should have been processed",
+	)
+
+	// both data items in the report should have been stored
+	count, err := t.countTableEntries(t.app.TelemetryDB, "telemetryData")
+	t.NoError(err, "select count statement should have succeeded")
+	t.Equal(2, count, "staged report data items should have been stored")
+}
+
+func (t *AppTestSuite) TestReportTelemetryResubmitted() {
+	// Test that resubmitting an already processed report returns the
+	// original response without processing the report again
+
+	for _, staged := range []bool{false, true} {
+		t.Run(fmt.Sprintf("staged=%v", staged), func() {
+			t.app.Config.Staging.Enabled = staged
+
+			body, err := createReportPayload("TestCustomer")
+			t.Require().NoError(err, "creating a report payload should succeed")
+
+			stagedBefore, err := t.countTableEntries(t.app.OperationalDB, "reports")
+			t.Require().NoError(err)
+			itemsBefore, err := t.countTableEntries(t.app.TelemetryDB, "telemetryData")
+			t.Require().NoError(err)
+
+			var responses [2]restapi.TelemetryReportResponse
+			for i := range responses {
+				rr, err := postToReportTelemetryHandler(body, "", true, t)
+				t.Require().NoError(err, "posting telemetry should succeed")
+				t.Require().Equal(http.StatusOK, rr.Code)
+				t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &responses[i]))
+			}
+
+			t.Equal(responses[0], responses[1], "resubmission should return the original response")
+
+			stagedAfter, err := t.countTableEntries(t.app.OperationalDB, "reports")
+			t.Require().NoError(err)
+			itemsAfter, err := t.countTableEntries(t.app.TelemetryDB, "telemetryData")
+			t.Require().NoError(err)
+
+			if staged {
+				t.NotZero(responses[0].ProcessingId)
+				t.Equal(stagedBefore+1, stagedAfter, "report should have been staged once")
+				t.Equal(itemsBefore, itemsAfter)
+			} else {
+				t.Zero(responses[0].ProcessingId)
+				t.Equal(stagedBefore, stagedAfter)
+				t.Equal(itemsBefore+2, itemsAfter, "report should have been processed once")
+			}
+
+			count, err := t.countTableEntries(t.app.OperationalDB, "processedReports")
+			t.Require().NoError(err)
+			t.NotZero(count)
+		})
+	}
+}
+
+func (t *AppTestSuite) TestReportTelemetryReserved() {
+	// Test that a report reserved by another request is rejected as in
+	// progress, until its reservation is released or expires
+
+	t.app.Config.Staging.Enabled = false
+
+	body, err := createReportPayload("ReservedCustomer")
+	t.Require().NoError(err, "creating a report payload should succeed")
+
+	var trReq restapi.TelemetryReportRequest
+	t.Require().NoError(json.Unmarshal([]byte(body), &trReq))
+	rHeader := &trReq.TelemetryReport.Header
+
+	reservation, trResp, err := t.app.ReserveProcessedReport(t.regId, rHeader)
+	t.Require().NoError(err)
+	t.Require().NotNil(reservation, "first reservation should succeed")
+	t.Nil(trResp)
+
+	rr, err := postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err, "posting telemetry should succeed")
+	t.Equal(http.StatusConflict, rr.Code, "reserved report should be rejected as in progress")
+
+	// a released reservation can be reserved again
+	t.app.ReleaseProcessedReport(reservation)
+	reservation, _, err = t.app.ReserveProcessedReport(t.regId, rHeader)
+	t.Require().NoError(err)
+	t.Require().NotNil(reservation, "released report should be reservable")
+
+	// an expired reservation is taken over by a resubmission
+	expired := database.DbTime(time.Now().Add(-2 * time.Hour))
+	_, err = t.app.OperationalDB.Conn().DB().Exec(
+		`UPDATE processedReports SET processedAt = ? WHERE id = ?`, expired, reservation.Id,
+	)
+	t.Require().NoError(err)
+
+	rr, err = postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err, "posting telemetry should succeed")
+	t.Require().Equal(http.StatusOK, rr.Code, "expired reservation should be taken over")
+
+	t.Require().True(reservation.Exists())
+	t.False(reservation.Pending, "processed report should have been completed")
+	t.True(reservation.ProcessedAt.After(expired))
+
+	// the original request completing late does not overwrite the entry
+	completed, err := reservation.Complete(0, expired)
+	t.Require().NoError(err)
+	t.False(completed, "completing a lost reservation should fail")
+}
+
+func (t *AppTestSuite) TestPruneProcessedReports() {
+	// Test that pruning removes processed reports ledger entries older than
+	// the cutoff, including pending reservations whose requests were lost
+	// and whose reports were never resubmitted
+
+	t.app.Config.Staging.Enabled = false
+
+	body, err := createReportPayload("PruneCustomer")
+	t.Require().NoError(err, "creating a report payload should succeed")
+
+	rr, err := postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err, "posting telemetry should succeed")
+	t.Require().Equal(http.StatusOK, rr.Code)
+
+	pendingBody, err := createReportPayload("PruneCustomer")
+	t.Require().NoError(err, "creating a report payload should succeed")
+
+	var trReq restapi.TelemetryReportRequest
+	t.Require().NoError(json.Unmarshal([]byte(pendingBody), &trReq))
+	reservation, _, err := t.app.ReserveProcessedReport(t.regId, &trReq.TelemetryReport.Header)
+	t.Require().NoError(err)
+	t.Require().NotNil(reservation)
+
+	// entries within the maximum age, including pending ones, are retained
+	before, err := t.countTableEntries(t.app.OperationalDB, "processedReports")
+	t.Require().NoError(err)
+	t.Require().Greater(before, 1)
+
+	pruned, err := t.app.ProcessedReports.Prune()
+	t.Require().NoError(err)
+	t.Zero(pruned, "entries within the maximum age should not be pruned")
+
+	// a reservation that is still pending once it exceeds the maximum age
+	// is pruned along with the completed entries
+	_, err = t.app.OperationalDB.Conn().DB().Exec(
+		`UPDATE processedReports SET processedAt = ?`, database.DbTime(time.Now().Add(-8*24*time.Hour)),
+	)
+	t.Require().NoError(err)
+
+	pruned, err = t.app.PruneProcessedReports(time.Now().Add(-7*24*time.Hour), 1)
+	t.Require().NoError(err)
+	t.Equal(int64(before), pruned, "all expired entries should have been pruned")
+
+	remaining, err := t.countTableEntries(t.app.OperationalDB, "processedReports")
+	t.Require().NoError(err)
+	t.Zero(remaining)
+	t.False(reservation.Exists(), "the expired reservation should have been pruned")
+
+	// pruned reports are processed again if resubmitted
+	for _, report := range []string{body, pendingBody} {
+		rr, err = postToReportTelemetryHandler(report, "", true, t)
+		t.Require().NoError(err, "posting telemetry should succeed")
+		t.Equal(http.StatusOK, rr.Code)
+	}
+}
+
+func (t *AppTestSuite) TestProcessedReportsOfOtherClients() {
+	// Test that the processed reports ledger entries of a client's reports
+	// are not visible to other clients, so that a client claiming another
+	// client's reportId can neither retrieve the original response nor block
+	// the other client's submission
+
+	t.app.Config.Staging.Enabled = false
+
+	body, err := createReportPayload("LedgerOwnerCustomer")
+	t.Require().NoError(err, "creating a report payload should succeed")
+
+	var trReq restapi.TelemetryReportRequest
+	t.Require().NoError(json.Unmarshal([]byte(body), &trReq))
+	rHeader := &trReq.TelemetryReport.Header
+
+	// another registration has reserved, and is processing, the same
+	// clientId and reportId pair
+	otherReservation, _, err := t.app.ReserveProcessedReport(t.regId+1000, rHeader)
+	t.Require().NoError(err)
+	t.Require().NotNil(otherReservation)
+
+	rr, err := postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err, "posting telemetry should succeed")
+	t.Require().Equal(http.StatusOK, rr.Code, "the report should not be blocked by another registration's entry")
+
+	// once completed, the other registration's response is not returned
+	t.app.CompleteProcessedReport(otherReservation, restapi.NewTelemetryReportResponse(
+		4242,
+		types.TelemetryTimeStamp{Time: database.DbNow()},
+	))
+
+	var trResp restapi.TelemetryReportResponse
+	rr, err = postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err, "posting telemetry should succeed")
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &trResp))
+	t.NotEqual(int64(4242), trResp.ProcessingId, "another registration's response should not be returned")
+}
+
+func (t *AppTestSuite) TestProcessedReportsConfig() {
+	// Test that the processed reports ledger settings are validated, and
+	// that the ledger is pruned by its own background job, independently of
+	// telemetry data retention
+
+	for _, pc := range []config.ProcessedReportsConfig{
+		{Reservation: "0s"},
+		{MaxAge: "forever"},
+		{PruneInterval: "-1m"},
+		{BatchSize: -1},
+		{Reservation: "10m", MaxAge: "5m"},
+	} {
+		_, err := app.NewProcessedReportsLedger(t.app, &pc)
+		t.Error(err, "%+v should be rejected", pc)
+	}
+
+	t.app.Config.Staging.Enabled = false
+	t.Require().False(t.app.Config.Retention.Enabled)
+
+	body, err := createReportPayload("LedgerPruneCustomer")
+	t.Require().NoError(err, "creating a report payload should succeed")
+	rr, err := postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err, "posting telemetry should succeed")
+	t.Require().Equal(http.StatusOK, rr.Code)
+
+	_, err = t.app.OperationalDB.Conn().DB().Exec(
+		`UPDATE processedReports SET processedAt = ?`, database.DbTime(time.Now().Add(-time.Hour)),
+	)
+	t.Require().NoError(err)
+
+	ledger, err := app.NewProcessedReportsLedger(t.app, &config.ProcessedReportsConfig{
+		Reservation:   "30s",
+		MaxAge:        "1m",
+		PruneInterval: "1s",
+	})
+	t.Require().NoError(err)
+	ledger.Start()
+	t.True(ledger.Running())
+
+	t.Eventually(func() bool {
+		count, err := t.countTableEntries(t.app.OperationalDB, "processedReports")
+		return err == nil && count == 0
+	}, 5*time.Second, 100*time.Millisecond, "expired entries should have been pruned")
+
+	ledger.Stop()
+	t.False(ledger.Running())
+}
+
+func (t *AppTestSuite) TestProcessTelemetryReportAtomic() {
+	// Test that a report is stored all-or-nothing, such that a failure to
+	// store one data item rolls back all of the report's changes
+
+	body, err := createReportPayload("AtomicCustomer")
+	t.Require().NoError(err, "creating a report payload should succeed")
+
+	var trReq restapi.TelemetryReportRequest
+	t.Require().NoError(json.Unmarshal([]byte(body), &trReq))
+
+	items := trReq.TelemetryReport.TelemetryBundles[0].TelemetryDataItems
+	t.Require().Len(items, 2)
+
+	// force the insert of the report's second data item to fail
+	_, err = t.app.TelemetryDB.Conn().DB().Exec(
+		`CREATE TRIGGER failInsert BEFORE INSERT ON telemetryData ` +
+			`WHEN NEW.telemetryId = '` + items[1].Header.TelemetryId + `' ` +
+			`BEGIN SELECT RAISE(ABORT, 'forced insert failure'); END`,
+	)
+	t.Require().NoError(err, "creating the failure trigger should succeed")
+
+	tables := []string{"telemetryData", "tagSets", "customers"}
+	before := map[string]int{}
+	for _, table := range tables {
+		before[table], err = t.countTableEntries(t.app.TelemetryDB, table)
+		t.Require().NoError(err)
+	}
+
+	err = t.app.ProcessTelemetryReport(&trReq.TelemetryReport)
+	t.Require().Error(err, "report processing should have failed")
+	t.Contains(err.Error(), "forced insert failure")
+
+	for _, table := range tables {
+		count, err := t.countTableEntries(t.app.TelemetryDB, table)
+		t.Require().NoError(err)
+		t.Equal(before[table], count, "%s changes should have been rolled back", table)
+	}
+}
+
+func (t *AppTestSuite) TestProcessTelemetryReportBulkDedup() {
+	// Test that bulk storing a report's data items skips those that are
+	// duplicated within the report or have already been stored
+
+	body, err := createReportPayload("BulkCustomer")
+	t.Require().NoError(err, "creating a report payload should succeed")
+
+	var trReq restapi.TelemetryReportRequest
+	t.Require().NoError(json.Unmarshal([]byte(body), &trReq))
+
+	// duplicate the report's bundle
+	report := &trReq.TelemetryReport
+	report.TelemetryBundles = append(report.TelemetryBundles, report.TelemetryBundles[0])
+
+	before, err := t.countTableEntries(t.app.TelemetryDB, "telemetryData")
+	t.Require().NoError(err)
+
+	for i := 0; i < 2; i++ {
+		t.Require().NoError(t.app.ProcessTelemetryReport(report), "report processing should succeed")
+
+		count, err := t.countTableEntries(t.app.TelemetryDB, "telemetryData")
+		t.Require().NoError(err)
+		t.Equal(before+2, count, "each unique data item should be stored once")
+	}
+
+	// the existing entries lookup should use the telemetryData index rather
+	// than scanning the table
+	tdRow := new(database.TelemetryDataRow)
+	t.Require().NoError(tdRow.SetupDB(t.app.TelemetryDB))
+	rows, err := t.app.TelemetryDB.Conn().DB().Query(
+		"EXPLAIN QUERY PLAN "+tdRow.ExistingKeysStmt(2),
+		"client", "telemetry1", "telemetry2",
+	)
+	t.Require().NoError(err)
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var id, parent, notused int
+		var detail string
+		t.Require().NoError(rows.Scan(&id, &parent, &notused, &detail))
+		plan = append(plan, detail)
+	}
+	t.Require().NoError(rows.Err())
+	t.Require().NotEmpty(plan)
+	for _, detail := range plan {
+		t.NotContains(detail, "SCAN telemetryData")
+	}
+	t.Contains(strings.Join(plan, "\n"), "idx_telemetryData_clientId_telemetryId_timestamp")
+}
+
+func (t *AppTestSuite) TestProcessTelemetryReportInvalidTimestamps() {
+	// Test that data items whose client supplied timestamps are not valid
+	// RFC3339 timestamps are still stored, with the bundle's timestamp, or
+	// failing that the fallback timestamp
+
+	body, err := createReportPayload("InvalidTimestampCustomer")
+	t.Require().NoError(err, "creating a report payload should succeed")
+
+	var trReq restapi.TelemetryReportRequest
+	t.Require().NoError(json.Unmarshal([]byte(body), &trReq))
+
+	bundle := &trReq.TelemetryReport.TelemetryBundles[0]
+	t.Require().Len(bundle.TelemetryDataItems, 2)
+	bundle.Header.BundleTimeStamp = "2024-07-01T10:00:00Z"
+	bundle.TelemetryDataItems[0].Header.TelemetryTimeStamp = "01/07/2024 09:00"
+
+	// a second bundle with an invalid timestamp of its own
+	invalidBundle := *bundle
+	invalidBundle.Header.BundleTimeStamp = ""
+	invalidBundle.TelemetryDataItems = []telemetrylib.TelemetryDataItem{bundle.TelemetryDataItems[1]}
+	invalidBundle.TelemetryDataItems[0].Header.TelemetryId = uuid.NewString()
+	invalidBundle.TelemetryDataItems[0].Header.TelemetryTimeStamp = ""
+	trReq.TelemetryReport.TelemetryBundles = append(trReq.TelemetryReport.TelemetryBundles, invalidBundle)
+
+	t.Require().NoError(t.app.ProcessTelemetryReport(&trReq.TelemetryReport), "report processing should succeed")
+
+	timestamp := func(telemetryId string) (ts time.Time) {
+		err := t.app.TelemetryDB.Conn().DB().QueryRow(
+			`SELECT timestamp FROM telemetryData WHERE telemetryId = ?`, telemetryId,
+		).Scan(&ts)
+		t.Require().NoError(err, "data item %s should have been stored", telemetryId)
+		return
+	}
+
+	ts := timestamp(bundle.TelemetryDataItems[0].Header.TelemetryId)
+	t.True(ts.Equal(time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC)), "unexpected timestamp %v", ts)
+
+	ts = timestamp(invalidBundle.TelemetryDataItems[0].Header.TelemetryId)
+	t.True(ts.Equal(database.TimestampFallback), "unexpected timestamp %v", ts)
+
+	// reprocessing the report should not store the items again
+	before, err := t.countTableEntries(t.app.TelemetryDB, "telemetryData")
+	t.Require().NoError(err)
+	t.Require().NoError(t.app.ProcessTelemetryReport(&trReq.TelemetryReport))
+	count, err := t.countTableEntries(t.app.TelemetryDB, "telemetryData")
+	t.Require().NoError(err)
+	t.Equal(before, count)
+}
+
+func (t *AppTestSuite) TestPreparedStatementCache() {
+	// Test that row operations use cached prepared statements, and that
+	// the cache is invalidated when the DB is reconnected
+
+	// the operational DB is used, as telemetry DB lookups may be satisfied
+	// by the tagSet and customer id caches
+	cache := t.app.OperationalDB.Conn().StmtCache()
+
+	for i := 0; i < 2; i++ {
+		body, err := createReportPayload("TestCustomer")
+		t.Require().NoError(err, "creating a report payload should succeed")
+
+		rr, err := postToReportTelemetryHandler(body, "", true, t)
+		t.Require().NoError(err, "posting telemetry should succeed")
+		t.Require().Equal(http.StatusOK, rr.Code)
+
+		t.NotZero(cache.Prepared(), "statements should have been prepared")
+
+		// reconnecting should discard the prepared statements
+		t.Require().NoError(t.app.OperationalDB.Connect())
+		t.Zero(cache.Prepared(), "reconnect should discard prepared statements")
+	}
+}
+
+func (t *AppTestSuite) TestPreparedStatementCacheLimits() {
+	// Test that paged queries share a single cached prepared statement,
+	// regardless of the limit and offset values
+
+	cache := t.app.OperationalDB.Conn().StmtCache()
+
+	failed := new(database.FailedReportRow)
+	t.Require().NoError(failed.SetupDB(t.app.OperationalDB))
+
+	_, err := failed.List(1, 0)
+	t.Require().NoError(err)
+	prepared := cache.Prepared()
+	t.NotZero(prepared)
+
+	for i := uint(1); i <= 5; i++ {
+		_, err = failed.List(i*10, i)
+		t.Require().NoError(err)
+	}
+	t.Equal(prepared, cache.Prepared(), "paging should not prepare additional statements")
+}
+
+func (t *AppTestSuite) TestSchemaMigrations() {
+	// Test that migrations bring an existing DB up to date with the current
+	// table specs, and that a DB newer than the binary is rejected
+
+	// freshly created DBs should be at the latest schema version
+	version, err := t.app.OperationalDB.SchemaVersion()
+	t.Require().NoError(err)
+	t.Equal(operationaldb.GetMigrations().Latest(), version)
+
+	// create a DB with a reports table that predates the staging retry columns
+	dbCfg := &config.DBConfig{
+		Driver: "sqlite3",
+		Params: t.path + "/migrated.db",
+	}
+	oldDb, err := sql.Open(dbCfg.Driver, dbCfg.Params)
+	t.Require().NoError(err)
+	_, err = oldDb.Exec(`CREATE TABLE reports(` +
+		`id INTEGER NOT NULL PRIMARY KEY, ` +
+		`clientId VARCHAR NOT NULL, ` +
+		`reportId VARCHAR NOT NULL, ` +
+		`data TEXT NOT NULL, ` +
+		`receivedAt VARCHAR NOT NULL, ` +
+		`allocated BOOLEAN NOT NULL DEFAULT false, ` +
+		`allocatedAt VARCHAR NULL)`)
+	t.Require().NoError(err)
+	_, err = oldDb.Exec(`INSERT INTO reports(clientId, reportId, data, receivedAt) ` +
+		`VALUES('client', 'report', '{}', '2024-07-01T00:00:00Z')`)
+	t.Require().NoError(err)
+	t.Require().NoError(oldDb.Close())
+
+	adb, err := database.GetDb("Migrated", dbCfg, operationaldb.GetTables(), operationaldb.GetMigrations())
+	t.Require().NoError(err)
+	t.Require().NoError(adb.Connect(), "connecting should migrate the existing DB")
+
+	var attempts int64
+	var lastError string
+	err = adb.Conn().DB().QueryRow(`SELECT attempts, lastError FROM reports`).Scan(&attempts, &lastError)
+	t.Require().NoError(err, "migrated reports table should have the new columns")
+	t.Zero(attempts)
+	t.Empty(lastError)
+
+	version, err = adb.SchemaVersion()
+	t.Require().NoError(err)
+	t.Equal(operationaldb.GetMigrations().Latest(), version)
+
+	// reconnecting should be a no-op
+	t.Require().NoError(adb.Connect())
+
+	// simulate a newer binary having migrated the DB
+	_, err = adb.Conn().DB().Exec(
+		`INSERT INTO schemaVersions(version, description, appliedAt) VALUES(1000, 'from the future', ?)`,
+		database.DbTime(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)),
+	)
+	t.Require().NoError(err)
+
+	err = adb.Connect()
+	t.Require().Error(err, "connecting to a DB newer than the binary should fail")
+	t.ErrorContains(err, "newer than the latest version")
+	t.NoError(adb.Close())
+}
+
+func (t *AppTestSuite) TestTableIndexes() {
+	// Test that the indexes defined in the table specs are created, and
+	// that unique and partial index options are honoured
+
+	indexes := func(adb *database.AppDb, table string) (names []string) {
+		rows, err := adb.Conn().DB().Query(
+			`SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL`,
+			table,
+		)
+		t.Require().NoError(err)
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			t.Require().NoError(rows.Scan(&name))
+			names = append(names, name)
+		}
+		return
+	}
+
+	t.Contains(indexes(t.app.TelemetryDB, "telemetryData"), "idx_telemetryData_clientId_telemetryId_timestamp")
+	t.Contains(indexes(t.app.TelemetryDB, "tagSets"), "uidx_tagSets_tagSet")
+	t.Contains(indexes(t.app.OperationalDB, "clients"), "idx_clients_clientId")
+	t.Contains(indexes(t.app.OperationalDB, "reports"), "idx_reports_allocated")
+
+	// reconnecting should not fail because the indexes already exist
+	t.Require().NoError(t.app.OperationalDB.Connect())
+
+	idx := database.TableSpecIndex{
+		Columns: []string{"reportId"},
+		Unique:  true,
+		Where:   "allocated = false",
+	}
+	conn := t.app.OperationalDB.Conn()
+	createCmd := idx.Create(conn, "reports")
+	t.Equal(
+		"CREATE UNIQUE INDEX IF NOT EXISTS uidx_reports_reportId ON reports (reportId) WHERE allocated = false",
+		createCmd,
+	)
+	_, err := conn.DB().Exec(createCmd)
+	t.Require().NoError(err)
+
+	// unique only applies to unallocated reports
+	insert := `INSERT INTO reports(clientId, reportId, data, receivedAt, allocated) VALUES('c', 'r', '{}', 'now', ?)`
+	_, err = conn.DB().Exec(insert, true)
+	t.Require().NoError(err)
+	_, err = conn.DB().Exec(insert, false)
+	t.Require().NoError(err)
+	_, err = conn.DB().Exec(insert, false)
+	t.Error(err, "duplicate unallocated reports should violate the unique partial index")
+}
+
+func (t *AppTestSuite) TestUpsertConflictTarget() {
+	// Test that upserts only ignore conflicts on the targeted unique index,
+	// with other constraint violations still failing the insert
+
+	tsRow := new(database.TagSetRow)
+	t.Require().NoError(tsRow.SetupDB(t.app.TelemetryDB))
+
+	stmt, err := tsRow.UpsertStmt([]string{"tagSet"}, []string{"tagSet"}, "", "id")
+	t.Require().NoError(err)
+	t.Contains(stmt, "ON CONFLICT (tagSet) DO NOTHING")
+
+	db := t.app.TelemetryDB.Conn().DB()
+
+	var id int64
+	t.Require().NoError(db.QueryRow(stmt, "|upsert|").Scan(&id))
+	t.NotZero(id)
+
+	err = db.QueryRow(stmt, "|upsert|").Scan(&id)
+	t.ErrorIs(err, sql.ErrNoRows, "a conflicting insert should be ignored")
+
+	err = db.QueryRow(stmt, nil).Scan(&id)
+	t.Require().Error(err, "a NOT NULL violation should not be ignored")
+	t.NotErrorIs(err, sql.ErrNoRows)
+}
+
+func (t *AppTestSuite) TestConcurrentTagSetAndCustomerLookups() {
+	// Test that concurrent lookups of the same new tagSet and customer
+	// all return the single canonical id, which is then cached until the
+	// customer entry is changed
+
+	const lookups = 8
+	tagSetIds := make([]int64, lookups)
+	customerRefIds := make([]int64, lookups)
+	errs := make([]error, lookups)
+
+	var wg sync.WaitGroup
+	for i := 0; i < lookups; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var tsErr, cErr error
+			tagSetIds[i], tsErr = t.app.GetTagSetId(nil, "|concurrent|")
+			customerRefIds[i], cErr = t.app.GetCustomerRefId(nil, "ConcurrentCustomer")
+			errs[i] = errors.Join(tsErr, cErr)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < lookups; i++ {
+		t.Require().NoError(errs[i])
+		t.Equal(tagSetIds[0], tagSetIds[i], "all tagSet lookups should return the same id")
+		t.Equal(customerRefIds[0], customerRefIds[i], "all customer lookups should return the same id")
+	}
+
+	count, err := t.countTableEntries(t.app.TelemetryDB, "tagSets")
+	t.Require().NoError(err)
+	t.Equal(1, count, "only one tagSets entry should have been added")
+
+	count, err = t.countCustomerIdEntries("ConcurrentCustomer")
+	t.Require().NoError(err)
+	t.Equal(1, count, "only one customers entry should have been added")
+
+	// the tagSet id should now be cached, so it is still returned even if
+	// the tagSets entry is removed behind the server's back
+	_, err = t.app.TelemetryDB.Conn().DB().Exec(`DELETE FROM tagSets`)
+	t.Require().NoError(err)
+	cachedId, err := t.app.GetTagSetId(nil, "|concurrent|")
+	t.Require().NoError(err)
+	t.Equal(tagSetIds[0], cachedId, "cached tagSet id should have been returned")
+
+	// marking the customer as deleted should invalidate the cached id, and
+	// a deleted customer entry doesn't prevent a new active entry
+	cRow := new(database.CustomersRow)
+	t.Require().NoError(cRow.SetupDB(t.app.TelemetryDB))
+	cRow.Id = customerRefIds[0]
+	t.Require().True(cRow.IdExists())
+	deletedAt := database.DbNow()
+	cRow.Deleted = true
+	cRow.DeletedAt = &deletedAt
+	t.Require().NoError(cRow.Update())
+
+	newRefId, err := t.app.GetCustomerRefId(nil, "ConcurrentCustomer")
+	t.Require().NoError(err)
+	t.NotEqual(customerRefIds[0], newRefId, "a new customer entry should have been added")
+}
+
+func (t *AppTestSuite) TestIdCacheInvalidatedByOtherProcesses() {
+	// Test that a cached tagSet id is discarded once another process, e.g.
+	// the retention job of another server instance, marks the tagSets entry
+	// as orphaned, bypassing this process's row change hooks
+
+	tagSetId, err := t.app.GetTagSetId(nil, "|other|")
+	t.Require().NoError(err)
+
+	otherDb, err := telemetrydb.New(t.config)
+	t.Require().NoError(err)
+	t.Require().NoError(otherDb.Connect())
+	defer otherDb.Close()
+
+	tsRow := new(database.TagSetRow)
+	t.Require().NoError(tsRow.SetupDB(otherDb))
+	marked, err := tsRow.MarkOrphans(time.Now(), 10)
+	t.Require().NoError(err)
+	t.Equal(int64(1), marked, "the unreferenced tagSets entry should have been marked")
+
+	// once the cache generations have been checked the tagSet is looked up
+	// again, reclaiming the marked entry
+	time.Sleep(time.Second)
+	reclaimedId, err := t.app.GetTagSetId(nil, "|other|")
+	t.Require().NoError(err)
+	t.Equal(tagSetId, reclaimedId)
+
+	tsRow.Init("|other|")
+	t.Require().True(tsRow.Exists())
+	t.Nil(tsRow.OrphanedAt, "the tagSets entry should have been reclaimed")
+}
+
+func (t *AppTestSuite) TestIdCacheLookupInterleavedWithRowChange() {
+	// Test that a customer lookup that started before the customer entry
+	// was changed doesn't cache the stale id once its transaction commits
+
+	// use WAL journaling so that the lookup's transaction can remain open
+	// while the change is committed
+	t.Require().NoError(t.app.Shutdown())
+	t.config.DataBases.Telemetry.Params += "?_journal_mode=WAL"
+	t.app, t.router = InitializeApp(t.config, true)
+
+	refId, err := t.app.GetCustomerRefId(nil, "InterleavedCustomer")
+	t.Require().NoError(err)
+
+	cRow := new(database.CustomersRow)
+	t.Require().NoError(cRow.SetupDB(t.app.TelemetryDB))
+	cRow.Id = refId
+	t.Require().True(cRow.IdExists())
+
+	// discard the cached id, so that the lookup must retrieve it
+	t.Require().NoError(cRow.Update())
+
+	tx, err := t.app.TelemetryDB.Begin()
+	t.Require().NoError(err)
+	defer tx.Rollback()
+
+	lookupId, err := t.app.GetCustomerRefId(tx, "InterleavedCustomer")
+	t.Require().NoError(err)
+	t.Equal(refId, lookupId)
+
+	// the customer is erased while the lookup's transaction is still open
+	deletedAt := database.DbNow()
+	cRow.Deleted = true
+	cRow.DeletedAt = &deletedAt
+	t.Require().NoError(cRow.Update())
+
+	t.Require().NoError(tx.Commit())
+
+	newRefId, err := t.app.GetCustomerRefId(nil, "InterleavedCustomer")
+	t.Require().NoError(err)
+	t.NotEqual(refId, newRefId, "the erased customer's id should not have been cached")
+}
+
+func (t *AppTestSuite) TestReportForCustomerErasedWhileCached() {
+	// Test that a report for a customer that was erased by another process,
+	// e.g. the telemetry-admin, while its id is still cached, is stored for
+	// a new entry of the customer rather than the erased one
+
+	erasedId, err := t.app.GetCustomerRefId(nil, "ErasedCustomer")
+	t.Require().NoError(err)
+
+	otherDb, err := telemetrydb.New(t.config)
+	t.Require().NoError(err)
+	t.Require().NoError(otherDb.Connect())
+	defer otherDb.Close()
+
+	cRow := new(database.CustomersRow)
+	t.Require().NoError(cRow.SetupDB(otherDb))
+	cRow.Id = erasedId
+	t.Require().True(cRow.IdExists())
+	erasedAt := database.DbNow()
+	cRow.Deleted = true
+	cRow.DeletedAt = &erasedAt
+	t.Require().NoError(cRow.Update())
+
+	body, err := createReportPayload("ErasedCustomer")
+	t.Require().NoError(err)
+	rr, err := postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err)
+	t.Require().Equal(200, rr.Code)
+
+	var erasedItems, activeItems int
+	db := t.app.TelemetryDB.Conn().DB()
+	t.Require().NoError(db.QueryRow(
+		`SELECT COUNT(id) FROM telemetryData WHERE customerRefId = ?`,
+		erasedId,
+	).Scan(&erasedItems))
+	t.Zero(erasedItems, "no data items should have been stored for the erased customer")
+
+	t.Require().NoError(db.QueryRow(
+		`SELECT COUNT(telemetryData.id) FROM telemetryData `+
+			`JOIN customers ON customers.id = telemetryData.customerRefId `+
+			`WHERE customers.customerId = ? AND customers.deleted = false`,
+		"ErasedCustomer",
+	).Scan(&activeItems))
+	t.Equal(2, activeItems, "the data items should have been stored for a new customer entry")
+}
+
+func (t *AppTestSuite) TestMergeDuplicateTagSetsMigration() {
+	// Test that duplicate tagSets created before the unique index existed
+	// are merged when the telemetry DB is migrated
+
+	dbCfg := &config.DBConfig{
+		Driver: "sqlite3",
+		Params: t.path + "/duplicates.db",
+	}
+	oldDb, err := sql.Open(dbCfg.Driver, dbCfg.Params)
+	t.Require().NoError(err)
+	for _, stmt := range []string{
+		`CREATE TABLE tagSets(id INTEGER NOT NULL PRIMARY KEY, tagSet VARCHAR NOT NULL)`,
+		`INSERT INTO tagSets(id, tagSet) VALUES(1, '|a|'), (2, '|b|'), (3, '|a|')`,
+		`CREATE TABLE customers(id INTEGER NOT NULL PRIMARY KEY, customerId VARCHAR NULL, ` +
+			`deleted BOOLEAN NOT NULL DEFAULT false, deletedAt VARCHAR NULL)`,
+		`INSERT INTO customers(id, customerId) VALUES(1, 'C'), (2, 'C')`,
+		`CREATE TABLE telemetryData(id INTEGER NOT NULL PRIMARY KEY, clientId VARCHAR NOT NULL, ` +
+			`customerRefId INTEGER NOT NULL, telemetryId VARCHAR NOT NULL, telemetryType VARCHAR NOT NULL, ` +
+			`tagSetId INTEGER NULL, timestamp VARCHAR NOT NULL, dataItem TEXT NOT NULL)`,
+		`INSERT INTO telemetryData(clientId, customerRefId, telemetryId, telemetryType, tagSetId, timestamp, dataItem) ` +
+			`VALUES('c', 2, 't1', 'type', 3, '2024-07-01T12:00:00.123456789+02:00', '{}'), ` +
+			`('c', 1, 't2', 'type', 2, '2024-07-01T10:00:00Z', '{}')`,
+	} {
+		_, err = oldDb.Exec(stmt)
+		t.Require().NoError(err, stmt)
+	}
+	t.Require().NoError(oldDb.Close())
+
+	adb, err := database.GetDb("Duplicates", dbCfg, telemetrydb.GetTables(), telemetrydb.GetMigrations())
+	t.Require().NoError(err)
+	t.Require().NoError(adb.Connect(), "connecting should merge the duplicates")
+	defer adb.Close()
+
+	count, err := t.countTableEntries(adb, "tagSets")
+	t.Require().NoError(err)
+	t.Equal(2, count, "duplicate tagSets should have been merged")
+
+	count, err = t.countTableEntries(adb, "customers")
+	t.Require().NoError(err)
+	t.Equal(1, count, "duplicate customers should have been merged")
+
+	var tagSetId, customerRefId int64
+	err = adb.Conn().DB().QueryRow(
+		`SELECT tagSetId, customerRefId FROM telemetryData WHERE telemetryId = 't1'`,
+	).Scan(&tagSetId, &customerRefId)
+	t.Require().NoError(err)
+	t.Equal(int64(1), tagSetId, "telemetry data should reference the canonical tagSet")
+	t.Equal(int64(1), customerRefId, "telemetry data should reference the canonical customer")
+
+	// the timestamps should have been converted, and now order correctly
+	// despite originally having different timezones
+	var timestamps []time.Time
+	rows, err := adb.Conn().DB().Query(`SELECT timestamp FROM telemetryData ORDER BY timestamp`)
+	t.Require().NoError(err)
+	defer rows.Close()
+	for rows.Next() {
+		var timestamp time.Time
+		t.Require().NoError(rows.Scan(&timestamp))
+		timestamps = append(timestamps, timestamp)
+	}
+	t.Require().NoError(rows.Err())
+	t.Require().Len(timestamps, 2)
+	t.True(timestamps[0].Equal(time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC)), "unexpected first timestamp %v", timestamps[0])
+	t.True(timestamps[1].Equal(time.Date(2024, 7, 1, 10, 0, 0, 123457000, time.UTC)), "unexpected second timestamp %v", timestamps[1])
+}
+
+func (t *AppTestSuite) TestTimestampColumnsMigration() {
+	// Test that the VARCHAR timestamp columns of an existing operational DB,
+	// which predates schema migrations, are converted to native timestamp
+	// columns when it is migrated
+
+	dbCfg := &config.DBConfig{
+		Driver: "sqlite3",
+		Params: t.path + "/timestamps.db",
+	}
+	oldDb, err := sql.Open(dbCfg.Driver, dbCfg.Params)
+	t.Require().NoError(err)
+	for _, stmt := range []string{
+		`CREATE TABLE clients(id INTEGER NOT NULL PRIMARY KEY, clientId VARCHAR NOT NULL, ` +
+			`systemUUID VARCHAR NULL, clientTimestamp VARCHAR NOT NULL, registrationDate VARCHAR NOT NULL, ` +
+			`authToken VARCHAR NOT NULL)`,
+		`INSERT INTO clients(clientId, systemUUID, clientTimestamp, registrationDate, authToken) ` +
+			`VALUES('c1', 's1', 'ts', '2024-07-01T12:00:00+02:00', 'token'), ` +
+			`('c2', 's2', 'ts', '2024-07-01T11:00:00Z', 'token')`,
+		`CREATE TABLE reports(id INTEGER NOT NULL PRIMARY KEY, clientId VARCHAR NOT NULL, ` +
+			`reportId VARCHAR NOT NULL, data TEXT NOT NULL, receivedAt VARCHAR NOT NULL, ` +
+			`allocated BOOLEAN NOT NULL DEFAULT false, allocatedAt VARCHAR NULL)`,
+		`INSERT INTO reports(clientId, reportId, data, receivedAt, allocated, allocatedAt) ` +
+			`VALUES('c1', 'r1', '{}', '2024-07-01T12:00:00.5Z', true, '2024-07-01T12:01:00Z'), ` +
+			`('c1', 'r2', '{}', '2024-07-01T12:00:01Z', false, '')`,
+	} {
+		_, err = oldDb.Exec(stmt)
+		t.Require().NoError(err, stmt)
+	}
+	t.Require().NoError(oldDb.Close())
+
+	adb, err := database.GetDb("Timestamps", dbCfg, operationaldb.GetTables(), operationaldb.GetMigrations())
+	t.Require().NoError(err)
+	t.Require().NoError(adb.Connect(), "connecting should convert the timestamp columns")
+	defer adb.Close()
+
+	// the converted tables should match their specs
+	report, err := adb.CheckSchemaDrift()
+	t.Require().NoError(err)
+	t.False(report.HasDrift(), "converted tables should not have drifted: %+v", report.Tables)
+
+	// migrations should have been recorded in the schemaVersions table
+	version, err := adb.SchemaVersion()
+	t.Require().NoError(err)
+	t.Equal(operationaldb.GetMigrations().Latest(), version)
+
+	// registrations should be listed in registration date order
+	client := new(database.ClientsRow)
+	t.Require().NoError(client.SetupDB(adb))
+	clients, err := client.ListMatching(time.Date(2024, 7, 1, 10, 30, 0, 0, time.UTC), time.Time{}, 0, 0)
+	t.Require().NoError(err)
+	t.Require().Len(clients, 1, "only the later registration should be listed")
+	t.Equal("c2", clients[0].ClientId)
+	t.True(clients[0].RegistrationDate.Equal(time.Date(2024, 7, 1, 11, 0, 0, 0, time.UTC)))
+
+	// existing registrations should have been first seen when registered
+	client.InitRegistrationId(1)
+	t.Require().True(client.Exists())
+
+	activity := new(database.ClientActivityRow)
+	t.Require().NoError(activity.SetupDB(adb))
+	activity.RegistrationId = client.Id
+	t.Require().True(activity.Exists())
+	t.True(activity.FirstSeenAt.Equal(time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC)))
+	t.True(activity.LastActiveAt.Equal(activity.FirstSeenAt), "never active registrations should be last active when first seen")
+
+	// activity entries should reference their registrations
+	foreignKeys, err := adb.Conn().TableForeignKeys(adb.Conn().DB(), "clientActivity")
+	t.Require().NoError(err)
+	t.Contains(foreignKeys, database.DbForeignKeyInfo{Column: "registrationId", ReferencedTable: "clients", ReferencedColumn: "id"})
+
+	// the allocated report's allocation time should have been preserved,
+	// and the unallocated report's empty allocation time should be NULL
+	staged := new(database.ReportStagingTableRow)
+	t.Require().NoError(staged.SetupDB(adb))
+	allocated, err := staged.AllocatedRows()
+	t.Require().NoError(err)
+	t.Require().Len(allocated, 1)
+	t.True(allocated[0].ReceivedAt.Equal(time.Date(2024, 7, 1, 12, 0, 0, 500000000, time.UTC)))
+	t.Require().NotNil(allocated[0].AllocatedAt)
+	t.True(allocated[0].AllocatedAt.Equal(time.Date(2024, 7, 1, 12, 1, 0, 0, time.UTC)))
+
+	var nullAllocatedAt int
+	err = adb.Conn().DB().QueryRow(`SELECT COUNT(id) FROM reports WHERE allocatedAt IS NULL`).Scan(&nullAllocatedAt)
+	t.Require().NoError(err)
+	t.Equal(1, nullAllocatedAt, "empty allocatedAt should have been converted to NULL")
+
+	// the allocated report can still be released using its converted
+	// allocation time
+	released, err := allocated[0].Release()
+	t.Require().NoError(err)
+	t.True(released, "allocated report should have been released")
+}
+
+func (t *AppTestSuite) TestTimestampColumnsMigrationInvalidValues() {
+	// Test that empty or malformed legacy timestamps, e.g. those supplied
+	// by clients, don't prevent the timestamp columns of an existing
+	// telemetry DB from being converted
+
+	dbCfg := &config.DBConfig{
+		Driver: "sqlite3",
+		Params: t.path + "/invalid_timestamps.db",
+	}
+	oldDb, err := sql.Open(dbCfg.Driver, dbCfg.Params)
+	t.Require().NoError(err)
+	for _, stmt := range []string{
+		`CREATE TABLE customers(id INTEGER NOT NULL PRIMARY KEY, customerId VARCHAR NULL, ` +
+			`deleted BOOLEAN NOT NULL DEFAULT false, deletedAt VARCHAR NULL)`,
+		`INSERT INTO customers(id, customerId, deleted, deletedAt) VALUES(1, 'C1', true, 'yesterday'), ` +
+			`(2, 'C2', false, '')`,
+		`CREATE TABLE telemetryData(id INTEGER NOT NULL PRIMARY KEY, clientId VARCHAR NOT NULL, ` +
+			`customerRefId INTEGER NOT NULL, telemetryId VARCHAR NOT NULL, telemetryType VARCHAR NOT NULL, ` +
+			`tagSetId INTEGER NULL, timestamp VARCHAR NOT NULL, dataItem TEXT NOT NULL)`,
+		`INSERT INTO telemetryData(id, clientId, customerRefId, telemetryId, telemetryType, timestamp, dataItem) ` +
+			`VALUES(1, 'c', 2, 't1', 'type', '2024-07-01T10:00:00Z', '{}'), ` +
+			`(2, 'c', 2, 't2', 'type', '01/07/2024 10:00', '{}'), ` +
+			`(3, 'c', 2, 't3', 'type', '', '{}')`,
+	} {
+		_, err = oldDb.Exec(stmt)
+		t.Require().NoError(err, stmt)
+	}
+	t.Require().NoError(oldDb.Close())
+
+	adb, err := database.GetDb("InvalidTimestamps", dbCfg, telemetrydb.GetTables(), telemetrydb.GetMigrations())
+	t.Require().NoError(err)
+	t.Require().NoError(adb.Connect(), "invalid timestamps should not prevent the migration")
+	defer adb.Close()
+
+	version, err := adb.SchemaVersion()
+	t.Require().NoError(err)
+	t.Equal(telemetrydb.GetMigrations().Latest(), version)
+
+	// valid timestamps are preserved, whereas malformed and empty ones are
+	// replaced by the fallback, as the column cannot be NULL
+	timestamps := map[int64]time.Time{}
+	rows, err := adb.Conn().DB().Query(`SELECT id, timestamp FROM telemetryData`)
+	t.Require().NoError(err)
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var timestamp time.Time
+		t.Require().NoError(rows.Scan(&id, &timestamp))
+		timestamps[id] = timestamp
+	}
+	t.Require().NoError(rows.Err())
+	t.Require().Len(timestamps, 3)
+	t.True(timestamps[1].Equal(time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC)), "unexpected valid timestamp %v", timestamps[1])
+	t.True(timestamps[2].Equal(database.TimestampFallback), "unexpected malformed timestamp %v", timestamps[2])
+	t.True(timestamps[3].Equal(database.TimestampFallback), "unexpected empty timestamp %v", timestamps[3])
+
+	// nullable columns have their invalid values replaced with NULL
+	var nullDeletedAt int
+	err = adb.Conn().DB().QueryRow(`SELECT COUNT(id) FROM customers WHERE deletedAt IS NULL`).Scan(&nullDeletedAt)
+	t.Require().NoError(err)
+	t.Equal(2, nullDeletedAt)
+}
+
+func (t *AppTestSuite) TestStagedReportReaping() {
+	// Test that staged reports that fail processing are released for
+	// reprocessing once their lease expires, and dead-lettered after
+	// the maximum number of attempts
+
+	// stage a report whose data cannot be processed, completing its
+	// processed reports ledger entry as the report handler does
+	reportId := uuid.NewString()
+	header := &telemetrylib.TelemetryReportHeader{
+		ReportId:       reportId,
+		ReportClientId: uuid.NewString(),
+	}
+	reservation, trResp, err := t.app.ReserveProcessedReport(t.regId, header)
+	t.Require().NoError(err)
+	t.Require().Nil(trResp)
+	t.Require().NotNil(reservation, "report should have been reserved")
+
+	stagingId, err := t.app.StageTelemetryReport(t.regId, []byte(`{"invalid": json`), header)
+	t.Require().NoError(err, "staging a report should succeed")
+	t.app.CompleteProcessedReport(
+		reservation,
+		restapi.NewTelemetryReportResponse(stagingId, types.TelemetryTimeStamp{Time: database.DbNow()}),
+	)
+
+	maxAttempts := int64(2)
+	for attempt := int64(1); attempt <= maxAttempts; attempt++ {
+		found, err := t.app.ProcessNextStagedReport()
+		t.True(found, "attempt %d should have found the staged report", attempt)
+		t.Error(err, "attempt %d should have failed to process the staged report", attempt)
+
+		// the failed report remains allocated until its lease expires
+		found, err = t.app.ProcessNextStagedReport()
+		t.False(found, "attempt %d failed report should remain allocated", attempt)
+		t.NoError(err)
+
+		// expire the lease immediately
+		released, deadLettered, err := t.app.ReapStagedReports(0, maxAttempts)
+		t.NoError(err, "attempt %d reaping should succeed", attempt)
+		if attempt < maxAttempts {
+			t.Equal(1, released, "attempt %d report should have been released", attempt)
+			t.Equal(0, deadLettered, "attempt %d report should not have been dead-lettered", attempt)
+		} else {
+			t.Equal(0, released, "attempt %d report should not have been released", attempt)
+			t.Equal(1, deadLettered, "attempt %d report should have been dead-lettered", attempt)
+		}
+	}
+
+	// a dead-lettered report is no longer processed
+	found, err := t.app.ProcessNextStagedReport()
+	t.False(found, "dead-lettered report should not be processed")
+	t.NoError(err)
+
+	// the report should have been moved to the failedReports table
+	count, err := t.countTableEntries(t.app.OperationalDB, "reports")
+	t.NoError(err)
+	t.Equal(0, count, "dead-lettered report should be removed from reports")
+
+	var attempts int64
+	var lastError string
+	row := t.app.OperationalDB.Conn().DB().QueryRow(
+		`SELECT attempts, lastError FROM failedReports WHERE reportId = ?`,
+		reportId,
+	)
+	t.Require().NoError(row.Scan(&attempts, &lastError), "failed report should exist")
+	t.Equal(maxAttempts, attempts, "failed report attempts should match")
+	t.NotEmpty(lastError, "failed report should record the processing error")
+
+	// a resubmission of the dead-lettered report should be processed again,
+	// rather than being answered as already processed
+	reservation, trResp, err = t.app.ReserveProcessedReport(t.regId, header)
+	t.Require().NoError(err)
+	t.Nil(trResp, "dead-lettered report should not be answered as processed")
+	t.NotNil(reservation, "dead-lettered report should be reservable again")
+}
+
+func (t *AppTestSuite) TestStagedReportLostLease() {
+	// Test that a worker whose lease expired, and whose report was then
+	// allocated by another worker, doesn't delete the reallocated report
+
+	_, err := t.app.StageTelemetryReport(
+		t.regId,
+		[]byte(`{}`),
+		&telemetrylib.TelemetryReportHeader{
+			ReportId:       uuid.NewString(),
+			ReportClientId: uuid.NewString(),
+		},
+	)
+	t.Require().NoError(err, "staging a report should succeed")
+
+	slow := new(database.ReportStagingTableRow)
+	t.Require().NoError(slow.SetupDB(t.app.OperationalDB))
+	t.Require().True(slow.FirstUnallocated(), "slow worker should allocate the report")
+
+	// expire the slow worker's lease, and let another worker allocate it,
+	// ensuring the allocation times differ
+	time.Sleep(time.Millisecond)
+	released, _, err := t.app.ReapStagedReports(0, 10)
+	t.Require().NoError(err)
+	t.Require().Equal(1, released, "report should have been released")
+
+	fast := new(database.ReportStagingTableRow)
+	t.Require().NoError(fast.SetupDB(t.app.OperationalDB))
+	t.Require().True(fast.FirstUnallocated(), "fast worker should allocate the report")
+	t.Require().Equal(slow.Id, fast.Id)
+
+	deleted, err := slow.DeleteAllocated()
+	t.Require().NoError(err)
+	t.False(deleted, "slow worker should no longer be able to delete the report")
+
+	count, err := t.countTableEntries(t.app.OperationalDB, "reports")
+	t.Require().NoError(err)
+	t.Equal(1, count, "reallocated report should remain staged")
+
+	deleted, err = fast.DeleteAllocated()
+	t.Require().NoError(err)
+	t.True(deleted, "fast worker should be able to delete the report")
+}
+
 type clientTestReg struct {
 	Name         string
 	ClientId     string
@@ -427,6 +1595,50 @@ func (t *AppTestSuite) TestAuthenticateClient() {
 
 }
 
+func (t *AppTestSuite) TestAuthenticateClientTokenReuse() {
+	// Test that a client's existing token is returned while it remains
+	// fresh, and replaced once it is close to expiring
+	body := fmt.Sprintf(
+		`{"registrationId":%d,"regHash":{"method":"%s","value":"%s"}}`,
+		t.regId, t.clientRegHash.Method, t.clientRegHash.Value,
+	)
+
+	authenticate := func() string {
+		rr, err := postToAuthenticateClientHandler(body, t)
+		t.Require().NoError(err)
+		t.Require().Equal(http.StatusOK, rr.Code)
+
+		var caResp restapi.ClientAuthenticationResponse
+		t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &caResp))
+		return caResp.AuthToken
+	}
+
+	t.Equal(t.authToken, authenticate(), "fresh token should be reused")
+
+	// store a token that is close to expiring
+	shortAm, err := app.NewAuthManager(&config.AuthConfig{
+		Secret:   t.config.Auth.Secret,
+		Duration: "1m",
+	})
+	t.Require().NoError(err)
+	shortToken, err := shortAm.CreateToken(t.regId)
+	t.Require().NoError(err)
+	_, err = t.app.OperationalDB.Conn().DB().Exec(
+		`UPDATE clients SET authToken = ? WHERE id = ?`,
+		shortToken,
+		t.regId,
+	)
+	t.Require().NoError(err)
+
+	newToken := authenticate()
+	t.NotEqual(shortToken, newToken, "token close to expiry should be replaced")
+
+	var stored string
+	row := t.app.OperationalDB.Conn().DB().QueryRow(`SELECT authToken FROM clients WHERE id = ?`, t.regId)
+	t.Require().NoError(row.Scan(&stored))
+	t.Equal(newToken, stored, "new token should be stored")
+}
+
 func (t *AppTestSuite) TestReportTelemetryWithInvalidJSON() {
 	// Create a POST request with the necessary body
 	body := `{"header":{reportTimeStamp":"2024-05-29T23:45:34.871802018Z","reportClientId":1,"reportAnnotations":["abc=pqr","xyz"]},"telemetryBundles":[{"header":{"bundleId":"702ef1ed-5a38-440e-9680-357ca8d36a42","bundleTimeStamp":"2024-05-29T23:45:34.670907855Z","bundleClientId":"78b81c06-2892-4c35-b528-15db6baa0a0f","bundleCustomerId":"1234567890","bundleAnnotations":["abc=pqr","xyz"]},"telemetryDataItems":[{"header":{"telemetryId":"b016f023-77bc-4538-a82e-a1e1a2b8e9c8","telemetryTimeStamp":"2024-05-29T23:45:34.57108633Z","telemetryType":"SLE-SERVER-Test","telemetryAnnotations":["abc=pqr","xyz"]},"telemetryData":{"ItemA":1,"ItemB":"b"},"footer":{"checksum":"ichecksum"}}],"footer":{"checksum":"bchecksum"}}],"footer":{"checksum":"rchecksum"}}`
@@ -448,6 +1660,439 @@ func (t *AppTestSuite) TestReportTelemetryMissingAuth() {
 	assert.Equal(t.T(), 401, rr.Code)
 }
 
+func (t *AppTestSuite) TestReportTelemetryWithOtherClientsToken() {
+	// Test that a token issued to another registration is rejected, even
+	// if it matches the token stored for the specified registration
+	token, err := t.app.AuthManager.CreateToken(t.regId + 1)
+	t.Require().NoError(err)
+	_, err = t.app.OperationalDB.Conn().DB().Exec(
+		`UPDATE clients SET authToken = ? WHERE id = ?`,
+		token,
+		t.regId,
+	)
+	t.Require().NoError(err)
+	t.authToken = token
+
+	body, err := createReportPayload("TestCustomer")
+	t.NoError(err, "creating a report payload should succeed")
+
+	rr, err := postToReportTelemetryHandler(body, "", true, t)
+	t.NoError(err)
+	t.Equal(http.StatusUnauthorized, rr.Code)
+	t.Contains(rr.Header().Get("WWW-Authenticate"), `scope="authenticate"`)
+}
+
+func (t *AppTestSuite) TestReportTelemetryWithRevokedToken() {
+	// Test that a revoked token is rejected, and replaced rather than
+	// reused when the client re-authenticates
+	// parse the token without verification, which would load the token
+	// revocations, so that they will be loaded from the DB by the first
+	// check, after the revocation has been recorded
+	claims := new(jwt.RegisteredClaims)
+	_, _, err := jwt.NewParser().ParseUnverified(t.authToken, claims)
+	t.Require().NoError(err)
+
+	now := types.Now()
+	_, err = t.app.OperationalDB.Conn().DB().Exec(
+		`INSERT INTO tokenRevocations(jti, revokedAt, expiresAt) VALUES(?, ?, ?)`,
+		claims.ID,
+		now.String(),
+		types.TelemetryTimeStamp{Time: now.Add(time.Hour)}.String(),
+	)
+	t.Require().NoError(err)
+
+	body, err := createReportPayload("TestCustomer")
+	t.Require().NoError(err)
+
+	rr, err := postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err)
+	t.Equal(http.StatusUnauthorized, rr.Code)
+	t.Contains(rr.Header().Get("WWW-Authenticate"), `scope="authenticate"`)
+
+	authBody := fmt.Sprintf(
+		`{"registrationId":%d,"regHash":{"method":"%s","value":"%s"}}`,
+		t.regId, t.clientRegHash.Method, t.clientRegHash.Value,
+	)
+	rr, err = postToAuthenticateClientHandler(authBody, t)
+	t.Require().NoError(err)
+	t.Require().Equal(http.StatusOK, rr.Code)
+
+	var caResp restapi.ClientAuthenticationResponse
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &caResp))
+	t.NotEqual(t.authToken, caResp.AuthToken, "revoked token should not be reused")
+	t.authToken = caResp.AuthToken
+
+	rr, err = postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err)
+	t.Equal(http.StatusOK, rr.Code)
+}
+
+// cloneSignals retrieves the clone signals recorded for the registration
+func (t *AppTestSuite) cloneSignals(regId int64) (signals []database.CloneSignalRow) {
+	rows, err := t.app.OperationalDB.Conn().DB().Query(
+		`SELECT signal, COALESCE(relatedRegistrationId, 0), occurrences FROM cloneSignals WHERE registrationId = ? ORDER BY id`,
+		regId,
+	)
+	t.Require().NoError(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var signal database.CloneSignalRow
+		t.Require().NoError(rows.Scan(&signal.Signal, &signal.RelatedRegistrationId, &signal.Occurrences))
+		signals = append(signals, signal)
+	}
+	t.Require().NoError(rows.Err())
+
+	return
+}
+
+// cloneSuspected checks if the registration has been flagged as a suspected clone
+func (t *AppTestSuite) cloneSuspected(regId int64) (suspected bool) {
+	row := t.app.OperationalDB.Conn().DB().QueryRow(`SELECT cloneSuspected FROM clients WHERE id = ?`, regId)
+	t.Require().NoError(row.Scan(&suspected))
+	return
+}
+
+// reportWithStaleToken submits a report using a new valid, but superseded,
+// token for the test client's registration
+func (t *AppTestSuite) reportWithStaleToken() *httptest.ResponseRecorder {
+	staleToken, err := t.app.AuthManager.CreateToken(t.regId)
+	t.Require().NoError(err)
+
+	return t.reportWithToken(staleToken)
+}
+
+// reportWithToken submits a report using the specified superseded token
+// for the test client's registration
+func (t *AppTestSuite) reportWithToken(staleToken string) *httptest.ResponseRecorder {
+	storedToken := t.authToken
+	defer func() { t.authToken = storedToken }()
+	t.authToken = staleToken
+
+	body, err := createReportPayload("TestCustomer")
+	t.Require().NoError(err)
+
+	rr, err := postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err)
+	t.Require().Equal(http.StatusUnauthorized, rr.Code)
+
+	return rr
+}
+
+// ageAuthToken replaces the test client's current token with one that was
+// issued the specified duration ago, so that superseded tokens presented for
+// its registration are no longer within the stale token grace period
+func (t *AppTestSuite) ageAuthToken(age time.Duration) {
+	secret, err := base64.StdEncoding.DecodeString(t.config.Auth.Secret)
+	t.Require().NoError(err)
+
+	issuedAt := time.Now().Add(-age)
+	claims := jwt.RegisteredClaims{
+		Issuer:    t.app.AuthManager.Issuer(),
+		Subject:   t.app.AuthManager.Subject(t.regId),
+		IssuedAt:  jwt.NewNumericDate(issuedAt),
+		ExpiresAt: jwt.NewNumericDate(issuedAt.Add(t.app.AuthManager.Duration())),
+		ID:        uuid.NewString(),
+	}
+	t.authToken, err = jwt.NewWithClaims(t.app.AuthManager.SigningMethod(), claims).SignedString(secret)
+	t.Require().NoError(err)
+	t.Require().NoError(t.app.AuthManager.VerifyToken(t.authToken, t.regId))
+
+	_, err = t.app.OperationalDB.Conn().DB().Exec(
+		`UPDATE clients SET authToken = ? WHERE id = ?`,
+		t.authToken,
+		t.regId,
+	)
+	t.Require().NoError(err)
+}
+
+func (t *AppTestSuite) TestCloneDetectionStaleTokenGrace() {
+	// Test that a superseded token presented shortly after the client
+	// authenticated again, e.g. by a request that was in flight when the
+	// token was reissued, is ignored rather than recorded as a clone signal
+
+	// a request with the client's token is in flight when it is reissued
+	inFlightToken := t.authToken
+	t.Require().NoError(t.app.AuthManager.VerifyToken(inFlightToken, t.regId))
+	t.ageAuthToken(time.Second)
+
+	rr := t.reportWithToken(inFlightToken)
+	t.Contains(rr.Header().Get("WWW-Authenticate"), `scope="authenticate"`)
+
+	// and is then retried once
+	t.reportWithToken(inFlightToken)
+
+	t.Empty(t.cloneSignals(t.regId), "superseded tokens within the grace period should be ignored")
+	t.False(t.cloneSuspected(t.regId))
+
+	// once the grace period has elapsed superseded tokens are signals
+	t.ageAuthToken(time.Hour)
+	t.reportWithToken(inFlightToken)
+	t.Len(t.cloneSignals(t.regId), 1)
+}
+
+func (t *AppTestSuite) TestCloneDetectionStaleTokens() {
+	// Test that stale tokens are recorded as clone signals, flagging the
+	// registration once the threshold is reached
+	t.ageAuthToken(time.Hour)
+
+	staleToken, err := t.app.AuthManager.CreateToken(t.regId)
+	t.Require().NoError(err)
+
+	rr := t.reportWithToken(staleToken)
+	t.Contains(rr.Header().Get("WWW-Authenticate"), `scope="authenticate"`)
+	t.Len(t.cloneSignals(t.regId), 1)
+	t.False(t.cloneSuspected(t.regId), "registration should not be flagged below the threshold")
+
+	// presenting the same stale token again is only counted as a further
+	// occurrence of its signal
+	t.reportWithToken(staleToken)
+	signals := t.cloneSignals(t.regId)
+	t.Require().Len(signals, 1, "a repeated stale token should not be recorded again")
+	t.Equal(int64(2), signals[0].Occurrences)
+	t.False(t.cloneSuspected(t.regId), "a repeated stale token should not reach the threshold")
+
+	rr = t.reportWithStaleToken()
+	t.Contains(
+		rr.Header().Get("WWW-Authenticate"),
+		`scope="authenticate"`,
+		"suspected clones should only be flagged by the default policy",
+	)
+	signals = t.cloneSignals(t.regId)
+	t.Require().Len(signals, 2)
+	t.Equal(database.CLONE_SIGNAL_STALE_TOKEN, signals[1].Signal)
+	t.True(t.cloneSuspected(t.regId), "registration should be flagged at the threshold")
+
+	// once flagged, further stale tokens are only counted against the most
+	// recent signal
+	for i := 0; i < 3; i++ {
+		t.reportWithStaleToken()
+	}
+	signals = t.cloneSignals(t.regId)
+	t.Require().Len(signals, 2, "stale tokens of suspected clones should not be recorded again")
+	t.Equal(int64(4), signals[1].Occurrences)
+
+	// the client holding the current token is unaffected
+	body, err := createReportPayload("TestCustomer")
+	t.Require().NoError(err)
+	rr, err = postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err)
+	t.Equal(http.StatusOK, rr.Code)
+}
+
+func (t *AppTestSuite) TestCloneDetectionReregisterPolicy() {
+	// Test that suspected clones presenting stale tokens are forced to
+	// register again under the reregister policy
+	t.Require().NoError(t.app.Shutdown())
+	t.config.CloneDetection.Policy = app.CLONE_POLICY_REREGISTER
+	t.app, t.router = InitializeApp(t.config, true)
+	t.ageAuthToken(time.Hour)
+
+	rr := t.reportWithStaleToken()
+	t.Contains(rr.Header().Get("WWW-Authenticate"), `scope="authenticate"`)
+
+	rr = t.reportWithStaleToken()
+	t.Contains(rr.Header().Get("WWW-Authenticate"), `scope="register"`, "suspected clone should be forced to register")
+
+	// the suspected clone can register again with the cloned registration
+	crReq := restapi.ClientRegistrationRequest{ClientRegistration: t.clientReg}
+	reqBody, err := json.Marshal(&crReq)
+	t.Require().NoError(err)
+	rr, err = postToRegisterClientHandler(string(reqBody), t)
+	t.Require().NoError(err)
+	t.Require().Equal(http.StatusOK, rr.Code)
+
+	var crResp restapi.ClientRegistrationResponse
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &crResp))
+	t.NotEqual(t.regId, crResp.RegistrationId, "clone should obtain a registration of its own")
+	t.False(t.cloneSuspected(crResp.RegistrationId))
+}
+
+func (t *AppTestSuite) TestCloneDetectionDuplicateClientId() {
+	// Test that registering an existing clientId with a different
+	// systemUUID is recorded as a clone signal
+	reg := t.clientReg
+	reg.SystemUUID = "d1c9e3a4-7b0b-4f0e-9a7e-6d7a5b8c9d0e"
+	crReq := restapi.ClientRegistrationRequest{ClientRegistration: reg}
+	reqBody, err := json.Marshal(&crReq)
+	t.Require().NoError(err)
+
+	rr, err := postToRegisterClientHandler(string(reqBody), t)
+	t.Require().NoError(err)
+	t.Require().Equal(http.StatusOK, rr.Code)
+
+	var crResp restapi.ClientRegistrationResponse
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &crResp))
+
+	signals := t.cloneSignals(crResp.RegistrationId)
+	t.Require().Len(signals, 1)
+	t.Equal(database.CLONE_SIGNAL_DUPLICATE_CLIENT_ID, signals[0].Signal)
+	t.Equal(t.regId, signals[0].RelatedRegistrationId)
+	t.Empty(t.cloneSignals(t.regId))
+}
+
+func (t *AppTestSuite) TestCloneDetectionInterleavedAuthentications() {
+	// Test that authentications alternating between systems holding
+	// different tokens within the interleave window are recorded as clone
+	// signals, whereas a single client authenticating again is not
+	t.ageAuthToken(time.Hour)
+
+	body := fmt.Sprintf(
+		`{"registrationId":%d,"regHash":{"method":"%s","value":"%s"}}`,
+		t.regId, t.clientRegHash.Method, t.clientRegHash.Value,
+	)
+	authenticate := func() {
+		rr, err := postToAuthenticateClientHandler(body, t)
+		t.Require().NoError(err)
+		t.Require().Equal(http.StatusOK, rr.Code)
+	}
+
+	for i := 0; i < 3; i++ {
+		authenticate()
+	}
+	t.Empty(t.cloneSignals(t.regId), "a client authenticating again should not be a signal")
+	t.False(t.cloneSuspected(t.regId))
+
+	// another system presents its superseded token, and then authenticates
+	t.reportWithStaleToken()
+	authenticate()
+
+	signals := t.cloneSignals(t.regId)
+	t.Require().Len(signals, 2)
+	t.Equal(database.CLONE_SIGNAL_STALE_TOKEN, signals[0].Signal)
+	t.Equal(database.CLONE_SIGNAL_INTERLEAVED_AUTH, signals[1].Signal)
+	t.True(t.cloneSuspected(t.regId))
+}
+
+// deleteFromRegisterClientHandler submits a deregistration request for the
+// test client, optionally including its authorization
+func deleteFromRegisterClientHandler(auth bool, t *AppTestSuite) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("DELETE", "/telemetry/register", nil)
+	t.Require().NoError(err)
+	if auth {
+		req.Header.Set("Authorization", "Bearer "+t.authToken)
+	}
+	req.Header.Set("X-Telemetry-Registration-Id", fmt.Sprintf("%d", t.regId))
+
+	rr := httptest.NewRecorder()
+	t.router.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func (t *AppTestSuite) TestDeregisterClient() {
+	// Test that clients can remove their registration, after which their
+	// token is rejected with a register challenge
+
+	rr := deleteFromRegisterClientHandler(false, t)
+	t.Equal(http.StatusUnauthorized, rr.Code, "deregistration should require authorization")
+	t.Contains(rr.Header().Get("WWW-Authenticate"), `scope="register"`)
+
+	rr = deleteFromRegisterClientHandler(true, t)
+	t.Require().Equal(http.StatusOK, rr.Code)
+
+	var resp struct {
+		RegistrationId int64 `json:"registrationId"`
+	}
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+	t.Equal(t.regId, resp.RegistrationId)
+
+	count, err := t.countTableEntries(t.app.OperationalDB, "clients")
+	t.Require().NoError(err)
+	t.Zero(count, "client registration should have been removed")
+
+	body, err := createReportPayload("TestCustomer")
+	t.Require().NoError(err)
+	rr, err = postToReportTelemetryHandler(body, "", true, t)
+	t.Require().NoError(err)
+	t.Equal(http.StatusUnauthorized, rr.Code, "deregistered client's token should be rejected")
+	t.Contains(rr.Header().Get("WWW-Authenticate"), `scope="register"`)
+
+	rr = deleteFromRegisterClientHandler(true, t)
+	t.Equal(http.StatusUnauthorized, rr.Code, "deregistered client cannot deregister again")
+	t.Contains(rr.Header().Get("WWW-Authenticate"), `scope="register"`)
+}
+
+// clientActivity retrieves the activity recorded for the registration
+func (t *AppTestSuite) clientActivity(regId int64) *database.ClientActivityRow {
+	activity := new(database.ClientActivityRow)
+	t.Require().NoError(activity.SetupDB(t.app.OperationalDB))
+	activity.RegistrationId = regId
+	if !activity.Exists() {
+		return nil
+	}
+	return activity
+}
+
+func (t *AppTestSuite) TestClientActivityTracking() {
+	// Test that registrations, authentications and reports are recorded
+	// in the client's activity, along with the client software used
+
+	t.Nil(t.clientActivity(t.regId), "no activity should have been recorded yet")
+
+	authBody := fmt.Sprintf(
+		`{"registrationId":%d,"regHash":{"method":"%s","value":"%s"}}`,
+		t.regId, t.clientRegHash.Method, t.clientRegHash.Value,
+	)
+	rr, err := postToAuthenticateClientHandler(authBody, t)
+	t.Require().NoError(err)
+	t.Require().Equal(http.StatusOK, rr.Code)
+
+	activity := t.clientActivity(t.regId)
+	t.Require().NotNil(activity, "authentication should have been recorded")
+	t.Equal(int64(1), activity.AuthenticationCount)
+	t.NotEmpty(activity.LastAuthenticatedAt)
+	t.Zero(activity.ReportCount)
+	t.Empty(activity.LastReportAt)
+
+	body, err := createReportPayload("TestCustomer")
+	t.Require().NoError(err)
+	req, err := http.NewRequest("POST", "/telemetry/report", strings.NewReader(body))
+	t.Require().NoError(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+t.authToken)
+	req.Header.Set("X-Telemetry-Registration-Id", fmt.Sprintf("%d", t.regId))
+	req.Header.Set("User-Agent", "telemetry-client-test/1.0")
+	req.Header.Set("X-Telemetry-Client-Version", "1.2.3")
+	rr = httptest.NewRecorder()
+	t.router.ServeHTTP(rr, req)
+	t.Require().Equal(http.StatusOK, rr.Code)
+
+	activity = t.clientActivity(t.regId)
+	t.Require().NotNil(activity)
+	t.Equal(int64(1), activity.ReportCount)
+	t.Require().NotNil(activity.LastReportAt)
+	t.True(activity.LastActiveAt.Equal(*activity.LastReportAt), "last active should be the last report")
+	t.Equal(int64(1), activity.AuthenticationCount)
+	t.Equal("telemetry-client-test/1.0", activity.UserAgent)
+	t.Equal("1.2.3", activity.ClientVersion)
+
+	// newly registered clients are tracked from their registration
+	newClient := clientTestReg{
+		ClientId:   "0b0f1e5e-6a4e-4d3c-9f0e-6f1d2c3b4a59",
+		SystemUUID: "7e0c1d2b-3a4f-4e5d-8c6b-9a0f1e2d3c4b",
+		Timestamp:  types.Now().String(),
+	}
+	rr, err = postToRegisterClientHandler(newClient.ReqBody(), t)
+	t.Require().NoError(err)
+	t.Require().Equal(http.StatusOK, rr.Code)
+
+	var crResp restapi.ClientRegistrationResponse
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &crResp))
+	activity = t.clientActivity(crResp.RegistrationId)
+	t.Require().NotNil(activity, "registration should have been recorded")
+	registrationDate, err := types.TimeStampFromString(crResp.RegistrationDate)
+	t.Require().NoError(err)
+	t.True(registrationDate.Equal(activity.FirstSeenAt), "registration date should be first seen time")
+	t.Zero(activity.ReportCount)
+	t.Zero(activity.AuthenticationCount)
+
+	// deregistering removes the client's activity
+	rr = deleteFromRegisterClientHandler(true, t)
+	t.Require().Equal(http.StatusOK, rr.Code)
+	t.Nil(t.clientActivity(t.regId), "deregistered client's activity should have been removed")
+}
+
 func (t *AppTestSuite) TestRegisterClientWithInvalidJSON() {
 	// Create a POST request with the necessary body
 	body := `{"clientRegistration":{}}`
@@ -977,3 +2622,20 @@ func (t *AppTestSuite) TestHealthCheckHandler() {
 	assert.Equal(t.T(), http.StatusOK, rr.Code)
 
 }
+
+func (t *AppTestSuite) TestJWKSHandler() {
+	// Test the wrapper.getJWKS handler; the test config uses a shared
+	// secret so no public keys should be published
+	req, err := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	t.Require().NoError(err)
+
+	rr := httptest.NewRecorder()
+	t.router.ServeHTTP(rr, req)
+
+	t.Equal(http.StatusOK, rr.Code)
+
+	var jwks app.JWKS
+	t.Require().NoError(json.Unmarshal(rr.Body.Bytes(), &jwks))
+	t.NotNil(jwks.Keys, "keys should be an empty list rather than null")
+	t.Empty(jwks.Keys)
+}
@@ -31,6 +31,10 @@ func (rw *routerWrapper) registerClient(w http.ResponseWriter, r *http.Request)
 	rw.app.RegisterClient(app.NewAppRequest(w, r, mux.Vars(r)))
 }
 
+func (rw *routerWrapper) deregisterClient(w http.ResponseWriter, r *http.Request) {
+	rw.app.DeregisterClient(app.NewAppRequest(w, r, mux.Vars(r)))
+}
+
 func (rw *routerWrapper) reportTelemetry(w http.ResponseWriter, r *http.Request) {
 	rw.app.ReportTelemetry(app.NewAppRequest(w, r, mux.Vars(r)))
 }
@@ -47,6 +51,10 @@ func (rw *routerWrapper) getVersion(w http.ResponseWriter, r *http.Request) {
 	rw.app.Version(app.QuietAppRequest(w, r, mux.Vars(r)))
 }
 
+func (rw *routerWrapper) getJWKS(w http.ResponseWriter, r *http.Request) {
+	rw.app.JWKS(app.QuietAppRequest(w, r, mux.Vars(r)))
+}
+
 // options is a struct of the options
 type options struct {
 	Config string `json:"config"`
@@ -81,6 +89,10 @@ func main() {
 
 	a, _ := InitializeApp(cfg, opts.Debug)
 
+	// the telemetry-server ingests reports, so it runs the background jobs
+	// that process and maintain them
+	a.StartBackgroundJobs()
+
 	a.Run()
 }
 
@@ -98,10 +110,12 @@ func SetupRouterWrapper(router *mux.Router, app *app.App) {
 
 	router.HandleFunc("/telemetry/authenticate", wrapper.authenticateClient).Methods("POST")
 	router.HandleFunc("/telemetry/register", wrapper.registerClient).Methods("POST")
+	router.HandleFunc("/telemetry/register", wrapper.deregisterClient).Methods("DELETE")
 	router.HandleFunc("/telemetry/report", wrapper.reportTelemetry).Methods("POST")
 	router.HandleFunc("/healthz", wrapper.healthCheck).Methods("GET", "HEAD")
 	router.HandleFunc("/live", wrapper.liveCheck).Methods("GET", "HEAD")
 	router.HandleFunc("/version", wrapper.getVersion).Methods("GET", "HEAD")
+	router.HandleFunc("/.well-known/jwks.json", wrapper.getJWKS).Methods("GET", "HEAD")
 }
 
 func InitializeApp(cfg *config.Config, debug bool) (a *app.App, router *mux.Router) {